@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/kingoftac/flagon/cli"
+)
+
+// Exit codes, so that scripts can tell why a command failed.
+const (
+	exitError    = 1 // the command could not be carried out
+	exitUsage    = 2 // invalid arguments or flags
+	exitNotFound = 3 // the workflow, run or backfill does not exist
+	exitFailed   = 4 // the run or backfill finished without succeeding
+)
+
+// commandError is an error returned by a command handler rather than by
+// flagon while parsing the command line.
+type commandError struct {
+	err error
+}
+
+func (e commandError) Error() string { return e.err.Error() }
+func (e commandError) Unwrap() error { return e.err }
+
+// markCommandErrors is middleware that tells errors returned by handlers
+// apart from usage errors.
+func markCommandErrors(next cli.Handler) cli.Handler {
+	return func(ctx context.Context) error {
+		if err := next(ctx); err != nil {
+			return commandError{err}
+		}
+		return nil
+	}
+}
+
+// exitCode is the code to exit with for an error returned by the CLI.
+func exitCode(err error) int {
+	if errors.As(err, new(commandError)) {
+		return exitError
+	}
+	return exitUsage
+}
+
+// fatalf logs like log.Fatalf but exits with code.
+func fatalf(code int, format string, v ...any) {
+	log.Printf(format, v...)
+	os.Exit(code)
+}
+
+// fatalLookup exits after a failed lookup, with exitNotFound if nothing
+// matched and exitError otherwise.
+func fatalLookup(err error, format string, v ...any) {
+	if errors.Is(err, sql.ErrNoRows) {
+		fatalf(exitNotFound, format, v...)
+	}
+	log.Fatal(err)
+}
+
+// parseID parses an ID argument, exiting with exitUsage if it is not one.
+func parseID(arg string) int64 {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		fatalf(exitUsage, "Invalid ID %q", arg)
+	}
+	return id
+}
@@ -2,22 +2,34 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/apparentlymart/go-userdirs/userdirs"
 	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 
 	"github.com/kingoftac/flagon/cli"
+	"github.com/kingoftac/gork/internal/apply"
 	"github.com/kingoftac/gork/internal/db"
 	"github.com/kingoftac/gork/internal/engine"
 	"github.com/kingoftac/gork/internal/fmtc"
+	"github.com/kingoftac/gork/internal/graph"
+	"github.com/kingoftac/gork/internal/lease"
+	"github.com/kingoftac/gork/internal/lint"
+	"github.com/kingoftac/gork/internal/models"
 	"github.com/kingoftac/gork/internal/version"
 )
 
@@ -33,6 +45,7 @@ func main() {
 		Description: "Workflow Orchestration Engine",
 		Flags: func(fs *flag.FlagSet) {
 			fs.Bool("version", false, "Print version information and exit")
+			fs.String("output", "table", "Output format of commands that list or show things: table, json, yaml or csv (also -o, accepted after any command)")
 		},
 		Handler: func(ctx context.Context) error {
 			showVersion := flag.Lookup("version")
@@ -89,6 +102,128 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:        "validate",
+				Description: "Check workflow files without creating them, reporting every error with its line and column, unknown keys, inputs that no upstream step provides and exec commands missing on this machine",
+				Args: []cli.Arg{
+					{Name: "file", Description: "Workflow YAML file", Variadic: true},
+				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.Bool("strict", false, "Fail on warnings as well as errors")
+				},
+				Handler: func(ctx context.Context) error {
+					files := cli.Args(ctx)
+					if len(files) == 0 {
+						fatalf(exitUsage, "Specify at least one workflow file")
+					}
+					strict := cli.Flags(ctx)["strict"].(bool)
+
+					var diags []lint.Diagnostic
+					invalid := 0
+					for _, file := range files {
+						fileDiags, err := lint.File(file)
+						if err != nil {
+							fileDiags = []lint.Diagnostic{{File: file, Severity: lint.SeverityError, Message: err.Error()}}
+						}
+						if lint.HasErrors(fileDiags) || (strict && len(fileDiags) > 0) {
+							invalid++
+						}
+						diags = append(diags, fileDiags...)
+					}
+
+					if outputFormat != "table" {
+						out := make(diagnosticsOutput, len(diags))
+						for i, d := range diags {
+							out[i] = diagnosticOutput{File: d.File, Line: d.Line, Column: d.Column, Severity: d.Severity, Message: d.Message}
+						}
+						if err := printOutput(out); err != nil {
+							return err
+						}
+					} else {
+						printDiagnostics(diags)
+					}
+
+					if invalid > 0 {
+						fatalf(exitError, "%d of %d files are invalid", invalid, len(files))
+					}
+					if outputFormat == "table" {
+						fmt.Println("No errors found")
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "apply",
+				Description: "Make the workflows in the database match the YAML files in a directory: show what would be created, updated and deleted, then apply it all in one transaction",
+				Args: []cli.Arg{
+					{Name: "dir", Description: "Directory of workflow YAML files"},
+				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.Bool("prune", false, "Delete workflows applied from this directory whose files have been removed")
+					fs.Bool("dry-run", false, "Show the plan without applying it")
+					fs.Bool("yes", false, "Apply without asking for confirmation")
+				},
+				Handler: func(ctx context.Context) error {
+					dir := cli.Args(ctx)[0]
+					flags := cli.Flags(ctx)
+					prune := flags["prune"].(bool)
+					dryRun := flags["dry-run"].(bool)
+					yes := flags["yes"].(bool)
+
+					files, diags, err := apply.Load(dir)
+					if err != nil {
+						log.Fatal(err)
+					}
+					printDiagnostics(diags)
+					if lint.HasErrors(diags) {
+						fatalf(exitError, "Nothing was applied; fix the errors above first")
+					}
+
+					db, err := db.NewDB(dbPath)
+					if err != nil {
+						log.Fatal(err)
+					}
+					defer db.Close()
+
+					existing, err := db.ListWorkflows()
+					if err != nil {
+						log.Fatal(err)
+					}
+					plan, err := apply.NewPlan(dir, files, existing, prune)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					printPlan(plan)
+					if plan.Empty() {
+						fmt.Println("Nothing to apply")
+						return nil
+					}
+					if dryRun {
+						return nil
+					}
+
+					if !yes {
+						if !term.IsTerminal(int(os.Stdin.Fd())) {
+							fatalf(exitUsage, "Not applying without confirmation; pass --yes to apply non-interactively")
+						}
+						fmtc.Printf("Type {bright:green}'yes'{reset} to apply these changes: ")
+						var response string
+						fmt.Scanln(&response)
+						if response != "yes" {
+							fmt.Println("Apply cancelled.")
+							return nil
+						}
+					}
+
+					if err := db.ApplyWorkflows(plan.Upserts(), plan.Deletes()); err != nil {
+						log.Fatal(err)
+					}
+					fmt.Printf("Applied: %d created, %d updated, %d deleted\n",
+						plan.Count(apply.ActionCreate), plan.Count(apply.ActionUpdate), plan.Count(apply.ActionDelete))
+					return nil
+				},
+			},
 			{
 				Name: "list",
 				Handler: func(ctx context.Context) error {
@@ -106,7 +241,27 @@ func main() {
 						return workflows[i].ID < workflows[j].ID
 					})
 
+					if outputFormat != "table" {
+						out := make(workflowsOutput, len(workflows))
+						for i, w := range workflows {
+							out[i] = newWorkflowOutput(w)
+						}
+						return printOutput(out)
+					}
+
+					paused, err := db.SchedulingPaused()
+					if err != nil {
+						log.Fatal(err)
+					}
+					if paused {
+						fmt.Println("Scheduling is paused for all workflows")
+					}
+
 					for _, w := range workflows {
+						if w.Paused {
+							fmt.Printf("- %d: %s (paused)\n", w.ID, w.Name)
+							continue
+						}
 						fmt.Printf("- %d: %s\n", w.ID, w.Name)
 					}
 					return nil
@@ -118,20 +273,33 @@ func main() {
 					{Name: "workflow-id", Description: "ID of the workflow"},
 				},
 				Handler: func(ctx context.Context) error {
-					id, err := strconv.ParseInt(cli.Args(ctx)[0], 10, 64)
-					if err != nil {
-						log.Fatal(err)
-					}
+					id := parseID(cli.Args(ctx)[0])
 
 					db, err := db.NewDB(dbPath)
 					if err != nil {
 						log.Fatal(err)
 					}
 					defer db.Close()
+					workflow, err := db.GetWorkflow(id)
+					if err != nil {
+						fatalLookup(err, "Workflow with ID %d not found", id)
+					}
 					runs, err := db.ListRuns(&id)
 					if err != nil {
 						log.Fatal(err)
 					}
+					sort.Slice(runs, func(i, j int) bool {
+						return runs[i].ID < runs[j].ID
+					})
+
+					if outputFormat != "table" {
+						out := make(runsOutput, len(runs))
+						for i, r := range runs {
+							out[i] = newRunOutput(r, workflow.Name)
+						}
+						return printOutput(out)
+					}
+
 					if len(runs) == 0 {
 						fmt.Println("No runs found")
 						return nil
@@ -173,16 +341,8 @@ func main() {
 					fmtc.Printf(headerFmt, "ID", "Workflow", "Status", "Started", "Completed", "Trigger")
 					fmt.Println(strings.Repeat("-", termWidth))
 
-					sort.Slice(runs, func(i, j int) bool {
-						return runs[i].ID < runs[j].ID
-					})
-
 					for _, r := range runs {
-						workflowName := "Unknown"
-						workflow, err := db.GetWorkflow(r.WorkflowID)
-						if err == nil {
-							workflowName = workflow.Name
-						}
+						workflowName := workflow.Name
 
 						started := "N/A"
 						if !r.StartedAt.IsZero() {
@@ -206,19 +366,6 @@ func main() {
 							paddedStatus = fmtc.Sprintf("{bright:green}"+statusFmt+"{reset}", status)
 						case "failed", "error":
 							paddedStatus = fmtc.Sprintf("{bright:red}"+statusFmt+"{reset}", status)
-
-							highlightRowFmt := fmtc.Sprintf("{bg:bright:red}{black}%%-%dd %%-%ds %%s %%-%ds %%-%ds %%-%ds{reset}\n",
-								idWidth-1, workflowWidth, startedWidth, completedWidth, triggerWidth)
-							paddedStatus = fmt.Sprintf(statusFmt, status)
-
-							fmtc.Printf(highlightRowFmt,
-								r.ID,
-								truncateString(workflowName, workflowWidth),
-								paddedStatus,
-								started,
-								completed,
-								r.Trigger)
-							continue
 						default:
 							paddedStatus = fmtc.Sprintf("{bright:white}"+statusFmt+"{reset}", status)
 						}
@@ -236,12 +383,29 @@ func main() {
 				},
 			},
 			{
-				Name: "run",
+				Name:        "run",
+				Description: "Queue a workflow run for the daemon. Waits for the run and streams its logs unless --detach is given.",
 				Args: []cli.Arg{
 					{Name: "workflow-name", Description: "Name of the workflow to run"},
 				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.Bool("wait", false, "Wait for the run to finish and stream its logs (default)")
+					fs.Bool("detach", false, "Print the run ID and return without waiting")
+					fs.Int("priority", 0, "Queue priority; higher priorities are executed first")
+					fs.Var(paramsFlag{}, "param", "Run parameter as key=value, passed to steps as an environment variable (repeatable)")
+				},
 				Handler: func(ctx context.Context) error {
 					name := cli.Args(ctx)[0]
+					flags := cli.Flags(ctx)
+					detach := flags["detach"].(bool)
+					if detach && flags["wait"].(bool) {
+						fatalf(exitUsage, "--wait and --detach cannot be used together")
+					}
+					params := flags["param"].(map[string]string)
+					if err := models.ValidateParams(params); err != nil {
+						fatalf(exitUsage, "%v", err)
+					}
+
 					db, err := db.NewDB(dbPath)
 					if err != nil {
 						log.Fatal(err)
@@ -250,47 +414,782 @@ func main() {
 
 					workflow, err := db.GetWorkflowByName(name)
 					if err != nil {
-						log.Fatalf("Workflow %s not found", name)
+						fatalLookup(err, "Workflow %s not found", name)
 					}
 
-					eng := engine.NewEngine(db)
-					run, err := eng.ExecuteWorkflow(context.Background(), workflow, "cli")
+					runID, err := db.EnqueueRun(&models.Run{WorkflowID: workflow.ID, Trigger: "cli", Params: params}, flags["priority"].(int))
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					structured := outputFormat != "table"
+					if detach {
+						if structured {
+							run, err := db.GetRun(runID)
+							if err != nil {
+								log.Fatal(err)
+							}
+							return printOutput(runsOutput{newRunOutput(*run, workflow.Name)})
+						}
+						fmt.Println(runID)
+						return nil
+					}
+
+					if !structured {
+						fmt.Printf("Queued run %d of %s\n", runID, workflow.Name)
+					}
+					run, err := waitForRun(db, runID, !structured)
 					if err != nil {
 						log.Fatal(err)
 					}
+					if structured {
+						out, err := newRunLogsOutput(db, run)
+						if err != nil {
+							log.Fatal(err)
+						}
+						if err := printOutput(out); err != nil {
+							log.Fatal(err)
+						}
+						if run.Status != models.RunStatusSuccess {
+							os.Exit(exitFailed)
+						}
+						return nil
+					}
+					if run.Status != models.RunStatusSuccess {
+						fatalf(exitFailed, "Run %d finished with status %s", run.ID, run.Status)
+					}
 					fmt.Printf("Run %d completed with status %s\n", run.ID, run.Status)
 
 					return nil
 				},
 			},
 			{
-				Name: "logs",
+				Name:        "exec",
+				Description: "Validate and run a workflow file in this process without creating it, streaming step output. The run is recorded against the created workflow of the same name, which must match the file, or nowhere if there is none or with --ephemeral.",
+				Args: []cli.Arg{
+					{Name: "file", Description: "Workflow YAML file"},
+				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.Bool("ephemeral", false, "Use an in-memory database, so that nothing is recorded")
+					fs.Var(&stepsFlag{}, "only", "Run only this step and the steps it depends on (repeatable or comma-separated)")
+					fs.Var(&stepsFlag{}, "skip", "Do not run this step or the steps that depend on it (repeatable or comma-separated)")
+					fs.Var(paramsFlag{}, "param", "Run parameter as key=value, passed to steps as an environment variable (repeatable)")
+				},
+				Handler: func(ctx context.Context) error {
+					file := cli.Args(ctx)[0]
+					flags := cli.Flags(ctx)
+					ephemeral := flags["ephemeral"].(bool)
+					params := flags["param"].(map[string]string)
+					if err := models.ValidateParams(params); err != nil {
+						fatalf(exitUsage, "%v", err)
+					}
+
+					diags, err := lint.File(file)
+					if err != nil {
+						log.Fatal(err)
+					}
+					printDiagnostics(diags)
+					if lint.HasErrors(diags) {
+						fatalf(exitError, "Not running %s; fix the errors above first", file)
+					}
+					data, err := os.ReadFile(file)
+					if err != nil {
+						log.Fatal(err)
+					}
+					var workflow models.Workflow
+					if err := yaml.Unmarshal(data, &workflow); err != nil {
+						log.Fatal(err)
+					}
+					defined := workflow
+					workflow, err = workflow.Subset(flags["only"].([]string), flags["skip"].([]string))
+					if err != nil {
+						fatalf(exitUsage, "%v", err)
+					}
+
+					var database *db.DB
+					if !ephemeral {
+						database, err = db.NewDB(dbPath)
+						if err != nil {
+							log.Fatal(err)
+						}
+						stored, err := database.GetWorkflowByName(workflow.Name)
+						switch {
+						case errors.Is(err, sql.ErrNoRows):
+							// There is nothing to record the run against.
+							database.Close()
+							database = nil
+							ephemeral = true
+							fmtc.Printf("{bright:yellow}Workflow %s has not been created; running it without recording the run{reset}\n", workflow.Name)
+						case err != nil:
+							log.Fatal(err)
+						default:
+							// The run is recorded against the created
+							// workflow, so it must be the one that runs.
+							diff, err := apply.DefinitionDiff(stored, &defined)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if diff != nil {
+								fmt.Printf("%s differs from the created workflow %s:\n", file, workflow.Name)
+								printDiff(diff)
+								fatalf(exitError, "Not running %s; apply it first, or pass --ephemeral to run it without recording", file)
+							}
+							workflow.ID = stored.ID
+						}
+					}
+					if ephemeral {
+						database, err = db.NewMemoryDB()
+						if err != nil {
+							log.Fatal(err)
+						}
+					}
+					defer database.Close()
+
+					if ephemeral {
+						if err := database.InsertWorkflow(&workflow); err != nil {
+							log.Fatal(err)
+						}
+						stored, err := database.GetWorkflowByName(workflow.Name)
+						if err != nil {
+							log.Fatal(err)
+						}
+						workflow.ID = stored.ID
+					}
+
+					steps := make([]string, len(workflow.Steps))
+					for i, s := range workflow.Steps {
+						steps[i] = s.Name
+					}
+					fmt.Printf("Running %s: %s\n", workflow.Name, strings.Join(steps, ", "))
+
+					var mu sync.Mutex
+					eng := engine.NewEngine(database)
+					eng.StreamOutput(func(step, line string) {
+						mu.Lock()
+						defer mu.Unlock()
+						fmtc.Printf("{dim}[%s]{reset} %s\n", step, line)
+					})
+					eng.Subscribe(func(_ *models.Workflow, event models.Event) {
+						mu.Lock()
+						defer mu.Unlock()
+						switch event.Type {
+						case models.EventStepRetried:
+							fmtc.Printf("{bright:yellow}[%s] attempt %d failed, retrying: %s{reset}\n", event.Step, event.Attempt, event.Error)
+						case models.EventStepFailed:
+							fmtc.Printf("{bright:red}[%s] %s: %s{reset}\n", event.Step, event.Status, event.Error)
+						}
+					})
+
+					ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					run := &models.Run{WorkflowID: workflow.ID, Status: models.RunStatusPending, Trigger: "exec", Params: params}
+					release := func() {}
+					if !ephemeral {
+						// Daemons recover runs whose owner holds no lease, so
+						// hold one for as long as this process runs the run.
+						hostname, _ := os.Hostname()
+						run.Owner = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+						release, err = lease.Hold(database, models.ExecLeasePrefix+run.Owner, run.Owner)
+						if err != nil {
+							log.Fatal(err)
+						}
+					}
+					run.ID, err = database.InsertRun(run)
+					if err != nil {
+						release()
+						log.Fatal(err)
+					}
+					run, runErr := eng.ExecuteRun(ctx, &workflow, run)
+					release()
+					if run == nil {
+						log.Fatal(runErr)
+					}
+
+					stepRuns, err := database.GetStepRuns(run.ID)
+					if err != nil {
+						log.Fatal(err)
+					}
+					fmt.Println()
+					tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					for _, sr := range stepRuns {
+						duration := ""
+						if !sr.StartedAt.IsZero() && !sr.CompletedAt.IsZero() {
+							duration = sr.CompletedAt.Sub(sr.StartedAt).Round(time.Millisecond).String()
+						}
+						fmt.Fprintf(tw, "%s\t%s\t%s\n", sr.StepName, sr.Status, duration)
+					}
+					tw.Flush()
+
+					if ephemeral {
+						if run.Status != models.RunStatusSuccess {
+							fatalf(exitFailed, "Run finished with status %s", run.Status)
+						}
+						fmt.Printf("Run completed with status %s\n", run.Status)
+						return nil
+					}
+					if run.Status != models.RunStatusSuccess {
+						fatalf(exitFailed, "Run %d finished with status %s", run.ID, run.Status)
+					}
+					fmt.Printf("Run %d completed with status %s\n", run.ID, run.Status)
+					return nil
+				},
+			},
+			{
+				Name:        "schedule",
+				Description: "Inspect workflow schedules",
+				Commands: []*cli.Command{
+					{
+						Name:        "list",
+						Description: "List scheduled workflows with their last run and when they run next",
+						Handler: func(ctx context.Context) error {
+							db, err := db.NewDB(dbPath)
+							if err != nil {
+								log.Fatal(err)
+							}
+							defer db.Close()
+
+							workflows, err := db.ListWorkflows()
+							if err != nil {
+								log.Fatal(err)
+							}
+							sort.Slice(workflows, func(i, j int) bool {
+								return workflows[i].ID < workflows[j].ID
+							})
+
+							paused, err := db.SchedulingPaused()
+							if err != nil {
+								log.Fatal(err)
+							}
+
+							if outputFormat != "table" {
+								out := schedulesOutput{}
+								for _, w := range workflows {
+									if w.Schedule == "" {
+										continue
+									}
+									s := scheduleOutput{WorkflowID: w.ID, Workflow: w.Name, Schedule: w.Schedule, Paused: paused || w.Paused}
+									runs, err := db.ListRuns(&w.ID)
+									if err != nil {
+										log.Fatal(err)
+									}
+									if len(runs) > 0 {
+										s.LastRunID = &runs[0].ID
+										s.LastStatus = runs[0].Status
+										s.LastStartedAt = optionalTime(runs[0].StartedAt)
+									}
+									if !s.Paused {
+										s.NextFireAt = optionalTime(w.NextFireAt)
+									}
+									out = append(out, s)
+								}
+								return printOutput(out)
+							}
+
+							if paused {
+								fmt.Println("Scheduling is paused for all workflows")
+							}
+
+							now := time.Now()
+							tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(tw, "WORKFLOW\tSCHEDULE\tLAST RUN\tLAST STATUS\tNEXT RUN")
+							for _, w := range workflows {
+								if w.Schedule == "" {
+									continue
+								}
+
+								lastRun, lastStatus := "-", "-"
+								runs, err := db.ListRuns(&w.ID)
+								if err != nil {
+									log.Fatal(err)
+								}
+								if len(runs) > 0 {
+									lastStatus = string(runs[0].Status)
+									if !runs[0].StartedAt.IsZero() {
+										lastRun = runs[0].StartedAt.Format("2006-01-02 15:04:05")
+									}
+								}
+
+								nextRun := w.NextRunSummary(now)
+								if !w.Paused && !w.NextFireAt.IsZero() {
+									nextRun = w.NextFireAt.Format("2006-01-02 15:04:05") + " (" + nextRun + ")"
+								}
+								fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", w.Name, w.Schedule, lastRun, lastStatus, nextRun)
+							}
+							return tw.Flush()
+						},
+					},
+					{
+						Name:        "preview",
+						Description: "Show when a schedule expression would fire for a workflow scheduled now",
+						Args: []cli.Arg{
+							{Name: "expression", Description: "Schedule expression, e.g. 15m or 24h"},
+						},
+						Flags: func(fs *flag.FlagSet) {
+							fs.Int("n", 10, "Number of fire times to show")
+						},
+						Handler: func(ctx context.Context) error {
+							expr := cli.Args(ctx)[0]
+							n := cli.Flags(ctx)["n"].(int)
+							if n < 1 {
+								fatalf(exitUsage, "-n must be at least 1")
+							}
+
+							start := time.Now()
+							times, err := models.ScheduleTimes(expr, start, n)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if outputFormat != "table" {
+								out := make(fireTimesOutput, len(times))
+								for i, t := range times {
+									out[i] = fireTimeOutput{Time: t, After: t.Sub(start).String()}
+								}
+								return printOutput(out)
+							}
+							for i, t := range times {
+								fmt.Printf("%3d  %s  +%s\n", i+1, t.Format("2006-01-02 15:04:05"), t.Sub(start))
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:        "pause",
+				Description: "Stop scheduling a workflow until it is resumed, or every workflow with --all. Runs already in progress are not affected.",
+				Args: []cli.Arg{
+					{Name: "workflow-name", Description: "Name of the workflow to pause", Optional: true},
+				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.Bool("all", false, "Pause scheduling for every workflow")
+				},
+				Handler: func(ctx context.Context) error {
+					return setPaused(ctx, true)
+				},
+			},
+			{
+				Name:        "resume",
+				Description: "Resume scheduling a paused workflow, or every workflow with --all",
+				Args: []cli.Arg{
+					{Name: "workflow-name", Description: "Name of the workflow to resume", Optional: true},
+				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.Bool("all", false, "Resume scheduling for every workflow")
+				},
+				Handler: func(ctx context.Context) error {
+					return setPaused(ctx, false)
+				},
+			},
+			{
+				Name:        "backfill",
+				Description: "Queue one run per schedule slot from --from through --to, passing each slot to its steps as GORK_LOGICAL_DATE. Waits and reports progress unless --detach is given.",
+				Args: []cli.Arg{
+					{Name: "workflow-name", Description: "Name of the workflow to backfill"},
+				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.String("from", "", "First date to backfill (YYYY-MM-DD)")
+					fs.String("to", "", "Last date to backfill, inclusive (YYYY-MM-DD)")
+					fs.Int("parallel", 1, "Maximum number of backfill runs executing at once")
+					fs.Bool("detach", false, "Print the backfill ID and return without waiting")
+				},
+				Handler: func(ctx context.Context) error {
+					name := cli.Args(ctx)[0]
+					flags := cli.Flags(ctx)
+					from, err := time.ParseInLocation(time.DateOnly, flags["from"].(string), time.Local)
+					if err != nil {
+						fatalf(exitUsage, "Invalid --from date: %v", err)
+					}
+					to, err := time.ParseInLocation(time.DateOnly, flags["to"].(string), time.Local)
+					if err != nil {
+						fatalf(exitUsage, "Invalid --to date: %v", err)
+					}
+					parallel := flags["parallel"].(int)
+					if parallel < 1 {
+						fatalf(exitUsage, "--parallel must be at least 1")
+					}
+
+					db, err := db.NewDB(dbPath)
+					if err != nil {
+						log.Fatal(err)
+					}
+					defer db.Close()
+
+					workflow, err := db.GetWorkflowByName(name)
+					if err != nil {
+						fatalLookup(err, "Workflow %s not found", name)
+					}
+
+					slots, err := workflow.BackfillSlots(from, to)
+					if err != nil {
+						log.Fatal(err)
+					}
+					interval, _ := models.ParseSchedule(workflow.Schedule)
+
+					runs := make([]models.Run, len(slots))
+					for i, slot := range slots {
+						runs[i] = models.Run{
+							WorkflowID:  workflow.ID,
+							Trigger:     "backfill",
+							ScheduledAt: slot,
+							Params:      map[string]string{models.LogicalDateParam: models.LogicalDate(slot, interval)},
+						}
+					}
+
+					backfillID, err := db.CreateBackfill(&models.Backfill{WorkflowID: workflow.ID, From: from, To: to, Parallel: parallel}, runs)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					if flags["detach"].(bool) {
+						fmt.Println(backfillID)
+						return nil
+					}
+
+					fmt.Printf("Backfill %d of %s: queued %d runs from %s to %s, %d at a time\n",
+						backfillID, workflow.Name, len(runs), from.Format(time.DateOnly), to.Format(time.DateOnly), parallel)
+					fmt.Printf("Cancel it with: gorkctl backfill cancel %d\n", backfillID)
+
+					backfill, runs, err := waitForBackfill(db, backfillID)
+					if err != nil {
+						log.Fatal(err)
+					}
+					summary := fmt.Sprintf("Backfill %d %s: %s", backfill.ID, backfill.Status, backfillSummary(runs))
+					for _, r := range runs {
+						if r.Status != models.RunStatusSuccess {
+							fatalf(exitFailed, "%s", summary)
+						}
+					}
+					fmt.Println(summary)
+
+					return nil
+				},
+				Commands: []*cli.Command{
+					{
+						Name:        "list",
+						Description: "List backfills and their progress",
+						Handler: func(ctx context.Context) error {
+							db, err := db.NewDB(dbPath)
+							if err != nil {
+								log.Fatal(err)
+							}
+							defer db.Close()
+
+							backfills, err := db.ListBackfills()
+							if err != nil {
+								log.Fatal(err)
+							}
+
+							if outputFormat != "table" {
+								out := make(backfillsOutput, len(backfills))
+								for i, b := range backfills {
+									workflowName := "Unknown"
+									if workflow, err := db.GetWorkflow(b.WorkflowID); err == nil {
+										workflowName = workflow.Name
+									}
+									runs, err := db.ListBackfillRuns(b.ID)
+									if err != nil {
+										log.Fatal(err)
+									}
+									out[i] = newBackfillOutput(b, workflowName, runs)
+								}
+								return printOutput(out)
+							}
+
+							if len(backfills) == 0 {
+								fmt.Println("No backfills found")
+								return nil
+							}
+
+							for _, b := range backfills {
+								workflowName := "Unknown"
+								if workflow, err := db.GetWorkflow(b.WorkflowID); err == nil {
+									workflowName = workflow.Name
+								}
+								runs, err := db.ListBackfillRuns(b.ID)
+								if err != nil {
+									log.Fatal(err)
+								}
+								fmt.Printf("- %d: %s %s to %s, %s (%s)\n", b.ID, workflowName,
+									b.From.Format(time.DateOnly), b.To.Format(time.DateOnly), b.Status, backfillSummary(runs))
+							}
+							return nil
+						},
+					},
+					{
+						Name:        "status",
+						Description: "Show the runs of a backfill",
+						Args: []cli.Arg{
+							{Name: "backfill-id", Description: "ID of the backfill"},
+						},
+						Handler: func(ctx context.Context) error {
+							id := parseID(cli.Args(ctx)[0])
+
+							db, err := db.NewDB(dbPath)
+							if err != nil {
+								log.Fatal(err)
+							}
+							defer db.Close()
+
+							backfill, err := db.GetBackfill(id)
+							if err != nil {
+								fatalLookup(err, "Backfill %d not found", id)
+							}
+							runs, err := db.ListBackfillRuns(id)
+							if err != nil {
+								log.Fatal(err)
+							}
+
+							if outputFormat != "table" {
+								workflowName := "Unknown"
+								if workflow, err := db.GetWorkflow(backfill.WorkflowID); err == nil {
+									workflowName = workflow.Name
+								}
+								out := backfillStatusOutput{Backfill: newBackfillOutput(*backfill, workflowName, runs), Runs: make(runsOutput, len(runs))}
+								for i, r := range runs {
+									out.Runs[i] = newRunOutput(r, workflowName)
+								}
+								return printOutput(out)
+							}
+
+							fmt.Printf("Backfill %d: %s, %d at a time (%s)\n", backfill.ID, backfill.Status, backfill.Parallel, backfillSummary(runs))
+							for _, r := range runs {
+								fmt.Printf("  %-25s run %-6d %s\n", r.Params[models.LogicalDateParam], r.ID, r.Status)
+							}
+							return nil
+						},
+					},
+					{
+						Name:        "cancel",
+						Description: "Cancel every queued and running run of a backfill",
+						Args: []cli.Arg{
+							{Name: "backfill-id", Description: "ID of the backfill"},
+						},
+						Handler: func(ctx context.Context) error {
+							id := parseID(cli.Args(ctx)[0])
+
+							db, err := db.NewDB(dbPath)
+							if err != nil {
+								log.Fatal(err)
+							}
+							defer db.Close()
+
+							if _, err := db.GetBackfill(id); err != nil {
+								fatalLookup(err, "Backfill %d not found", id)
+							}
+							canceled, err := db.CancelBackfill(id)
+							if err != nil {
+								log.Fatal(err)
+							}
+							fmt.Printf("Canceled backfill %d: %d queued runs canceled, running runs are stopped by the daemon\n", id, canceled)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:        "daemons",
+				Description: "List the daemons sharing the database and which one is leader",
+				Handler: func(ctx context.Context) error {
+					db, err := db.NewDB(dbPath)
+					if err != nil {
+						log.Fatal(err)
+					}
+					defer db.Close()
+
+					leases, err := db.ListLeases()
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					now := time.Now()
+					var leader string
+					for _, l := range leases {
+						if l.Name == models.LeaderLease && !l.Expired(now) {
+							leader = l.Holder
+						}
+					}
+
+					if outputFormat != "table" {
+						out := daemonsOutput{}
+						for _, l := range leases {
+							if owner, ok := strings.CutPrefix(l.Name, models.DaemonLeasePrefix); ok {
+								out = append(out, daemonOutput{Owner: owner, Leader: owner == leader, StartedAt: l.AcquiredAt, ExpiresAt: l.ExpiresAt, Expired: l.Expired(now)})
+							}
+						}
+						return printOutput(out)
+					}
+
+					tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(tw, "DAEMON\tROLE\tSTARTED\tLEASE")
+					for _, l := range leases {
+						owner, ok := strings.CutPrefix(l.Name, models.DaemonLeasePrefix)
+						if !ok {
+							continue
+						}
+						role := "worker"
+						if owner == leader {
+							role = "leader"
+						}
+						status := "expires in " + l.ExpiresAt.Sub(now).Round(time.Second).String()
+						if l.Expired(now) {
+							role = "-"
+							status = "expired " + now.Sub(l.ExpiresAt).Round(time.Second).String() + " ago"
+						}
+						fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", owner, role, l.AcquiredAt.Local().Format("2006-01-02 15:04:05"), status)
+					}
+					return tw.Flush()
+				},
+			},
+			{
+				Name:        "graph",
+				Description: "Draw the step dependency graph of a workflow, with edges labelled by the outputs steps pass as inputs. With --run, steps are coloured by how they fared in that run.",
+				Args: []cli.Arg{
+					{Name: "workflow-name", Description: "Name of the workflow to draw"},
+				},
+				Flags: func(fs *flag.FlagSet) {
+					fs.String("format", string(graph.FormatASCII), "Graph format: dot, mermaid or ascii")
+					fs.Int64("run", 0, "ID of a run of the workflow to show step statuses and durations for")
+				},
+				Handler: func(ctx context.Context) error {
+					name := cli.Args(ctx)[0]
+					flags := cli.Flags(ctx)
+					format := graph.Format(flags["format"].(string))
+					if !slices.Contains(graph.Formats, format) {
+						fatalf(exitUsage, "Unknown graph format %q: expected dot, mermaid or ascii", format)
+					}
+
+					db, err := db.NewDB(dbPath)
+					if err != nil {
+						log.Fatal(err)
+					}
+					defer db.Close()
+
+					workflow, err := db.GetWorkflowByName(name)
+					if err != nil {
+						fatalLookup(err, "Workflow %s not found", name)
+					}
+
+					var run *models.Run
+					var stepRuns []models.StepRun
+					if runID := flags["run"].(int64); runID != 0 {
+						run, err = db.GetRun(runID)
+						if err != nil {
+							fatalLookup(err, "Run %d not found", runID)
+						}
+						if run.WorkflowID != workflow.ID {
+							fatalf(exitUsage, "Run %d is not a run of %s", runID, workflow.Name)
+						}
+						if stepRuns, err = db.GetStepRuns(runID); err != nil {
+							log.Fatal(err)
+						}
+					}
+
+					return graph.New(workflow, run, stepRuns).Write(os.Stdout, format)
+				},
+			},
+			{
+				Name:        "notifications",
+				Description: "List the notifications sent for a run, with every delivery attempt",
 				Args: []cli.Arg{
 					{Name: "run-id", Description: "ID of the workflow run"},
 				},
 				Handler: func(ctx context.Context) error {
-					id, err := strconv.ParseInt(cli.Args(ctx)[0], 10, 64)
+					id := parseID(cli.Args(ctx)[0])
+
+					db, err := db.NewDB(dbPath)
+					if err != nil {
+						log.Fatal(err)
+					}
+					defer db.Close()
+
+					attempts, err := db.ListNotificationAttempts(id)
 					if err != nil {
 						log.Fatal(err)
 					}
 
+					if outputFormat != "table" {
+						out := make(notificationsOutput, len(attempts))
+						for i, a := range attempts {
+							out[i] = notificationOutput{
+								ID:        a.ID,
+								RunID:     a.RunID,
+								Notifier:  a.Notifier,
+								Event:     a.Event,
+								Step:      a.Step,
+								Attempt:   a.Attempt,
+								Status:    a.Status,
+								Error:     a.Error,
+								CreatedAt: a.CreatedAt,
+							}
+						}
+						return printOutput(out)
+					}
+
+					if len(attempts) == 0 {
+						fmt.Printf("No notifications for run %d\n", id)
+						return nil
+					}
+
+					tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(tw, "TIME\tNOTIFIER\tEVENT\tSTEP\tATTEMPT\tSTATUS\tERROR")
+					for _, a := range attempts {
+						step := a.Step
+						if step == "" {
+							step = "-"
+						}
+						fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", a.CreatedAt.Local().Format("2006-01-02 15:04:05"), a.Notifier, a.Event, step, a.Attempt, a.Status, a.Error)
+					}
+					return tw.Flush()
+				},
+			},
+			{
+				Name: "logs",
+				Args: []cli.Arg{
+					{Name: "run-id", Description: "ID of the workflow run"},
+				},
+				Handler: func(ctx context.Context) error {
+					id := parseID(cli.Args(ctx)[0])
+
 					db, err := db.NewDB(dbPath)
 					if err != nil {
 						log.Fatal(err)
 					}
 					defer db.Close()
 
+					run, err := db.GetRun(id)
+					if err != nil {
+						fatalLookup(err, "Run %d not found", id)
+					}
 					stepRuns, err := db.GetStepRuns(id)
 					if err != nil {
 						log.Fatal(err)
 					}
 
+					if outputFormat != "table" {
+						out, err := newRunLogsOutput(db, run)
+						if err != nil {
+							log.Fatal(err)
+						}
+						return printOutput(out)
+					}
+
 					for _, sr := range stepRuns {
-						stepLine := fmt.Sprintf("Step: %s\n", sr.StepName)
-						fmt.Printf(stepLine)
-						fmt.Println(strings.Repeat("-", len(stepLine)-1))
-						for i, log := range sr.Logs {
-							fmt.Printf("[%d] %s\n", i+1, log)
+						stepLine := fmt.Sprintf("Step: %s", sr.StepName)
+						fmt.Println(stepLine)
+						fmt.Println(strings.Repeat("-", len(stepLine)))
+
+						// Runs recorded before per-attempt history only have
+						// the combined step logs.
+						if len(sr.Attempts) == 0 {
+							for i, log := range sr.Logs {
+								fmt.Printf("[%d] %s\n", i+1, log)
+							}
+							if sr.Error != "" {
+								fmt.Printf("%s: %s\n", sr.Status, sr.Error)
+							}
+						}
+						for _, attempt := range sr.Attempts {
+							printAttempt(attempt.Summary(), attempt)
 						}
 						fmt.Println()
 					}
@@ -319,10 +1218,7 @@ func main() {
 					{Name: "output-file", Description: "File to write the exported workflow YAML"},
 				},
 				Handler: func(ctx context.Context) error {
-					id, err := strconv.ParseInt(cli.Args(ctx)[0], 10, 64)
-					if err != nil {
-						log.Fatal(err)
-					}
+					id := parseID(cli.Args(ctx)[0])
 					outputFile := cli.Args(ctx)[1]
 
 					db, err := db.NewDB(dbPath)
@@ -333,7 +1229,7 @@ func main() {
 
 					workflow, err := db.GetWorkflow(id)
 					if err != nil {
-						log.Fatalf("Workflow with ID %d not found", id)
+						fatalLookup(err, "Workflow with ID %d not found", id)
 					}
 
 					data, err := yaml.Marshal(workflow)
@@ -354,10 +1250,7 @@ func main() {
 					{Name: "workflow-id", Description: "ID of the workflow to delete"},
 				},
 				Handler: func(ctx context.Context) error {
-					id, err := strconv.ParseInt(cli.Args(ctx)[0], 10, 64)
-					if err != nil {
-						log.Fatal(err)
-					}
+					id := parseID(cli.Args(ctx)[0])
 
 					db, err := db.NewDB(dbPath)
 					if err != nil {
@@ -426,9 +1319,300 @@ func main() {
 	// 	return nil
 	// })
 
-	if err := c.Run(os.Args[1:]); err != nil {
+	c.Use(markCommandErrors)
+	c.Use(checkOutputFormat(c))
+
+	args, format, err := extractOutputFlag(os.Args[1:])
+	if err != nil {
+		fatalf(exitUsage, "%v", err)
+	}
+	outputFormat = format
+
+	if err := c.Run(args); err != nil {
+		fatalf(exitCode(err), "%v", err)
+	}
+}
+
+// paramsFlag collects repeated key=value flags into a map.
+type paramsFlag map[string]string
+
+func (p paramsFlag) String() string {
+	pairs := make([]string, 0, len(p))
+	for k, v := range p {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p paramsFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	p[key] = val
+	return nil
+}
+
+func (p paramsFlag) Get() any {
+	return map[string]string(p)
+}
+
+// stepsFlag collects step names from repeated or comma-separated flags.
+type stepsFlag []string
+
+func (s *stepsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stepsFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*s = append(*s, name)
+		}
+	}
+	return nil
+}
+
+func (s *stepsFlag) Get() any {
+	return []string(*s)
+}
+
+// printDiagnostics prints lint diagnostics, colouring them by severity.
+func printDiagnostics(diags []lint.Diagnostic) {
+	for _, d := range diags {
+		color := "{bright:yellow}"
+		if d.Severity == lint.SeverityError {
+			color = "{bright:red}"
+		}
+		fmtc.Printf("%s: "+color+"%s{reset}: %s\n", d.Position(), d.Severity, d.Message)
+	}
+}
+
+// printPlan prints each change of an apply plan, with the diff of updated
+// workflows, followed by a summary.
+func printPlan(plan *apply.Plan) {
+	markers := map[apply.Action]string{
+		apply.ActionCreate:    "{bright:green}+",
+		apply.ActionUpdate:    "{bright:yellow}~",
+		apply.ActionDelete:    "{bright:red}-",
+		apply.ActionUnchanged: "{dim} ",
+	}
+	for _, c := range plan.Changes {
+		fmtc.Printf(markers[c.Action]+" %s %s{reset} (%s)\n", c.Action, c.Name, c.Source)
+		printDiff(c.Diff)
+	}
+	for _, w := range plan.Orphans {
+		fmtc.Printf("{dim}? %s was applied from %s, which no longer exists; pass --prune to delete it{reset}\n", w.Name, w.Source)
+	}
+	fmt.Printf("\nPlan: %d to create, %d to update, %d to delete, %d unchanged\n",
+		plan.Count(apply.ActionCreate), plan.Count(apply.ActionUpdate), plan.Count(apply.ActionDelete), plan.Count(apply.ActionUnchanged))
+}
+
+func printDiff(diff []apply.DiffLine) {
+	colors := map[apply.DiffOp]string{
+		apply.DiffInsert: "{green}",
+		apply.DiffDelete: "{red}",
+		apply.DiffEqual:  "{dim}",
+	}
+	for _, l := range diff {
+		fmtc.Printf("    "+colors[l.Op]+"%s{reset}\n", l)
+	}
+}
+
+func printAttempt(header string, attempt models.StepAttempt) {
+	fmt.Printf("=== %s ===\n", header)
+	for i, line := range attempt.Logs {
+		fmt.Printf("[%d] %s\n", i+1, line)
+	}
+	if attempt.Error != "" {
+		fmt.Printf("error: %s\n", attempt.Error)
+	}
+}
+
+// waitForRun polls a queued run until it finishes, printing each step
+// attempt as it completes.
+func waitForRun(db *db.DB, runID int64, stream bool) (*models.Run, error) {
+	printed := make(map[int64]bool)
+	started := false
+	for {
+		run, err := db.GetRun(runID)
+		if err != nil {
+			return nil, err
+		}
+		if !started && run.Status != models.RunStatusPending {
+			started = true
+			if stream {
+				fmt.Printf("Run %d started\n", runID)
+			}
+		}
+		if !started {
+			live, err := daemonRunning(db)
+			if err != nil {
+				return nil, err
+			}
+			if !live {
+				fatalf(exitError, "Run %d is queued, but no daemon is running to execute it; start gorkd, or pass --detach to queue runs without waiting", runID)
+			}
+		}
+
+		if !stream {
+			if run.Status.IsTerminal() {
+				return run, nil
+			}
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+
+		stepRuns, err := db.GetStepRuns(runID)
+		if err != nil {
+			return nil, err
+		}
+		for _, sr := range stepRuns {
+			for _, attempt := range sr.Attempts {
+				if printed[attempt.ID] || !attempt.Status.IsTerminal() {
+					continue
+				}
+				printed[attempt.ID] = true
+				printAttempt(sr.StepName+" "+attempt.Summary(), attempt)
+			}
+		}
+
+		if run.Status.IsTerminal() {
+			for _, sr := range stepRuns {
+				if len(sr.Attempts) == 0 && sr.Error != "" {
+					fmt.Printf("=== %s: %s (%s) ===\n", sr.StepName, sr.Status, sr.Error)
+				}
+			}
+			return run, nil
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// newRunLogsOutput returns run with its steps as the logs command prints them
+// in the structured output formats.
+func newRunLogsOutput(db *db.DB, run *models.Run) (runLogsOutput, error) {
+	stepRuns, err := db.GetStepRuns(run.ID)
+	if err != nil {
+		return runLogsOutput{}, err
+	}
+	data, err := db.GetAllStepData(run.ID)
+	if err != nil {
+		return runLogsOutput{}, err
+	}
+	workflowName := "Unknown"
+	if workflow, err := db.GetWorkflow(run.WorkflowID); err == nil {
+		workflowName = workflow.Name
+	}
+	out := runLogsOutput{Run: newRunOutput(*run, workflowName), Steps: make([]stepRunOutput, len(stepRuns))}
+	for i, sr := range stepRuns {
+		out.Steps[i] = newStepRunOutput(sr, data[sr.StepName])
+	}
+	return out, nil
+}
+
+// daemonRunning reports whether any daemon holds an unexpired lease, and so
+// will pick up queued runs.
+func daemonRunning(db *db.DB) (bool, error) {
+	leases, err := db.ListLeases()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	for _, l := range leases {
+		if strings.HasPrefix(l.Name, models.DaemonLeasePrefix) && !l.Expired(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setPaused implements the pause and resume commands.
+func setPaused(ctx context.Context, paused bool) error {
+	action := "Resumed"
+	if paused {
+		action = "Paused"
+	}
+	args := cli.Args(ctx)
+	all := cli.Flags(ctx)["all"].(bool)
+	if all == (len(args) == 1) {
+		fatalf(exitUsage, "Specify either a workflow name or --all")
+	}
+
+	db, err := db.NewDB(dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if all {
+		if err := db.SetSchedulingPaused(paused); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s scheduling for all workflows\n", action)
+		return nil
+	}
+
+	workflow, err := db.GetWorkflowByName(args[0])
+	if err != nil {
+		fatalLookup(err, "Workflow %s not found", args[0])
+	}
+	if err := db.SetWorkflowPaused(workflow.ID, paused); err != nil {
 		log.Fatal(err)
 	}
+	fmt.Printf("%s workflow %s\n", action, workflow.Name)
+	return nil
+}
+
+// waitForBackfill polls a backfill until none of its runs are left to
+// execute, printing each run as it finishes.
+func waitForBackfill(db *db.DB, backfillID int64) (*models.Backfill, []models.Run, error) {
+	reported := make(map[int64]bool)
+	for {
+		backfill, err := db.GetBackfill(backfillID)
+		if err != nil {
+			return nil, nil, err
+		}
+		runs, err := db.ListBackfillRuns(backfillID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, r := range runs {
+			if reported[r.ID] || !r.Status.IsTerminal() {
+				continue
+			}
+			reported[r.ID] = true
+			fmt.Printf("[%d/%d] %s: run %d %s\n", len(reported), len(runs), r.Params[models.LogicalDateParam], r.ID, r.Status)
+		}
+
+		if backfill.Status != models.BackfillStatusRunning {
+			return backfill, runs, nil
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// backfillSummary counts runs by status, e.g. "28 success, 2 failed".
+func backfillSummary(runs []models.Run) string {
+	counts := make(map[models.RunStatus]int)
+	var statuses []string
+	for _, r := range runs {
+		if counts[r.Status] == 0 {
+			statuses = append(statuses, string(r.Status))
+		}
+		counts[r.Status]++
+	}
+	sort.Strings(statuses)
+
+	parts := make([]string, len(statuses))
+	for i, s := range statuses {
+		parts[i] = fmt.Sprintf("%d %s", counts[models.RunStatus(s)], s)
+	}
+	return strings.Join(parts, ", ")
 }
 
 func truncateString(s string, maxLen int) string {
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kingoftac/flagon/cli"
+	"github.com/kingoftac/gork/internal/lint"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// outputFormats are the values of the global --output flag. Table is the
+// human-readable default; the others are meant for scripts.
+var outputFormats = []string{"table", "json", "yaml", "csv"}
+
+// outputFormat is the format commands print in.
+var outputFormat = "table"
+
+// structuredCommands are the commands that print in every output format, by
+// path. The others only print for people.
+var structuredCommands = [][]string{
+	{"validate"}, {"list"}, {"runs"}, {"run"}, {"logs"}, {"notifications"}, {"daemons"},
+	{"schedule", "list"}, {"schedule", "preview"}, {"backfill", "list"}, {"backfill", "status"},
+}
+
+// checkOutputFormat is middleware that refuses the json, yaml and csv output
+// formats for commands that are not structuredCommands, rather than
+// silently printing a table.
+func checkOutputFormat(c *cli.CLI) cli.Middleware {
+	return func(next cli.Handler) cli.Handler {
+		return func(ctx context.Context) error {
+			cmd := cli.CurrentCommand(ctx)
+			supported := slices.ContainsFunc(structuredCommands, func(path []string) bool {
+				found, ok := c.FindCommand(path...)
+				return ok && found == cmd
+			})
+			if outputFormat != "table" && !supported {
+				fatalf(exitUsage, "%s does not support --output %s", cmd.Name, outputFormat)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// extractOutputFlag removes the global --output (or -o) flag from args and
+// returns its value. flagon only parses the flags of the command being run,
+// so a global flag has to be taken out before it sees the arguments. It may
+// appear anywhere before a "--".
+func extractOutputFlag(args []string) ([]string, string, error) {
+	format := outputFormat
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		if !strings.HasPrefix(arg, "-") || (name != "output" && name != "o") {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return nil, "", fmt.Errorf("flag needs an argument: %s", arg)
+			}
+			i++
+			value = args[i]
+		}
+		if !slices.Contains(outputFormats, value) {
+			return nil, "", fmt.Errorf("invalid output format %q (want %s)", value, strings.Join(outputFormats, ", "))
+		}
+		format = value
+	}
+	return rest, format, nil
+}
+
+// The types below are the JSON, YAML and CSV schemas of the structured
+// commands. Scripts depend on them, so fields may be added but are never
+// renamed or removed. Times are RFC 3339 and null when unset.
+
+type workflowOutput struct {
+	ID          int64      `json:"id" yaml:"id"`
+	Name        string     `json:"name" yaml:"name"`
+	Description string     `json:"description" yaml:"description"`
+	Schedule    string     `json:"schedule" yaml:"schedule"`
+	Paused      bool       `json:"paused" yaml:"paused"`
+	NextFireAt  *time.Time `json:"next_fire_at" yaml:"next_fire_at"`
+	Source      string     `json:"source" yaml:"source"`
+	Steps       []string   `json:"steps" yaml:"steps"`
+	CreatedAt   time.Time  `json:"created_at" yaml:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" yaml:"updated_at"`
+}
+
+type runOutput struct {
+	ID          int64             `json:"id" yaml:"id"`
+	WorkflowID  int64             `json:"workflow_id" yaml:"workflow_id"`
+	Workflow    string            `json:"workflow" yaml:"workflow"`
+	Status      models.RunStatus  `json:"status" yaml:"status"`
+	Trigger     string            `json:"trigger" yaml:"trigger"`
+	Params      map[string]string `json:"params" yaml:"params"`
+	ScheduledAt *time.Time        `json:"scheduled_at" yaml:"scheduled_at"`
+	StartedAt   *time.Time        `json:"started_at" yaml:"started_at"`
+	CompletedAt *time.Time        `json:"completed_at" yaml:"completed_at"`
+	CreatedAt   time.Time         `json:"created_at" yaml:"created_at"`
+}
+
+// runLogsOutput is what the logs command prints: the run and each of its
+// steps with their attempts and the data they stored.
+type runLogsOutput struct {
+	Run   runOutput       `json:"run" yaml:"run"`
+	Steps []stepRunOutput `json:"steps" yaml:"steps"`
+}
+
+type stepRunOutput struct {
+	ID          int64             `json:"id" yaml:"id"`
+	Name        string            `json:"name" yaml:"name"`
+	Status      models.StepStatus `json:"status" yaml:"status"`
+	StartedAt   *time.Time        `json:"started_at" yaml:"started_at"`
+	CompletedAt *time.Time        `json:"completed_at" yaml:"completed_at"`
+	Error       string            `json:"error" yaml:"error"`
+	Data        map[string]string `json:"data" yaml:"data"`
+	Attempts    []attemptOutput   `json:"attempts" yaml:"attempts"`
+}
+
+type attemptOutput struct {
+	// Attempt is numbered from 1, as in the table output.
+	Attempt     int               `json:"attempt" yaml:"attempt"`
+	Status      models.StepStatus `json:"status" yaml:"status"`
+	StartedAt   *time.Time        `json:"started_at" yaml:"started_at"`
+	CompletedAt *time.Time        `json:"completed_at" yaml:"completed_at"`
+	ExitCode    *int              `json:"exit_code" yaml:"exit_code"`
+	Error       string            `json:"error" yaml:"error"`
+	Logs        []string          `json:"logs" yaml:"logs"`
+}
+
+// scheduleOutput is a row of schedule list.
+type scheduleOutput struct {
+	WorkflowID int64  `json:"workflow_id" yaml:"workflow_id"`
+	Workflow   string `json:"workflow" yaml:"workflow"`
+	Schedule   string `json:"schedule" yaml:"schedule"`
+	// Paused is set if the workflow or all scheduling is paused.
+	Paused        bool             `json:"paused" yaml:"paused"`
+	LastRunID     *int64           `json:"last_run_id" yaml:"last_run_id"`
+	LastStatus    models.RunStatus `json:"last_status" yaml:"last_status"`
+	LastStartedAt *time.Time       `json:"last_started_at" yaml:"last_started_at"`
+	NextFireAt    *time.Time       `json:"next_fire_at" yaml:"next_fire_at"`
+}
+
+// fireTimeOutput is a row of schedule preview.
+type fireTimeOutput struct {
+	Time time.Time `json:"time" yaml:"time"`
+	// After is how long after now the schedule fires, as a Go duration.
+	After string `json:"after" yaml:"after"`
+}
+
+// backfillOutput is a row of backfill list. From and To are dates, and Runs
+// counts the runs of the backfill by status.
+type backfillOutput struct {
+	ID         int64                 `json:"id" yaml:"id"`
+	WorkflowID int64                 `json:"workflow_id" yaml:"workflow_id"`
+	Workflow   string                `json:"workflow" yaml:"workflow"`
+	From       string                `json:"from" yaml:"from"`
+	To         string                `json:"to" yaml:"to"`
+	Parallel   int                   `json:"parallel" yaml:"parallel"`
+	Status     models.BackfillStatus `json:"status" yaml:"status"`
+	Runs       map[string]int        `json:"runs" yaml:"runs"`
+	CreatedAt  time.Time             `json:"created_at" yaml:"created_at"`
+}
+
+// backfillStatusOutput is what backfill status prints: the backfill and each
+// of its runs.
+type backfillStatusOutput struct {
+	Backfill backfillOutput `json:"backfill" yaml:"backfill"`
+	Runs     runsOutput     `json:"runs" yaml:"runs"`
+}
+
+type notificationOutput struct {
+	ID        int64                     `json:"id" yaml:"id"`
+	RunID     int64                     `json:"run_id" yaml:"run_id"`
+	Notifier  string                    `json:"notifier" yaml:"notifier"`
+	Event     models.EventType          `json:"event" yaml:"event"`
+	Step      string                    `json:"step" yaml:"step"`
+	Attempt   int                       `json:"attempt" yaml:"attempt"`
+	Status    models.NotificationStatus `json:"status" yaml:"status"`
+	Error     string                    `json:"error" yaml:"error"`
+	CreatedAt time.Time                 `json:"created_at" yaml:"created_at"`
+}
+
+type daemonOutput struct {
+	Owner     string    `json:"owner" yaml:"owner"`
+	Leader    bool      `json:"leader" yaml:"leader"`
+	StartedAt time.Time `json:"started_at" yaml:"started_at"`
+	ExpiresAt time.Time `json:"expires_at" yaml:"expires_at"`
+	Expired   bool      `json:"expired" yaml:"expired"`
+}
+
+func newWorkflowOutput(w models.Workflow) workflowOutput {
+	steps := make([]string, len(w.Steps))
+	for i, s := range w.Steps {
+		steps[i] = s.Name
+	}
+	return workflowOutput{
+		ID:          w.ID,
+		Name:        w.Name,
+		Description: w.Description,
+		Schedule:    w.Schedule,
+		Paused:      w.Paused,
+		NextFireAt:  optionalTime(w.NextFireAt),
+		Source:      w.Source,
+		Steps:       steps,
+		CreatedAt:   w.CreatedAt,
+		UpdatedAt:   w.UpdatedAt,
+	}
+}
+
+func newRunOutput(r models.Run, workflowName string) runOutput {
+	params := r.Params
+	if params == nil {
+		params = map[string]string{}
+	}
+	return runOutput{
+		ID:          r.ID,
+		WorkflowID:  r.WorkflowID,
+		Workflow:    workflowName,
+		Status:      r.Status,
+		Trigger:     r.Trigger,
+		Params:      params,
+		ScheduledAt: optionalTime(r.ScheduledAt),
+		StartedAt:   optionalTime(r.StartedAt),
+		CompletedAt: optionalTime(r.CompletedAt),
+		CreatedAt:   r.CreatedAt,
+	}
+}
+
+func newStepRunOutput(sr models.StepRun, data map[string]string) stepRunOutput {
+	if data == nil {
+		data = map[string]string{}
+	}
+	attempts := make([]attemptOutput, len(sr.Attempts))
+	for i, a := range sr.Attempts {
+		attempts[i] = attemptOutput{
+			Attempt:     a.Attempt + 1,
+			Status:      a.Status,
+			StartedAt:   optionalTime(a.StartedAt),
+			CompletedAt: optionalTime(a.CompletedAt),
+			ExitCode:    a.ExitCode,
+			Error:       a.Error,
+			Logs:        nonNil(a.Logs),
+		}
+	}
+	// Runs recorded before per-attempt history only have the combined step
+	// logs, which are reported as a single attempt.
+	if len(sr.Attempts) == 0 {
+		attempts = append(attempts, attemptOutput{
+			Attempt:     sr.Attempt + 1,
+			Status:      sr.Status,
+			StartedAt:   optionalTime(sr.StartedAt),
+			CompletedAt: optionalTime(sr.CompletedAt),
+			Error:       sr.Error,
+			Logs:        nonNil(sr.Logs),
+		})
+	}
+	return stepRunOutput{
+		ID:          sr.ID,
+		Name:        sr.StepName,
+		Status:      sr.Status,
+		StartedAt:   optionalTime(sr.StartedAt),
+		CompletedAt: optionalTime(sr.CompletedAt),
+		Error:       sr.Error,
+		Data:        data,
+		Attempts:    attempts,
+	}
+}
+
+func newBackfillOutput(b models.Backfill, workflowName string, runs []models.Run) backfillOutput {
+	counts := make(map[string]int)
+	for _, r := range runs {
+		counts[string(r.Status)]++
+	}
+	return backfillOutput{
+		ID:         b.ID,
+		WorkflowID: b.WorkflowID,
+		Workflow:   workflowName,
+		From:       b.From.Format(time.DateOnly),
+		To:         b.To.Format(time.DateOnly),
+		Parallel:   b.Parallel,
+		Status:     b.Status,
+		Runs:       counts,
+		CreatedAt:  b.CreatedAt,
+	}
+}
+
+// csvTable is output that can also be written as CSV, one row per item.
+type csvTable interface {
+	csvHeader() []string
+	csvRows() [][]string
+}
+
+type workflowsOutput []workflowOutput
+
+func (o workflowsOutput) csvHeader() []string {
+	return []string{"id", "name", "description", "schedule", "paused", "next_fire_at", "steps", "created_at", "updated_at", "source"}
+}
+
+func (o workflowsOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, w := range o {
+		rows[i] = []string{
+			strconv.FormatInt(w.ID, 10), w.Name, w.Description, w.Schedule, strconv.FormatBool(w.Paused),
+			csvTime(w.NextFireAt), strings.Join(w.Steps, ","), csvTime(&w.CreatedAt), csvTime(&w.UpdatedAt), w.Source,
+		}
+	}
+	return rows
+}
+
+type runsOutput []runOutput
+
+func (o runsOutput) csvHeader() []string {
+	return []string{"id", "workflow_id", "workflow", "status", "trigger", "params", "scheduled_at", "started_at", "completed_at", "created_at"}
+}
+
+func (o runsOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, r := range o {
+		rows[i] = []string{
+			strconv.FormatInt(r.ID, 10), strconv.FormatInt(r.WorkflowID, 10), r.Workflow, string(r.Status), r.Trigger,
+			csvJSON(r.Params), csvTime(r.ScheduledAt), csvTime(r.StartedAt), csvTime(r.CompletedAt), csvTime(&r.CreatedAt),
+		}
+	}
+	return rows
+}
+
+// As CSV, the logs of a run are one row per step attempt. Map columns are
+// JSON objects and log lines are separated by newlines.
+
+func (o runLogsOutput) csvHeader() []string {
+	return []string{"run_id", "step", "step_status", "data", "attempt", "status", "exit_code", "started_at", "completed_at", "error", "logs"}
+}
+
+func (o runLogsOutput) csvRows() [][]string {
+	var rows [][]string
+	for _, s := range o.Steps {
+		for _, a := range s.Attempts {
+			exitCode := ""
+			if a.ExitCode != nil {
+				exitCode = strconv.Itoa(*a.ExitCode)
+			}
+			rows = append(rows, []string{
+				strconv.FormatInt(o.Run.ID, 10), s.Name, string(s.Status), csvJSON(s.Data),
+				strconv.Itoa(a.Attempt), string(a.Status), exitCode, csvTime(a.StartedAt), csvTime(a.CompletedAt),
+				a.Error, strings.Join(a.Logs, "\n"),
+			})
+		}
+	}
+	return rows
+}
+
+type schedulesOutput []scheduleOutput
+
+func (o schedulesOutput) csvHeader() []string {
+	return []string{"workflow_id", "workflow", "schedule", "paused", "last_run_id", "last_status", "last_started_at", "next_fire_at"}
+}
+
+func (o schedulesOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, s := range o {
+		lastRunID := ""
+		if s.LastRunID != nil {
+			lastRunID = strconv.FormatInt(*s.LastRunID, 10)
+		}
+		rows[i] = []string{
+			strconv.FormatInt(s.WorkflowID, 10), s.Workflow, s.Schedule, strconv.FormatBool(s.Paused),
+			lastRunID, string(s.LastStatus), csvTime(s.LastStartedAt), csvTime(s.NextFireAt),
+		}
+	}
+	return rows
+}
+
+type fireTimesOutput []fireTimeOutput
+
+func (o fireTimesOutput) csvHeader() []string {
+	return []string{"time", "after"}
+}
+
+func (o fireTimesOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, f := range o {
+		rows[i] = []string{csvTime(&f.Time), f.After}
+	}
+	return rows
+}
+
+type backfillsOutput []backfillOutput
+
+func (o backfillsOutput) csvHeader() []string {
+	return []string{"id", "workflow_id", "workflow", "from", "to", "parallel", "status", "runs", "created_at"}
+}
+
+func (o backfillsOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, b := range o {
+		rows[i] = []string{
+			strconv.FormatInt(b.ID, 10), strconv.FormatInt(b.WorkflowID, 10), b.Workflow, b.From, b.To,
+			strconv.Itoa(b.Parallel), string(b.Status), csvJSON(b.Runs), csvTime(&b.CreatedAt),
+		}
+	}
+	return rows
+}
+
+// As CSV, the status of a backfill is one row per run.
+
+func (o backfillStatusOutput) csvHeader() []string {
+	return append([]string{"backfill_id"}, o.Runs.csvHeader()...)
+}
+
+func (o backfillStatusOutput) csvRows() [][]string {
+	rows := o.Runs.csvRows()
+	for i, row := range rows {
+		rows[i] = append([]string{strconv.FormatInt(o.Backfill.ID, 10)}, row...)
+	}
+	return rows
+}
+
+type notificationsOutput []notificationOutput
+
+func (o notificationsOutput) csvHeader() []string {
+	return []string{"id", "run_id", "notifier", "event", "step", "attempt", "status", "error", "created_at"}
+}
+
+func (o notificationsOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, n := range o {
+		rows[i] = []string{
+			strconv.FormatInt(n.ID, 10), strconv.FormatInt(n.RunID, 10), n.Notifier, string(n.Event), n.Step,
+			strconv.Itoa(n.Attempt), string(n.Status), n.Error, csvTime(&n.CreatedAt),
+		}
+	}
+	return rows
+}
+
+type daemonsOutput []daemonOutput
+
+func (o daemonsOutput) csvHeader() []string {
+	return []string{"owner", "leader", "started_at", "expires_at", "expired"}
+}
+
+func (o daemonsOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, d := range o {
+		rows[i] = []string{d.Owner, strconv.FormatBool(d.Leader), csvTime(&d.StartedAt), csvTime(&d.ExpiresAt), strconv.FormatBool(d.Expired)}
+	}
+	return rows
+}
+
+// diagnosticOutput is one problem found by the validate command.
+type diagnosticOutput struct {
+	File     string        `json:"file" yaml:"file"`
+	Line     int           `json:"line" yaml:"line"`
+	Column   int           `json:"column" yaml:"column"`
+	Severity lint.Severity `json:"severity" yaml:"severity"`
+	Message  string        `json:"message" yaml:"message"`
+}
+
+type diagnosticsOutput []diagnosticOutput
+
+func (o diagnosticsOutput) csvHeader() []string {
+	return []string{"file", "line", "column", "severity", "message"}
+}
+
+func (o diagnosticsOutput) csvRows() [][]string {
+	rows := make([][]string, len(o))
+	for i, d := range o {
+		rows[i] = []string{d.File, strconv.Itoa(d.Line), strconv.Itoa(d.Column), string(d.Severity), d.Message}
+	}
+	return rows
+}
+
+// printOutput writes v to stdout in the json, yaml or csv output format.
+func printOutput(v csvTable) error {
+	switch outputFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(v.csvHeader())
+		w.WriteAll(v.csvRows())
+		return w.Error()
+	}
+	return fmt.Errorf("output format %q has no structured form", outputFormat)
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func csvJSON(m any) string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
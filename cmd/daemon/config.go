@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kingoftac/gork/internal/tracing"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPath is read if it exists and no -config flag is given.
+var defaultConfigPath = filepath.Join(dirs.ConfigHome(), "daemon.yml")
+
+// config is the daemon config file. Every section is optional.
+type config struct {
+	Tracing tracing.Config `yaml:"tracing"`
+}
+
+// loadConfig reads the config file at path. A missing file is only an error
+// if it was asked for explicitly.
+func loadConfig(path string, explicit bool) (*config, error) {
+	cfg := &config{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if err := cfg.Tracing.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: tracing: %w", path, err)
+	}
+	return cfg, nil
+}
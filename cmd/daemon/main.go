@@ -2,15 +2,29 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/apparentlymart/go-userdirs/userdirs"
 	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/dispatcher"
+	"github.com/kingoftac/gork/internal/lease"
+	"github.com/kingoftac/gork/internal/metrics"
+	"github.com/kingoftac/gork/internal/notify"
+	"github.com/kingoftac/gork/internal/runner"
 	"github.com/kingoftac/gork/internal/scheduler"
+	"github.com/kingoftac/gork/internal/tracing"
+	"github.com/kingoftac/gork/internal/trigger"
 	"github.com/kingoftac/gork/internal/version"
+	"github.com/kingoftac/gork/internal/worker"
 )
 
 var (
@@ -20,6 +34,13 @@ var (
 )
 
 func main() {
+	maxRuns := flag.Int("max-runs", dispatcher.DefaultWorkers, "Maximum number of workflow runs to execute at the same time")
+	httpAddr := flag.String("http-addr", "127.0.0.1:8470", "Address to serve webhook triggers, workers and metrics on (empty to disable)")
+	workerToken := flag.String("worker-token", os.Getenv("GORK_WORKER_TOKEN"), "Token workers must present to run steps (defaults to $GORK_WORKER_TOKEN); workers are disabled without one")
+	configPath := flag.String("config", defaultConfigPath, "Path of the daemon config file")
+	localWorker := flag.Bool("local-worker", false, "Run a worker inside the daemon for steps with runs_on labels")
+	flag.Parse()
+
 	// Use a writer that flushes immediately for real-time log output
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
@@ -29,6 +50,46 @@ func main() {
 	// Disable output buffering for real-time logs
 	os.Stdout.Sync()
 
+	if *maxRuns < 1 {
+		slog.Error("max-runs must be at least 1", "max_runs", *maxRuns)
+		os.Exit(1)
+	}
+	if *localWorker && *httpAddr == "" {
+		slog.Error("local-worker requires http-addr")
+		os.Exit(1)
+	}
+	if *localWorker && *workerToken == "" {
+		// The in-process worker is the only one that needs to know it.
+		token, err := worker.NewToken()
+		if err != nil {
+			slog.Error("failed to generate worker token", "error", err)
+			os.Exit(1)
+		}
+		*workerToken = token
+	}
+
+	configSet := false
+	flag.Visit(func(f *flag.Flag) { configSet = configSet || f.Name == "config" })
+	cfg, err := loadConfig(*configPath, configSet)
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		slog.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+	if cfg.Tracing.Exporter != "" {
+		slog.Info("Exporting traces", "exporter", cfg.Tracing.Exporter)
+	}
+
 	db, err := db.NewDB(dbPath)
 	if err != nil {
 		slog.Error("failed to open database", "error", err)
@@ -36,7 +97,24 @@ func main() {
 	}
 	defer db.Close()
 
+	metrics.NewGaugeFunc("gork_queue_depth", "Runs in the queue shared by all daemons, by queue status.", "status", func() (map[string]float64, error) {
+		counts, err := db.CountQueuedRuns()
+		if err != nil {
+			return nil, err
+		}
+		depth := make(map[string]float64, len(counts))
+		for status, n := range counts {
+			depth[string(status)] = float64(n)
+		}
+		return depth, nil
+	})
+
+	disp := dispatcher.NewDispatcher(db, *maxRuns)
+	notifier := notify.NewSender(db)
+	disp.Subscribe(notifier.Handle)
 	sched := scheduler.NewScheduler(db)
+	watcher := trigger.NewFileWatcher(db)
+	elector := lease.NewElector(db, disp.Owner())
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -50,6 +128,89 @@ func main() {
 	}()
 
 	slog.Info("Starting gork daemon...", "version", version.Version)
-	sched.Start(ctx)
+	if err := runner.PrepareCgroups(); err != nil {
+		slog.Info("Step cgroups are unavailable; memory and process limits fall back to rlimits", "reason", err)
+	}
+
+	if err := elector.Register(); err != nil {
+		slog.Error("failed to register daemon lease", "error", err)
+		os.Exit(1)
+	}
+	defer elector.Unregister()
+
+	// The HTTP server outlives the dispatcher, so that workers can report
+	// steps stopped during shutdown.
+	var server *http.Server
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(trigger.WebhookPath, trigger.NewWebhookHandler(db))
+		mux.Handle("/metrics", metrics.Handler())
+
+		// Workers run arbitrary commands, so the agent API is only served
+		// to those presenting the token.
+		if *workerToken != "" {
+			pool := worker.NewPool(*workerToken)
+			disp.SetRemoteRunner(pool)
+			go pool.Start(ctx)
+			mux.Handle(worker.Path, pool.Handler())
+		} else {
+			slog.Info("Workers are disabled; set --worker-token or GORK_WORKER_TOKEN to accept them")
+		}
+		server = &http.Server{Addr: *httpAddr, Handler: mux}
+
+		go func() {
+			slog.Info("Serving webhook triggers, workers and metrics", "addr", *httpAddr)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP server failed, webhook triggers, workers and metrics are unavailable", "addr", *httpAddr, "error", err)
+			}
+		}()
+
+		if *localWorker {
+			agent := worker.NewAgent(localURL(*httpAddr), "local", []string{"local"}, *workerToken, *maxRuns)
+			go agent.Run(ctx)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		disp.Start(ctx)
+	}()
+
+	// Every daemon executes queued runs, but only the leader schedules them
+	// and watches for file triggers, so that each fires once.
+	elector.Run(ctx, func(ctx context.Context) {
+		var leaderWg sync.WaitGroup
+		leaderWg.Add(1)
+		go func() {
+			defer leaderWg.Done()
+			watcher.Start(ctx)
+		}()
+		sched.Start(ctx)
+		leaderWg.Wait()
+	})
+	wg.Wait()
+
+	notifyCtx, notifyCancel := context.WithTimeout(context.Background(), 15*time.Second)
+	notifier.Shutdown(notifyCtx)
+	notifyCancel()
+
+	if server != nil {
+		server.Close()
+	}
 	slog.Info("Gork daemon stopped")
 }
+
+// localURL returns the URL at which the daemon's own HTTP server is reached
+// when it listens on addr.
+func localURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
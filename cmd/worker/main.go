@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kingoftac/gork/internal/models"
+	"github.com/kingoftac/gork/internal/runner"
+	"github.com/kingoftac/gork/internal/tracing"
+	"github.com/kingoftac/gork/internal/version"
+	"github.com/kingoftac/gork/internal/worker"
+)
+
+func main() {
+	hostname, _ := os.Hostname()
+
+	daemonURL := flag.String("daemon", "http://127.0.0.1:8470", "URL of the daemon to take steps from")
+	name := flag.String("name", hostname, "Name of this worker in daemon logs")
+	labels := flag.String("labels", "", "Comma-separated labels to advertise, in addition to the OS and architecture")
+	token := flag.String("token", os.Getenv("GORK_WORKER_TOKEN"), "Token to present to the daemon (defaults to $GORK_WORKER_TOKEN)")
+	slots := flag.Int("slots", 1, "Maximum number of steps to run at the same time")
+	traceExporter := flag.String("trace-exporter", "", "Export spans of the steps this worker runs, in the daemon's traces: otlp, file or stdout")
+	traceEndpoint := flag.String("trace-endpoint", "", "Collector endpoint of the otlp exporter (defaults to "+tracing.DefaultEndpoint+")")
+	traceFile := flag.String("trace-file", "", "File the file exporter appends spans to")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+	slog.SetDefault(logger)
+
+	var labelList []string
+	for l := range strings.SplitSeq(*labels, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labelList = append(labelList, l)
+		}
+	}
+	if err := models.ValidateWorkerLabels(labelList); err != nil {
+		slog.Error("invalid labels", "error", err)
+		os.Exit(1)
+	}
+	if *slots < 1 {
+		slog.Error("slots must be at least 1", "slots", *slots)
+		os.Exit(1)
+	}
+	if *token == "" {
+		slog.Error("token is required; set --token or GORK_WORKER_TOKEN to the daemon's worker token")
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := tracing.Setup(tracing.Config{Exporter: *traceExporter, Endpoint: *traceEndpoint, File: *traceFile, ServiceName: "gork-worker"})
+	if err != nil {
+		slog.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	slog.Info("Starting gork worker...", "version", version.Version)
+	if err := runner.PrepareCgroups(); err != nil {
+		slog.Info("Step cgroups are unavailable; memory and process limits fall back to rlimits", "reason", err)
+	}
+	worker.NewAgent(*daemonURL, *name, labelList, *token, *slots).Run(ctx)
+}
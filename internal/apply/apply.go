@@ -0,0 +1,252 @@
+// Package apply compares a directory of workflow files with the workflows in
+// the database and plans the changes that make the database match it.
+package apply
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kingoftac/gork/internal/lint"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// File is a workflow file in the applied directory.
+type File struct {
+	Path     string
+	Workflow *models.Workflow
+}
+
+// Load lints and decodes every .yml and .yaml file directly in dir. Files are
+// only returned if there are no errors among the diagnostics, which include
+// workflow names used by more than one file. Paths are absolute.
+func Load(dir string) ([]File, []lint.Diagnostic, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []File
+	var diags []lint.Diagnostic
+	seen := make(map[string]string)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileDiags := lint.Lint(path, data)
+		diags = append(diags, fileDiags...)
+		if lint.HasErrors(fileDiags) {
+			continue
+		}
+
+		var w models.Workflow
+		if err := yaml.Unmarshal(data, &w); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if other, ok := seen[w.Name]; ok {
+			diags = append(diags, lint.Diagnostic{
+				File:     path,
+				Severity: lint.SeverityError,
+				Message:  fmt.Sprintf("workflow %q is also defined in %s", w.Name, other),
+			})
+			continue
+		}
+		seen[w.Name] = path
+		w.Source = path
+		files = append(files, File{Path: path, Workflow: &w})
+	}
+
+	if lint.HasErrors(diags) {
+		return nil, diags, nil
+	}
+	return files, diags, nil
+}
+
+type Action string
+
+const (
+	ActionCreate    Action = "create"
+	ActionUpdate    Action = "update"
+	ActionDelete    Action = "delete"
+	ActionUnchanged Action = "unchanged"
+)
+
+// Change is what applying does to one workflow.
+type Change struct {
+	Action Action
+	Name   string
+	// Source is the file the workflow is applied from, or for deletes the
+	// file it was last applied from.
+	Source string
+	// Workflow is the workflow from the file, nil for deletes.
+	Workflow *models.Workflow
+	// ID is the ID of the workflow in the database, 0 for creates.
+	ID int64
+	// Diff shows the changed lines of the workflow as YAML, for updates.
+	Diff []DiffLine
+}
+
+// Plan is the list of changes that makes the database match a directory.
+type Plan struct {
+	Changes []Change
+	// Orphans are workflows applied from the directory whose files are gone,
+	// which are only deleted when pruning.
+	Orphans []models.Workflow
+}
+
+// NewPlan compares the workflows in files, loaded from dir, with the existing
+// workflows. If prune is set, workflows that were applied from dir but no
+// longer have a file there are deleted.
+func NewPlan(dir string, files []File, existing []models.Workflow, prune bool) (*Plan, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]models.Workflow, len(existing))
+	for _, w := range existing {
+		current[w.Name] = w
+	}
+
+	plan := &Plan{}
+	wanted := make(map[string]bool, len(files))
+	for _, f := range files {
+		w := f.Workflow
+		wanted[w.Name] = true
+		old, ok := current[w.Name]
+		if !ok {
+			plan.Changes = append(plan.Changes, Change{Action: ActionCreate, Name: w.Name, Source: f.Path, Workflow: w})
+			continue
+		}
+
+		change := Change{Action: ActionUnchanged, Name: w.Name, Source: f.Path, Workflow: w, ID: old.ID}
+		diff, err := DefinitionDiff(&old, w)
+		if err != nil {
+			return nil, err
+		}
+		if old.Source != f.Path {
+			change.Action = ActionUpdate
+			change.Diff = append(change.Diff, sourceDiff(old.Source, f.Path)...)
+		}
+		if diff != nil {
+			change.Action = ActionUpdate
+			change.Diff = append(change.Diff, diff...)
+		}
+		plan.Changes = append(plan.Changes, change)
+	}
+
+	for _, w := range existing {
+		if wanted[w.Name] || w.Source == "" || filepath.Dir(w.Source) != dir {
+			continue
+		}
+		if !prune {
+			plan.Orphans = append(plan.Orphans, w)
+			continue
+		}
+		plan.Changes = append(plan.Changes, Change{Action: ActionDelete, Name: w.Name, Source: w.Source, ID: w.ID})
+	}
+
+	slices.SortStableFunc(plan.Changes, func(a, b Change) int { return strings.Compare(a.Name, b.Name) })
+	return plan, nil
+}
+
+// Count returns how many changes have action.
+func (p *Plan) Count(action Action) int {
+	n := 0
+	for _, c := range p.Changes {
+		if c.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Empty reports whether applying the plan would change nothing.
+func (p *Plan) Empty() bool {
+	return p.Count(ActionUnchanged) == len(p.Changes)
+}
+
+// Upserts returns the workflows to create or update.
+func (p *Plan) Upserts() []*models.Workflow {
+	var upserts []*models.Workflow
+	for _, c := range p.Changes {
+		if c.Action == ActionCreate || c.Action == ActionUpdate {
+			upserts = append(upserts, c.Workflow)
+		}
+	}
+	return upserts
+}
+
+// Deletes returns the IDs of the workflows to delete.
+func (p *Plan) Deletes() []int64 {
+	var deletes []int64
+	for _, c := range p.Changes {
+		if c.Action == ActionDelete {
+			deletes = append(deletes, c.ID)
+		}
+	}
+	return deletes
+}
+
+// DefinitionDiff compares the definitions of two versions of a workflow, as
+// written in a workflow file, and returns the difference, or nil if there is
+// none.
+func DefinitionDiff(old, w *models.Workflow) ([]DiffLine, error) {
+	oldYAML, err := definition(old)
+	if err != nil {
+		return nil, err
+	}
+	newYAML, err := definition(w)
+	if err != nil {
+		return nil, err
+	}
+	if oldYAML == newYAML {
+		return nil, nil
+	}
+	return Diff(oldYAML, newYAML), nil
+}
+
+// definition returns w as YAML without the fields that the database sets, so
+// that a workflow read back from the database equals the file it came from.
+func definition(w *models.Workflow) (string, error) {
+	var doc yaml.Node
+	if err := doc.Encode(w); err != nil {
+		return "", fmt.Errorf("failed to marshal workflow %s: %w", w.Name, err)
+	}
+	var content []*yaml.Node
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		switch doc.Content[i].Value {
+		case "id", "created_at", "updated_at":
+			continue
+		}
+		content = append(content, doc.Content[i], doc.Content[i+1])
+	}
+	doc.Content = content
+
+	data, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal workflow %s: %w", w.Name, err)
+	}
+	return string(data), nil
+}
+
+func sourceDiff(from, to string) []DiffLine {
+	var lines []DiffLine
+	if from != "" {
+		lines = append(lines, DiffLine{Op: DiffDelete, Text: "# source: " + from})
+	}
+	return append(lines, DiffLine{Op: DiffInsert, Text: "# source: " + to})
+}
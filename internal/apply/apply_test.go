@@ -0,0 +1,269 @@
+package apply
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/lint"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// workflowYAML returns a workflow with a single echo step, triggered after
+// each of the upstream workflows.
+func workflowYAML(name, message string, after ...string) string {
+	var b strings.Builder
+	b.WriteString("name: " + name + "\n")
+	if len(after) > 0 {
+		b.WriteString("triggers:\n  after:\n")
+		for _, a := range after {
+			b.WriteString("    - workflow: " + a + "\n")
+		}
+	}
+	b.WriteString("steps:\n  - name: say\n    exec:\n      command: echo\n      args: [" + message + "]\n")
+	return b.String()
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	alpha := writeFile(t, dir, "alpha.yml", workflowYAML("alpha", "hi"))
+	beta := writeFile(t, dir, "beta.yaml", workflowYAML("beta", "hi"))
+	writeFile(t, dir, "README.md", "not a workflow")
+	if err := os.Mkdir(filepath.Join(dir, "nested.yml"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	files, diags, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	var got []string
+	for _, f := range files {
+		if f.Workflow.Source != f.Path {
+			t.Errorf("%s: source = %q, want the file path", f.Path, f.Workflow.Source)
+		}
+		got = append(got, f.Path)
+	}
+	if want := []string{alpha, beta}; !slices.Equal(got, want) {
+		t.Fatalf("loaded %q, want %q", got, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name:  "invalid file",
+			files: map[string]string{"alpha.yml": workflowYAML("alpha", "hi"), "beta.yml": "name: beta\nsteps: []\n"},
+			want:  "at least one step",
+		},
+		{
+			name:  "duplicate name",
+			files: map[string]string{"alpha.yml": workflowYAML("alpha", "hi"), "copy.yml": workflowYAML("alpha", "hi")},
+			want:  `workflow "alpha" is also defined in`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				writeFile(t, dir, name, content)
+			}
+
+			files, diags, err := Load(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files != nil {
+				t.Fatalf("loaded %d files despite errors", len(files))
+			}
+			if !slices.ContainsFunc(diags, func(d lint.Diagnostic) bool {
+				return d.Severity == lint.SeverityError && strings.Contains(d.Message, tt.want)
+			}) {
+				t.Fatalf("diagnostics %v do not contain an error mentioning %q", diags, tt.want)
+			}
+		})
+	}
+}
+
+// applyDir loads dir and applies it to database, returning the plan.
+func applyDir(t *testing.T, database *db.DB, dir string, prune bool) *Plan {
+	t.Helper()
+	files, diags, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lint.HasErrors(diags) {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	existing, err := database.ListWorkflows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(dir, files, existing, prune)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.ApplyWorkflows(plan.Upserts(), plan.Deletes()); err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func actions(plan *Plan) map[string]Action {
+	got := make(map[string]Action, len(plan.Changes))
+	for _, c := range plan.Changes {
+		got[c.Name] = c.Action
+	}
+	return got
+}
+
+func orphans(plan *Plan) []string {
+	var names []string
+	for _, w := range plan.Orphans {
+		names = append(names, w.Name)
+	}
+	return names
+}
+
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func TestNewPlan(t *testing.T) {
+	database := newTestDB(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "alpha.yml", workflowYAML("alpha", "hi"))
+	writeFile(t, dir, "beta.yml", workflowYAML("beta", "hi"))
+	gamma := writeFile(t, dir, "gamma.yml", workflowYAML("gamma", "hi"))
+	applyDir(t, database, dir, false)
+
+	// A workflow applied from elsewhere is never an orphan of dir.
+	other := &models.Workflow{Name: "other", Source: filepath.Join(t.TempDir(), "other.yml"), Steps: []models.WorkflowStep{
+		{Name: "say", Exec: &models.ExecAction{Command: "echo"}},
+	}}
+	if err := database.InsertWorkflow(other); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := applyDir(t, database, dir, false)
+	if !plan.Empty() {
+		t.Fatalf("reapplying an unchanged directory planned %v", actions(plan))
+	}
+
+	writeFile(t, dir, "beta.yml", workflowYAML("beta", "bye"))
+	writeFile(t, dir, "delta.yml", workflowYAML("delta", "hi"))
+	if err := os.Remove(gamma); err != nil {
+		t.Fatal(err)
+	}
+	plan = applyDir(t, database, dir, false)
+	want := map[string]Action{"alpha": ActionUnchanged, "beta": ActionUpdate, "delta": ActionCreate}
+	if got := actions(plan); !maps.Equal(got, want) {
+		t.Fatalf("planned %v, want %v", got, want)
+	}
+	if got := orphans(plan); !slices.Equal(got, []string{"gamma"}) {
+		t.Fatalf("orphans = %q, want gamma", got)
+	}
+	var diff []DiffLine
+	for _, c := range plan.Changes {
+		if c.Name == "beta" {
+			diff = c.Diff
+		}
+	}
+	if !slices.Contains(diff, DiffLine{DiffDelete, "            - hi"}) || !slices.Contains(diff, DiffLine{DiffInsert, "            - bye"}) {
+		t.Fatalf("beta diff does not show the changed argument: %q", diff)
+	}
+
+	plan = applyDir(t, database, dir, true)
+	want = map[string]Action{"alpha": ActionUnchanged, "beta": ActionUnchanged, "delta": ActionUnchanged, "gamma": ActionDelete}
+	if got := actions(plan); !maps.Equal(got, want) {
+		t.Fatalf("pruning planned %v, want %v", got, want)
+	}
+	if _, err := database.GetWorkflowByName("gamma"); err == nil {
+		t.Fatal("pruned workflow gamma still exists")
+	}
+	if _, err := database.GetWorkflowByName("other"); err != nil {
+		t.Fatalf("workflow from another directory was pruned: %v", err)
+	}
+}
+
+func TestNewPlanMovedSource(t *testing.T) {
+	database := newTestDB(t)
+	dir := t.TempDir()
+	old := writeFile(t, dir, "alpha.yml", workflowYAML("alpha", "hi"))
+	applyDir(t, database, dir, false)
+
+	if err := os.Rename(old, filepath.Join(dir, "renamed.yml")); err != nil {
+		t.Fatal(err)
+	}
+	plan := applyDir(t, database, dir, true)
+	if got := actions(plan); !maps.Equal(got, map[string]Action{"alpha": ActionUpdate}) {
+		t.Fatalf("planned %v, want alpha updated", got)
+	}
+	if d := plan.Changes[0].Diff; len(d) != 2 || d[0].Op != DiffDelete || d[1].Op != DiffInsert || !strings.HasPrefix(d[0].Text, "# source: ") {
+		t.Fatalf("diff = %v, want only the source to change", d)
+	}
+}
+
+func TestApplyReversesTrigger(t *testing.T) {
+	database := newTestDB(t)
+	dir := t.TempDir()
+	writeFile(t, dir, "alpha.yml", workflowYAML("alpha", "hi"))
+	writeFile(t, dir, "beta.yml", workflowYAML("beta", "hi", "alpha"))
+	applyDir(t, database, dir, false)
+
+	// Checked one workflow at a time, the new alpha would form a cycle with
+	// the old beta.
+	writeFile(t, dir, "alpha.yml", workflowYAML("alpha", "hi", "beta"))
+	writeFile(t, dir, "beta.yml", workflowYAML("beta", "hi"))
+	applyDir(t, database, dir, false)
+
+	alpha, err := database.GetWorkflowByName("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := alpha.Upstreams(); !slices.Equal(got, []string{"beta"}) {
+		t.Fatalf("alpha runs after %q, want beta", got)
+	}
+
+	writeFile(t, dir, "beta.yml", workflowYAML("beta", "hi", "alpha"))
+	files, _, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := database.ListWorkflows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(dir, files, existing, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.ApplyWorkflows(plan.Upserts(), plan.Deletes()); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("err = %v, want a trigger cycle", err)
+	}
+}
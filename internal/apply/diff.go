@@ -0,0 +1,101 @@
+package apply
+
+import "strings"
+
+// DiffOp marks a line of a diff as kept, added or removed. Its value is the
+// prefix the line is shown with.
+type DiffOp byte
+
+const (
+	DiffEqual  DiffOp = ' '
+	DiffInsert DiffOp = '+'
+	DiffDelete DiffOp = '-'
+)
+
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+func (l DiffLine) String() string {
+	return string(l.Op) + " " + l.Text
+}
+
+// diffContext is how many unchanged lines are kept around each change. Longer
+// runs of unchanged lines are replaced by a single "..." line.
+const diffContext = 2
+
+// Diff returns the line diff from a to b, with unchanged lines away from any
+// change left out.
+func Diff(a, b string) []DiffLine {
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.Op == DiffEqual {
+			continue
+		}
+		for j := max(0, i-diffContext); j <= min(len(lines)-1, i+diffContext); j++ {
+			keep[j] = true
+		}
+	}
+
+	var out []DiffLine
+	for i, l := range lines {
+		if keep[i] {
+			out = append(out, l)
+		} else if len(out) == 0 || out[len(out)-1].Text != "..." {
+			out = append(out, DiffLine{Op: DiffEqual, Text: "..."})
+		}
+	}
+	return out
+}
+
+// diffLines diffs a and b by their longest common subsequence. Workflow
+// definitions are short, so the quadratic table is not a concern.
+func diffLines(a, b []string) []DiffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []DiffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, DiffLine{Op: DiffEqual, Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{Op: DiffDelete, Text: a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{Op: DiffInsert, Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, DiffLine{Op: DiffDelete, Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, DiffLine{Op: DiffInsert, Text: b[j]})
+	}
+	return lines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,67 @@
+package apply
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		a, b string
+		want []string
+	}{
+		{
+			name: "equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: []string{"  ..."},
+		},
+		{
+			name: "changed line",
+			a:    "a\nb\nc\n",
+			b:    "a\nx\nc\n",
+			want: []string{"  a", "- b", "+ x", "  c"},
+		},
+		{
+			name: "from empty",
+			a:    "",
+			b:    "a\nb\n",
+			want: []string{"+ a", "+ b"},
+		},
+		{
+			name: "to empty",
+			a:    "a\n",
+			b:    "",
+			want: []string{"- a"},
+		},
+		{
+			name: "distant context is elided",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want: []string{"  ...", "  3", "  4", "- 5", "+ five", "  6", "  7", "  ..."},
+		},
+		{
+			name: "nearby changes share context",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			b:    "one\n2\n3\n4\n5\nsix\n7\n8\n9\n10\n",
+			want: []string{"- 1", "+ one", "  2", "  3", "  4", "  5", "- 6", "+ six", "  7", "  8", "  ..."},
+		},
+		{
+			name: "inserted lines",
+			a:    "a\nc\n",
+			b:    "a\nb1\nb2\nc\n",
+			want: []string{"  a", "+ b1", "+ b2", "  c"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, l := range Diff(tt.a, tt.b) {
+				got = append(got, l.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("Diff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
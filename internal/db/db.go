@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/kingoftac/gork/internal/metrics"
 	"github.com/kingoftac/gork/internal/models"
 	_ "modernc.org/sqlite"
 )
@@ -40,10 +43,37 @@ func NewDB(dbPath string) (*DB, error) {
 	return db, nil
 }
 
-func retryDBOperation(operation func() error) error {
+// NewMemoryDB returns a database that only exists in memory and is gone once
+// it is closed.
+func NewMemoryDB() (*DB, error) {
+	sqlDB, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(on)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// Every connection to :memory: opens a database of its own, so all
+	// queries have to share one.
+	sqlDB.SetMaxOpenConns(1)
+
+	db := &DB{sqlDB}
+	if err := db.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return db, nil
+}
+
+func retryDBOperation(operation func() error) (err error) {
 	maxRetries := 5
 	baseDelay := 50 * time.Millisecond
 
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		metrics.DBOperationDuration.Observe(time.Since(start).Seconds(), result)
+	}()
+
 	for i := 0; i < maxRetries; i++ {
 		err := operation()
 		if err == nil {
@@ -52,6 +82,7 @@ func retryDBOperation(operation func() error) error {
 
 		if strings.Contains(err.Error(), "database os locked") || strings.Contains(err.Error(), "SQLITE_BUSY") {
 			if i < maxRetries-1 {
+				metrics.DBOperationRetries.Inc()
 				delay := time.Duration(1<<uint(i)) * baseDelay
 				time.Sleep(delay)
 				continue
@@ -98,6 +129,63 @@ func (db *DB) migrate() error {
 			logs TEXT,
 			FOREIGN KEY (run_id) REFERENCES runs(id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS step_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			step_run_id INTEGER NOT NULL,
+			run_id INTEGER NOT NULL,
+			attempt INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			started_at DATETIME,
+			completed_at DATETIME,
+			exit_code INTEGER,
+			error TEXT,
+			logs TEXT,
+			FOREIGN KEY (step_run_id) REFERENCES step_runs(id),
+			FOREIGN KEY (run_id) REFERENCES runs(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_step_attempts_run_id ON step_attempts(run_id)`,
+		`CREATE TABLE IF NOT EXISTS run_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL UNIQUE,
+			workflow_id INTEGER NOT NULL,
+			priority INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL,
+			enqueued_at DATETIME NOT NULL,
+			claimed_at DATETIME,
+			claimed_by TEXT,
+			FOREIGN KEY (run_id) REFERENCES runs(id),
+			FOREIGN KEY (workflow_id) REFERENCES workflows(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_run_queue_status ON run_queue(status, priority, id)`,
+		`CREATE TABLE IF NOT EXISTS backfills (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			workflow_id INTEGER NOT NULL,
+			from_date DATETIME NOT NULL,
+			to_date DATETIME NOT NULL,
+			parallel INTEGER NOT NULL DEFAULT 1,
+			status TEXT NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (workflow_id) REFERENCES workflows(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS workflow_changes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			workflow_id INTEGER NOT NULL,
+			workflow_name TEXT NOT NULL,
+			change TEXT NOT NULL,
+			changed_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			acquired_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)`,
 		`CREATE TABLE IF NOT EXISTS step_data (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			run_id INTEGER NOT NULL,
@@ -108,6 +196,19 @@ func (db *DB) migrate() error {
 			FOREIGN KEY (run_id) REFERENCES runs(id),
 			UNIQUE(run_id, step_name, key)
 		)`,
+		`CREATE TABLE IF NOT EXISTS notification_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			notifier TEXT NOT NULL,
+			event TEXT NOT NULL,
+			step_name TEXT NOT NULL DEFAULT '',
+			attempt INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (run_id) REFERENCES runs(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_notification_attempts_run ON notification_attempts(run_id)`,
 	}
 
 	for _, query := range queries {
@@ -116,260 +217,1366 @@ func (db *DB) migrate() error {
 		}
 	}
 
+	columns := []struct{ table, name, definition string }{
+		{"workflows", "timeout", "INTEGER NOT NULL DEFAULT 0"},
+		{"workflows", "deadline", "TEXT NOT NULL DEFAULT ''"},
+		{"runs", "params", "TEXT NOT NULL DEFAULT '{}'"},
+		{"workflows", "max_parallel", "INTEGER NOT NULL DEFAULT 0"},
+		{"workflows", "concurrency", "TEXT NOT NULL DEFAULT ''"},
+		{"workflows", "misfire", "TEXT NOT NULL DEFAULT ''"},
+		{"runs", "scheduled_at", "DATETIME"},
+		{"runs", "backfill_id", "INTEGER"},
+		{"workflows", "paused", "INTEGER NOT NULL DEFAULT 0"},
+		{"workflows", "next_fire_at", "DATETIME"},
+		{"workflows", "triggers", "TEXT NOT NULL DEFAULT ''"},
+		{"runs", "owner", "TEXT NOT NULL DEFAULT ''"},
+		{"workflows", "on_restart", "TEXT NOT NULL DEFAULT ''"},
+		{"workflows", "notify", "TEXT NOT NULL DEFAULT ''"},
+		{"workflows", "source", "TEXT NOT NULL DEFAULT ''"},
+		{"run_queue", "concurrency_key", "TEXT NOT NULL DEFAULT ''"},
+		{"run_queue", "cancel_requested", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := db.addColumn(c.table, c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (db *DB) InsertWorkflow(w *models.Workflow) error {
-	stepsJSON, err := json.Marshal(w.Steps)
+// addColumn adds a column to a table created by an earlier version of the
+// schema. It does nothing if the column already exists.
+func (db *DB) addColumn(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return fmt.Errorf("failed to marshal steps: %w", err)
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
 	}
+	defer rows.Close()
 
-	query := `INSERT OR REPLACE INTO workflows (id, name, description, schedule, steps, created_at, updated_at) VALUES ((SELECT id FROM workflows WHERE name = ?), ?, ?, ?, ?, (SELECT created_at FROM workflows WHERE name = ?), ?)`
-	now := time.Now()
-	_, err = db.Exec(query, w.Name, w.Name, w.Description, w.Schedule, string(stepsJSON), w.Name, now)
-	if err != nil {
-		return fmt.Errorf("failed to insert workflow: %w", err)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
 	}
 	return nil
 }
 
-func (db *DB) GetWorkflow(id int64) (*models.Workflow, error) {
-	query := `SELECT id, name, description, schedule, steps, created_at, updated_at FROM workflows WHERE id = ?`
-	row := db.QueryRow(query, id)
+func (db *DB) InsertWorkflow(w *models.Workflow) error {
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
 
-	var w models.Workflow
-	var stepsJSON string
-	err := row.Scan(&w.ID, &w.Name, &w.Description, &w.Schedule, &stepsJSON, &w.CreatedAt, &w.UpdatedAt)
+		if err := checkTriggerCycles(tx, []*models.Workflow{w}); err != nil {
+			return err
+		}
+		if err := insertWorkflow(tx, w); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get workflow: %w", err)
-	}
-
-	if err := json.Unmarshal([]byte(stepsJSON), &w.Steps); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal steps: %w", err)
+		return fmt.Errorf("failed to insert workflow: %w", err)
 	}
-
-	return &w, nil
+	return nil
 }
 
-func (db *DB) GetWorkflowByName(name string) (*models.Workflow, error) {
-	query := `SELECT id, name, description, schedule, steps, created_at, updated_at FROM workflows WHERE name = ?`
-	row := db.QueryRow(query, name)
-
-	var w models.Workflow
-	var stepsJSON string
-	err := row.Scan(&w.ID, &w.Name, &w.Description, &w.Schedule, &stepsJSON, &w.CreatedAt, &w.UpdatedAt)
+// insertWorkflow creates w, or replaces the workflow with the same name while
+// keeping its ID, pause state and next fire time. Callers check for trigger
+// cycles first.
+func insertWorkflow(tx *sql.Tx, w *models.Workflow) error {
+	stepsJSON, err := json.Marshal(w.Steps)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get workflow: %w", err)
+		return fmt.Errorf("failed to marshal steps: %w", err)
 	}
 
-	if err := json.Unmarshal([]byte(stepsJSON), &w.Steps); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal steps: %w", err)
+	var concurrencyJSON []byte
+	if w.Concurrency != nil {
+		concurrencyJSON, err = json.Marshal(w.Concurrency)
+		if err != nil {
+			return fmt.Errorf("failed to marshal concurrency: %w", err)
+		}
 	}
 
-	return &w, nil
-}
-
-func (db *DB) ListWorkflows() ([]models.Workflow, error) {
-	query := `SELECT id, name, description, schedule, steps, created_at, updated_at FROM workflows ORDER BY name`
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list workflows: %w", err)
+	var misfireJSON []byte
+	if w.Misfire != nil {
+		misfireJSON, err = json.Marshal(w.Misfire)
+		if err != nil {
+			return fmt.Errorf("failed to marshal misfire: %w", err)
+		}
 	}
-	defer rows.Close()
 
-	var workflows []models.Workflow
-	for rows.Next() {
-		var w models.Workflow
-		var stepsJSON string
-		err := rows.Scan(&w.ID, &w.Name, &w.Description, &w.Schedule, &stepsJSON, &w.CreatedAt, &w.UpdatedAt)
+	var triggersJSON []byte
+	if w.Triggers != nil {
+		triggersJSON, err = json.Marshal(w.Triggers)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan workflow: %w", err)
+			return fmt.Errorf("failed to marshal triggers: %w", err)
 		}
+	}
 
-		if err := json.Unmarshal([]byte(stepsJSON), &w.Steps); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal steps: %w", err)
+	var notifyJSON []byte
+	if len(w.Notify) > 0 {
+		notifyJSON, err = json.Marshal(w.Notify)
+		if err != nil {
+			return fmt.Errorf("failed to marshal notify: %w", err)
 		}
-
-		workflows = append(workflows, w)
 	}
 
-	return workflows, nil
-}
+	query := `INSERT OR REPLACE INTO workflows (id, name, description, schedule, timeout, deadline, max_parallel, concurrency, misfire, triggers, on_restart, notify, paused, next_fire_at, source, steps, created_at, updated_at) VALUES ((SELECT id FROM workflows WHERE name = ?), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE((SELECT paused FROM workflows WHERE name = ?), 0), (SELECT next_fire_at FROM workflows WHERE name = ?), ?, ?, (SELECT created_at FROM workflows WHERE name = ?), ?)`
 
-func (db *DB) DeleteWorkflow(id int64) error {
-	stepDataQuery := `DELETE FROM step_data WHERE run_id IN (SELECT id FROM runs WHERE workflow_id = ?)`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(stepDataQuery, id)
+	change := models.WorkflowCreated
+	var existing int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM workflows WHERE name = ?`, w.Name).Scan(&existing); err != nil {
 		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete step data: %w", err)
 	}
-
-	stepRunsQuery := `DELETE FROM step_runs WHERE run_id IN (SELECT id FROM runs WHERE workflow_id = ?)`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(stepRunsQuery, id)
-		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete step runs: %w", err)
+	if existing > 0 {
+		change = models.WorkflowUpdated
 	}
 
-	runsQuery := `DELETE FROM runs WHERE workflow_id = ?`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(runsQuery, id)
+	now := time.Now()
+	result, err := tx.Exec(query, w.Name, w.Name, w.Description, w.Schedule, int64(w.Timeout), w.Deadline, w.MaxParallel, string(concurrencyJSON), string(misfireJSON), string(triggersJSON), w.OnRestart, string(notifyJSON), w.Name, w.Name, w.Source, string(stepsJSON), w.Name, now)
+	if err != nil {
 		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete runs: %w", err)
 	}
-
-	workflowQuery := `DELETE FROM workflows WHERE id = ?`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(workflowQuery, id)
+	id, err := result.LastInsertId()
+	if err != nil {
 		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete workflow: %w", err)
 	}
-
-	return nil
+	return recordWorkflowChange(tx, id, w.Name, change, now)
 }
 
-func (db *DB) ResetAllData() error {
-
-	stepDataQuery := `DELETE FROM step_data`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(stepDataQuery)
-		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete step data: %w", err)
+// checkTriggerCycles rejects ws, which are about to be created or replaced
+// together, if their after triggers would form a cycle with each other or
+// with those of the other workflows already stored.
+func checkTriggerCycles(tx *sql.Tx, ws []*models.Workflow) error {
+	if !slices.ContainsFunc(ws, func(w *models.Workflow) bool { return len(w.Upstreams()) > 0 }) {
+		return nil
 	}
 
-	stepRunsQuery := `DELETE FROM step_runs`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(stepRunsQuery)
+	rows, err := tx.Query(`SELECT name, triggers FROM workflows WHERE triggers != ''`)
+	if err != nil {
 		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete step runs: %w", err)
 	}
+	defer rows.Close()
 
-	runsQuery := `DELETE FROM runs`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(runsQuery)
+	upstreams := make(map[string][]string)
+	for rows.Next() {
+		var other models.Workflow
+		var triggersJSON string
+		if err := rows.Scan(&other.Name, &triggersJSON); err != nil {
+			return err
+		}
+		other.Triggers = &models.Triggers{}
+		if err := json.Unmarshal([]byte(triggersJSON), other.Triggers); err != nil {
+			return fmt.Errorf("failed to unmarshal triggers of %s: %w", other.Name, err)
+		}
+		upstreams[other.Name] = other.Upstreams()
+	}
+	if err := rows.Err(); err != nil {
 		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete runs: %w", err)
 	}
 
-	workflowsQuery := `DELETE FROM workflows`
-	if err := retryDBOperation(func() error {
-		_, err := db.Exec(workflowsQuery)
-		return err
-	}); err != nil {
-		return fmt.Errorf("failed to delete workflows: %w", err)
+	for _, w := range ws {
+		upstreams[w.Name] = w.Upstreams()
 	}
+	for _, w := range ws {
+		if cycle := models.FindTriggerCycle(*w, upstreams); cycle != nil {
+			return fmt.Errorf("after triggers form a cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	return nil
+}
+
+func recordWorkflowChange(exec interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}, id int64, name string, change models.WorkflowChangeKind, now time.Time) error {
+	query := `INSERT INTO workflow_changes (workflow_id, workflow_name, change, changed_at) VALUES (?, ?, ?, ?)`
+	_, err := exec.Exec(query, id, name, change, now)
+	return err
+}
+
+// SetWorkflowPaused pauses or resumes the schedule of a workflow.
+func (db *DB) SetWorkflowPaused(id int64, paused bool) error {
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		var name string
+		err = tx.QueryRow(`UPDATE workflows SET paused = ?, updated_at = ? WHERE id = ? RETURNING name`, paused, now, id).Scan(&name)
+		if err != nil {
+			return err
+		}
+		if err := recordWorkflowChange(tx, id, name, models.WorkflowUpdated, now); err != nil {
+			return err
+		}
 
+		return tx.Commit()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set workflow paused: %w", err)
+	}
 	return nil
 }
 
-func (db *DB) InsertRun(r *models.Run) (int64, error) {
-	query := `INSERT INTO runs (workflow_id, status, started_at, completed_at, created_at, updated_at, trigger) VALUES (?, ?, ?, ?, ?, ?, ?)`
-	now := time.Now()
-	var result sql.Result
+// SetNextFireAt records when the scheduler will next fire a workflow. The
+// zero time clears it, for workflows the daemon is not scheduling.
+func (db *DB) SetNextFireAt(id int64, next time.Time) error {
 	err := retryDBOperation(func() error {
-		var err error
-		result, err = db.Exec(query, r.WorkflowID, r.Status, r.StartedAt, r.CompletedAt, now, now, r.Trigger)
+		_, err := db.Exec(`UPDATE workflows SET next_fire_at = ? WHERE id = ?`, nullTime(next), id)
 		return err
 	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert run: %w", err)
+		return fmt.Errorf("failed to set next fire time: %w", err)
 	}
+	return nil
+}
 
-	id, err := result.LastInsertId()
+const settingSchedulingPaused = "scheduling_paused"
+
+// SchedulingPaused reports whether scheduling has been paused for every
+// workflow, as a maintenance switch.
+func (db *DB) SchedulingPaused() (bool, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key = ?`, settingSchedulingPaused).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to get last insert id: %w", err)
+		return false, fmt.Errorf("failed to get setting: %w", err)
 	}
-
-	return id, nil
+	return value == "true", nil
 }
 
-func (db *DB) UpdateRunStatus(id int64, status models.RunStatus, completedAt *time.Time) error {
-	query := `UPDATE runs SET status = ?, completed_at = ?, updated_at = ? WHERE id = ?`
-	now := time.Now()
+func (db *DB) SetSchedulingPaused(paused bool) error {
+	query := `INSERT INTO settings (key, value, updated_at) VALUES (?, ?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`
 	err := retryDBOperation(func() error {
-		_, err := db.Exec(query, status, completedAt, now, id)
+		_, err := db.Exec(query, settingSchedulingPaused, strconv.FormatBool(paused), time.Now())
 		return err
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update run status: %w", err)
+		return fmt.Errorf("failed to set setting: %w", err)
 	}
 	return nil
 }
 
-func (db *DB) GetRun(id int64) (*models.Run, error) {
-	query := `SELECT id, workflow_id, status, started_at, completed_at, created_at, updated_at, trigger FROM runs WHERE id = ?`
-	row := db.QueryRow(query, id)
-
-	var r models.Run
-	var completedAt sql.NullTime
-	err := row.Scan(&r.ID, &r.WorkflowID, &r.Status, &r.StartedAt, &completedAt, &r.CreatedAt, &r.UpdatedAt, &r.Trigger)
+// AcquireLease takes the named lease for holder, or renews it if holder
+// already has it, so that it expires ttl from now. It reports false if
+// another holder has the lease and it has not expired.
+func (db *DB) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	query := `INSERT INTO leases (name, holder, acquired_at, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			acquired_at = CASE WHEN leases.holder = excluded.holder THEN leases.acquired_at ELSE excluded.acquired_at END,
+			holder = excluded.holder,
+			expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at <= excluded.acquired_at`
+	var acquired bool
+	err := retryDBOperation(func() error {
+		// Lease times are kept in UTC so that they compare correctly between
+		// daemons.
+		now := time.Now().UTC()
+		result, err := db.Exec(query, name, holder, now, now.Add(ttl))
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		acquired = n == 1
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get run: %w", err)
-	}
-	if completedAt.Valid {
-		r.CompletedAt = completedAt.Time
+		return false, fmt.Errorf("failed to acquire lease: %w", err)
 	}
-
-	return &r, nil
+	return acquired, nil
 }
 
-func (db *DB) ListRuns(workflowID *int64) ([]models.Run, error) {
-	var query string
-	var args []interface{}
-	if workflowID != nil {
-		query = `SELECT id, workflow_id, status, started_at, completed_at, created_at, updated_at, trigger FROM runs WHERE workflow_id = ? ORDER BY created_at DESC`
-		args = []interface{}{*workflowID}
-	} else {
-		query = `SELECT id, workflow_id, status, started_at, completed_at, created_at, updated_at, trigger FROM runs ORDER BY created_at DESC`
-		args = []interface{}{}
+// ReleaseLease gives up the named lease if holder has it.
+func (db *DB) ReleaseLease(name, holder string) error {
+	err := retryDBOperation(func() error {
+		_, err := db.Exec(`DELETE FROM leases WHERE name = ? AND holder = ?`, name, holder)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release lease: %w", err)
 	}
+	return nil
+}
 
-	rows, err := db.Query(query, args...)
+// ListLeases returns every lease, including expired ones, by name.
+func (db *DB) ListLeases() ([]models.Lease, error) {
+	rows, err := db.Query(`SELECT name, holder, acquired_at, expires_at FROM leases ORDER BY name`)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list runs: %w", err)
+		return nil, fmt.Errorf("failed to list leases: %w", err)
 	}
 	defer rows.Close()
 
-	var runs []models.Run
+	var leases []models.Lease
 	for rows.Next() {
-		var r models.Run
-		var completedAt sql.NullTime
-		err := rows.Scan(&r.ID, &r.WorkflowID, &r.Status, &r.StartedAt, &completedAt, &r.CreatedAt, &r.UpdatedAt, &r.Trigger)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan run: %w", err)
+		var l models.Lease
+		if err := rows.Scan(&l.Name, &l.Holder, &l.AcquiredAt, &l.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to scan lease: %w", err)
 		}
-		if completedAt.Valid {
-			r.CompletedAt = completedAt.Time
-		}
-		runs = append(runs, r)
+		leases = append(leases, l)
 	}
+	return leases, rows.Err()
+}
 
-	return runs, nil
+// liveOwners selects the owners of daemons and exec processes whose lease has
+// not expired. It takes the current time as its one parameter.
+const liveOwners = `SELECT holder FROM leases WHERE name IN ('` + models.DaemonLeasePrefix + `' || holder, '` + models.ExecLeasePrefix + `' || holder) AND expires_at > ?`
+
+// LatestWorkflowChangeID returns the ID of the newest workflow change, or 0
+// if there are none.
+func (db *DB) LatestWorkflowChangeID() (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM workflow_changes`).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get latest workflow change: %w", err)
+	}
+	return id, nil
 }
 
-func (db *DB) InsertStepRun(sr *models.StepRun) (int64, error) {
-	logsJSON, err := json.Marshal(sr.Logs)
+// ListWorkflowChanges returns the workflow changes made after the change with
+// ID afterID, oldest first.
+func (db *DB) ListWorkflowChanges(afterID int64) ([]models.WorkflowChange, error) {
+	query := `SELECT id, workflow_id, workflow_name, change, changed_at FROM workflow_changes WHERE id > ? ORDER BY id`
+	rows, err := db.Query(query, afterID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to marshal logs: %w", err)
+		return nil, fmt.Errorf("failed to list workflow changes: %w", err)
 	}
+	defer rows.Close()
 
-	query := `INSERT INTO step_runs (run_id, step_name, status, attempt, started_at, completed_at, error, logs) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	var result sql.Result
-	err = retryDBOperation(func() error {
-		var err error
-		result, err = db.Exec(query, sr.RunID, sr.StepName, sr.Status, sr.Attempt, sr.StartedAt, sr.CompletedAt, sr.Error, string(logsJSON))
+	var changes []models.WorkflowChange
+	for rows.Next() {
+		var c models.WorkflowChange
+		if err := rows.Scan(&c.ID, &c.WorkflowID, &c.WorkflowName, &c.Change, &c.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workflow change: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// PruneWorkflowChanges deletes workflow changes made before the given time.
+func (db *DB) PruneWorkflowChanges(before time.Time) error {
+	err := retryDBOperation(func() error {
+		_, err := db.Exec(`DELETE FROM workflow_changes WHERE changed_at < ?`, before)
 		return err
 	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert step run: %w", err)
+		return fmt.Errorf("failed to prune workflow changes: %w", err)
+	}
+	return nil
+}
+
+const workflowColumns = `id, name, description, schedule, timeout, deadline, max_parallel, concurrency, misfire, triggers, on_restart, notify, paused, next_fire_at, source, steps, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWorkflow(row rowScanner) (*models.Workflow, error) {
+	var w models.Workflow
+	var stepsJSON, concurrencyJSON, misfireJSON, triggersJSON, notifyJSON string
+	var timeout int64
+	var nextFireAt sql.NullTime
+	err := row.Scan(&w.ID, &w.Name, &w.Description, &w.Schedule, &timeout, &w.Deadline, &w.MaxParallel, &concurrencyJSON, &misfireJSON, &triggersJSON, &w.OnRestart, &notifyJSON, &w.Paused, &nextFireAt, &w.Source, &stepsJSON, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	w.Timeout = time.Duration(timeout)
+	if nextFireAt.Valid {
+		w.NextFireAt = nextFireAt.Time
+	}
+
+	if concurrencyJSON != "" {
+		w.Concurrency = &models.Concurrency{}
+		if err := json.Unmarshal([]byte(concurrencyJSON), w.Concurrency); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal concurrency: %w", err)
+		}
+	}
+
+	if misfireJSON != "" {
+		w.Misfire = &models.Misfire{}
+		if err := json.Unmarshal([]byte(misfireJSON), w.Misfire); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal misfire: %w", err)
+		}
+	}
+
+	if triggersJSON != "" {
+		w.Triggers = &models.Triggers{}
+		if err := json.Unmarshal([]byte(triggersJSON), w.Triggers); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal triggers: %w", err)
+		}
+	}
+
+	if notifyJSON != "" {
+		if err := json.Unmarshal([]byte(notifyJSON), &w.Notify); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal notify: %w", err)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(stepsJSON), &w.Steps); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal steps: %w", err)
+	}
+
+	return &w, nil
+}
+
+func (db *DB) GetWorkflow(id int64) (*models.Workflow, error) {
+	query := `SELECT ` + workflowColumns + ` FROM workflows WHERE id = ?`
+	w, err := scanWorkflow(db.QueryRow(query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workflow: %w", err)
+	}
+	return w, nil
+}
+
+func (db *DB) GetWorkflowByName(name string) (*models.Workflow, error) {
+	query := `SELECT ` + workflowColumns + ` FROM workflows WHERE name = ?`
+	w, err := scanWorkflow(db.QueryRow(query, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workflow: %w", err)
+	}
+	return w, nil
+}
+
+func (db *DB) ListWorkflows() ([]models.Workflow, error) {
+	query := `SELECT ` + workflowColumns + ` FROM workflows ORDER BY name`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workflows: %w", err)
+	}
+	defer rows.Close()
+
+	var workflows []models.Workflow
+	for rows.Next() {
+		w, err := scanWorkflow(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan workflow: %w", err)
+		}
+		workflows = append(workflows, *w)
+	}
+
+	return workflows, nil
+}
+
+func (db *DB) DeleteWorkflow(id int64) error {
+	return retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := deleteWorkflow(tx, id); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// deleteWorkflow deletes a workflow with all of its runs, queued runs and
+// backfills. Daemons stop the deleted runs they are executing.
+func deleteWorkflow(tx *sql.Tx, id int64) error {
+	deletes := []struct {
+		query, what string
+	}{
+		{`DELETE FROM step_data WHERE run_id IN (SELECT id FROM runs WHERE workflow_id = ?)`, "step data"},
+		{`DELETE FROM notification_attempts WHERE run_id IN (SELECT id FROM runs WHERE workflow_id = ?)`, "notification attempts"},
+		{`DELETE FROM step_attempts WHERE run_id IN (SELECT id FROM runs WHERE workflow_id = ?)`, "step attempts"},
+		{`DELETE FROM step_runs WHERE run_id IN (SELECT id FROM runs WHERE workflow_id = ?)`, "step runs"},
+		{`DELETE FROM run_queue WHERE workflow_id = ?`, "queued runs"},
+		{`DELETE FROM runs WHERE workflow_id = ?`, "runs"},
+		{`DELETE FROM backfills WHERE workflow_id = ?`, "backfills"},
+	}
+	for _, d := range deletes {
+		if _, err := tx.Exec(d.query, id); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", d.what, err)
+		}
+	}
+
+	changeQuery := `INSERT INTO workflow_changes (workflow_id, workflow_name, change, changed_at) SELECT id, name, ?, ? FROM workflows WHERE id = ?`
+	if _, err := tx.Exec(changeQuery, models.WorkflowDeleted, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to record workflow change: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM workflows WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete workflow: %w", err)
+	}
+	return nil
+}
+
+// ApplyWorkflows deletes and then creates or replaces workflows in a single
+// transaction, so that either all of the changes are made or none are. Trigger
+// cycles are checked against the workflows as they are once all changes are
+// made, so that edges may be reversed in one apply.
+func (db *DB) ApplyWorkflows(upserts []*models.Workflow, deletes []int64) error {
+	return retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, id := range deletes {
+			if err := deleteWorkflow(tx, id); err != nil {
+				return err
+			}
+		}
+		if err := checkTriggerCycles(tx, upserts); err != nil {
+			return err
+		}
+		for _, w := range upserts {
+			if err := insertWorkflow(tx, w); err != nil {
+				return fmt.Errorf("failed to apply workflow %s: %w", w.Name, err)
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+func (db *DB) ResetAllData() error {
+
+	stepDataQuery := `DELETE FROM step_data`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(stepDataQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete step data: %w", err)
+	}
+
+	notificationsQuery := `DELETE FROM notification_attempts`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(notificationsQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete notification attempts: %w", err)
+	}
+
+	stepAttemptsQuery := `DELETE FROM step_attempts`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(stepAttemptsQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete step attempts: %w", err)
+	}
+
+	stepRunsQuery := `DELETE FROM step_runs`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(stepRunsQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete step runs: %w", err)
+	}
+
+	queueQuery := `DELETE FROM run_queue`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(queueQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete queued runs: %w", err)
+	}
+
+	runsQuery := `DELETE FROM runs`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(runsQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete runs: %w", err)
+	}
+
+	backfillsQuery := `DELETE FROM backfills`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(backfillsQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete backfills: %w", err)
+	}
+
+	changeQuery := `INSERT INTO workflow_changes (workflow_id, workflow_name, change, changed_at) SELECT id, name, ?, ? FROM workflows`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(changeQuery, models.WorkflowDeleted, time.Now())
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to record workflow changes: %w", err)
+	}
+
+	workflowsQuery := `DELETE FROM workflows`
+	if err := retryDBOperation(func() error {
+		_, err := db.Exec(workflowsQuery)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to delete workflows: %w", err)
+	}
+
+	return nil
+}
+
+const runColumns = `id, workflow_id, status, started_at, completed_at, created_at, updated_at, trigger, params, scheduled_at, backfill_id, owner`
+
+func scanRun(row rowScanner) (*models.Run, error) {
+	var r models.Run
+	var startedAt, completedAt, scheduledAt sql.NullTime
+	var trigger sql.NullString
+	var paramsJSON string
+	var backfillID sql.NullInt64
+	err := row.Scan(&r.ID, &r.WorkflowID, &r.Status, &startedAt, &completedAt, &r.CreatedAt, &r.UpdatedAt, &trigger, &paramsJSON, &scheduledAt, &backfillID, &r.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if startedAt.Valid {
+		r.StartedAt = startedAt.Time
+	}
+	if completedAt.Valid {
+		r.CompletedAt = completedAt.Time
+	}
+	if scheduledAt.Valid {
+		r.ScheduledAt = scheduledAt.Time
+	}
+	r.Trigger = trigger.String
+	r.BackfillID = backfillID.Int64
+
+	if err := json.Unmarshal([]byte(paramsJSON), &r.Params); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal params: %w", err)
+	}
+
+	return &r, nil
+}
+
+// nullTime stores the zero time as NULL, for columns such as started_at that
+// are only set once something has happened.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func insertRun(exec interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}, r *models.Run, now time.Time) (int64, error) {
+	params := r.Params
+	if params == nil {
+		params = map[string]string{}
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal params: %w", err)
+	}
+
+	query := `INSERT INTO runs (workflow_id, status, started_at, completed_at, created_at, updated_at, trigger, params, scheduled_at, backfill_id, owner) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	var backfillID any
+	if r.BackfillID != 0 {
+		backfillID = r.BackfillID
+	}
+	result, err := exec.Exec(query, r.WorkflowID, r.Status, nullTime(r.StartedAt), nullTime(r.CompletedAt), now, now, r.Trigger, string(paramsJSON), nullTime(r.ScheduledAt), backfillID, r.Owner)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (db *DB) InsertRun(r *models.Run) (int64, error) {
+	var id int64
+	err := retryDBOperation(func() error {
+		var err error
+		id, err = insertRun(db, r, time.Now())
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert run: %w", err)
+	}
+
+	return id, nil
+}
+
+func (db *DB) UpdateRunStatus(id int64, status models.RunStatus, completedAt *time.Time) error {
+	query := `UPDATE runs SET status = ?, completed_at = ?, updated_at = ? WHERE id = ?`
+	now := time.Now()
+	err := retryDBOperation(func() error {
+		_, err := db.Exec(query, status, completedAt, now, id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update run status: %w", err)
+	}
+	return nil
+}
+
+// StartRun marks a pending run as running from startedAt.
+func (db *DB) StartRun(id int64, startedAt time.Time) error {
+	// A resumed run keeps the time it first started.
+	query := `UPDATE runs SET status = ?, started_at = COALESCE(started_at, ?), updated_at = ? WHERE id = ?`
+	err := retryDBOperation(func() error {
+		_, err := db.Exec(query, models.RunStatusRunning, startedAt, time.Now(), id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start run: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) GetRun(id int64) (*models.Run, error) {
+	query := `SELECT ` + runColumns + ` FROM runs WHERE id = ?`
+	r, err := scanRun(db.QueryRow(query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get run: %w", err)
+	}
+	return r, nil
+}
+
+// LastScheduledAt returns the schedule slot of the workflow's most recent
+// scheduled run, or the zero time if the scheduler has never run it. Backfill
+// runs are not counted.
+func (db *DB) LastScheduledAt(workflowID int64) (time.Time, error) {
+	query := `SELECT scheduled_at FROM runs WHERE workflow_id = ? AND trigger = 'scheduler' AND scheduled_at IS NOT NULL ORDER BY id DESC LIMIT 1`
+	var scheduledAt sql.NullTime
+	err := db.QueryRow(query, workflowID).Scan(&scheduledAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get last scheduled run: %w", err)
+	}
+	return scheduledAt.Time, nil
+}
+
+// RequeueRun puts an interrupted run back in the queue as pending, keeping
+// its priority and enqueue time, so that a daemon resumes it.
+func (db *DB) RequeueRun(id int64) error {
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var workflowID int64
+		err = tx.QueryRow(`UPDATE runs SET status = ?, owner = '', updated_at = ? WHERE id = ? RETURNING workflow_id`, models.RunStatusPending, time.Now(), id).Scan(&workflowID)
+		if err != nil {
+			return err
+		}
+
+		query := `INSERT INTO run_queue (run_id, workflow_id, priority, status, enqueued_at) VALUES (?, ?, 0, ?, ?)
+			ON CONFLICT(run_id) DO UPDATE SET status = excluded.status, claimed_at = NULL, claimed_by = NULL`
+		if _, err := tx.Exec(query, id, workflowID, models.QueueStatusQueued, time.Now()); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to requeue run: %w", err)
+	}
+	return nil
+}
+
+// InterruptStepRuns marks the step runs and attempts of a run that were left
+// in progress as interrupted and returns how many step runs there were.
+func (db *DB) InterruptStepRuns(runID int64, reason string) (int64, error) {
+	var interrupted int64
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		result, err := tx.Exec(`UPDATE step_runs SET status = ?, completed_at = ?, error = ? WHERE run_id = ? AND status IN (?, ?, ?)`,
+			models.StepStatusInterrupted, now, reason, runID, models.StepStatusPending, models.StepStatusRunning, models.StepStatusRetrying)
+		if err != nil {
+			return err
+		}
+		if interrupted, err = result.RowsAffected(); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`UPDATE step_attempts SET status = ?, completed_at = ?, error = ? WHERE run_id = ? AND status = ?`,
+			models.StepStatusInterrupted, now, reason, runID, models.StepStatusRunning); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to interrupt step runs: %w", err)
+	}
+	return interrupted, nil
+}
+
+// ListOrphanedRuns returns the runs left pending or running by daemons whose
+// lease has expired, not counting runs still waiting in the queue.
+func (db *DB) ListOrphanedRuns() ([]models.Run, error) {
+	query := `SELECT ` + runColumns + ` FROM runs WHERE status IN (?, ?) AND id NOT IN (SELECT run_id FROM run_queue WHERE status = ?) AND owner NOT IN (` + liveOwners + `) ORDER BY id`
+	rows, err := db.Query(query, models.RunStatusPending, models.RunStatusRunning, models.QueueStatusQueued, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list orphaned runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []models.Run
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan run: %w", err)
+		}
+		runs = append(runs, *r)
+	}
+	return runs, rows.Err()
+}
+
+func (db *DB) ListRuns(workflowID *int64) ([]models.Run, error) {
+	var query string
+	var args []interface{}
+	if workflowID != nil {
+		query = `SELECT ` + runColumns + ` FROM runs WHERE workflow_id = ? ORDER BY created_at DESC`
+		args = []interface{}{*workflowID}
+	} else {
+		query = `SELECT ` + runColumns + ` FROM runs ORDER BY created_at DESC`
+		args = []interface{}{}
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []models.Run
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan run: %w", err)
+		}
+		runs = append(runs, *r)
+	}
+
+	return runs, nil
+}
+
+// EnqueueRun inserts r as a pending run together with the queue entry that
+// asks the daemon to execute it, and returns the new run's ID.
+func (db *DB) EnqueueRun(r *models.Run, priority int) (int64, error) {
+	var runID int64
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		pending := *r
+		pending.Status = models.RunStatusPending
+		runID, err = insertRun(tx, &pending, now)
+		if err != nil {
+			return err
+		}
+
+		query := `INSERT INTO run_queue (run_id, workflow_id, priority, status, enqueued_at) VALUES (?, ?, ?, ?, ?)`
+		if _, err := tx.Exec(query, runID, r.WorkflowID, priority, models.QueueStatusQueued, now); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to enqueue run: %w", err)
+	}
+
+	return runID, nil
+}
+
+// ListQueuedRuns returns the entries waiting in the queue in the order they
+// should be considered: highest priority first, then oldest first.
+func (db *DB) ListQueuedRuns() ([]models.QueueEntry, error) {
+	query := `SELECT q.id, q.run_id, q.workflow_id, q.priority, q.status, q.enqueued_at, r.backfill_id, COALESCE(r.trigger, '') FROM run_queue q JOIN runs r ON r.id = q.run_id WHERE q.status = ? ORDER BY q.priority DESC, q.id`
+	rows, err := db.Query(query, models.QueueStatusQueued)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queued runs: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []models.QueueEntry
+	for rows.Next() {
+		var e models.QueueEntry
+		var backfillID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.RunID, &e.WorkflowID, &e.Priority, &e.Status, &e.EnqueuedAt, &backfillID, &e.Trigger); err != nil {
+			return nil, fmt.Errorf("failed to scan queued run: %w", err)
+		}
+		e.BackfillID = backfillID.Int64
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// CountQueuedRuns returns how many runs are waiting in the queue and how many
+// have been claimed but not completed.
+func (db *DB) CountQueuedRuns() (map[models.QueueStatus]int, error) {
+	query := `SELECT status, COUNT(*) FROM run_queue WHERE status IN (?, ?) GROUP BY status`
+	rows, err := db.Query(query, models.QueueStatusQueued, models.QueueStatusClaimed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count queued runs: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[models.QueueStatus]int{
+		models.QueueStatusQueued:  0,
+		models.QueueStatusClaimed: 0,
+	}
+	for rows.Next() {
+		var status models.QueueStatus
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan queue count: %w", err)
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// CountClaimedRuns returns how many claimed entries, across every daemon,
+// count towards the concurrency key.
+func (db *DB) CountClaimedRuns(key string) (int, error) {
+	n, err := countClaimedRuns(db, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count claimed runs: %w", err)
+	}
+	return n, nil
+}
+
+func countClaimedRuns(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}, key string) (int, error) {
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM run_queue WHERE status = ? AND concurrency_key = ?`, models.QueueStatusClaimed, key).Scan(&n)
+	return n, err
+}
+
+// ClaimQueuedRun marks a queued entry as claimed by owner under the
+// concurrency key and records owner as the owner of its run. If limit is
+// positive, the entry is only claimed while fewer than limit entries with
+// the same key are claimed, and a backfill run only while fewer than its
+// backfill's parallel runs are, so that daemons sharing the database cannot
+// together exceed either. It reports false if the entry was not claimed.
+func (db *DB) ClaimQueuedRun(id int64, owner, key string, limit int) (bool, error) {
+	var claimed bool
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if limit > 0 {
+			n, err := countClaimedRuns(tx, key)
+			if err != nil {
+				return err
+			}
+			if n >= limit {
+				claimed = false
+				return nil
+			}
+		}
+		if claimed, err = claimQueuedRun(tx, id, owner, key); err != nil || !claimed {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to claim queued run: %w", err)
+	}
+	return claimed, nil
+}
+
+// ClaimQueuedRunReplacing claims a queued entry like ClaimQueuedRun and asks
+// for the oldest claimed entries with the same key to be canceled, so that
+// once they stop fewer than limit remain besides the new one. It returns the
+// runs of the replaced entries, which the daemons that claimed them cancel.
+func (db *DB) ClaimQueuedRunReplacing(id int64, owner, key string, limit int) (bool, []int64, error) {
+	var claimed bool
+	var replaced []int64
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`SELECT run_id FROM run_queue WHERE status = ? AND concurrency_key = ? ORDER BY claimed_at, id`, models.QueueStatusClaimed, key)
+		if err != nil {
+			return err
+		}
+		var running []int64
+		for rows.Next() {
+			var runID int64
+			if err := rows.Scan(&runID); err != nil {
+				rows.Close()
+				return err
+			}
+			running = append(running, runID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		replaced = nil
+		if excess := len(running) - limit + 1; excess > 0 {
+			replaced = running[:excess]
+		}
+		for _, runID := range replaced {
+			if _, err := tx.Exec(`UPDATE run_queue SET cancel_requested = 1 WHERE run_id = ?`, runID); err != nil {
+				return err
+			}
+		}
+
+		if claimed, err = claimQueuedRun(tx, id, owner, key); err != nil || !claimed {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to claim queued run: %w", err)
+	}
+	if !claimed {
+		return false, nil, nil
+	}
+	return true, replaced, nil
+}
+
+// CountClaimedBackfillRuns returns how many runs of the backfill are
+// claimed, across every daemon.
+func (db *DB) CountClaimedBackfillRuns(backfillID int64) (int, error) {
+	var n int
+	if err := db.QueryRow(claimedBackfillRuns, models.QueueStatusClaimed, backfillID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count claimed backfill runs: %w", err)
+	}
+	return n, nil
+}
+
+const claimedBackfillRuns = `SELECT COUNT(*) FROM run_queue q JOIN runs r ON r.id = q.run_id WHERE q.status = ? AND r.backfill_id = ?`
+
+func claimQueuedRun(tx *sql.Tx, id int64, owner, key string) (bool, error) {
+	var backfillID sql.NullInt64
+	var parallel int
+	err := tx.QueryRow(`SELECT r.backfill_id, COALESCE(b.parallel, 0) FROM run_queue q JOIN runs r ON r.id = q.run_id LEFT JOIN backfills b ON b.id = r.backfill_id WHERE q.id = ?`, id).Scan(&backfillID, &parallel)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if backfillID.Valid {
+		var n int
+		if err := tx.QueryRow(claimedBackfillRuns, models.QueueStatusClaimed, backfillID.Int64).Scan(&n); err != nil {
+			return false, err
+		}
+		if n >= max(parallel, 1) {
+			return false, nil
+		}
+	}
+
+	query := `UPDATE run_queue SET status = ?, claimed_at = ?, claimed_by = ?, concurrency_key = ? WHERE id = ? AND status = ? RETURNING run_id`
+	var runID int64
+	err = tx.QueryRow(query, models.QueueStatusClaimed, time.Now(), owner, key, id, models.QueueStatusQueued).Scan(&runID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE runs SET owner = ? WHERE id = ?`, owner, runID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CountClaimedRunsOf returns how many of the runs are still claimed.
+func (db *DB) CountClaimedRunsOf(runIDs []int64) (int, error) {
+	if len(runIDs) == 0 {
+		return 0, nil
+	}
+	query := `SELECT COUNT(*) FROM run_queue WHERE status = ? AND run_id IN (` + placeholders(len(runIDs)) + `)`
+	args := []any{models.QueueStatusClaimed}
+	for _, id := range runIDs {
+		args = append(args, id)
+	}
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count claimed runs: %w", err)
+	}
+	return n, nil
+}
+
+// ListRunsToStop returns, for those of the claimed runs that must stop, the
+// reason why: the run or its workflow was deleted, another run replaced it
+// under a cancel-previous policy, or its backfill was canceled.
+func (db *DB) ListRunsToStop(runIDs []int64) (map[int64]string, error) {
+	if len(runIDs) == 0 {
+		return nil, nil
+	}
+	query := `SELECT r.id, w.id IS NULL, COALESCE(q.cancel_requested, 0), COALESCE(b.status, '') FROM runs r
+		LEFT JOIN workflows w ON w.id = r.workflow_id
+		LEFT JOIN run_queue q ON q.run_id = r.id
+		LEFT JOIN backfills b ON b.id = r.backfill_id
+		WHERE r.id IN (` + placeholders(len(runIDs)) + `)`
+	args := make([]any, len(runIDs))
+	for i, id := range runIDs {
+		args[i] = id
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs to stop: %w", err)
+	}
+	defer rows.Close()
+
+	stop := make(map[int64]string)
+	for _, id := range runIDs {
+		stop[id] = "run deleted"
+	}
+	for rows.Next() {
+		var runID int64
+		var workflowDeleted, cancelRequested bool
+		var backfillStatus models.BackfillStatus
+		if err := rows.Scan(&runID, &workflowDeleted, &cancelRequested, &backfillStatus); err != nil {
+			return nil, fmt.Errorf("failed to scan run to stop: %w", err)
+		}
+		delete(stop, runID)
+		switch {
+		case workflowDeleted:
+			stop[runID] = "workflow deleted"
+		case cancelRequested:
+			stop[runID] = "replaced by a newer run"
+		case backfillStatus == models.BackfillStatusCanceled:
+			stop[runID] = "backfill canceled"
+		}
+	}
+	return stop, rows.Err()
+}
+
+// placeholders returns n comma-separated query placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (db *DB) CompleteQueuedRun(id int64) error {
+	query := `UPDATE run_queue SET status = ? WHERE id = ?`
+	err := retryDBOperation(func() error {
+		_, err := db.Exec(query, models.QueueStatusDone, id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete queued run: %w", err)
+	}
+	return nil
+}
+
+// ReleaseClaimedRuns closes out queue entries left claimed by daemons whose
+// lease has expired and returns how many there were.
+func (db *DB) ReleaseClaimedRuns() (int64, error) {
+	query := `UPDATE run_queue SET status = ? WHERE status = ? AND COALESCE(claimed_by, '') NOT IN (` + liveOwners + `)`
+	var released int64
+	err := retryDBOperation(func() error {
+		result, err := db.Exec(query, models.QueueStatusDone, models.QueueStatusClaimed, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		released, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to release claimed runs: %w", err)
+	}
+	return released, nil
+}
+
+// CreateBackfill records b and queues runs as its members in one
+// transaction, returning the backfill ID.
+func (db *DB) CreateBackfill(b *models.Backfill, runs []models.Run) (int64, error) {
+	var backfillID int64
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		query := `INSERT INTO backfills (workflow_id, from_date, to_date, parallel, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+		result, err := tx.Exec(query, b.WorkflowID, b.From, b.To, b.Parallel, models.BackfillStatusRunning, now, now)
+		if err != nil {
+			return err
+		}
+		backfillID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		queueQuery := `INSERT INTO run_queue (run_id, workflow_id, priority, status, enqueued_at) VALUES (?, ?, ?, ?, ?)`
+		for _, r := range runs {
+			r.Status = models.RunStatusPending
+			r.BackfillID = backfillID
+			runID, err := insertRun(tx, &r, now)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(queueQuery, runID, r.WorkflowID, 0, models.QueueStatusQueued, now); err != nil {
+				return err
+			}
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create backfill: %w", err)
+	}
+
+	return backfillID, nil
+}
+
+// backfillColumns reports a backfill that is not canceled as completed once
+// none of its runs are pending or running.
+const backfillColumns = `id, workflow_id, from_date, to_date, parallel,
+	CASE WHEN status = 'running' AND NOT EXISTS (
+		SELECT 1 FROM runs WHERE runs.backfill_id = backfills.id AND runs.status IN ('pending', 'running')
+	) THEN 'completed' ELSE status END,
+	created_at, updated_at`
+
+func scanBackfill(row rowScanner) (*models.Backfill, error) {
+	var b models.Backfill
+	err := row.Scan(&b.ID, &b.WorkflowID, &b.From, &b.To, &b.Parallel, &b.Status, &b.CreatedAt, &b.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (db *DB) GetBackfill(id int64) (*models.Backfill, error) {
+	query := `SELECT ` + backfillColumns + ` FROM backfills WHERE id = ?`
+	b, err := scanBackfill(db.QueryRow(query, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backfill: %w", err)
+	}
+	return b, nil
+}
+
+func (db *DB) ListBackfills() ([]models.Backfill, error) {
+	query := `SELECT ` + backfillColumns + ` FROM backfills ORDER BY id`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backfills: %w", err)
+	}
+	defer rows.Close()
+
+	var backfills []models.Backfill
+	for rows.Next() {
+		b, err := scanBackfill(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan backfill: %w", err)
+		}
+		backfills = append(backfills, *b)
+	}
+	return backfills, rows.Err()
+}
+
+// ListBackfillRuns returns the runs of a backfill in schedule order.
+func (db *DB) ListBackfillRuns(backfillID int64) ([]models.Run, error) {
+	query := `SELECT ` + runColumns + ` FROM runs WHERE backfill_id = ? ORDER BY scheduled_at, id`
+	rows, err := db.Query(query, backfillID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backfill runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []models.Run
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan run: %w", err)
+		}
+		runs = append(runs, *r)
+	}
+	return runs, rows.Err()
+}
+
+// CancelBackfill marks a backfill as canceled and cancels those of its runs
+// that are still waiting in the queue, returning how many there were. Runs
+// that a daemon has already claimed are canceled by that daemon.
+func (db *DB) CancelBackfill(id int64) (int64, error) {
+	var canceled int64
+	err := retryDBOperation(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		if _, err := tx.Exec(`UPDATE backfills SET status = ?, updated_at = ? WHERE id = ?`, models.BackfillStatusCanceled, now, id); err != nil {
+			return err
+		}
+
+		waiting := `SELECT run_id FROM run_queue WHERE status = ? AND run_id IN (SELECT id FROM runs WHERE backfill_id = ?)`
+		result, err := tx.Exec(`UPDATE runs SET status = ?, completed_at = ?, updated_at = ? WHERE id IN (`+waiting+`)`,
+			models.RunStatusCanceled, now, now, models.QueueStatusQueued, id)
+		if err != nil {
+			return err
+		}
+		if canceled, err = result.RowsAffected(); err != nil {
+			return err
+		}
+
+		queueQuery := `UPDATE run_queue SET status = ? WHERE status = ? AND run_id IN (SELECT id FROM runs WHERE backfill_id = ?)`
+		if _, err := tx.Exec(queueQuery, models.QueueStatusDone, models.QueueStatusQueued, id); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel backfill: %w", err)
+	}
+	return canceled, nil
+}
+
+func (db *DB) InsertStepRun(sr *models.StepRun) (int64, error) {
+	logsJSON, err := json.Marshal(sr.Logs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal logs: %w", err)
+	}
+
+	query := `INSERT INTO step_runs (run_id, step_name, status, attempt, started_at, completed_at, error, logs) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	var result sql.Result
+	err = retryDBOperation(func() error {
+		var err error
+		result, err = db.Exec(query, sr.RunID, sr.StepName, sr.Status, sr.Attempt, sr.StartedAt, sr.CompletedAt, sr.Error, string(logsJSON))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert step run: %w", err)
 	}
 
 	id, err := result.LastInsertId()
@@ -398,7 +1605,7 @@ func (db *DB) UpdateStepRun(id int64, status models.StepStatus, completedAt *tim
 }
 
 func (db *DB) GetStepRuns(runID int64) ([]models.StepRun, error) {
-	query := `SELECT id, run_id, step_name, status, attempt, started_at, completed_at, error, logs FROM step_runs WHERE run_id = ? ORDER BY started_at`
+	query := `SELECT id, run_id, step_name, status, attempt, started_at, completed_at, error, logs FROM step_runs WHERE run_id = ? ORDER BY id`
 	rows, err := db.Query(query, runID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get step runs: %w", err)
@@ -429,9 +1636,141 @@ func (db *DB) GetStepRuns(runID int64) ([]models.StepRun, error) {
 		stepRuns = append(stepRuns, sr)
 	}
 
+	attempts, err := db.GetStepAttempts(runID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stepRuns {
+		for _, a := range attempts {
+			if a.StepRunID == stepRuns[i].ID {
+				stepRuns[i].Attempts = append(stepRuns[i].Attempts, a)
+				stepRuns[i].Attempt = a.Attempt
+			}
+		}
+	}
+
 	return stepRuns, nil
 }
 
+func (db *DB) InsertStepAttempt(a *models.StepAttempt) (int64, error) {
+	logsJSON, err := json.Marshal(a.Logs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal logs: %w", err)
+	}
+
+	query := `INSERT INTO step_attempts (step_run_id, run_id, attempt, status, started_at, error, logs) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	var result sql.Result
+	err = retryDBOperation(func() error {
+		var err error
+		result, err = db.Exec(query, a.StepRunID, a.RunID, a.Attempt, a.Status, a.StartedAt, a.Error, string(logsJSON))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert step attempt: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return id, nil
+}
+
+// InsertNotificationAttempt records one try at sending a notification.
+func (db *DB) InsertNotificationAttempt(a *models.NotificationAttempt) error {
+	query := `INSERT INTO notification_attempts (run_id, notifier, event, step_name, attempt, status, error, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	err := retryDBOperation(func() error {
+		_, err := db.Exec(query, a.RunID, a.Notifier, a.Event, a.Step, a.Attempt, a.Status, a.Error, a.CreatedAt)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert notification attempt: %w", err)
+	}
+	return nil
+}
+
+// ListNotificationAttempts returns the notifications tried for a run, oldest
+// first.
+func (db *DB) ListNotificationAttempts(runID int64) ([]models.NotificationAttempt, error) {
+	query := `SELECT id, run_id, notifier, event, step_name, attempt, status, error, created_at FROM notification_attempts WHERE run_id = ? ORDER BY id`
+	rows, err := db.Query(query, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notification attempts: %w", err)
+	}
+	defer rows.Close()
+
+	var attempts []models.NotificationAttempt
+	for rows.Next() {
+		var a models.NotificationAttempt
+		if err := rows.Scan(&a.ID, &a.RunID, &a.Notifier, &a.Event, &a.Step, &a.Attempt, &a.Status, &a.Error, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notification attempt: %w", err)
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+func (db *DB) UpdateStepAttempt(id int64, status models.StepStatus, completedAt *time.Time, exitCode *int, errorMsg string, logs []string) error {
+	logsJSON, err := json.Marshal(logs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal logs: %w", err)
+	}
+
+	query := `UPDATE step_attempts SET status = ?, completed_at = ?, exit_code = ?, error = ?, logs = ? WHERE id = ?`
+	err = retryDBOperation(func() error {
+		_, err := db.Exec(query, status, completedAt, exitCode, errorMsg, string(logsJSON), id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update step attempt: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) GetStepAttempts(runID int64) ([]models.StepAttempt, error) {
+	query := `SELECT id, step_run_id, run_id, attempt, status, started_at, completed_at, exit_code, error, logs FROM step_attempts WHERE run_id = ? ORDER BY step_run_id, attempt`
+	rows, err := db.Query(query, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get step attempts: %w", err)
+	}
+	defer rows.Close()
+
+	var attempts []models.StepAttempt
+	for rows.Next() {
+		var a models.StepAttempt
+		var logsJSON, errorMsg sql.NullString
+		var startedAt, completedAt sql.NullTime
+		var exitCode sql.NullInt64
+		err := rows.Scan(&a.ID, &a.StepRunID, &a.RunID, &a.Attempt, &a.Status, &startedAt, &completedAt, &exitCode, &errorMsg, &logsJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan step attempt: %w", err)
+		}
+
+		if startedAt.Valid {
+			a.StartedAt = startedAt.Time
+		}
+		if completedAt.Valid {
+			a.CompletedAt = completedAt.Time
+		}
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			a.ExitCode = &code
+		}
+		a.Error = errorMsg.String
+
+		if logsJSON.Valid {
+			if err := json.Unmarshal([]byte(logsJSON.String), &a.Logs); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal logs: %w", err)
+			}
+		}
+
+		attempts = append(attempts, a)
+	}
+
+	return attempts, rows.Err()
+}
+
 func (db *DB) AppendLogs(stepRunID int64, logs []string) error {
 	return retryDBOperation(func() error {
 
@@ -0,0 +1,510 @@
+package dispatcher
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/engine"
+	"github.com/kingoftac/gork/internal/lease"
+	"github.com/kingoftac/gork/internal/models"
+	"github.com/kingoftac/gork/internal/trigger"
+)
+
+// DefaultWorkers is the number of runs the daemon executes at once unless
+// configured otherwise.
+const DefaultWorkers = 4
+
+const pollInterval = time.Second
+
+// Dispatcher executes runs from the run queue on a fixed pool of workers,
+// which bounds how many runs execute at once across all workflows.
+type Dispatcher struct {
+	db      *db.DB
+	eng     *engine.Engine
+	workers int
+	owner   string
+	wg      sync.WaitGroup
+
+	// mu guards active and serializes claiming within this daemon.
+	// Concurrency and backfill limits are enforced by the database, across
+	// every daemon sharing it.
+	mu     sync.Mutex
+	active map[int64]*activeRun
+}
+
+// activeRun is a run this daemon has claimed, by which it can be stopped.
+type activeRun struct {
+	runID    int64
+	cancel   context.CancelFunc
+	stopping bool
+}
+
+// claim is a queue entry a worker has taken, along with the runs it
+// replaced, which must stop before it starts.
+type claim struct {
+	entry    models.QueueEntry
+	workflow *models.Workflow
+	active   *activeRun
+	ctx      context.Context
+	previous []int64
+}
+
+func NewDispatcher(db *db.DB, workers int) *Dispatcher {
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+	hostname, _ := os.Hostname()
+	return &Dispatcher{
+		db:      db,
+		eng:     engine.NewEngineWithVerboseLogs(db),
+		workers: workers,
+		owner:   fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		active:  make(map[int64]*activeRun),
+	}
+}
+
+// Owner identifies this daemon in run claims and leases.
+func (d *Dispatcher) Owner() string {
+	return d.owner
+}
+
+// SetRemoteRunner sets where steps with runs_on labels run.
+func (d *Dispatcher) SetRemoteRunner(r engine.RemoteRunner) {
+	d.eng.SetRemoteRunner(r)
+}
+
+// Subscribe adds h to the handlers called on run and step events. It must be
+// called before Start.
+func (d *Dispatcher) Subscribe(h engine.EventHandler) {
+	d.eng.Subscribe(h)
+}
+
+// Start recovers runs interrupted by a previous daemon and then executes
+// queued runs until ctx is canceled. It returns once every in-flight run has
+// stopped.
+func (d *Dispatcher) Start(ctx context.Context) {
+	slog.Info("Dispatcher starting", "component", "dispatcher", "workers", d.workers, "owner", d.owner)
+
+	slog.Info("Starting recovery of incomplete runs", "component", "dispatcher")
+	recovered, released := d.recoverRuns()
+	slog.Info("Recovery complete", "component", "dispatcher", "runs_recovered", recovered, "claims_released", released)
+
+	// Runs are stopped with engine.ErrShutdown rather than by ctx itself, so
+	// that the engine can tell the daemon stopping from a run being canceled.
+	runsCtx, stopRuns := context.WithCancelCause(context.WithoutCancel(ctx))
+	defer stopRuns(nil)
+	stop := context.AfterFunc(ctx, func() { stopRuns(engine.ErrShutdown) })
+	defer stop()
+
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go d.work(ctx, runsCtx, i)
+	}
+
+	d.wg.Add(1)
+	go d.watchRuns(ctx)
+
+	d.wg.Add(1)
+	go d.watchOrphans(ctx)
+
+	slog.Info("Dispatcher started", "component", "dispatcher")
+
+	d.wg.Wait()
+	slog.Info("Dispatcher stopped", "component", "dispatcher")
+}
+
+// work claims and executes queued runs until ctx is canceled. Claimed runs
+// execute under runsCtx.
+func (d *Dispatcher) work(ctx, runsCtx context.Context, worker int) {
+	defer d.wg.Done()
+
+	for ctx.Err() == nil {
+		c, err := d.claimNext(runsCtx)
+		if err != nil {
+			slog.Error("Failed to claim queued run", "component", "dispatcher", "worker", worker, "error", err)
+		}
+		if c == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		d.execute(worker, c)
+	}
+}
+
+// claimNext claims the first queued entry whose workflow may start under its
+// concurrency settings. Entries that are blocked by a queue policy are left
+// for later; entries blocked by a skip policy are finished as skipped.
+func (d *Dispatcher) claimNext(ctx context.Context) (*claim, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entries, err := d.db.ListQueuedRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.BackfillID != 0 && !d.backfillHasRoom(entry.BackfillID) {
+			continue
+		}
+
+		workflow, err := d.db.GetWorkflow(entry.WorkflowID)
+		if err != nil {
+			// Claim it anyway so the run is failed rather than left queued.
+			return d.take(ctx, entry, nil, "", 0)
+		}
+
+		key := workflow.ConcurrencyKey()
+		concurrency := concurrencyOf(workflow, entry)
+		if concurrency == nil {
+			return d.take(ctx, entry, workflow, key, 0)
+		}
+
+		limit := concurrency.EffectiveLimit()
+		running, err := d.db.CountClaimedRuns(key)
+		if err != nil {
+			return nil, err
+		}
+		if running < limit {
+			c, err := d.take(ctx, entry, workflow, key, limit)
+			if c != nil || err != nil {
+				return c, err
+			}
+			// Another daemon claimed the entry or took the last free slot.
+			continue
+		}
+
+		switch concurrency.EffectivePolicy() {
+		case models.ConcurrencyQueue:
+			continue
+
+		case models.ConcurrencySkip:
+			claimed, err := d.db.ClaimQueuedRun(entry.ID, d.owner, "", 0)
+			if err != nil || !claimed {
+				continue
+			}
+			slog.Info("Skipping queued run: concurrency limit reached", "component", "dispatcher", "workflow", workflow.Name, "run_id", entry.RunID, "key", key)
+			now := time.Now()
+			if err := d.db.UpdateRunStatus(entry.RunID, models.RunStatusSkipped, &now); err != nil {
+				slog.Error("Failed to mark run as skipped", "component", "dispatcher", "run_id", entry.RunID, "error", err)
+			}
+			if err := d.db.CompleteQueuedRun(entry.ID); err != nil {
+				slog.Error("Failed to complete queued run", "component", "dispatcher", "run_id", entry.RunID, "error", err)
+			}
+
+		case models.ConcurrencyCancelPrevious:
+			claimed, previous, err := d.db.ClaimQueuedRunReplacing(entry.ID, d.owner, key, limit)
+			if err != nil || !claimed {
+				return nil, err
+			}
+			c := d.activate(ctx, entry, workflow)
+			for _, runID := range previous {
+				slog.Info("Canceling previous run: concurrency limit reached", "component", "dispatcher", "workflow", workflow.Name, "run_id", runID, "replaced_by", entry.RunID, "key", key)
+				// Runs claimed by other daemons are canceled by them.
+				if p := d.active[runID]; p != nil {
+					p.stopping = true
+					p.cancel()
+				}
+			}
+			c.previous = previous
+			return c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// concurrencyOf returns the concurrency setting that applies to a queued
+// run. Scheduled runs of a workflow without one still never overlap: they
+// queue behind the workflow's other runs.
+func concurrencyOf(workflow *models.Workflow, entry models.QueueEntry) *models.Concurrency {
+	if workflow.Concurrency == nil && entry.Trigger == "scheduler" {
+		return &models.Concurrency{}
+	}
+	return workflow.Concurrency
+}
+
+// take claims entry under key, within limit if it is positive, and registers
+// it as active. It returns nil if the entry was not claimed, because another
+// daemon claimed it first or the limit was reached.
+func (d *Dispatcher) take(ctx context.Context, entry models.QueueEntry, workflow *models.Workflow, key string, limit int) (*claim, error) {
+	claimed, err := d.db.ClaimQueuedRun(entry.ID, d.owner, key, limit)
+	if err != nil || !claimed {
+		return nil, err
+	}
+	return d.activate(ctx, entry, workflow), nil
+}
+
+// activate registers a claimed entry as active. The caller must hold d.mu.
+func (d *Dispatcher) activate(ctx context.Context, entry models.QueueEntry, workflow *models.Workflow) *claim {
+	runCtx, cancel := context.WithCancel(ctx)
+	c := &claim{
+		entry:    entry,
+		workflow: workflow,
+		ctx:      runCtx,
+		active:   &activeRun{runID: entry.RunID, cancel: cancel},
+	}
+	d.active[entry.RunID] = c.active
+	return c
+}
+
+// backfillHasRoom reports whether another run of the backfill may start
+// without exceeding its parallel limit. Claiming checks the limit again, in
+// case another daemon started one in the meantime.
+func (d *Dispatcher) backfillHasRoom(id int64) bool {
+	b, err := d.db.GetBackfill(id)
+	if err != nil {
+		slog.Error("Failed to load backfill", "component", "dispatcher", "backfill_id", id, "error", err)
+		return true
+	}
+	n, err := d.db.CountClaimedBackfillRuns(id)
+	if err != nil {
+		slog.Error("Failed to count backfill runs", "component", "dispatcher", "backfill_id", id, "error", err)
+		return true
+	}
+	return n < max(b.Parallel, 1)
+}
+
+func (d *Dispatcher) release(c *claim) {
+	c.active.cancel()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.active, c.active.runID)
+}
+
+// watchRuns cancels the claimed runs that must stop: runs that were deleted
+// along with their workflow, runs replaced under a cancel-previous policy, by
+// this daemon or another one, and runs of backfills that have been canceled.
+// Backfill runs still waiting in the queue are canceled by CancelBackfill
+// itself.
+func (d *Dispatcher) watchRuns(ctx context.Context) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		ids := make([]int64, 0, len(d.active))
+		for id, r := range d.active {
+			if !r.stopping {
+				ids = append(ids, id)
+			}
+		}
+		d.mu.Unlock()
+
+		stop, err := d.db.ListRunsToStop(ids)
+		if err != nil {
+			slog.Error("Failed to check claimed runs", "component", "dispatcher", "error", err)
+			continue
+		}
+
+		d.mu.Lock()
+		for id, reason := range stop {
+			if r := d.active[id]; r != nil && !r.stopping {
+				slog.Info("Canceling run", "component", "dispatcher", "run_id", id, "reason", reason)
+				r.stopping = true
+				r.cancel()
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// waitForReplaced waits until the runs a claim replaced have stopped and
+// given up their claims, wherever they run, or until ctx is done.
+func (d *Dispatcher) waitForReplaced(ctx context.Context, runIDs []int64) {
+	for {
+		n, err := d.db.CountClaimedRunsOf(runIDs)
+		if err != nil {
+			slog.Error("Failed to check replaced runs", "component", "dispatcher", "error", err)
+		}
+		if err == nil && n == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (d *Dispatcher) execute(worker int, c *claim) {
+	entry := c.entry
+	defer func() {
+		d.release(c)
+		if err := d.db.CompleteQueuedRun(entry.ID); err != nil {
+			slog.Error("Failed to complete queued run", "component", "dispatcher", "run_id", entry.RunID, "error", err)
+		}
+	}()
+
+	workflow := c.workflow
+	if workflow == nil {
+		slog.Error("Failed to load workflow for queued run", "component", "dispatcher", "run_id", entry.RunID, "workflow_id", entry.WorkflowID)
+		d.failRun(entry.RunID)
+		return
+	}
+
+	run, err := d.db.GetRun(entry.RunID)
+	if err != nil {
+		slog.Error("Failed to load queued run", "component", "dispatcher", "run_id", entry.RunID, "error", err)
+		d.failRun(entry.RunID)
+		return
+	}
+
+	// Runs replaced under a cancel-previous policy still hold the resource
+	// until their steps have stopped.
+	if len(c.previous) > 0 {
+		d.waitForReplaced(c.ctx, c.previous)
+	}
+
+	runCtx := c.ctx
+	if run.Trigger == "scheduler" {
+		// The deadline is relative to when the schedule fired, not to when a
+		// worker became free.
+		if deadline, ok := workflow.NextDeadline(entry.EnqueuedAt); ok {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithDeadline(runCtx, deadline)
+			defer cancel()
+		}
+	}
+
+	slog.Info("Starting queued run", "component", "dispatcher", "worker", worker, "workflow", workflow.Name, "run_id", run.ID, "trigger", run.Trigger, "priority", entry.Priority)
+
+	run, err = d.eng.ExecuteRun(runCtx, workflow, run)
+	if errors.Is(err, engine.ErrShutdown) {
+		slog.Info("Interrupted queued run: daemon is shutting down", "component", "dispatcher", "worker", worker, "workflow", workflow.Name, "run_id", run.ID)
+		return
+	}
+	if err != nil && run == nil {
+		if _, getErr := d.db.GetRun(entry.RunID); errors.Is(getErr, sql.ErrNoRows) {
+			slog.Info("Stopped queued run: it was deleted", "component", "dispatcher", "worker", worker, "workflow", workflow.Name, "run_id", entry.RunID)
+			return
+		}
+		slog.Error("Failed to execute queued run", "component", "dispatcher", "workflow", workflow.Name, "run_id", entry.RunID, "error", err)
+		d.failRun(entry.RunID)
+		return
+	}
+
+	slog.Info("Completed queued run", "component", "dispatcher", "worker", worker, "workflow", workflow.Name, "run_id", run.ID, "status", run.Status)
+
+	trigger.EnqueueDownstream(d.db, workflow, run)
+}
+
+func (d *Dispatcher) failRun(runID int64) {
+	now := time.Now()
+	if err := d.db.UpdateRunStatus(runID, models.RunStatusFailed, &now); err != nil {
+		slog.Error("Failed to mark run as failed", "component", "dispatcher", "run_id", runID, "error", err)
+	}
+}
+
+// recoverRuns handles runs that were in progress in daemons whose lease has
+// expired, including a previous run of this daemon, according to their
+// workflow's on_restart policy. Runs still waiting in the queue are left for
+// the workers, and runs of daemons that are still alive are left to them.
+func (d *Dispatcher) recoverRuns() (recovered int, released int64) {
+	released, err := d.db.ReleaseClaimedRuns()
+	if err != nil {
+		slog.Error("Failed to release claimed runs during recovery", "component", "dispatcher", "error", err)
+	}
+
+	runs, err := d.db.ListOrphanedRuns()
+	if err != nil {
+		slog.Error("Failed to list orphaned runs during recovery", "component", "dispatcher", "error", err)
+		return 0, released
+	}
+
+	for _, r := range runs {
+		if err := d.recoverRun(r); err != nil {
+			slog.Error("Failed to recover incomplete run", "component", "dispatcher", "run_id", r.ID, "error", err)
+			continue
+		}
+		recovered++
+	}
+	return recovered, released
+}
+
+func (d *Dispatcher) recoverRun(r models.Run) error {
+	interrupted, err := d.db.InterruptStepRuns(r.ID, "daemon stopped before the step finished")
+	if err != nil {
+		return err
+	}
+
+	policy := models.RestartCancel
+	if workflow, err := d.db.GetWorkflow(r.WorkflowID); err == nil {
+		policy = workflow.EffectiveRestartPolicy()
+	}
+
+	switch policy {
+	case models.RestartResume:
+		if err := d.db.RequeueRun(r.ID); err != nil {
+			return err
+		}
+		slog.Info("Resuming incomplete run", "component", "dispatcher", "run_id", r.ID, "status", r.Status, "owner", r.Owner, "steps_interrupted", interrupted)
+		return nil
+
+	case models.RestartRerun:
+		rerun := &models.Run{
+			WorkflowID:  r.WorkflowID,
+			Trigger:     r.Trigger,
+			Params:      r.Params,
+			ScheduledAt: r.ScheduledAt,
+			BackfillID:  r.BackfillID,
+		}
+		runID, err := d.db.EnqueueRun(rerun, 0)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := d.db.UpdateRunStatus(r.ID, models.RunStatusCanceled, &now); err != nil {
+			return err
+		}
+		slog.Info("Rerunning incomplete run", "component", "dispatcher", "run_id", r.ID, "status", r.Status, "owner", r.Owner, "rerun_id", runID)
+		return nil
+
+	default:
+		now := time.Now()
+		if err := d.db.UpdateRunStatus(r.ID, models.RunStatusCanceled, &now); err != nil {
+			return err
+		}
+		slog.Info("Recovered incomplete run", "component", "dispatcher", "run_id", r.ID, "status", r.Status, "owner", r.Owner, "steps_interrupted", interrupted)
+		return nil
+	}
+}
+
+// watchOrphans recovers the runs of daemons that stop while this one is
+// running, once their lease has expired.
+func (d *Dispatcher) watchOrphans(ctx context.Context) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(lease.TTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.recoverRuns()
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package dispatcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/lease"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func stepStatus(t *testing.T, database *db.DB, runID int64, step string) models.StepStatus {
+	t.Helper()
+	stepRuns, err := database.GetStepRuns(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status models.StepStatus
+	for _, sr := range stepRuns {
+		if sr.StepName == step {
+			status = sr.Status
+		}
+	}
+	return status
+}
+
+func TestShutdownInterruptsRunForResume(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	dir := t.TempDir()
+	count := filepath.Join(dir, "count")
+	marker := filepath.Join(dir, "marker")
+	w := &models.Workflow{Name: "resumable", OnRestart: models.RestartResume, Steps: []models.WorkflowStep{
+		{Name: "extract", Exec: &models.ExecAction{Command: "sh", Args: []string{"-c", "echo x >> " + count}}},
+		// The first time it runs, load blocks until the daemon stops.
+		{Name: "load", DependsOn: []string{"extract"}, Exec: &models.ExecAction{Command: "sh", Args: []string{"-c", "test -f " + marker + " || { touch " + marker + "; sleep 30; }"}}},
+	}}
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(w.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runID, err := database.EnqueueRun(&models.Run{WorkflowID: stored.ID, Trigger: "test"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := NewDispatcher(database, 1)
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		first.Start(ctx)
+		close(stopped)
+	}()
+	waitFor(t, "load to start", func() bool { return stepStatus(t, database, runID, "load") == models.StepStatusRunning })
+	stop()
+	<-stopped
+
+	run, err := database.GetRun(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != models.RunStatusRunning || run.Owner != first.Owner() {
+		t.Fatalf("after shutdown run is %s owned by %q, want running owned by %q", run.Status, run.Owner, first.Owner())
+	}
+	if got := stepStatus(t, database, runID, "load"); got != models.StepStatusInterrupted {
+		t.Fatalf("after shutdown load is %s, want interrupted", got)
+	}
+
+	second := NewDispatcher(database, 1)
+	ctx, stop = context.WithCancel(context.Background())
+	defer stop()
+	go second.Start(ctx)
+	waitFor(t, "the run to be resumed", func() bool {
+		run, err = database.GetRun(runID)
+		return err == nil && run.Status.IsTerminal()
+	})
+
+	if run.Status != models.RunStatusSuccess {
+		t.Fatalf("resumed run finished with status %s, want success", run.Status)
+	}
+	if got := stepStatus(t, database, runID, "load"); got != models.StepStatusSuccess {
+		t.Fatalf("resumed load is %s, want success", got)
+	}
+	data, err := os.ReadFile(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "x"); n != 1 {
+		t.Fatalf("extract ran %d times, want once", n)
+	}
+}
+
+func TestRecoveryLeavesRunsOfLiveExec(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := &models.Workflow{Name: "adhoc", Steps: []models.WorkflowStep{
+		{Name: "report", Exec: &models.ExecAction{Command: "echo"}},
+	}}
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(w.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A run started by gorkctl exec, which holds its own lease.
+	owner := "exec-host:1"
+	release, err := lease.Hold(database, models.ExecLeasePrefix+owner, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runID, err := database.InsertRun(&models.Run{WorkflowID: stored.ID, Status: models.RunStatusRunning, Trigger: "exec", Owner: owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(database, 1)
+	if recovered, _ := d.recoverRuns(); recovered != 0 {
+		t.Fatalf("recovered %d runs of a live exec process", recovered)
+	}
+	run, err := database.GetRun(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != models.RunStatusRunning {
+		t.Fatalf("run of a live exec process is %s, want running", run.Status)
+	}
+
+	// Once the process is gone its run is orphaned like a daemon's.
+	release()
+	if recovered, _ := d.recoverRuns(); recovered != 1 {
+		t.Fatalf("recovered %d runs after the exec process exited, want 1", recovered)
+	}
+}
+
+// insertWorkflow stores w and returns it as stored.
+func insertWorkflow(t *testing.T, database *db.DB, w *models.Workflow) *models.Workflow {
+	t.Helper()
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(w.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func enqueue(t *testing.T, database *db.DB, w *models.Workflow, trigger string) int64 {
+	t.Helper()
+	runID, err := database.EnqueueRun(&models.Run{WorkflowID: w.ID, Trigger: trigger}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runID
+}
+
+// claimRun has d claim the next queued run, failing the test if it cannot.
+func claimRun(t *testing.T, d *Dispatcher) *claim {
+	t.Helper()
+	c, err := d.claimNext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil {
+		t.Fatal("no run was claimed")
+	}
+	return c
+}
+
+func assertNoClaim(t *testing.T, d *Dispatcher) {
+	t.Helper()
+	c, err := d.claimNext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != nil {
+		t.Fatalf("claimed run %d despite the concurrency limit", c.entry.RunID)
+	}
+}
+
+// finish ends a claim as execute does once its run has stopped.
+func finish(t *testing.T, d *Dispatcher, c *claim) {
+	t.Helper()
+	d.release(c)
+	if err := d.db.CompleteQueuedRun(c.entry.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// twoDaemons returns dispatchers for two daemons sharing database.
+func twoDaemons(database *db.DB) (*Dispatcher, *Dispatcher) {
+	first, second := NewDispatcher(database, 1), NewDispatcher(database, 1)
+	first.owner, second.owner = "first:1", "second:1"
+	return first, second
+}
+
+func TestConcurrencyLimitSpansDaemons(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// Two workflows in one group share its limit.
+	concurrency := &models.Concurrency{Limit: 1, Group: "warehouse"}
+	load := insertWorkflow(t, database, &models.Workflow{Name: "load", Concurrency: concurrency, Steps: []models.WorkflowStep{
+		{Name: "copy", Exec: &models.ExecAction{Command: "echo"}},
+	}})
+	vacuum := insertWorkflow(t, database, &models.Workflow{Name: "vacuum", Concurrency: concurrency, Steps: []models.WorkflowStep{
+		{Name: "vacuum", Exec: &models.ExecAction{Command: "echo"}},
+	}})
+	first := enqueue(t, database, load, "test")
+	second := enqueue(t, database, vacuum, "test")
+
+	d1, d2 := twoDaemons(database)
+	c := claimRun(t, d1)
+	if c.entry.RunID != first {
+		t.Fatalf("claimed run %d, want %d", c.entry.RunID, first)
+	}
+	assertNoClaim(t, d2)
+
+	finish(t, d1, c)
+	if c := claimRun(t, d2); c.entry.RunID != second {
+		t.Fatalf("claimed run %d, want %d", c.entry.RunID, second)
+	}
+}
+
+func TestSkipPolicySpansDaemons(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := insertWorkflow(t, database, &models.Workflow{Name: "report", Concurrency: &models.Concurrency{Policy: models.ConcurrencySkip}, Steps: []models.WorkflowStep{
+		{Name: "report", Exec: &models.ExecAction{Command: "echo"}},
+	}})
+	enqueue(t, database, w, "test")
+	skipped := enqueue(t, database, w, "test")
+
+	d1, d2 := twoDaemons(database)
+	claimRun(t, d1)
+	assertNoClaim(t, d2)
+
+	run, err := database.GetRun(skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != models.RunStatusSkipped {
+		t.Fatalf("overlapping run is %s, want skipped", run.Status)
+	}
+}
+
+func TestCancelPreviousSpansDaemons(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := insertWorkflow(t, database, &models.Workflow{Name: "deploy", Concurrency: &models.Concurrency{Policy: models.ConcurrencyCancelPrevious}, Steps: []models.WorkflowStep{
+		{Name: "deploy", Exec: &models.ExecAction{Command: "echo"}},
+	}})
+	previous := enqueue(t, database, w, "test")
+	enqueue(t, database, w, "test")
+
+	d1, d2 := twoDaemons(database)
+	old := claimRun(t, d1)
+	replacing := claimRun(t, d2)
+	if len(replacing.previous) != 1 || replacing.previous[0] != previous {
+		t.Fatalf("replaced runs %v, want [%d]", replacing.previous, previous)
+	}
+
+	// The daemon holding the previous run notices and cancels it.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	d1.wg.Add(1)
+	go d1.watchRuns(ctx)
+	select {
+	case <-old.ctx.Done():
+	case <-time.After(20 * time.Second):
+		t.Fatal("the previous run was not canceled by the daemon holding it")
+	}
+
+	// The new run starts only once the previous one has given up its claim.
+	waited := make(chan struct{})
+	go func() {
+		d2.waitForReplaced(context.Background(), replacing.previous)
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("the new run did not wait for the previous one to stop")
+	case <-time.After(2 * pollInterval):
+	}
+	finish(t, d1, old)
+	select {
+	case <-waited:
+	case <-time.After(20 * time.Second):
+		t.Fatal("the new run kept waiting after the previous one stopped")
+	}
+}
+
+func TestScheduledRunsDoNotOverlapByDefault(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := insertWorkflow(t, database, &models.Workflow{Name: "hourly", Schedule: "1h", Steps: []models.WorkflowStep{
+		{Name: "report", Exec: &models.ExecAction{Command: "echo"}},
+	}})
+	enqueue(t, database, w, "scheduler")
+	enqueue(t, database, w, "scheduler")
+	manual := enqueue(t, database, w, "cli")
+
+	d1, d2 := twoDaemons(database)
+	claimRun(t, d1)
+	// The second scheduled run waits; the manual run is not limited.
+	if c := claimRun(t, d2); c.entry.RunID != manual {
+		t.Fatalf("claimed run %d, want the manual run %d", c.entry.RunID, manual)
+	}
+	assertNoClaim(t, d2)
+}
+
+func TestBackfillParallelSpansDaemons(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := insertWorkflow(t, database, &models.Workflow{Name: "daily", Schedule: "24h", Steps: []models.WorkflowStep{
+		{Name: "report", Exec: &models.ExecAction{Command: "echo"}},
+	}})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	runs := []models.Run{
+		{WorkflowID: w.ID, Trigger: "backfill", ScheduledAt: from},
+		{WorkflowID: w.ID, Trigger: "backfill", ScheduledAt: from.Add(24 * time.Hour)},
+	}
+	if _, err := database.CreateBackfill(&models.Backfill{WorkflowID: w.ID, From: from, To: from.Add(24 * time.Hour), Parallel: 1}, runs); err != nil {
+		t.Fatal(err)
+	}
+
+	d1, d2 := twoDaemons(database)
+	c := claimRun(t, d1)
+	assertNoClaim(t, d2)
+
+	// A daemon that saw room before the other claimed is still refused.
+	entries, err := database.ListQueuedRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d runs queued, want 1", len(entries))
+	}
+	if claimed, err := database.ClaimQueuedRun(entries[0].ID, d2.owner, "", 0); err != nil || claimed {
+		t.Fatalf("claim beyond the backfill's parallel limit = %v, %v; want refused", claimed, err)
+	}
+
+	finish(t, d1, c)
+	claimRun(t, d2)
+}
+
+func TestDeletingWorkflowStopsItsRun(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := insertWorkflow(t, database, &models.Workflow{Name: "slow", Steps: []models.WorkflowStep{
+		{Name: "wait", Exec: &models.ExecAction{Command: "sleep", Args: []string{"30"}}},
+		{Name: "after", DependsOn: []string{"wait"}, Exec: &models.ExecAction{Command: "echo"}},
+	}})
+	runID := enqueue(t, database, w, "test")
+
+	d := NewDispatcher(database, 1)
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		d.Start(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		stop()
+		<-stopped
+	}()
+	waitFor(t, "the step to start", func() bool { return stepStatus(t, database, runID, "wait") == models.StepStatusRunning })
+
+	if err := database.DeleteWorkflow(w.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the run to stop", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.active) == 0
+	})
+
+	stepRuns, err := database.GetStepRuns(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stepRuns) != 0 {
+		t.Fatalf("the stopped run left %d step runs behind its deleted run", len(stepRuns))
+	}
+}
@@ -3,6 +3,7 @@ package engine
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -17,14 +18,80 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/metrics"
 	"github.com/kingoftac/gork/internal/models"
 	"github.com/kingoftac/gork/internal/runner"
+	"github.com/kingoftac/gork/internal/tracing"
 )
 
+// ErrShutdown is the cause a daemon cancels the context of its runs with when
+// it stops. A run stopped this way is left running, with its unfinished steps
+// interrupted, so that the next daemon recovers it according to its
+// on_restart policy.
+var ErrShutdown = errors.New("daemon is shutting down")
+
+// shuttingDown reports whether ctx was canceled because the daemon is
+// stopping, rather than to cancel the run.
+func shuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrShutdown)
+}
+
+// stoppedStatus is the status of a step stopped because its run ended.
+func stoppedStatus(ctx context.Context) models.StepStatus {
+	if shuttingDown(ctx) {
+		return models.StepStatusInterrupted
+	}
+	return models.StepStatusCanceled
+}
+
 type Engine struct {
 	db          *db.DB
 	mu          sync.Mutex
 	verboseLogs bool
+	remote      RemoteRunner
+	handlers    []EventHandler
+	output      StepOutput
+}
+
+// EventHandler is called with each event of a run of workflow. Handlers are
+// called on the goroutine executing the run, so they must not block.
+type EventHandler func(workflow *models.Workflow, event models.Event)
+
+// Subscribe adds h to the handlers called on run and step events. It must be
+// called before any run is executed.
+func (e *Engine) Subscribe(h EventHandler) {
+	e.handlers = append(e.handlers, h)
+}
+
+func (e *Engine) emit(workflow *models.Workflow, event models.Event) {
+	event.Time = time.Now()
+	event.WorkflowID = workflow.ID
+	event.Workflow = workflow.Name
+	for _, h := range e.handlers {
+		h(workflow, event)
+	}
+}
+
+// RemoteRunner runs steps with runs_on labels on a worker other than the
+// daemon, passing their output to onLogs as it arrives.
+type RemoteRunner interface {
+	RunStep(ctx context.Context, step models.WorkflowStep, onLogs func([]string)) ([]string, error)
+}
+
+// SetRemoteRunner sets where steps with runs_on labels run. Without one,
+// such steps fail.
+func (e *Engine) SetRemoteRunner(r RemoteRunner) {
+	e.remote = r
+}
+
+// StepOutput receives a line of output of the named step.
+type StepOutput func(step, line string)
+
+// StreamOutput passes each line that exec and script steps write to out
+// while they run. HTTP steps only have output once they finish, which is
+// passed to out then. It must be called before any run is executed.
+func (e *Engine) StreamOutput(out StepOutput) {
+	e.output = out
 }
 
 func NewEngine(db *db.DB) *Engine {
@@ -71,7 +138,6 @@ func (e *Engine) ExecuteWorkflow(ctx context.Context, workflow *models.Workflow,
 	run := &models.Run{
 		WorkflowID: workflow.ID,
 		Status:     models.RunStatusPending,
-		StartedAt:  time.Now(),
 		Trigger:    trigger,
 	}
 
@@ -81,44 +147,108 @@ func (e *Engine) ExecuteWorkflow(ctx context.Context, workflow *models.Workflow,
 	}
 	run.ID = runID
 
-	if err := e.db.UpdateRunStatus(runID, models.RunStatusRunning, nil); err != nil {
-		return nil, fmt.Errorf("failed to update run status: %w", err)
+	return e.ExecuteRun(ctx, workflow, run)
+}
+
+// ExecuteRun executes an existing pending run of workflow, such as one taken
+// from the run queue. A run resumed after its daemon stopped skips the steps
+// that had already succeeded.
+func (e *Engine) ExecuteRun(ctx context.Context, workflow *models.Workflow, run *models.Run) (*models.Run, error) {
+	runID := run.ID
+	startedAt := time.Now()
+	if err := e.db.StartRun(runID, startedAt); err != nil {
+		return nil, err
 	}
 	run.Status = models.RunStatusRunning
+	if run.StartedAt.IsZero() {
+		run.StartedAt = startedAt
+	}
+	metrics.ActiveRuns.Add(1, workflow.Name)
+	defer metrics.ActiveRuns.Add(-1, workflow.Name)
+
+	ctx, span := tracing.Start(ctx, "run "+workflow.Name, tracing.KindInternal,
+		tracing.String("gork.workflow", workflow.Name),
+		tracing.Int("gork.run_id", runID),
+		tracing.String("gork.trigger", run.Trigger),
+	)
+	defer span.Finish()
+
+	e.emit(workflow, models.Event{Type: models.EventRunStarted, RunID: runID, Trigger: run.Trigger, Status: string(models.RunStatusRunning)})
+
+	completed, err := e.succeededSteps(runID)
+	if err != nil {
+		return nil, err
+	}
 
+	steps := withParams(workflow.Steps, run.Params)
 	stepMap := make(map[string]models.WorkflowStep)
-	for _, step := range workflow.Steps {
+	for _, step := range steps {
 		stepMap[step.Name] = step
 	}
 
+	// A step's done channel is closed when it succeeds and its failed
+	// channel when it does not, which skips the steps that depend on it.
 	doneChans := make(map[string]chan struct{})
+	failedChans := make(map[string]chan struct{})
 	for name := range stepMap {
 		doneChans[name] = make(chan struct{})
+		failedChans[name] = make(chan struct{})
 	}
 
-	errCh := make(chan error, len(workflow.Steps))
-	for _, step := range workflow.Steps {
-		go e.executeStep(ctx, runID, step, stepMap, doneChans, errCh)
+	var runCtx context.Context
+	var cancel context.CancelFunc
+	if workflow.Timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, workflow.Timeout)
+	} else {
+		runCtx, cancel = context.WithCancel(ctx)
 	}
+	defer cancel()
 
-	for i := 0; i < len(workflow.Steps); i++ {
-		if err := <-errCh; err != nil {
-			e.db.UpdateRunStatus(runID, models.RunStatusFailed, &time.Time{})
-			return run, err
+	// slots bounds how many steps execute at once; nil means no limit.
+	var slots chan struct{}
+	if workflow.MaxParallel > 0 {
+		slots = make(chan struct{}, workflow.MaxParallel)
+	}
+
+	errCh := make(chan error, len(steps))
+	for _, step := range steps {
+		if completed[step.Name] {
+			close(doneChans[step.Name])
+			errCh <- nil
+			continue
 		}
+		go e.executeStep(runCtx, runID, workflow, step, stepMap, doneChans, failedChans, slots, errCh)
 	}
 
-	stepRuns, err := e.db.GetStepRuns(runID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get step runs: %w", err)
+	// Every step reports exactly once. A failed step only stops the steps
+	// that depend on it; independent branches run to completion.
+	var runErr error
+	for i := 0; i < len(steps); i++ {
+		if err := <-errCh; err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+
+	if shuttingDown(ctx) {
+		slog.Info("Leaving run to be recovered: daemon is shutting down", "workflow", workflow.Name, "run_id", runID)
+		span.SetError(ErrShutdown)
+		return run, ErrShutdown
+	}
+
+	if err := e.cancelUnstartedSteps(runID, workflow); err != nil {
+		return nil, err
 	}
 
 	runStatus := models.RunStatusSuccess
-	for _, sr := range stepRuns {
-		if sr.Status == models.StepStatusFailed || sr.Status == models.StepStatusTimeout {
-			runStatus = models.RunStatusFailed
-			break
-		}
+	switch {
+	case runCtx.Err() == context.DeadlineExceeded:
+		runStatus = models.RunStatusTimeout
+		runErr = fmt.Errorf("run %d timed out: %w", runID, runCtx.Err())
+	case ctx.Err() != nil:
+		runStatus = models.RunStatusCanceled
+		runErr = ctx.Err()
+	case runErr != nil:
+		runStatus = models.RunStatusFailed
 	}
 
 	completedAt := time.Now()
@@ -127,14 +257,123 @@ func (e *Engine) ExecuteWorkflow(ctx context.Context, workflow *models.Workflow,
 	}
 	run.Status = runStatus
 	run.CompletedAt = completedAt
+	span.SetAttributes(tracing.String("gork.run.status", string(runStatus)))
+	span.SetError(runErr)
+
+	event := models.Event{RunID: runID, Trigger: run.Trigger, Status: string(runStatus)}
+	switch runStatus {
+	case models.RunStatusSuccess:
+		event.Type = models.EventRunSucceeded
+	case models.RunStatusFailed, models.RunStatusTimeout:
+		event.Type = models.EventRunFailed
+		event.Error = runErr.Error()
+	}
+	if event.Type != "" {
+		e.emit(workflow, event)
+	}
+	metrics.RunsTotal.Inc(workflow.Name, string(runStatus))
+	metrics.RunDuration.Observe(completedAt.Sub(startedAt).Seconds(), workflow.Name, string(runStatus))
+
+	return run, runErr
+}
+
+// withParams returns a copy of steps with the run's parameters added to each
+// step's environment, taking precedence over the step's own env values.
+func withParams(steps []models.WorkflowStep, params map[string]string) []models.WorkflowStep {
+	result := make([]models.WorkflowStep, len(steps))
+	for i, step := range steps {
+		env := make(map[string]string, len(step.Env)+len(params))
+		for k, v := range step.Env {
+			env[k] = v
+		}
+		for k, v := range params {
+			env[k] = v
+		}
+		step.Env = env
+		result[i] = step
+	}
+	return result
+}
+
+// succeededSteps returns the names of the steps of a run that have already
+// succeeded, which is only the case for a resumed run. Their outputs are
+// kept in step_data, so the steps that depend on them can still resolve
+// their inputs.
+func (e *Engine) succeededSteps(runID int64) (map[string]bool, error) {
+	stepRuns, err := e.db.GetStepRuns(runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get step runs: %w", err)
+	}
+
+	succeeded := make(map[string]bool)
+	for _, sr := range stepRuns {
+		if sr.Status == models.StepStatusSuccess {
+			succeeded[sr.StepName] = true
+		}
+	}
+	return succeeded, nil
+}
+
+// cancelUnstartedSteps records a canceled step run for every step of the run
+// that never got as far as starting.
+func (e *Engine) cancelUnstartedSteps(runID int64, workflow *models.Workflow) error {
+	stepRuns, err := e.db.GetStepRuns(runID)
+	if err != nil {
+		return fmt.Errorf("failed to get step runs: %w", err)
+	}
+
+	started := make(map[string]bool, len(stepRuns))
+	for _, sr := range stepRuns {
+		started[sr.StepName] = true
+	}
+
+	now := time.Now()
+	for _, step := range workflow.Steps {
+		if started[step.Name] {
+			continue
+		}
+		stepRun := &models.StepRun{
+			RunID:       runID,
+			StepName:    step.Name,
+			Status:      models.StepStatusCanceled,
+			CompletedAt: now,
+			Error:       "canceled before starting",
+			Logs:        []string{},
+		}
+		if _, err := e.db.InsertStepRun(stepRun); err != nil {
+			return fmt.Errorf("failed to insert step run: %w", err)
+		}
+	}
 
-	return run, nil
+	return nil
 }
 
-func (e *Engine) executeStep(ctx context.Context, runID int64, step models.WorkflowStep, stepMap map[string]models.WorkflowStep, doneChans map[string]chan struct{}, errCh chan<- error) {
+func (e *Engine) executeStep(ctx context.Context, runID int64, workflow *models.Workflow, step models.WorkflowStep, stepMap map[string]models.WorkflowStep, doneChans, failedChans map[string]chan struct{}, slots chan struct{}, errCh chan<- error) {
+	succeeded := false
+	defer func() {
+		if succeeded {
+			close(doneChans[step.Name])
+		} else {
+			close(failedChans[step.Name])
+		}
+	}()
+
 	for _, dep := range step.DependsOn {
 		select {
 		case <-doneChans[dep]:
+		case <-failedChans[dep]:
+			errCh <- e.skipStep(runID, workflow, step, fmt.Sprintf("upstream step %s did not succeed", dep))
+			return
+		case <-ctx.Done():
+			errCh <- ctx.Err()
+			return
+		}
+	}
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
 		case <-ctx.Done():
 			errCh <- ctx.Err()
 			return
@@ -148,11 +387,12 @@ func (e *Engine) executeStep(ctx context.Context, runID int64, step models.Workf
 	}
 
 	stepRun := &models.StepRun{
-		RunID:    runID,
-		StepName: step.Name,
-		Status:   models.StepStatusPending,
-		Attempt:  0,
-		Logs:     []string{},
+		RunID:     runID,
+		StepName:  step.Name,
+		Status:    models.StepStatusPending,
+		Attempt:   0,
+		StartedAt: time.Now(),
+		Logs:      []string{},
 	}
 	stepRunID, err := e.db.InsertStepRun(stepRun)
 	if err != nil {
@@ -166,10 +406,13 @@ func (e *Engine) executeStep(ctx context.Context, runID int64, step models.Workf
 		return
 	}
 
+	policy := step.RetryPolicy()
 	var lastErr error
-	for attempt := 0; attempt <= step.Retries; attempt++ {
+	for attempt := 0; attempt <= policy.MaxRetries; attempt++ {
 		stepRun.Attempt = attempt
 		if attempt > 0 {
+			delay := withJitter(policy.BackoffDelay(attempt), policy.Jitter)
+			stepRun.Logs = append(stepRun.Logs, fmt.Sprintf("[gork] attempt %d of %d in %s", attempt+1, policy.MaxRetries+1, delay.Round(time.Millisecond)))
 			e.mu.Lock()
 			if err := e.db.UpdateStepRun(stepRunID, models.StepStatusRetrying, nil, "", stepRun.Logs); err != nil {
 				e.mu.Unlock()
@@ -178,39 +421,116 @@ func (e *Engine) executeStep(ctx context.Context, runID int64, step models.Workf
 			}
 			e.mu.Unlock()
 			select {
-			case <-time.After(step.RetryDelay):
+			case <-time.After(delay):
 			case <-ctx.Done():
+				completedAt := time.Now()
+				status := stoppedStatus(ctx)
+				e.mu.Lock()
+				if err := e.db.UpdateStepRun(stepRunID, status, &completedAt, ctx.Err().Error(), stepRun.Logs); err != nil {
+					e.mu.Unlock()
+					errCh <- fmt.Errorf("failed to update step run: %w", err)
+					return
+				}
+				e.mu.Unlock()
+				metrics.StepsTotal.Inc(workflow.Name, step.Name, string(status))
 				errCh <- ctx.Err()
 				return
 			}
 		}
 
 		stepCtx := ctx
-		var cancel context.CancelFunc
+		cancel := context.CancelFunc(func() {})
 		if step.Timeout > 0 {
 			stepCtx, cancel = context.WithTimeout(ctx, time.Duration(step.Timeout))
-			defer cancel()
 		}
 
-		logs, err := runner.RunStep(stepCtx, resolvedStep)
-		stepRun.Logs = append(stepRun.Logs, logs...)
+		stepAttempt := &models.StepAttempt{
+			StepRunID: stepRunID,
+			RunID:     runID,
+			Attempt:   attempt,
+			Status:    models.StepStatusRunning,
+			StartedAt: time.Now(),
+		}
+		e.mu.Lock()
+		attemptID, err := e.db.InsertStepAttempt(stepAttempt)
+		e.mu.Unlock()
+		if err != nil {
+			cancel()
+			errCh <- fmt.Errorf("failed to insert step attempt: %w", err)
+			return
+		}
 
-		if e.verboseLogs && len(logs) > 0 {
-			slog.Info("Step output", "step", step.Name, "attempt", attempt+1)
-			for _, line := range logs {
-				fmt.Printf("  [%s] %s\n", step.Name, line)
+		attemptCtx, span := tracing.Start(stepCtx, "step "+step.Name, tracing.KindInternal,
+			tracing.String("gork.workflow", workflow.Name),
+			tracing.Int("gork.run_id", runID),
+			tracing.String("gork.step", step.Name),
+			tracing.Int("gork.step.attempt", int64(attempt+1)),
+		)
+		remote := len(step.RunsOn) > 0
+		logs, err := e.runStep(attemptCtx, stepRunID, resolvedStep)
+		// A step stopped because the whole run ended is canceled, not timed
+		// out, even if the run ended by reaching its own deadline.
+		canceled := ctx.Err() != nil
+		timedOut := !canceled && stepCtx.Err() == context.DeadlineExceeded
+		cancel()
+		attemptCompletedAt := time.Now()
+
+		retry := false
+		if err != nil && !canceled && attempt < policy.MaxRetries {
+			var reason string
+			if reason, retry = retryReason(policy, err, logs, timedOut); retry {
+				logs = append(logs, fmt.Sprintf("[gork] attempt %d failed; retrying (%s)", attempt+1, reason))
+				metrics.StepRetries.Inc(workflow.Name, step.Name)
+				e.emit(workflow, models.Event{Type: models.EventStepRetried, RunID: runID, Step: step.Name, Attempt: attempt + 1, Error: err.Error()})
+			} else {
+				logs = append(logs, fmt.Sprintf("[gork] attempt %d failed; not retrying (no retry_on condition matched)", attempt+1))
 			}
-			os.Stdout.Sync()
 		}
+		stepRun.Logs = append(stepRun.Logs, logs...)
 
+		attemptStatus, attemptErr := models.StepStatusSuccess, ""
+		if err != nil {
+			attemptStatus, attemptErr = models.StepStatusFailed, err.Error()
+			if canceled {
+				attemptStatus = stoppedStatus(ctx)
+			} else if timedOut {
+				attemptStatus = models.StepStatusTimeout
+			}
+		}
+		metrics.StepDuration.Observe(attemptCompletedAt.Sub(stepAttempt.StartedAt).Seconds(), workflow.Name, step.Name, string(attemptStatus))
+		span.SetAttributes(tracing.String("gork.step.status", string(attemptStatus)))
+		if code := exitCode(step, err); code != nil {
+			span.SetAttributes(tracing.Int("gork.step.exit_code", int64(*code)))
+		}
+		span.SetError(err)
+		span.Finish()
 		e.mu.Lock()
-		if err := e.db.AppendLogs(stepRunID, logs); err != nil {
+		if err := e.db.UpdateStepAttempt(attemptID, attemptStatus, &attemptCompletedAt, exitCode(step, err), attemptErr, logs); err != nil {
 			e.mu.Unlock()
-			errCh <- fmt.Errorf("failed to append logs: %w", err)
+			errCh <- fmt.Errorf("failed to update step attempt: %w", err)
 			return
 		}
 		e.mu.Unlock()
 
+		// Remote steps have already written and printed their output as
+		// it arrived.
+		if !remote {
+			e.printLogs(step.Name, attempt, logs)
+			if e.output != nil && step.ActionType() == models.StepTypeHTTP {
+				for _, line := range logs {
+					e.output(step.Name, line)
+				}
+			}
+
+			e.mu.Lock()
+			if err := e.db.AppendLogs(stepRunID, logs); err != nil {
+				e.mu.Unlock()
+				errCh <- fmt.Errorf("failed to append logs: %w", err)
+				return
+			}
+			e.mu.Unlock()
+		}
+
 		if err == nil {
 			if err := e.storeStepOutputs(runID, step, logs); err != nil {
 				errCh <- fmt.Errorf("failed to store step outputs: %w", err)
@@ -225,19 +545,17 @@ func (e *Engine) executeStep(ctx context.Context, runID int64, step models.Workf
 				return
 			}
 			e.mu.Unlock()
+			metrics.StepsTotal.Inc(workflow.Name, step.Name, string(models.StepStatusSuccess))
 			break
 		}
 
 		lastErr = err
-		if attempt < step.Retries {
+		if retry {
 			continue
 		}
 
 		completedAt := time.Now()
-		status := models.StepStatusFailed
-		if stepCtx.Err() == context.DeadlineExceeded {
-			status = models.StepStatusTimeout
-		}
+		status := attemptStatus
 		e.mu.Lock()
 		if err := e.db.UpdateStepRun(stepRunID, status, &completedAt, lastErr.Error(), stepRun.Logs); err != nil {
 			e.mu.Unlock()
@@ -245,14 +563,39 @@ func (e *Engine) executeStep(ctx context.Context, runID int64, step models.Workf
 			return
 		}
 		e.mu.Unlock()
+		metrics.StepsTotal.Inc(workflow.Name, step.Name, string(status))
+		if !canceled {
+			e.emit(workflow, models.Event{Type: models.EventStepFailed, RunID: runID, Step: step.Name, Attempt: attempt + 1, Status: string(status), Error: lastErr.Error()})
+		}
 		errCh <- fmt.Errorf("step %s failed: %w", step.Name, lastErr)
 		return
 	}
 
-	close(doneChans[step.Name])
+	succeeded = true
 	errCh <- nil
 }
 
+// skipStep records a step run for a step that will not run because of
+// reason.
+func (e *Engine) skipStep(runID int64, workflow *models.Workflow, step models.WorkflowStep, reason string) error {
+	stepRun := &models.StepRun{
+		RunID:       runID,
+		StepName:    step.Name,
+		Status:      models.StepStatusSkipped,
+		CompletedAt: time.Now(),
+		Error:       reason,
+		Logs:        []string{},
+	}
+	e.mu.Lock()
+	_, err := e.db.InsertStepRun(stepRun)
+	e.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to insert step run: %w", err)
+	}
+	metrics.StepsTotal.Inc(workflow.Name, step.Name, string(models.StepStatusSkipped))
+	return nil
+}
+
 func topologicalSort(steps map[string]models.WorkflowStep) ([]string, error) {
 	inDegree := make(map[string]int)
 	graph := make(map[string][]string)
@@ -328,6 +671,52 @@ func (e *Engine) resolveStepInputs(runID int64, step models.WorkflowStep) (model
 	return resolvedStep, nil
 }
 
+// runStep runs step locally, or on a worker if it has runs_on labels. Output
+// of remote steps is appended to the step run as it arrives.
+func (e *Engine) runStep(ctx context.Context, stepRunID int64, step models.WorkflowStep) ([]string, error) {
+	if len(step.RunsOn) == 0 {
+		var sink runner.LogSink
+		if e.output != nil {
+			sink = func(line string) { e.output(step.Name, line) }
+		}
+		return runner.RunStepStreaming(ctx, step, sink)
+	}
+	if e.remote == nil {
+		return nil, fmt.Errorf("step needs a worker labeled %s, but workers are not enabled", strings.Join(step.RunsOn, ", "))
+	}
+
+	return e.remote.RunStep(ctx, step, func(lines []string) {
+		e.mu.Lock()
+		err := e.db.AppendLogs(stepRunID, lines)
+		e.mu.Unlock()
+		if err != nil {
+			slog.Error("Failed to append step logs", "step", step.Name, "error", err)
+		}
+		if e.output != nil {
+			for _, line := range lines {
+				e.output(step.Name, line)
+			}
+		}
+		if e.verboseLogs {
+			for _, line := range lines {
+				fmt.Printf("  [%s] %s\n", step.Name, line)
+			}
+			os.Stdout.Sync()
+		}
+	})
+}
+
+func (e *Engine) printLogs(stepName string, attempt int, logs []string) {
+	if !e.verboseLogs || len(logs) == 0 {
+		return
+	}
+	slog.Info("Step output", "step", stepName, "attempt", attempt+1)
+	for _, line := range logs {
+		fmt.Printf("  [%s] %s\n", stepName, line)
+	}
+	os.Stdout.Sync()
+}
+
 func (e *Engine) storeStepOutputs(runID int64, step models.WorkflowStep, logs []string) error {
 	for _, log := range logs {
 		if strings.HasPrefix(log, "HTTP_STATUS:") {
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// newTestEngine returns an engine on an in-memory database holding w.
+func newTestEngine(t *testing.T, w *models.Workflow) (*Engine, *db.DB) {
+	t.Helper()
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(w.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.ID = stored.ID
+	return NewEngine(database), database
+}
+
+func shStep(name, script string, dependsOn ...string) models.WorkflowStep {
+	return models.WorkflowStep{
+		Name:      name,
+		DependsOn: dependsOn,
+		Exec:      &models.ExecAction{Command: "sh", Args: []string{"-c", script}},
+	}
+}
+
+func stepStatuses(t *testing.T, database *db.DB, runID int64) map[string]models.StepStatus {
+	t.Helper()
+	stepRuns, err := database.GetStepRuns(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]models.StepStatus, len(stepRuns))
+	for _, sr := range stepRuns {
+		statuses[sr.StepName] = sr.Status
+	}
+	return statuses
+}
+
+func TestFailedStepOnlySkipsItsDependents(t *testing.T) {
+	w := &models.Workflow{Name: "branches", Steps: []models.WorkflowStep{
+		shStep("extract", "exit 1"),
+		shStep("load", "echo load", "extract"),
+		shStep("report", "echo report", "load"),
+		shStep("cleanup", "sleep 0.2; echo cleanup"),
+	}}
+	eng, database := newTestEngine(t, w)
+
+	run, err := eng.ExecuteWorkflow(context.Background(), w, "test")
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	if run.Status != models.RunStatusFailed {
+		t.Fatalf("run status = %s, want failed", run.Status)
+	}
+
+	want := map[string]models.StepStatus{
+		"extract": models.StepStatusFailed,
+		"load":    models.StepStatusSkipped,
+		"report":  models.StepStatusSkipped,
+		"cleanup": models.StepStatusSuccess,
+	}
+	got := stepStatuses(t, database, run.ID)
+	for name, status := range want {
+		if got[name] != status {
+			t.Errorf("step %s = %s, want %s", name, got[name], status)
+		}
+	}
+}
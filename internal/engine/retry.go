@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kingoftac/gork/internal/models"
+	"github.com/kingoftac/gork/internal/runner"
+)
+
+// retryReason reports whether a failed attempt should be retried under the
+// policy and, if so, which condition matched.
+func retryReason(policy models.RetryPolicy, err error, logs []string, timedOut bool) (string, bool) {
+	conditions := policy.RetryOn
+	if conditions == nil {
+		return "any failure", true
+	}
+
+	if timedOut && conditions.Timeout {
+		return "timeout", true
+	}
+
+	var exitErr exitCoder
+	if errors.As(err, &exitErr) && slices.Contains(conditions.ExitCodes, exitErr.ExitCode()) {
+		return fmt.Sprintf("exit code %d", exitErr.ExitCode()), true
+	}
+
+	var statusErr *runner.HTTPStatusError
+	if errors.As(err, &statusErr) && conditions.MatchesHTTPStatus(statusErr.StatusCode) {
+		return fmt.Sprintf("http status %d", statusErr.StatusCode), true
+	}
+
+	if conditions.Output != "" {
+		// The pattern was compiled during validation, so it cannot fail here.
+		re := regexp.MustCompile(conditions.Output)
+		if re.MatchString(strings.Join(logs, "\n")) {
+			return "output matched " + conditions.Output, true
+		}
+	}
+
+	return "", false
+}
+
+// withJitter spreads delay randomly by up to ±jitter of its length.
+func withJitter(delay time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	spread := float64(delay) * jitter
+	return delay + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// exitCoder is implemented by *exec.ExitError and by the errors of steps run
+// on a worker agent.
+type exitCoder interface {
+	ExitCode() int
+}
+
+// exitCode returns the exit code of an exec or script attempt, or nil when
+// the step is not a command or err did not come from the process exiting.
+func exitCode(step models.WorkflowStep, err error) *int {
+	if step.ActionType() == models.StepTypeHTTP {
+		return nil
+	}
+	code := 0
+	if err != nil {
+		var exitErr exitCoder
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+			return nil
+		}
+		code = exitErr.ExitCode()
+	}
+	return &code
+}
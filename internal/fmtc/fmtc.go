@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"strings"
+
+	"golang.org/x/term"
 )
 
 const (
@@ -99,8 +101,23 @@ var aliases = map[string]string{
 	"{bg:default}":        DEFAULT_BG,
 }
 
+// enabled reports whether the aliases expand to escape codes. It is off
+// when NO_COLOR is set (https://no-color.org), TERM is dumb or stdout is not
+// a terminal, so that piped output stays plain.
+var enabled = detect()
+
+func detect() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
 func expandColors(format string) string {
 	for k, v := range aliases {
+		if !enabled {
+			v = ""
+		}
 		format = strings.ReplaceAll(format, k, v)
 	}
 	return format
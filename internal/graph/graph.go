@@ -0,0 +1,313 @@
+// Package graph renders the step dependency graph of a workflow as Graphviz
+// DOT, a Mermaid flowchart or plain text, optionally showing how each step
+// fared in one run.
+package graph
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kingoftac/gork/internal/models"
+)
+
+type Format string
+
+const (
+	FormatDOT     Format = "dot"
+	FormatMermaid Format = "mermaid"
+	FormatASCII   Format = "ascii"
+)
+
+// Formats lists every format Write supports.
+var Formats = []Format{FormatDOT, FormatMermaid, FormatASCII}
+
+// notRun is shown for steps that have no step run, because the run ended
+// before reaching them.
+const notRun = "not run"
+
+// Graph is the dependency graph of a workflow and, if a run is given, the
+// latest step run of each of its steps.
+type Graph struct {
+	workflow *models.Workflow
+	run      *models.Run
+	steps    map[string]models.StepRun
+}
+
+// New returns the graph of w. run and stepRuns may be nil to render the
+// workflow without run state.
+func New(w *models.Workflow, run *models.Run, stepRuns []models.StepRun) *Graph {
+	g := &Graph{workflow: w, run: run, steps: make(map[string]models.StepRun)}
+	for _, sr := range stepRuns {
+		if prev, ok := g.steps[sr.StepName]; !ok || sr.ID > prev.ID {
+			g.steps[sr.StepName] = sr
+		}
+	}
+	return g
+}
+
+// edge is a dependency between two steps, labelled with the outputs of From
+// that To reads as inputs. Data edges are inputs read from a step that is
+// not a direct dependency.
+type edge struct {
+	from, to string
+	labels   []string
+	data     bool
+}
+
+func (g *Graph) edges() []edge {
+	var edges []edge
+	for _, step := range g.workflow.Steps {
+		flows := make(map[string][]string)
+		for input, spec := range step.Inputs {
+			source, output, ok := strings.Cut(spec, ".")
+			if ok {
+				flows[source] = append(flows[source], output+" → "+input)
+			}
+		}
+		for _, dep := range step.DependsOn {
+			edges = append(edges, edge{from: dep, to: step.Name, labels: sorted(flows[dep])})
+			delete(flows, dep)
+		}
+		sources := make([]string, 0, len(flows))
+		for source := range flows {
+			sources = append(sources, source)
+		}
+		slices.Sort(sources)
+		for _, source := range sources {
+			edges = append(edges, edge{from: source, to: step.Name, labels: sorted(flows[source]), data: true})
+		}
+	}
+	return edges
+}
+
+func sorted(s []string) []string {
+	slices.Sort(s)
+	return s
+}
+
+// Write renders the graph to w in format.
+func (g *Graph) Write(w io.Writer, format Format) error {
+	switch format {
+	case FormatDOT:
+		return g.writeDOT(w)
+	case FormatMermaid:
+		return g.writeMermaid(w)
+	case FormatASCII:
+		return g.writeASCII(w)
+	}
+	return fmt.Errorf("unknown graph format %q", format)
+}
+
+// status returns the status of step in the run and how long it took, or
+// the step's action type if there is no run.
+func (g *Graph) status(step models.WorkflowStep) (status, duration string) {
+	if g.run == nil {
+		return string(step.ActionType()), ""
+	}
+	sr, ok := g.steps[step.Name]
+	if !ok {
+		return notRun, ""
+	}
+	if !sr.StartedAt.IsZero() && !sr.CompletedAt.IsZero() {
+		duration = formatDuration(sr.CompletedAt.Sub(sr.StartedAt))
+	}
+	if n := len(sr.Attempts); n > 1 {
+		if duration != "" {
+			duration += ", "
+		}
+		duration += fmt.Sprintf("%d attempts", n)
+	}
+	return string(sr.Status), duration
+}
+
+func formatDuration(d time.Duration) string {
+	if d < 10*time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+func (g *Graph) title() string {
+	if g.run == nil {
+		return g.workflow.Name
+	}
+	return fmt.Sprintf("%s, run %d: %s", g.workflow.Name, g.run.ID, g.run.Status)
+}
+
+// colors are the fill and border of a node for each step status.
+var colors = map[string][2]string{
+	string(models.StepStatusSuccess):     {"#c8e6c9", "#2e7d32"},
+	string(models.StepStatusFailed):      {"#ffcdd2", "#c62828"},
+	string(models.StepStatusTimeout):     {"#ffe0b2", "#ef6c00"},
+	string(models.StepStatusRunning):     {"#bbdefb", "#1565c0"},
+	string(models.StepStatusRetrying):    {"#bbdefb", "#1565c0"},
+	string(models.StepStatusInterrupted): {"#fff9c4", "#f9a825"},
+	string(models.StepStatusPending):     {"#eeeeee", "#757575"},
+	string(models.StepStatusCanceled):    {"#eeeeee", "#757575"},
+	string(models.StepStatusSkipped):     {"#eeeeee", "#757575"},
+	notRun:                               {"#ffffff", "#9e9e9e"},
+}
+
+func nodeColors(status string) (fill, stroke string) {
+	if c, ok := colors[status]; ok {
+		return c[0], c[1]
+	}
+	return "#ffffff", "#424242"
+}
+
+func (g *Graph) writeDOT(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(g.workflow.Name))
+	fmt.Fprintf(&b, "  label=%s;\n  labelloc=t;\n  rankdir=LR;\n", dotQuote(g.title()))
+	b.WriteString("  node [shape=box, style=\"rounded,filled\", fillcolor=\"#ffffff\", fontname=\"Helvetica\"];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=10];\n")
+
+	for _, step := range g.workflow.Steps {
+		status, duration := g.status(step)
+		label := step.Name + "\n" + status
+		if duration != "" {
+			label += " (" + duration + ")"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s", dotQuote(step.Name), dotQuote(label))
+		if g.run != nil {
+			fill, stroke := nodeColors(status)
+			fmt.Fprintf(&b, ", fillcolor=%s, color=%s", dotQuote(fill), dotQuote(stroke))
+			if status == notRun {
+				b.WriteString(", style=\"rounded,dashed\"")
+			}
+		}
+		b.WriteString("];\n")
+	}
+
+	for _, e := range g.edges() {
+		fmt.Fprintf(&b, "  %s -> %s", dotQuote(e.from), dotQuote(e.to))
+		var attrs []string
+		if len(e.labels) > 0 {
+			attrs = append(attrs, "label="+dotQuote(strings.Join(e.labels, "\n")))
+		}
+		if e.data {
+			attrs = append(attrs, "style=dashed")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+func (g *Graph) writeMermaid(w io.Writer) error {
+	ids := make(map[string]string, len(g.workflow.Steps))
+	for i, step := range g.workflow.Steps {
+		ids[step.Name] = fmt.Sprintf("s%d", i)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "---\ntitle: %q\n---\nflowchart LR\n", g.title())
+
+	classes := make(map[string][]string)
+	var classOrder []string
+	for _, step := range g.workflow.Steps {
+		status, duration := g.status(step)
+		label := step.Name + "<br/>" + status
+		if duration != "" {
+			label += " (" + duration + ")"
+		}
+		fmt.Fprintf(&b, "  %s[\"%s\"]\n", ids[step.Name], mermaidEscape(label))
+		if g.run != nil {
+			class := strings.ReplaceAll(status, " ", "_")
+			if _, ok := classes[class]; !ok {
+				classOrder = append(classOrder, class)
+			}
+			classes[class] = append(classes[class], ids[step.Name])
+		}
+	}
+
+	for _, e := range g.edges() {
+		from, ok := ids[e.from]
+		if !ok {
+			continue
+		}
+		arrow := "-->"
+		if e.data {
+			arrow = "-.->"
+		}
+		if len(e.labels) > 0 {
+			fmt.Fprintf(&b, "  %s %s|\"%s\"| %s\n", from, arrow, mermaidEscape(strings.Join(e.labels, "<br/>")), ids[e.to])
+		} else {
+			fmt.Fprintf(&b, "  %s %s %s\n", from, arrow, ids[e.to])
+		}
+	}
+
+	for _, class := range classOrder {
+		fill, stroke := nodeColors(strings.ReplaceAll(class, "_", " "))
+		style := ""
+		if class == "not_run" {
+			style = ",stroke-dasharray:4 4"
+		}
+		fmt.Fprintf(&b, "  classDef %s fill:%s,stroke:%s%s\n", class, fill, stroke, style)
+		fmt.Fprintf(&b, "  class %s %s\n", strings.Join(classes[class], ","), class)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidEscape replaces the characters that end a quoted Mermaid label with
+// entity codes.
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s)
+}
+
+// writeASCII lists the steps level by level, each with the steps it waits
+// for and the data it reads from them.
+func (g *Graph) writeASCII(w io.Writer) error {
+	incoming := make(map[string][]string)
+	for _, e := range g.edges() {
+		in := e.from
+		if len(e.labels) > 0 {
+			in += " [" + strings.Join(e.labels, ", ") + "]"
+		}
+		if e.data {
+			in += " (data only)"
+		}
+		incoming[e.to] = append(incoming[e.to], in)
+	}
+	steps := make(map[string]models.WorkflowStep, len(g.workflow.Steps))
+	for _, s := range g.workflow.Steps {
+		steps[s.Name] = s
+	}
+
+	if _, err := fmt.Fprintf(w, "%s\n\n", g.title()); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, level := range g.workflow.Levels() {
+		for j, name := range level {
+			prefix := "   "
+			if j == 0 {
+				prefix = fmt.Sprintf("%2d ", i+1)
+			}
+			status, duration := g.status(steps[name])
+			after := ""
+			if in := incoming[name]; len(in) > 0 {
+				after = "← " + strings.Join(in, ", ")
+			}
+			fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\n", prefix, name, status, duration, after)
+		}
+	}
+	return tw.Flush()
+}
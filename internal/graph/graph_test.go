@@ -0,0 +1,84 @@
+package graph
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kingoftac/gork/internal/models"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func testWorkflow() *models.Workflow {
+	return &models.Workflow{Name: "etl", Steps: []models.WorkflowStep{
+		{Name: "extract", Exec: &models.ExecAction{Command: "echo"}, Outputs: map[string]string{"rows": "ROWS:", "path": "PATH:"}},
+		{Name: "transform", DependsOn: []string{"extract"}, Script: &models.ScriptAction{}, Inputs: map[string]string{
+			"ROWS": "extract.rows",
+			"FILE": "extract.path",
+		}},
+		{Name: "load", DependsOn: []string{"transform"}, Exec: &models.ExecAction{Command: "echo"}, Inputs: map[string]string{
+			"ROWS": "extract.rows",
+		}},
+		{Name: `notify "team"`, DependsOn: []string{"load"}, HTTP: &models.HTTPAction{Method: "POST", URL: "http://example.com"}},
+		{Name: "audit", Exec: &models.ExecAction{Command: "echo"}},
+	}}
+}
+
+func testRun() (*models.Run, []models.StepRun) {
+	start := time.Date(2024, 9, 1, 6, 0, 0, 0, time.UTC)
+	run := &models.Run{ID: 7, Status: models.RunStatusFailed}
+	stepRuns := []models.StepRun{
+		{ID: 1, StepName: "extract", Status: models.StepStatusSuccess, StartedAt: start, CompletedAt: start.Add(1500 * time.Millisecond)},
+		// Only the latest step run of a step is shown.
+		{ID: 2, StepName: "transform", Status: models.StepStatusFailed, StartedAt: start, CompletedAt: start.Add(time.Second)},
+		{ID: 4, StepName: "transform", Status: models.StepStatusSuccess, StartedAt: start, CompletedAt: start.Add(42 * time.Second),
+			Attempts: []models.StepAttempt{{Attempt: 0}, {Attempt: 1}}},
+		{ID: 5, StepName: "load", Status: models.StepStatusFailed, StartedAt: start, CompletedAt: start.Add(3 * time.Second)},
+		{ID: 3, StepName: "audit", Status: models.StepStatusRunning, StartedAt: start},
+	}
+	return run, stepRuns
+}
+
+func TestWrite(t *testing.T) {
+	run, stepRuns := testRun()
+	for _, format := range Formats {
+		for _, tt := range []struct {
+			name  string
+			graph *Graph
+		}{
+			{"etl", New(testWorkflow(), nil, nil)},
+			{"etl-run", New(testWorkflow(), run, stepRuns)},
+		} {
+			t.Run(tt.name+"."+string(format), func(t *testing.T) {
+				var b bytes.Buffer
+				if err := tt.graph.Write(&b, format); err != nil {
+					t.Fatal(err)
+				}
+
+				golden := filepath.Join("testdata", tt.name+"."+string(format))
+				if *update {
+					if err := os.WriteFile(golden, b.Bytes(), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := b.String(); got != string(want) {
+					t.Errorf("output differs from %s (rerun with -update to accept it):\n%s", golden, got)
+				}
+			})
+		}
+	}
+}
+
+func TestWriteUnknownFormat(t *testing.T) {
+	if err := New(testWorkflow(), nil, nil).Write(&bytes.Buffer{}, "svg"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,163 @@
+package lease
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// TTL is how long a lease lasts without being renewed. Leases are renewed
+// several times per TTL, so a daemon is only considered gone once it has
+// missed a few heartbeats.
+const TTL = 15 * time.Second
+
+// renewInterval is how often leases are renewed; tests shorten it.
+var renewInterval = TTL / 3
+
+// Elector keeps a daemon's own lease alive and competes with the other
+// daemons sharing the database for the leader lease. Every daemon executes
+// queued runs; only the leader schedules them.
+type Elector struct {
+	db    *db.DB
+	owner string
+}
+
+func NewElector(db *db.DB, owner string) *Elector {
+	return &Elector{db: db, owner: owner}
+}
+
+func (e *Elector) daemonLease() string {
+	return models.DaemonLeasePrefix + e.owner
+}
+
+// Register takes the daemon's own lease. It should be called before the
+// daemon claims any runs, so that other daemons do not treat them as
+// orphaned.
+func (e *Elector) Register() error {
+	_, err := e.db.AcquireLease(e.daemonLease(), e.owner, TTL)
+	return err
+}
+
+// Unregister releases the daemon's own lease once it has stopped all of its
+// runs.
+func (e *Elector) Unregister() {
+	if err := e.db.ReleaseLease(e.daemonLease(), e.owner); err != nil {
+		slog.Error("Failed to release daemon lease", "component", "lease", "owner", e.owner, "error", err)
+	}
+}
+
+// Run renews the daemon's lease and, whenever this daemon holds the leader
+// lease, runs lead with a context that is canceled once leadership is lost.
+// It returns after ctx is canceled and lead has returned.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	var (
+		// stop is set while this daemon is leader.
+		stop      func()
+		standby   bool
+		renewedAt time.Time
+	)
+	stepDown := func() {
+		stop()
+		stop = nil
+		if err := e.db.ReleaseLease(models.LeaderLease, e.owner); err != nil {
+			slog.Error("Failed to release leader lease", "component", "lease", "owner", e.owner, "error", err)
+		}
+	}
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := e.db.AcquireLease(e.daemonLease(), e.owner, TTL); err != nil {
+			slog.Error("Failed to renew daemon lease", "component", "lease", "owner", e.owner, "error", err)
+		}
+
+		acquired, err := e.db.AcquireLease(models.LeaderLease, e.owner, TTL)
+		switch {
+		case err != nil:
+			slog.Error("Failed to acquire leader lease", "component", "lease", "owner", e.owner, "error", err)
+		case acquired:
+			renewedAt = time.Now()
+		}
+
+		// A leader that cannot renew its lease steps down before the lease
+		// expires, since another daemon may take over once it does.
+		if stop != nil && (err == nil && !acquired || time.Since(renewedAt) >= TTL-renewInterval) {
+			slog.Warn("Lost leadership", "component", "lease", "owner", e.owner)
+			stepDown()
+		}
+
+		if stop == nil && err == nil && !acquired && !standby {
+			slog.Info("Another daemon is leader, standing by to schedule", "component", "lease", "owner", e.owner)
+			standby = true
+		}
+
+		if stop == nil && acquired {
+			slog.Info("Acquired leadership", "component", "lease", "owner", e.owner)
+			standby = false
+			stop = start(ctx, lead)
+		}
+
+		select {
+		case <-ctx.Done():
+			if stop != nil {
+				stepDown()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Hold takes the lease name for holder and keeps renewing it in the
+// background until the returned function is called, which releases it. It is
+// for processes other than daemons that own runs, such as gorkctl exec.
+func Hold(db *db.DB, name, holder string) (func(), error) {
+	if _, err := db.AcquireLease(name, holder, TTL); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(renewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := db.AcquireLease(name, holder, TTL); err != nil {
+				slog.Error("Failed to renew lease", "component", "lease", "lease", name, "error", err)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		if err := db.ReleaseLease(name, holder); err != nil {
+			slog.Error("Failed to release lease", "component", "lease", "lease", name, "error", err)
+		}
+	}, nil
+}
+
+// start runs fn in a goroutine and returns a function that cancels it and
+// waits for it to return.
+func start(ctx context.Context, fn func(ctx context.Context)) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
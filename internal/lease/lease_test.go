@@ -0,0 +1,173 @@
+package lease
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func getLease(t *testing.T, database *db.DB, name string) models.Lease {
+	t.Helper()
+	leases, err := database.ListLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range leases {
+		if l.Name == name {
+			return l
+		}
+	}
+	t.Fatalf("lease %s does not exist", name)
+	return models.Lease{}
+}
+
+func acquire(t *testing.T, database *db.DB, holder string, ttl time.Duration) bool {
+	t.Helper()
+	acquired, err := database.AcquireLease("test", holder, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acquired
+}
+
+func TestAcquireLease(t *testing.T) {
+	database := newTestDB(t)
+
+	if !acquire(t, database, "a", 100*time.Millisecond) {
+		t.Fatal("a could not take a free lease")
+	}
+	first := getLease(t, database, "test")
+	if acquire(t, database, "b", time.Minute) {
+		t.Fatal("b took a lease a holds")
+	}
+
+	// Renewing keeps the time the lease was first acquired.
+	if !acquire(t, database, "a", 100*time.Millisecond) {
+		t.Fatal("a could not renew its lease")
+	}
+	renewed := getLease(t, database, "test")
+	if !renewed.AcquiredAt.Equal(first.AcquiredAt) || !renewed.ExpiresAt.After(first.ExpiresAt) {
+		t.Fatalf("renewed lease %+v, want the acquired time of %+v kept and the expiry extended", renewed, first)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !acquire(t, database, "b", time.Minute) {
+		t.Fatal("b could not take over an expired lease")
+	}
+	taken := getLease(t, database, "test")
+	if taken.Holder != "b" || !taken.AcquiredAt.After(first.AcquiredAt) {
+		t.Fatalf("lease after takeover = %+v, want held by b since the takeover", taken)
+	}
+	if acquire(t, database, "a", time.Minute) {
+		t.Fatal("a took back a lease b holds")
+	}
+
+	// Only the holder can release a lease.
+	if err := database.ReleaseLease("test", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if getLease(t, database, "test").Holder != "b" {
+		t.Fatal("a released b's lease")
+	}
+}
+
+// shortenRenewals makes electors renew their leases every few milliseconds.
+func shortenRenewals(t *testing.T) {
+	old := renewInterval
+	renewInterval = 10 * time.Millisecond
+	t.Cleanup(func() { renewInterval = old })
+}
+
+// runElector runs an elector for owner until the test ends and returns a
+// channel that receives the context of each term it leads.
+func runElector(t *testing.T, database *db.DB, owner string) (chan context.Context, context.CancelFunc) {
+	t.Helper()
+	terms := make(chan context.Context, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewElector(database, owner).Run(ctx, func(ctx context.Context) {
+			terms <- ctx
+			<-ctx.Done()
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return terms, func() {
+		cancel()
+		<-done
+	}
+}
+
+func waitTerm(t *testing.T, terms chan context.Context, owner string) context.Context {
+	t.Helper()
+	select {
+	case ctx := <-terms:
+		return ctx
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s did not become leader", owner)
+		return nil
+	}
+}
+
+func TestElectorHasOneLeader(t *testing.T) {
+	shortenRenewals(t)
+	database := newTestDB(t)
+
+	aTerms, stopA := runElector(t, database, "a")
+	term := waitTerm(t, aTerms, "a")
+	bTerms, _ := runElector(t, database, "b")
+
+	select {
+	case <-bTerms:
+		t.Fatal("b led while a held the leader lease")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a steps down when it stops and releases the lease for b.
+	stopA()
+	if term.Err() == nil {
+		t.Fatal("a's term did not end when it stopped")
+	}
+	waitTerm(t, bTerms, "b")
+	if l := getLease(t, database, models.LeaderLease); l.Holder != "b" {
+		t.Fatalf("leader lease held by %s, want b", l.Holder)
+	}
+}
+
+func TestElectorStepsDownWhenLeaseIsLost(t *testing.T) {
+	shortenRenewals(t)
+	database := newTestDB(t)
+
+	terms, _ := runElector(t, database, "a")
+	term := waitTerm(t, terms, "a")
+
+	// Another daemon took the lease, as if a had missed renewing it.
+	if _, err := database.Exec(`UPDATE leases SET holder = 'b', expires_at = ? WHERE name = ?`, time.Now().UTC().Add(time.Hour), models.LeaderLease); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-term.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("a kept leading after losing the leader lease")
+	}
+	if l := getLease(t, database, models.LeaderLease); l.Holder != "b" {
+		t.Fatalf("a released the lease b took; it is held by %q", l.Holder)
+	}
+}
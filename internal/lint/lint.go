@@ -0,0 +1,390 @@
+// Package lint checks workflow files and reports every problem it finds with
+// its position in the file, rather than only the first as loading a workflow
+// does.
+package lint
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kingoftac/gork/internal/models"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is one problem in a workflow file. Line and Column start at 1
+// and are 0 if the position is not known.
+type Diagnostic struct {
+	File     string
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+}
+
+// Position returns the file, line and column as "file:line:column", leaving
+// out what is not known.
+func (d Diagnostic) Position() string {
+	pos := d.File
+	if d.Line > 0 {
+		pos += ":" + strconv.Itoa(d.Line)
+		if d.Column > 0 {
+			pos += ":" + strconv.Itoa(d.Column)
+		}
+	}
+	return pos
+}
+
+// String formats d like a compiler message, e.g.
+// "workflows/etl.yml:12:5: warning: unknown key "depends-on" is ignored".
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Position(), d.Severity, d.Message)
+}
+
+// HasErrors reports whether any of diags is an error rather than a warning.
+func HasErrors(diags []Diagnostic) bool {
+	return slices.ContainsFunc(diags, func(d Diagnostic) bool { return d.Severity == SeverityError })
+}
+
+// File lints the workflow file at path. It only returns an error if the file
+// cannot be read.
+func File(path string) ([]Diagnostic, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Lint(path, data), nil
+}
+
+// Lint checks the workflow in data, read from file. It reports YAML syntax
+// and type errors, unknown keys, everything Workflow.ValidateAll finds, inputs
+// that read outputs which no upstream step declares, and exec commands that
+// do not exist on this machine.
+func Lint(file string, data []byte) []Diagnostic {
+	l := &linter{file: file}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		line := yamlErrorLine(err.Error())
+		l.add(SeverityError, line, 0, strings.TrimPrefix(err.Error(), fmt.Sprintf("yaml: line %d: ", line)))
+		return l.diags
+	}
+	if len(doc.Content) == 0 {
+		l.add(SeverityError, 0, 0, "file is empty")
+		return l.diags
+	}
+	l.root = doc.Content[0]
+	if l.root.Kind != yaml.MappingNode {
+		l.addAt(SeverityError, l.root, "a workflow must be a mapping with a name and steps")
+		return l.diags
+	}
+
+	l.checkKeys(l.root, reflect.TypeFor[models.Workflow]())
+
+	var w models.Workflow
+	if err := l.root.Decode(&w); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			l.addAt(SeverityError, l.root, err.Error())
+			return l.diags
+		}
+		for _, msg := range typeErr.Errors {
+			line := yamlErrorLine(msg)
+			l.addAt(SeverityError, l.lastNodeOnLine(line), strings.TrimPrefix(msg, fmt.Sprintf("line %d: ", line)))
+		}
+	}
+
+	for _, err := range w.ValidateAll() {
+		l.addAt(SeverityError, l.lookup(err.Path...), err.Error())
+	}
+	l.checkInputs(w)
+	l.checkCommands(w)
+
+	slices.SortStableFunc(l.diags, func(a, b Diagnostic) int {
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Column - b.Column
+	})
+	return l.diags
+}
+
+type linter struct {
+	file  string
+	root  *yaml.Node
+	diags []Diagnostic
+}
+
+func (l *linter) add(severity Severity, line, column int, msg string) {
+	l.diags = append(l.diags, Diagnostic{File: l.file, Line: line, Column: column, Severity: severity, Message: msg})
+}
+
+func (l *linter) addAt(severity Severity, n *yaml.Node, msg string) {
+	if n == nil {
+		l.add(severity, 0, 0, msg)
+		return
+	}
+	l.add(severity, n.Line, n.Column, msg)
+}
+
+var (
+	timeType        = reflect.TypeFor[time.Time]()
+	unmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// checkKeys warns about mapping keys that do not match a field of t, which
+// decoding silently ignores.
+func (l *linter) checkKeys(n *yaml.Node, t reflect.Type) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType || reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				l.addAt(SeverityWarning, key, unknownKeyMessage(key.Value, fields))
+				continue
+			}
+			l.checkKeys(value, field)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 1; i < len(n.Content); i += 2 {
+			l.checkKeys(n.Content[i], t.Elem())
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range n.Content {
+			l.checkKeys(item, t.Elem())
+		}
+	}
+}
+
+// yamlFields maps the YAML keys of struct type t to the types of their
+// fields.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func unknownKeyMessage(key string, fields map[string]reflect.Type) string {
+	msg := fmt.Sprintf("unknown key %q is ignored", key)
+	best, bestDistance := "", 3
+	for name := range fields {
+		d := distance(strings.ReplaceAll(strings.ToLower(key), "-", "_"), name)
+		if d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	if best != "" {
+		msg += fmt.Sprintf("; did you mean %q?", best)
+	}
+	return msg
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// checkInputs reports inputs that read from a step that is not upstream of
+// theirs, or an output that the step does not declare. Inputs that are not
+// in the step.key format are already reported by ValidateAll.
+func (l *linter) checkInputs(w models.Workflow) {
+	steps := make(map[string]models.WorkflowStep, len(w.Steps))
+	for _, s := range w.Steps {
+		steps[s.Name] = s
+	}
+
+	for i, step := range w.Steps {
+		ancestors := w.Ancestors(step.Name)
+		keys := make([]string, 0, len(step.Inputs))
+		for k := range step.Inputs {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			spec := step.Inputs[key]
+			sourceName, output, ok := strings.Cut(spec, ".")
+			if !ok || strings.Contains(output, ".") {
+				continue
+			}
+			node := l.lookup("steps", strconv.Itoa(i), "inputs", key)
+
+			source, exists := steps[sourceName]
+			switch {
+			case sourceName == step.Name:
+				l.addAt(SeverityError, node, fmt.Sprintf("input %s reads from its own step %q", key, sourceName))
+			case !exists:
+				l.addAt(SeverityError, node, fmt.Sprintf("input %s reads from unknown step %q", key, sourceName))
+			case !ancestors[sourceName]:
+				l.addAt(SeverityError, node, fmt.Sprintf("input %s reads from step %q, which does not run before %q; add it to depends_on", key, sourceName, step.Name))
+			case !source.ProvidesOutput(output):
+				l.addAt(SeverityError, node, fmt.Sprintf("input %s reads output %q, which step %q does not declare", key, output, sourceName))
+			}
+		}
+	}
+}
+
+// windowsPath matches absolute Windows paths such as C:\tools\build.exe.
+var windowsPath = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+
+// checkCommands warns about exec commands that cannot be found on this
+// machine. Steps with runs_on labels are skipped, since they run on workers
+// that may have other commands or another OS, as are commands that are not
+// allowed at all.
+func (l *linter) checkCommands(w models.Workflow) {
+	for i, step := range w.Steps {
+		if step.Exec == nil || len(step.RunsOn) > 0 || step.Exec.Validate() != nil {
+			continue
+		}
+		command := strings.TrimSpace(step.Exec.Command)
+		if command == "" {
+			continue
+		}
+		node := l.lookup("steps", strconv.Itoa(i), "exec", "command")
+
+		switch {
+		case windowsPath.MatchString(command) && runtime.GOOS != "windows":
+			l.addAt(SeverityWarning, node, fmt.Sprintf("command %s is a Windows path and will not exist on %s", command, runtime.GOOS))
+		case strings.ContainsAny(command, `/\`):
+			path := command
+			if !filepath.IsAbs(path) && step.Exec.WorkingDir != "" {
+				path = filepath.Join(step.Exec.WorkingDir, path)
+			}
+			if _, err := os.Stat(path); err != nil {
+				l.addAt(SeverityWarning, node, fmt.Sprintf("command %s does not exist", command))
+			}
+		default:
+			if _, err := exec.LookPath(command); err != nil {
+				l.addAt(SeverityWarning, node, fmt.Sprintf("command %s was not found in PATH on %s", command, runtime.GOOS))
+			}
+		}
+	}
+}
+
+// lookup returns the node at path, or the deepest node on the way to it if
+// the path does not exist in the file.
+func (l *linter) lookup(path ...string) *yaml.Node {
+	n := l.root
+	for _, elem := range path {
+		var next *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == elem {
+					next = n.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(elem); err == nil && i < len(n.Content) {
+				next = n.Content[i]
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+	return n
+}
+
+// lastNodeOnLine returns the last node that starts on line, which for a
+// "key: value" line is the value.
+func (l *linter) lastNodeOnLine(line int) *yaml.Node {
+	var found *yaml.Node
+	var visit func(*yaml.Node)
+	visit = func(n *yaml.Node) {
+		if n.Line == line {
+			found = n
+		}
+		for _, c := range n.Content {
+			visit(c)
+		}
+	}
+	visit(l.root)
+	if found == nil {
+		return &yaml.Node{Line: line}
+	}
+	return found
+}
+
+var lineRe = regexp.MustCompile(`line (\d+)`)
+
+// yamlErrorLine extracts the line number from a yaml.v3 error message.
+func yamlErrorLine(msg string) int {
+	if m := lineRe.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return line
+	}
+	return 0
+}
@@ -0,0 +1,185 @@
+package lint
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		yaml string
+		want []Diagnostic
+	}{
+		{
+			name: "valid",
+			yaml: `name: etl
+steps:
+  - name: extract
+    exec:
+      command: echo
+    outputs:
+      rows: "ROWS:"
+  - name: load
+    depends_on: [extract]
+    exec:
+      command: echo
+    inputs:
+      ROWS: extract.rows
+`,
+		},
+		{
+			name: "unknown keys",
+			yaml: `name: etl
+schedul: 1h
+steps:
+  - name: extract
+    exec:
+      command: echo
+      argz: [a]
+  - name: load
+    depends-on: [extract]
+    exec:
+      command: echo
+`,
+			want: []Diagnostic{
+				{Line: 2, Column: 1, Severity: SeverityWarning, Message: `unknown key "schedul" is ignored; did you mean "schedule"?`},
+				{Line: 7, Column: 7, Severity: SeverityWarning, Message: `unknown key "argz" is ignored; did you mean "args"?`},
+				{Line: 9, Column: 5, Severity: SeverityWarning, Message: `unknown key "depends-on" is ignored; did you mean "depends_on"?`},
+			},
+		},
+		{
+			name: "input from a step that is not an ancestor",
+			yaml: `name: etl
+steps:
+  - name: extract
+    exec:
+      command: echo
+    outputs:
+      rows: "ROWS:"
+  - name: load
+    exec:
+      command: echo
+    inputs:
+      ROWS: extract.rows
+`,
+			want: []Diagnostic{
+				{Line: 12, Column: 13, Severity: SeverityError, Message: `input ROWS reads from step "extract", which does not run before "load"; add it to depends_on`},
+			},
+		},
+		{
+			name: "input of an undeclared output",
+			yaml: `name: etl
+steps:
+  - name: extract
+    exec:
+      command: echo
+  - name: load
+    depends_on: [extract]
+    exec:
+      command: echo
+    inputs:
+      ROWS: extract.rows
+`,
+			want: []Diagnostic{
+				{Line: 11, Column: 13, Severity: SeverityError, Message: `input ROWS reads output "rows", which step "extract" does not declare`},
+			},
+		},
+		{
+			name: "input from an unknown step",
+			yaml: `name: etl
+steps:
+  - name: load
+    exec:
+      command: echo
+    inputs:
+      ROWS: extract.rows
+`,
+			want: []Diagnostic{
+				{Line: 7, Column: 13, Severity: SeverityError, Message: `input ROWS reads from unknown step "extract"`},
+			},
+		},
+		{
+			name: "type error",
+			yaml: `name: etl
+steps:
+  - name: extract
+    retries: many
+    exec:
+      command: echo
+`,
+			want: []Diagnostic{
+				{Line: 4, Column: 14, Severity: SeverityError, Message: "cannot unmarshal !!str `many` into int"},
+			},
+		},
+		{
+			name: "syntax error",
+			yaml: "name: etl\nsteps:\n  - name: [extract\n",
+			want: []Diagnostic{
+				{Line: 2, Severity: SeverityError, Message: "did not find expected ',' or ']'"},
+			},
+		},
+		{
+			name: "empty file",
+			yaml: "",
+			want: []Diagnostic{{Severity: SeverityError, Message: "file is empty"}},
+		},
+		{
+			name: "not a mapping",
+			yaml: "- name: etl\n",
+			want: []Diagnostic{{Line: 1, Column: 1, Severity: SeverityError, Message: "a workflow must be a mapping with a name and steps"}},
+		},
+		{
+			name: "no steps",
+			yaml: "name: etl\n",
+			want: []Diagnostic{{Line: 1, Column: 1, Severity: SeverityError, Message: "workflow must contain at least one step"}},
+		},
+		{
+			name: "missing command",
+			yaml: `name: etl
+steps:
+  - name: extract
+    exec:
+      command: ./missing-tool
+`,
+			want: []Diagnostic{
+				{Line: 5, Column: 16, Severity: SeverityWarning, Message: "command ./missing-tool does not exist"},
+			},
+		},
+		{
+			name: "missing command on a worker",
+			yaml: `name: etl
+steps:
+  - name: extract
+    runs_on: [gpu]
+    exec:
+      command: ./missing-tool
+`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lint("etl.yml", []byte(tt.yaml))
+			for i := range tt.want {
+				tt.want[i].File = "etl.yml"
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("Lint() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiagnosticString(t *testing.T) {
+	for _, tt := range []struct {
+		diag Diagnostic
+		want string
+	}{
+		{Diagnostic{File: "etl.yml", Line: 12, Column: 5, Severity: SeverityWarning, Message: "odd"}, "etl.yml:12:5: warning: odd"},
+		{Diagnostic{File: "etl.yml", Line: 12, Severity: SeverityError, Message: "bad"}, "etl.yml:12: error: bad"},
+		{Diagnostic{File: "etl.yml", Severity: SeverityError, Message: "empty"}, "etl.yml: error: empty"},
+	} {
+		if got := tt.diag.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package metrics
+
+// The metrics gork records. Run and step metrics are labeled by workflow
+// name, and step metrics also by step name, so they stay bounded by the
+// number of workflows rather than runs.
+var (
+	RunsTotal = NewCounter("gork_runs_total",
+		"Workflow runs that finished, by workflow and final status.",
+		"workflow", "status")
+	RunDuration = NewHistogram("gork_run_duration_seconds",
+		"Time spent executing a run, by workflow and final status.",
+		DefaultBuckets, "workflow", "status")
+	ActiveRuns = NewGauge("gork_active_runs",
+		"Workflow runs executing in this process, by workflow.",
+		"workflow")
+
+	StepsTotal = NewCounter("gork_steps_total",
+		"Steps that finished, after any retries, by workflow, step and final status.",
+		"workflow", "step", "status")
+	StepDuration = NewHistogram("gork_step_attempt_duration_seconds",
+		"Duration of each step attempt, by workflow, step and attempt status.",
+		DefaultBuckets, "workflow", "step", "status")
+	StepRetries = NewCounter("gork_step_retries_total",
+		"Step attempts that failed and were retried, by workflow and step.",
+		"workflow", "step")
+
+	SchedulerLag = NewHistogram("gork_scheduler_lag_seconds",
+		"Delay between a schedule slot's intended fire time and its run being queued, by workflow.",
+		[]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60, 300, 3600}, "workflow")
+
+	DBOperationDuration = NewHistogram("gork_db_operation_duration_seconds",
+		"Duration of database operations, including retries, by result.",
+		[]float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}, "result")
+	DBOperationRetries = NewCounter("gork_db_operation_retries_total",
+		"Database operations retried because the database was busy.")
+)
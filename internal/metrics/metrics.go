@@ -0,0 +1,318 @@
+// Package metrics keeps counters, gauges and histograms in memory and serves
+// them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit durations in seconds from milliseconds to an hour.
+var DefaultBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// metric is anything the registry can write.
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	mu       sync.Mutex
+	registry []metric
+)
+
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if slices.ContainsFunc(registry, func(r metric) bool { return r.name() == m.name() }) {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	registry = append(registry, m)
+}
+
+// Handler serves every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write writes every registered metric to w, sorted by name.
+func Write(w io.Writer) error {
+	mu.Lock()
+	metrics := slices.Clone(registry)
+	mu.Unlock()
+	slices.SortFunc(metrics, func(a, b metric) int { return strings.Compare(a.name(), b.name()) })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// desc is what every kind of metric has in common.
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d desc) name() string {
+	return d.metricName
+}
+
+func (d desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, kind)
+}
+
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series holds the values of one label combination.
+type series[T any] struct {
+	values []string
+	data   T
+}
+
+// vec keeps a metric's series by label values.
+type vec[T any] struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series[T]
+}
+
+func newVec[T any](name, help string, labels []string) vec[T] {
+	return vec[T]{desc: desc{metricName: name, help: help, labels: labels}, series: make(map[string]*series[T])}
+}
+
+// with calls fn with the series for values, creating it with init if needed.
+func (v *vec[T]) with(values []string, init func() T, fn func(*T)) {
+	key := v.key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series[T]{values: slices.Clone(values), data: init()}
+		v.series[key] = s
+	}
+	fn(&s.data)
+}
+
+// each calls fn for every series in label order.
+func (v *vec[T]) each(fn func(values []string, data T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		fn(s.values, s.data)
+	}
+}
+
+func zero() float64 { return 0 }
+
+// Counter is a value that only goes up, such as a number of runs.
+type Counter struct {
+	vec[float64]
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec[float64](name, help, labels)}
+	if len(labels) == 0 {
+		c.Add(0)
+	}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the series with the given
+// label values.
+func (c *Counter) Add(v float64, values ...string) {
+	c.with(values, zero, func(f *float64) { *f += v })
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.each(func(values []string, v float64) {
+		writeSample(w, c.metricName, c.labels, values, "", "", v)
+	})
+}
+
+// Gauge is a value that goes up and down, such as a number of active runs.
+type Gauge struct {
+	vec[float64]
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec[float64](name, help, labels)}
+	if len(labels) == 0 {
+		g.Set(0)
+	}
+	register(g)
+	return g
+}
+
+// Add adds v, which may be negative, to the series with the given label
+// values.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.with(values, zero, func(f *float64) { *f += v })
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.with(values, zero, func(f *float64) { *f = v })
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	g.each(func(values []string, v float64) {
+		writeSample(w, g.metricName, g.labels, values, "", "", v)
+	})
+}
+
+// GaugeFunc is a gauge whose value is read when metrics are written, for
+// values that live elsewhere such as the length of the run queue.
+type GaugeFunc struct {
+	desc
+	fn func() (map[string]float64, error)
+}
+
+// NewGaugeFunc registers a gauge with one label whose series are returned by
+// fn, keyed by label value.
+func NewGaugeFunc(name, help, label string, fn func() (map[string]float64, error)) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{metricName: name, help: help, labels: []string{label}}, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	values, err := g.fn()
+	if err != nil {
+		slog.Warn("Failed to read metric", "component", "metrics", "metric", g.metricName, "error", err)
+		return
+	}
+	g.header(w, "gauge")
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		writeSample(w, g.metricName, g.labels, []string{k}, "", "", values[k])
+	}
+}
+
+// Histogram counts observations, such as durations, in buckets.
+type Histogram struct {
+	vec[histogramData]
+	buckets []float64
+}
+
+type histogramData struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds, in
+// increasing order, and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{vec: newVec[histogramData](name, help, labels), buckets: buckets}
+	register(h)
+	return h
+}
+
+// Observe records v in the series with the given label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	init := func() histogramData { return histogramData{counts: make([]uint64, len(h.buckets))} }
+	h.with(values, init, func(d *histogramData) {
+		if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+			d.counts[i]++
+		}
+		d.sum += v
+		d.count++
+	})
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.each(func(values []string, d histogramData) {
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += d.counts[i]
+			writeSample(w, h.metricName+"_bucket", h.labels, values, "le", formatFloat(upper), float64(cumulative))
+		}
+		writeSample(w, h.metricName+"_bucket", h.labels, values, "le", "+Inf", float64(d.count))
+		writeSample(w, h.metricName+"_sum", h.labels, values, "", "", d.sum)
+		writeSample(w, h.metricName+"_count", h.labels, values, "", "", float64(d.count))
+	})
+}
+
+// writeSample writes one line, with an optional extra label such as a
+// histogram bucket's upper bound.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
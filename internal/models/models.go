@@ -1,10 +1,17 @@
 package models
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 )
 
@@ -39,6 +46,9 @@ const (
 	StepStatusTimeout  StepStatus = "timeout"
 	StepStatusSkipped  StepStatus = "skipped"
 	StepStatusRetrying StepStatus = "retrying"
+	// StepStatusInterrupted marks a step that was in flight when its
+	// daemon stopped.
+	StepStatusInterrupted StepStatus = "interrupted"
 )
 
 var (
@@ -145,11 +155,450 @@ type Workflow struct {
 	Name        string         `json:"name" yaml:"name"`
 	Description string         `json:"description,omitempty" yaml:"description,omitempty"`
 	Schedule    string         `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+	Timeout     time.Duration  `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Deadline    string         `json:"deadline,omitempty" yaml:"deadline,omitempty"`
+	MaxParallel int            `json:"max_parallel,omitempty" yaml:"max_parallel,omitempty"`
+	Concurrency *Concurrency   `json:"concurrency,omitempty" yaml:"concurrency,omitempty"`
+	Misfire     *Misfire       `json:"misfire,omitempty" yaml:"misfire,omitempty"`
+	Triggers    *Triggers      `json:"triggers,omitempty" yaml:"triggers,omitempty"`
+	OnRestart   RestartPolicy  `json:"on_restart,omitempty" yaml:"on_restart,omitempty"`
+	Notify      []Notifier     `json:"notify,omitempty" yaml:"notify,omitempty"`
+	Paused      bool           `json:"paused,omitempty" yaml:"-"`
+	NextFireAt  time.Time      `json:"next_fire_at,omitempty" yaml:"-"`
+	Source      string         `json:"source,omitempty" yaml:"-"`
 	Steps       []WorkflowStep `json:"steps" yaml:"steps"`
 	CreatedAt   time.Time      `json:"created_at" yaml:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at" yaml:"updated_at"`
 }
 
+type ConcurrencyPolicy string
+
+const (
+	ConcurrencyQueue          ConcurrencyPolicy = "queue"
+	ConcurrencySkip           ConcurrencyPolicy = "skip"
+	ConcurrencyCancelPrevious ConcurrencyPolicy = "cancel-previous"
+)
+
+// Concurrency limits how many runs of a workflow execute at once. Workflows
+// that name the same group share a single limit, for example when they all
+// touch the same database.
+type Concurrency struct {
+	Limit  int               `json:"limit,omitempty" yaml:"limit,omitempty"`
+	Group  string            `json:"group,omitempty" yaml:"group,omitempty"`
+	Policy ConcurrencyPolicy `json:"policy,omitempty" yaml:"policy,omitempty"`
+}
+
+// RestartPolicy decides what happens to a run that was in progress when its
+// daemon stopped.
+type RestartPolicy string
+
+const (
+	// RestartCancel cancels the run. It is the default.
+	RestartCancel RestartPolicy = "cancel"
+	// RestartResume continues the run, skipping the steps that had already
+	// succeeded and reusing their outputs.
+	RestartResume RestartPolicy = "resume"
+	// RestartRerun cancels the run and queues a new run with the same
+	// parameters that starts from the first step.
+	RestartRerun RestartPolicy = "rerun"
+)
+
+// EffectiveRestartPolicy returns the restart policy, defaulting to cancel.
+func (w Workflow) EffectiveRestartPolicy() RestartPolicy {
+	if w.OnRestart == "" {
+		return RestartCancel
+	}
+	return w.OnRestart
+}
+
+type MisfirePolicy string
+
+const (
+	MisfireSkip    MisfirePolicy = "skip"
+	MisfireRunOnce MisfirePolicy = "run-once"
+	MisfireCatchUp MisfirePolicy = "catch-up"
+)
+
+// DefaultMaxCatchUp bounds how many missed slots a catch-up policy runs when
+// max_catch_up is not set.
+const DefaultMaxCatchUp = 10
+
+// Misfire decides what happens to schedule slots that passed while the
+// daemon was stopped or the previous run was still going.
+type Misfire struct {
+	Policy     MisfirePolicy `json:"policy,omitempty" yaml:"policy,omitempty"`
+	MaxCatchUp int           `json:"max_catch_up,omitempty" yaml:"max_catch_up,omitempty"`
+}
+
+// Triggers start a workflow in response to events rather than on its
+// schedule.
+type Triggers struct {
+	Files   []FileTrigger   `json:"files,omitempty" yaml:"files,omitempty"`
+	Webhook *WebhookTrigger `json:"webhook,omitempty" yaml:"webhook,omitempty"`
+	After   []AfterTrigger  `json:"after,omitempty" yaml:"after,omitempty"`
+}
+
+type FileEvent string
+
+const (
+	FileCreated  FileEvent = "created"
+	FileModified FileEvent = "modified"
+)
+
+// FileTrigger starts a run when a file matching Pattern is created or
+// modified in Dir. Subdirectories are not watched.
+type FileTrigger struct {
+	Dir     string      `json:"dir" yaml:"dir"`
+	Pattern string      `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Events  []FileEvent `json:"events,omitempty" yaml:"events,omitempty"`
+}
+
+// WebhookTrigger starts a run when the daemon receives a POST to
+// /hooks/<workflow> signed with the shared secret, given either directly or
+// as the name of an environment variable of the daemon.
+type WebhookTrigger struct {
+	Secret    string `json:"secret,omitempty" yaml:"secret,omitempty"`
+	SecretEnv string `json:"secret_env,omitempty" yaml:"secret_env,omitempty"`
+}
+
+// AfterTrigger starts a run when a run of the named workflow finishes with
+// one of Statuses, by default only on success.
+type AfterTrigger struct {
+	Workflow string      `json:"workflow" yaml:"workflow"`
+	Statuses []RunStatus `json:"statuses,omitempty" yaml:"statuses,omitempty"`
+}
+
+// Trigger parameters passed to the steps of triggered runs. Runs started by
+// an after trigger also receive each output of the upstream run as
+// GORK_UPSTREAM_<STEP>_<KEY>.
+const (
+	TriggerFileParam      = "GORK_TRIGGER_FILE"
+	TriggerEventParam     = "GORK_TRIGGER_EVENT"
+	TriggerPayloadParam   = "GORK_TRIGGER_PAYLOAD"
+	UpstreamRunIDParam    = "GORK_UPSTREAM_RUN_ID"
+	UpstreamWorkflowParam = "GORK_UPSTREAM_WORKFLOW"
+	UpstreamStatusParam   = "GORK_UPSTREAM_STATUS"
+)
+
+func (t Triggers) Validate() error {
+	for i, f := range t.Files {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("files[%d]: %w", i, err)
+		}
+	}
+	if t.Webhook != nil {
+		if (t.Webhook.Secret == "") == (t.Webhook.SecretEnv == "") {
+			return errors.New("webhook: exactly one of secret or secret_env is required")
+		}
+	}
+	for i, a := range t.After {
+		if err := a.Validate(); err != nil {
+			return fmt.Errorf("after[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (a AfterTrigger) Validate() error {
+	if strings.TrimSpace(a.Workflow) == "" {
+		return errors.New("workflow is required")
+	}
+	for _, s := range a.Statuses {
+		switch s {
+		case RunStatusSuccess, RunStatusFailed, RunStatusCanceled, RunStatusTimeout:
+		default:
+			return fmt.Errorf("unknown status %q: expected success, failed, canceled or timeout", s)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether a run of upstream that finished with status fires
+// the trigger.
+func (a AfterTrigger) Matches(upstream string, status RunStatus) bool {
+	if a.Workflow != upstream {
+		return false
+	}
+	if len(a.Statuses) == 0 {
+		return status == RunStatusSuccess
+	}
+	return slices.Contains(a.Statuses, status)
+}
+
+// EventType names a point in the life of a run that notifiers can be sent on.
+type EventType string
+
+const (
+	EventRunStarted   EventType = "run.started"
+	EventRunSucceeded EventType = "run.succeeded"
+	// EventRunFailed is sent for runs that failed or timed out.
+	EventRunFailed   EventType = "run.failed"
+	EventStepFailed  EventType = "step.failed"
+	EventStepRetried EventType = "step.retried"
+)
+
+var eventTypes = []EventType{EventRunStarted, EventRunSucceeded, EventRunFailed, EventStepFailed, EventStepRetried}
+
+// Event describes something that happened to a run. It is what notifier
+// templates are rendered with.
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	WorkflowID int64     `json:"workflow_id"`
+	Workflow   string    `json:"workflow"`
+	RunID      int64     `json:"run_id"`
+	Trigger    string    `json:"trigger,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Step       string    `json:"step,omitempty"`
+	Attempt    int       `json:"attempt,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// DefaultNotifyAttempts is how many times a notification is tried when a
+// notifier does not set attempts.
+const DefaultNotifyAttempts = 3
+
+// Notifier sends a message when one of Events happens to a run of its
+// workflow, by default only when a run fails. Exactly one of Webhook, Slack
+// or Email is set.
+type Notifier struct {
+	Name     string         `json:"name,omitempty" yaml:"name,omitempty"`
+	Events   []EventType    `json:"events,omitempty" yaml:"events,omitempty"`
+	Attempts int            `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	Webhook  *WebhookNotify `json:"webhook,omitempty" yaml:"webhook,omitempty"`
+	Slack    *SlackNotify   `json:"slack,omitempty" yaml:"slack,omitempty"`
+	Email    *EmailNotify   `json:"email,omitempty" yaml:"email,omitempty"`
+}
+
+// WebhookNotify posts a JSON payload to a URL. Payload is a template that
+// must render to JSON; without one the event itself is sent.
+type WebhookNotify struct {
+	URL     string            `json:"url,omitempty" yaml:"url,omitempty"`
+	URLEnv  string            `json:"url_env,omitempty" yaml:"url_env,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Payload string            `json:"payload,omitempty" yaml:"payload,omitempty"`
+}
+
+// SlackNotify posts a message to a Slack-compatible incoming webhook.
+type SlackNotify struct {
+	URL    string `json:"url,omitempty" yaml:"url,omitempty"`
+	URLEnv string `json:"url_env,omitempty" yaml:"url_env,omitempty"`
+	Text   string `json:"text,omitempty" yaml:"text,omitempty"`
+}
+
+// EmailNotify sends a plain-text email through an SMTP server.
+type EmailNotify struct {
+	SMTP        string   `json:"smtp" yaml:"smtp"`
+	From        string   `json:"from" yaml:"from"`
+	To          []string `json:"to" yaml:"to"`
+	Username    string   `json:"username,omitempty" yaml:"username,omitempty"`
+	PasswordEnv string   `json:"password_env,omitempty" yaml:"password_env,omitempty"`
+	Subject     string   `json:"subject,omitempty" yaml:"subject,omitempty"`
+	Body        string   `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// NotifyTemplateFuncs are available to notifier templates. json quotes a
+// value for use inside a JSON payload.
+var NotifyTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// ParseNotifyTemplate parses a notifier template.
+func ParseNotifyTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(NotifyTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// DisplayName returns the notifier's name, or its kind if it has none.
+func (n Notifier) DisplayName() string {
+	switch {
+	case n.Name != "":
+		return n.Name
+	case n.Webhook != nil:
+		return "webhook"
+	case n.Slack != nil:
+		return "slack"
+	case n.Email != nil:
+		return "email"
+	}
+	return "notifier"
+}
+
+// Wants reports whether the notifier is sent on events of type t.
+func (n Notifier) Wants(t EventType) bool {
+	if len(n.Events) == 0 {
+		return t == EventRunFailed
+	}
+	return slices.Contains(n.Events, t)
+}
+
+// EffectiveAttempts returns how many times a notification is tried.
+func (n Notifier) EffectiveAttempts() int {
+	if n.Attempts == 0 {
+		return DefaultNotifyAttempts
+	}
+	return n.Attempts
+}
+
+func (n Notifier) Validate() error {
+	kinds := 0
+	for _, set := range []bool{n.Webhook != nil, n.Slack != nil, n.Email != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of webhook, slack or email is required")
+	}
+	for _, e := range n.Events {
+		if !slices.Contains(eventTypes, e) {
+			return fmt.Errorf("unknown event %q: expected run.started, run.succeeded, run.failed, step.failed or step.retried", e)
+		}
+	}
+	if n.Attempts < 0 || n.Attempts > 10 {
+		return errors.New("attempts must be between 1 and 10")
+	}
+
+	var templates map[string]string
+	switch {
+	case n.Webhook != nil:
+		if (n.Webhook.URL == "") == (n.Webhook.URLEnv == "") {
+			return errors.New("webhook: exactly one of url or url_env is required")
+		}
+		templates = map[string]string{"payload": n.Webhook.Payload}
+	case n.Slack != nil:
+		if (n.Slack.URL == "") == (n.Slack.URLEnv == "") {
+			return errors.New("slack: exactly one of url or url_env is required")
+		}
+		templates = map[string]string{"text": n.Slack.Text}
+	case n.Email != nil:
+		if n.Email.SMTP == "" || n.Email.From == "" || len(n.Email.To) == 0 {
+			return errors.New("email: smtp, from and to are required")
+		}
+		if _, _, err := net.SplitHostPort(n.Email.SMTP); err != nil {
+			return fmt.Errorf("email: smtp must be host:port: %w", err)
+		}
+		if (n.Email.Username == "") != (n.Email.PasswordEnv == "") {
+			return errors.New("email: username and password_env must be set together")
+		}
+		templates = map[string]string{"subject": n.Email.Subject, "body": n.Email.Body}
+	}
+	for name, text := range templates {
+		if _, err := ParseNotifyTemplate(name, text); err != nil {
+			return fmt.Errorf("invalid %s template: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// NotificationStatus is the outcome of one attempt to send a notification.
+type NotificationStatus string
+
+const (
+	NotificationSent   NotificationStatus = "sent"
+	NotificationFailed NotificationStatus = "failed"
+)
+
+// NotificationAttempt records one try at sending a notification.
+type NotificationAttempt struct {
+	ID        int64              `json:"id" yaml:"id"`
+	RunID     int64              `json:"run_id" yaml:"run_id"`
+	Notifier  string             `json:"notifier" yaml:"notifier"`
+	Event     EventType          `json:"event" yaml:"event"`
+	Step      string             `json:"step,omitempty" yaml:"step,omitempty"`
+	Attempt   int                `json:"attempt" yaml:"attempt"`
+	Status    NotificationStatus `json:"status" yaml:"status"`
+	Error     string             `json:"error,omitempty" yaml:"error,omitempty"`
+	CreatedAt time.Time          `json:"created_at" yaml:"created_at"`
+}
+
+// Upstreams returns the names of the workflows whose runs trigger w.
+func (w Workflow) Upstreams() []string {
+	if w.Triggers == nil {
+		return nil
+	}
+	var names []string
+	for _, a := range w.Triggers.After {
+		if !slices.Contains(names, a.Workflow) {
+			names = append(names, a.Workflow)
+		}
+	}
+	return names
+}
+
+// FindTriggerCycle reports whether the after triggers of w, together with
+// those of the other workflows given as a map from name to upstream names,
+// form a cycle. It returns the workflows in the cycle in the order they
+// trigger each other, starting and ending with w, or nil if there is none.
+func FindTriggerCycle(w Workflow, upstreams map[string][]string) []string {
+	edges := func(name string) []string {
+		if name == w.Name {
+			return w.Upstreams()
+		}
+		return upstreams[name]
+	}
+
+	visited := make(map[string]bool)
+	var visit func(path []string) []string
+	visit = func(path []string) []string {
+		for _, next := range edges(path[len(path)-1]) {
+			if next == w.Name {
+				return append(path, next)
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			if cycle := visit(append(path, next)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	cycle := visit([]string{w.Name})
+	slices.Reverse(cycle)
+	return cycle
+}
+
+func (f FileTrigger) Validate() error {
+	if f.Dir == "" {
+		return errors.New("dir is required")
+	}
+	if _, err := filepath.Match(f.EffectivePattern(), ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", f.Pattern, err)
+	}
+	for _, e := range f.Events {
+		if e != FileCreated && e != FileModified {
+			return fmt.Errorf("unknown event %q: expected created or modified", e)
+		}
+	}
+	return nil
+}
+
+// EffectivePattern returns the pattern, defaulting to every file.
+func (f FileTrigger) EffectivePattern() string {
+	if f.Pattern == "" {
+		return "*"
+	}
+	return f.Pattern
+}
+
+// Watches reports whether the trigger fires on event. With no events listed
+// it fires on both.
+func (f FileTrigger) Watches(event FileEvent) bool {
+	return len(f.Events) == 0 || slices.Contains(f.Events, event)
+}
+
+// ResolveSecret returns the webhook's shared secret.
+func (w WebhookTrigger) ResolveSecret() string {
+	if w.SecretEnv != "" {
+		return os.Getenv(w.SecretEnv)
+	}
+	return w.Secret
+}
+
 type WorkflowStep struct {
 	ID         int64             `json:"id,omitempty" yaml:"id,omitempty"`
 	Name       string            `json:"name" yaml:"name"`
@@ -163,6 +612,107 @@ type WorkflowStep struct {
 	Timeout    time.Duration     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
 	Retries    int               `json:"retries,omitempty" yaml:"retries,omitempty"`
 	RetryDelay time.Duration     `json:"retry_delay,omitempty" yaml:"retry_delay,omitempty"`
+	Retry      *RetryPolicy      `json:"retry,omitempty" yaml:"retry,omitempty"`
+	KillGrace  time.Duration     `json:"kill_grace,omitempty" yaml:"kill_grace,omitempty"`
+	Limits     *StepLimits       `json:"limits,omitempty" yaml:"limits,omitempty"`
+	RunsOn     []string          `json:"runs_on,omitempty" yaml:"runs_on,omitempty"`
+}
+
+type BackoffStrategy string
+
+const (
+	BackoffConstant    BackoffStrategy = "constant"
+	BackoffLinear      BackoffStrategy = "linear"
+	BackoffExponential BackoffStrategy = "exponential"
+)
+
+// RetryPolicy controls how a failed step is retried. When set on a step it
+// replaces the simpler Retries and RetryDelay fields.
+type RetryPolicy struct {
+	MaxRetries int              `json:"max_retries" yaml:"max_retries"`
+	Backoff    BackoffStrategy  `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	Delay      time.Duration    `json:"delay,omitempty" yaml:"delay,omitempty"`
+	MaxDelay   time.Duration    `json:"max_delay,omitempty" yaml:"max_delay,omitempty"`
+	Jitter     float64          `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	RetryOn    *RetryConditions `json:"retry_on,omitempty" yaml:"retry_on,omitempty"`
+}
+
+// RetryConditions restricts which failures are retried. A failure is retried
+// if it matches any of the conditions that are set.
+type RetryConditions struct {
+	ExitCodes  []int    `json:"exit_codes,omitempty" yaml:"exit_codes,omitempty"`
+	HTTPStatus []string `json:"http_status,omitempty" yaml:"http_status,omitempty"`
+	Timeout    bool     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Output     string   `json:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// StepLimits constrains the resources an exec or script step may consume.
+// Limits other than MaxOutput are only enforced on Linux.
+type StepLimits struct {
+	MaxMemory      ByteSize      `json:"max_memory,omitempty" yaml:"max_memory,omitempty"`
+	CPUTime        time.Duration `json:"cpu_time,omitempty" yaml:"cpu_time,omitempty"`
+	OpenFiles      int           `json:"open_files,omitempty" yaml:"open_files,omitempty"`
+	MaxProcesses   int           `json:"max_processes,omitempty" yaml:"max_processes,omitempty"`
+	MaxOutput      ByteSize      `json:"max_output,omitempty" yaml:"max_output,omitempty"`
+	IsolateNetwork bool          `json:"isolate_network,omitempty" yaml:"isolate_network,omitempty"`
+	ReadOnlyRoot   bool          `json:"read_only_root,omitempty" yaml:"read_only_root,omitempty"`
+}
+
+// ByteSize is a size in bytes that can be written as a plain number or with
+// a binary unit suffix such as "512K", "256M" or "1G".
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	multiplier := ByteSize(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(unit.suffix)) {
+			multiplier = unit.size
+			s = strings.TrimSpace(s[:len(s)-len(unit.suffix)])
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	if n < 0 {
+		return 0, errors.New("byte size cannot be negative")
+	}
+	return ByteSize(n) * multiplier, nil
+}
+
+func (b ByteSize) String() string {
+	for _, unit := range byteSizeUnits[:3] {
+		if b >= unit.size && b%unit.size == 0 {
+			return strconv.FormatInt(int64(b/unit.size), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
 }
 
 type ExecAction struct {
@@ -186,31 +736,202 @@ type ScriptAction struct {
 }
 
 type Run struct {
-	ID          int64     `json:"id" yaml:"id"`
-	WorkflowID  int64     `json:"workflow_id" yaml:"workflow_id"`
-	Status      RunStatus `json:"status" yaml:"status"`
-	StartedAt   time.Time `json:"started_at,omitempty" yaml:"started_at,omitempty"`
-	CompletedAt time.Time `json:"completed_at,omitempty" yaml:"completed_at,omitempty"`
-	CreatedAt   time.Time `json:"created_at" yaml:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" yaml:"updated_at"`
-	Trigger     string    `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	ID          int64             `json:"id" yaml:"id"`
+	WorkflowID  int64             `json:"workflow_id" yaml:"workflow_id"`
+	Status      RunStatus         `json:"status" yaml:"status"`
+	StartedAt   time.Time         `json:"started_at,omitempty" yaml:"started_at,omitempty"`
+	CompletedAt time.Time         `json:"completed_at,omitempty" yaml:"completed_at,omitempty"`
+	CreatedAt   time.Time         `json:"created_at" yaml:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at" yaml:"updated_at"`
+	Trigger     string            `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	Params      map[string]string `json:"params,omitempty" yaml:"params,omitempty"`
+	ScheduledAt time.Time         `json:"scheduled_at,omitempty" yaml:"scheduled_at,omitempty"`
+	BackfillID  int64             `json:"backfill_id,omitempty" yaml:"backfill_id,omitempty"`
+	Owner       string            `json:"owner,omitempty" yaml:"owner,omitempty"`
+}
+
+// LogicalDateParam is the run parameter, and so the step environment
+// variable, that carries a backfill run's logical execution date.
+const LogicalDateParam = "GORK_LOGICAL_DATE"
+
+// MaxBackfillRuns bounds the number of runs a single backfill may queue.
+const MaxBackfillRuns = 1000
+
+type BackfillStatus string
+
+const (
+	BackfillStatusRunning   BackfillStatus = "running"
+	BackfillStatusCompleted BackfillStatus = "completed"
+	BackfillStatusCanceled  BackfillStatus = "canceled"
+)
+
+// Backfill is a group of runs queued for the schedule slots in a past date
+// range. At most Parallel of its runs execute at once.
+type Backfill struct {
+	ID         int64          `json:"id" yaml:"id"`
+	WorkflowID int64          `json:"workflow_id" yaml:"workflow_id"`
+	From       time.Time      `json:"from" yaml:"from"`
+	To         time.Time      `json:"to" yaml:"to"`
+	Parallel   int            `json:"parallel" yaml:"parallel"`
+	Status     BackfillStatus `json:"status" yaml:"status"`
+	CreatedAt  time.Time      `json:"created_at" yaml:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at" yaml:"updated_at"`
+}
+
+// BackfillSlots returns the workflow's schedule slots from the start of the
+// from date through the end of the to date, counting intervals from midnight.
+func (w Workflow) BackfillSlots(from, to time.Time) ([]time.Time, error) {
+	if w.Schedule == "" {
+		return nil, fmt.Errorf("workflow %s has no schedule", w.Name)
+	}
+	interval, err := ParseSchedule(w.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	end := time.Date(to.Year(), to.Month(), to.Day()+1, 0, 0, 0, 0, to.Location())
+	if !end.After(start) {
+		return nil, errors.New("the end date is before the start date")
+	}
+
+	// Whole-day schedules step by calendar days so that slots stay at
+	// midnight across daylight saving changes.
+	next := func(t time.Time) time.Time { return t.Add(interval) }
+	if days := int(interval / (24 * time.Hour)); interval%(24*time.Hour) == 0 {
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, days) }
+	}
+
+	var slots []time.Time
+	for slot := start; slot.Before(end); slot = next(slot) {
+		if len(slots) == MaxBackfillRuns {
+			return nil, fmt.Errorf("range covers more than %d schedule slots", MaxBackfillRuns)
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+// LogicalDate formats a schedule slot for LogicalDateParam: a plain date for
+// schedules of whole days, and a full timestamp otherwise.
+func LogicalDate(slot time.Time, interval time.Duration) string {
+	if interval%(24*time.Hour) == 0 {
+		return slot.Format(time.DateOnly)
+	}
+	return slot.Format(time.RFC3339)
+}
+
+type WorkflowChangeKind string
+
+const (
+	WorkflowCreated WorkflowChangeKind = "created"
+	WorkflowUpdated WorkflowChangeKind = "updated"
+	WorkflowDeleted WorkflowChangeKind = "deleted"
+)
+
+// WorkflowChange is an entry in the log of workflow writes that the daemon
+// tails to apply schedule changes as soon as they are made.
+type WorkflowChange struct {
+	ID           int64              `json:"id" yaml:"id"`
+	WorkflowID   int64              `json:"workflow_id" yaml:"workflow_id"`
+	WorkflowName string             `json:"workflow_name" yaml:"workflow_name"`
+	Change       WorkflowChangeKind `json:"change" yaml:"change"`
+	ChangedAt    time.Time          `json:"changed_at" yaml:"changed_at"`
+}
+
+// Lease is a named, expiring claim held by one daemon. Each daemon renews a
+// lease of its own to show it is alive, and the scheduler leader holds the
+// leader lease.
+type Lease struct {
+	Name       string    `json:"name" yaml:"name"`
+	Holder     string    `json:"holder" yaml:"holder"`
+	AcquiredAt time.Time `json:"acquired_at" yaml:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at" yaml:"expires_at"`
+}
+
+// LeaderLease is the name of the lease held by the daemon that runs the
+// scheduler.
+const LeaderLease = "leader"
+
+// DaemonLeasePrefix prefixes the name of each daemon's own lease, which is
+// followed by the daemon's owner ID.
+const DaemonLeasePrefix = "daemon:"
+
+// ExecLeasePrefix prefixes the lease of a gorkctl exec process, which owns
+// the run it executes like a daemon owns the runs it claims.
+const ExecLeasePrefix = "exec:"
+
+func (l Lease) Expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+type QueueStatus string
+
+const (
+	QueueStatusQueued  QueueStatus = "queued"
+	QueueStatusClaimed QueueStatus = "claimed"
+	QueueStatusDone    QueueStatus = "done"
+)
+
+// QueueEntry is a request for the daemon to execute a pending run. Entries
+// are claimed highest priority first, then in the order they were queued.
+type QueueEntry struct {
+	ID         int64       `json:"id" yaml:"id"`
+	RunID      int64       `json:"run_id" yaml:"run_id"`
+	WorkflowID int64       `json:"workflow_id" yaml:"workflow_id"`
+	Priority   int         `json:"priority" yaml:"priority"`
+	Status     QueueStatus `json:"status" yaml:"status"`
+	EnqueuedAt time.Time   `json:"enqueued_at" yaml:"enqueued_at"`
+	BackfillID int64       `json:"backfill_id,omitempty" yaml:"backfill_id,omitempty"`
+	Trigger    string      `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	ClaimedAt  time.Time   `json:"claimed_at,omitempty" yaml:"claimed_at,omitempty"`
+	ClaimedBy  string      `json:"claimed_by,omitempty" yaml:"claimed_by,omitempty"`
 }
 
 type StepRun struct {
+	ID          int64         `json:"id" yaml:"id"`
+	RunID       int64         `json:"run_id" yaml:"run_id"`
+	StepName    string        `json:"step_name" yaml:"step_name"`
+	Status      StepStatus    `json:"status" yaml:"status"`
+	Attempt     int           `json:"attempt" yaml:"attempt"`
+	StartedAt   time.Time     `json:"started_at,omitempty" yaml:"started_at,omitempty"`
+	CompletedAt time.Time     `json:"completed_at,omitempty" yaml:"completed_at,omitempty"`
+	Error       string        `json:"error,omitempty" yaml:"error,omitempty"`
+	Logs        []string      `json:"logs,omitempty" yaml:"logs,omitempty"`
+	Attempts    []StepAttempt `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+}
+
+// StepAttempt records a single execution of a step. A step run has one
+// attempt per try, numbered from 0 like StepRun.Attempt.
+type StepAttempt struct {
 	ID          int64      `json:"id" yaml:"id"`
+	StepRunID   int64      `json:"step_run_id" yaml:"step_run_id"`
 	RunID       int64      `json:"run_id" yaml:"run_id"`
-	StepName    string     `json:"step_name" yaml:"step_name"`
-	Status      StepStatus `json:"status" yaml:"status"`
 	Attempt     int        `json:"attempt" yaml:"attempt"`
+	Status      StepStatus `json:"status" yaml:"status"`
 	StartedAt   time.Time  `json:"started_at,omitempty" yaml:"started_at,omitempty"`
 	CompletedAt time.Time  `json:"completed_at,omitempty" yaml:"completed_at,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty" yaml:"exit_code,omitempty"`
 	Error       string     `json:"error,omitempty" yaml:"error,omitempty"`
 	Logs        []string   `json:"logs,omitempty" yaml:"logs,omitempty"`
 }
 
+// Summary describes the attempt in one line, e.g.
+// "attempt 2: failed, exit code 1, 1.2s".
+func (a StepAttempt) Summary() string {
+	parts := []string{string(a.Status)}
+	if a.ExitCode != nil {
+		parts = append(parts, fmt.Sprintf("exit code %d", *a.ExitCode))
+	}
+	if !a.StartedAt.IsZero() && !a.CompletedAt.IsZero() {
+		parts = append(parts, a.CompletedAt.Sub(a.StartedAt).Round(time.Millisecond).String())
+	}
+	return fmt.Sprintf("attempt %d: %s", a.Attempt+1, strings.Join(parts, ", "))
+}
+
 func (s StepStatus) IsTerminal() bool {
 	switch s {
-	case StepStatusSuccess, StepStatusFailed, StepStatusCanceled, StepStatusTimeout, StepStatusSkipped:
+	case StepStatusSuccess, StepStatusFailed, StepStatusCanceled, StepStatusTimeout, StepStatusSkipped, StepStatusInterrupted:
 		return true
 	default:
 		return false
@@ -226,46 +947,451 @@ func (s RunStatus) IsTerminal() bool {
 	}
 }
 
+var workerLabelPattern = regexp.MustCompile(`^[A-Za-z0-9._=-]+$`)
+
+// ValidateWorkerLabels checks the labels a worker agent advertises.
+func ValidateWorkerLabels(labels []string) error {
+	for _, label := range labels {
+		if !workerLabelPattern.MatchString(label) {
+			return fmt.Errorf("invalid label %q: must be letters, digits, '.', '_', '-' or '='", label)
+		}
+	}
+	return nil
+}
+
+// HasLabels reports whether a worker with the given labels may run a step
+// that requires every label in runsOn.
+func HasLabels(labels, runsOn []string) bool {
+	for _, l := range runsOn {
+		if !slices.Contains(labels, l) {
+			return false
+		}
+	}
+	return true
+}
+
+var paramNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateParams checks that run parameter names can be used as environment
+// variable names, which is how steps receive them.
+func ValidateParams(params map[string]string) error {
+	for name := range params {
+		if !paramNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid parameter name %q: must be letters, digits and underscores, not starting with a digit", name)
+		}
+	}
+	return nil
+}
+
+// FieldError is a problem with one field of a workflow. Path holds the YAML
+// keys and sequence indexes leading to the field, e.g. steps, 2, depends_on.
+type FieldError struct {
+	Path []string
+	Err  error
+}
+
+func (e FieldError) Error() string { return e.Err.Error() }
+func (e FieldError) Unwrap() error { return e.Err }
+
 func (w Workflow) Validate() error {
+	if errs := w.ValidateAll(); len(errs) > 0 {
+		return errs[0].Err
+	}
+	return nil
+}
+
+// ValidateAll returns every problem with the workflow rather than only the
+// first, in the order Validate checks them. Each step is reported at most
+// once.
+func (w Workflow) ValidateAll() []FieldError {
+	var errs []FieldError
+	add := func(err error, path ...string) {
+		errs = append(errs, FieldError{Path: path, Err: err})
+	}
+
 	if strings.TrimSpace(w.Name) == "" {
-		return errors.New("workflow name is required")
+		add(errors.New("workflow name is required"), "name")
 	}
 	if len(w.Steps) == 0 {
-		return errors.New("workflow must contain at least one step")
+		add(errors.New("workflow must contain at least one step"), "steps")
+	}
+	if w.Timeout < 0 {
+		add(errors.New("workflow timeout cannot be negative"), "timeout")
+	}
+	if w.MaxParallel < 0 {
+		add(errors.New("max_parallel cannot be negative"), "max_parallel")
+	}
+	if w.Concurrency != nil {
+		if err := w.Concurrency.Validate(); err != nil {
+			add(fmt.Errorf("concurrency: %w", err), "concurrency")
+		}
+	}
+	if w.Schedule != "" {
+		if _, err := ParseSchedule(w.Schedule); err != nil {
+			add(err, "schedule")
+		}
+	}
+	if w.Triggers != nil {
+		if err := w.Triggers.Validate(); err != nil {
+			add(fmt.Errorf("triggers: %w", err), "triggers")
+		}
+	}
+	for i, n := range w.Notify {
+		if err := n.Validate(); err != nil {
+			add(fmt.Errorf("notify[%d]: %w", i, err), "notify", strconv.Itoa(i))
+		}
+	}
+	switch w.OnRestart {
+	case "", RestartCancel, RestartResume, RestartRerun:
+	default:
+		add(fmt.Errorf("unknown on_restart policy %q: expected resume, rerun or cancel", w.OnRestart), "on_restart")
+	}
+	if w.Misfire != nil {
+		if w.Schedule == "" {
+			add(errors.New("misfire requires a schedule"), "misfire")
+		} else if err := w.Misfire.Validate(); err != nil {
+			add(fmt.Errorf("misfire: %w", err), "misfire")
+		}
+	}
+	if w.Deadline != "" {
+		if w.Schedule == "" {
+			add(errors.New("deadline requires a schedule"), "deadline")
+		} else if _, err := time.Parse(deadlineLayout, w.Deadline); err != nil {
+			add(fmt.Errorf("invalid deadline %q: expected a time of day like 06:00", w.Deadline), "deadline")
+		}
 	}
 
 	stepsByName := make(map[string]WorkflowStep, len(w.Steps))
-	for _, step := range w.Steps {
+	for i, step := range w.Steps {
 		if _, exists := stepsByName[step.Name]; exists {
-			return fmt.Errorf("duplicate step name %q", step.Name)
+			add(fmt.Errorf("duplicate step name %q", step.Name), "steps", strconv.Itoa(i), "name")
+			continue
 		}
 
 		if err := step.Validate(); err != nil {
-			return fmt.Errorf("step %q: %w", step.Name, err)
+			add(fmt.Errorf("step %q: %w", step.Name, err), "steps", strconv.Itoa(i))
 		}
 
 		stepsByName[step.Name] = step
 	}
 
-	for _, step := range w.Steps {
-		for _, dep := range step.DependsOn {
+	badDeps := false
+	for i, step := range w.Steps {
+		for j, dep := range step.DependsOn {
+			path := []string{"steps", strconv.Itoa(i), "depends_on", strconv.Itoa(j)}
 			if dep == step.Name {
-				return fmt.Errorf("step %q cannot depend on itself", step.Name)
+				add(fmt.Errorf("step %q cannot depend on itself", step.Name), path...)
+				badDeps = true
+				continue
 			}
 
 			if _, ok := stepsByName[dep]; !ok {
-				return fmt.Errorf("step %q depends on unknown step %q", step.Name, dep)
+				add(fmt.Errorf("step %q depends on unknown step %q", step.Name, dep), path...)
+				badDeps = true
 			}
 		}
 	}
 
-	if err := detectCycles(stepsByName); err != nil {
-		return err
+	if !badDeps {
+		if err := detectCycles(stepsByName); err != nil {
+			add(err, "steps")
+		}
+	}
+
+	return errs
+}
+
+// Ancestors returns the names of the steps that the named step depends on,
+// directly or through other steps.
+func (w Workflow) Ancestors(name string) map[string]bool {
+	deps := make(map[string][]string, len(w.Steps))
+	for _, s := range w.Steps {
+		deps[s.Name] = s.DependsOn
+	}
+
+	ancestors := make(map[string]bool)
+	var visit func(string)
+	visit = func(name string) {
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; ok && !ancestors[dep] {
+				ancestors[dep] = true
+				visit(dep)
+			}
+		}
+	}
+	visit(name)
+	return ancestors
+}
+
+// Levels groups the steps by how deep they are in the dependency graph: the
+// first level holds the steps without dependencies and every other step is
+// one level below its deepest dependency. Steps keep their workflow order
+// within a level. The workflow must not have cycles.
+func (w Workflow) Levels() [][]string {
+	deps := make(map[string][]string, len(w.Steps))
+	for _, s := range w.Steps {
+		deps[s.Name] = s.DependsOn
+	}
+
+	depth := make(map[string]int, len(w.Steps))
+	var visit func(string) int
+	visit = func(name string) int {
+		if d, ok := depth[name]; ok {
+			return d
+		}
+		d := 0
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; ok {
+				d = max(d, visit(dep)+1)
+			}
+		}
+		depth[name] = d
+		return d
+	}
+
+	var levels [][]string
+	for _, s := range w.Steps {
+		d := visit(s.Name)
+		for len(levels) <= d {
+			levels = append(levels, nil)
+		}
+		levels[d] = append(levels[d], s.Name)
+	}
+	return levels
+}
+
+// Subset returns a copy of the workflow with only some of its steps. If only
+// is not empty, the named steps are kept along with every step they depend
+// on. The steps in skip are removed along with every step that depends on
+// them. Naming an unknown step, or skipping a step that an only step needs,
+// is an error.
+func (w Workflow) Subset(only, skip []string) (Workflow, error) {
+	exists := make(map[string]bool, len(w.Steps))
+	for _, s := range w.Steps {
+		exists[s.Name] = true
+	}
+	for _, name := range slices.Concat(only, skip) {
+		if !exists[name] {
+			return Workflow{}, fmt.Errorf("unknown step %q", name)
+		}
+	}
+
+	keep := exists
+	if len(only) > 0 {
+		keep = make(map[string]bool)
+		for _, name := range only {
+			keep[name] = true
+			for ancestor := range w.Ancestors(name) {
+				keep[ancestor] = true
+			}
+		}
+	}
+
+	skipped := make(map[string]bool, len(skip))
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, s := range w.Steps {
+			if !skipped[s.Name] && slices.ContainsFunc(s.DependsOn, func(dep string) bool { return skipped[dep] }) {
+				skipped[s.Name] = true
+				changed = true
+			}
+		}
+	}
+	for _, name := range only {
+		if skipped[name] {
+			return Workflow{}, fmt.Errorf("step %q cannot run because it is skipped or depends on a skipped step", name)
+		}
+	}
+
+	subset := w
+	subset.Steps = nil
+	for _, s := range w.Steps {
+		if keep[s.Name] && !skipped[s.Name] {
+			subset.Steps = append(subset.Steps, s)
+		}
 	}
+	if len(subset.Steps) == 0 {
+		return Workflow{}, errors.New("no steps left to run")
+	}
+	return subset, nil
+}
+
+// ConcurrencyKey identifies the runs that count towards the same limit as
+// this workflow's runs.
+func (w Workflow) ConcurrencyKey() string {
+	if w.Concurrency != nil && w.Concurrency.Group != "" {
+		return "group:" + w.Concurrency.Group
+	}
+	return fmt.Sprintf("workflow:%d", w.ID)
+}
 
+func (c Concurrency) Validate() error {
+	if c.Limit < 0 {
+		return errors.New("limit cannot be negative")
+	}
+	switch c.Policy {
+	case "", ConcurrencyQueue, ConcurrencySkip, ConcurrencyCancelPrevious:
+	default:
+		return fmt.Errorf("unknown policy %q: expected queue, skip or cancel-previous", c.Policy)
+	}
+	if c.Group != "" && strings.TrimSpace(c.Group) != c.Group {
+		return errors.New("group cannot start or end with whitespace")
+	}
 	return nil
 }
 
+// EffectiveLimit returns the number of concurrent runs allowed, which
+// defaults to one.
+func (c Concurrency) EffectiveLimit() int {
+	if c.Limit == 0 {
+		return 1
+	}
+	return c.Limit
+}
+
+// EffectivePolicy returns the overlap policy, which defaults to queue.
+func (c Concurrency) EffectivePolicy() ConcurrencyPolicy {
+	if c.Policy == "" {
+		return ConcurrencyQueue
+	}
+	return c.Policy
+}
+
+func (m Misfire) Validate() error {
+	switch m.Policy {
+	case "", MisfireSkip, MisfireRunOnce, MisfireCatchUp:
+	default:
+		return fmt.Errorf("unknown policy %q: expected skip, run-once or catch-up", m.Policy)
+	}
+	if m.MaxCatchUp < 0 {
+		return errors.New("max_catch_up cannot be negative")
+	}
+	if m.MaxCatchUp > 0 && m.Policy != MisfireCatchUp {
+		return errors.New("max_catch_up only applies to the catch-up policy")
+	}
+	return nil
+}
+
+// ParseSchedule parses a schedule expression, an interval such as "15m" or
+// "24h" between runs.
+func ParseSchedule(expr string) (time.Duration, error) {
+	interval, err := time.ParseDuration(expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule %q: %w", expr, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid schedule %q: interval must be positive", expr)
+	}
+	return interval, nil
+}
+
+// ScheduleTimes returns the first n times a schedule fires for a workflow
+// scheduled at start: immediately, then once every interval.
+func ScheduleTimes(expr string, start time.Time, n int) ([]time.Time, error) {
+	interval, err := ParseSchedule(expr)
+	if err != nil {
+		return nil, err
+	}
+	times := make([]time.Time, n)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i) * interval)
+	}
+	return times, nil
+}
+
+// NextRunSummary describes when a scheduled workflow will next run, e.g.
+// "next run in 4m12s", or returns "" for a workflow without a schedule.
+func (w Workflow) NextRunSummary(now time.Time) string {
+	switch {
+	case w.Schedule == "":
+		return ""
+	case w.Paused:
+		return "paused"
+	case w.NextFireAt.IsZero():
+		return "not scheduled"
+	}
+	d := w.NextFireAt.Sub(now).Round(time.Second)
+	if d <= 0 {
+		return "due now"
+	}
+	return "next run in " + d.String()
+}
+
+// PlanSlots decides which schedule slots to run when the scheduler fires.
+// Every interval after last, up to now, is a due slot; the latest one counts
+// as on time if it is less than a minute (or one interval) late, and the rest
+// are missed. It returns the slots to run, oldest first, the number of due
+// slots the misfire policy drops, and the latest due slot.
+func (w Workflow) PlanSlots(last time.Time, interval time.Duration, now time.Time) ([]time.Time, int, time.Time) {
+	if interval <= 0 || !now.After(last) {
+		return nil, 0, last
+	}
+	due := int(now.Sub(last) / interval)
+	if due == 0 {
+		return nil, 0, last
+	}
+	latest := last.Add(time.Duration(due) * interval)
+
+	grace := min(time.Minute, interval)
+	onTime := now.Sub(latest) < grace
+	missed := due
+	if onTime {
+		missed--
+	}
+
+	policy := MisfireRunOnce
+	maxCatchUp := DefaultMaxCatchUp
+	if w.Misfire != nil {
+		if w.Misfire.Policy != "" {
+			policy = w.Misfire.Policy
+		}
+		if w.Misfire.MaxCatchUp > 0 {
+			maxCatchUp = w.Misfire.MaxCatchUp
+		}
+	}
+
+	var count int
+	switch policy {
+	case MisfireSkip:
+		if onTime {
+			count = 1
+		}
+	case MisfireCatchUp:
+		count = min(missed, maxCatchUp)
+		if onTime {
+			count++
+		}
+	default:
+		count = 1
+	}
+
+	slots := make([]time.Time, count)
+	for i := range slots {
+		slots[i] = latest.Add(-time.Duration(count-1-i) * interval)
+	}
+	return slots, due - count, latest
+}
+
+const deadlineLayout = "15:04"
+
+// NextDeadline returns the first time after start at which a scheduled run
+// of the workflow must have finished, or false if it has no deadline.
+func (w Workflow) NextDeadline(start time.Time) (time.Time, bool) {
+	t, err := time.Parse(deadlineLayout, w.Deadline)
+	if w.Deadline == "" || err != nil {
+		return time.Time{}, false
+	}
+
+	deadline := time.Date(start.Year(), start.Month(), start.Day(), t.Hour(), t.Minute(), 0, 0, start.Location())
+	if !deadline.After(start) {
+		deadline = deadline.AddDate(0, 0, 1)
+	}
+	return deadline, true
+}
+
 func (s WorkflowStep) Validate() error {
 	if strings.TrimSpace(s.Name) == "" {
 		return errors.New("step name is required")
@@ -304,9 +1430,33 @@ func (s WorkflowStep) Validate() error {
 	if s.RetryDelay < 0 {
 		return errors.New("retry delay cannot be negative")
 	}
+	if s.Retry != nil {
+		if s.Retries != 0 || s.RetryDelay != 0 {
+			return errors.New("retries and retry_delay cannot be combined with a retry block")
+		}
+		if err := s.Retry.Validate(); err != nil {
+			return fmt.Errorf("retry: %w", err)
+		}
+	}
 	if s.Timeout < 0 {
 		return errors.New("timeout cannot be negative")
 	}
+	if s.KillGrace < 0 {
+		return errors.New("kill grace period cannot be negative")
+	}
+	if err := ValidateWorkerLabels(s.RunsOn); err != nil {
+		return fmt.Errorf("runs_on: %w", err)
+	}
+
+	if s.Limits != nil {
+		if s.HTTP != nil && (s.Limits.MaxMemory > 0 || s.Limits.CPUTime > 0 || s.Limits.OpenFiles > 0 ||
+			s.Limits.MaxProcesses > 0 || s.Limits.IsolateNetwork || s.Limits.ReadOnlyRoot) {
+			return errors.New("http steps only support the max_output limit")
+		}
+		if err := s.Limits.Validate(); err != nil {
+			return fmt.Errorf("limits: %w", err)
+		}
+	}
 
 	for k := range s.Env {
 		if strings.Contains(k, "=") {
@@ -378,6 +1528,104 @@ func (e ExecAction) Validate() error {
 	return nil
 }
 
+func (p RetryPolicy) Validate() error {
+	if p.MaxRetries < 0 {
+		return errors.New("max_retries cannot be negative")
+	}
+	switch p.Backoff {
+	case "", BackoffConstant, BackoffLinear, BackoffExponential:
+	default:
+		return fmt.Errorf("unknown backoff strategy %q", p.Backoff)
+	}
+	if p.Delay < 0 || p.MaxDelay < 0 {
+		return errors.New("delays cannot be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("jitter must be between 0 and 1")
+	}
+
+	if p.RetryOn != nil {
+		for _, status := range p.RetryOn.HTTPStatus {
+			if !httpStatusPattern.MatchString(strings.ToLower(status)) {
+				return fmt.Errorf("invalid http status %q: expected a code like 503 or a class like 5xx", status)
+			}
+		}
+		if p.RetryOn.Output != "" {
+			if _, err := regexp.Compile(p.RetryOn.Output); err != nil {
+				return fmt.Errorf("invalid output pattern: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+var httpStatusPattern = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+
+// DefaultMaxRetryDelay bounds linear and exponential backoff for policies
+// without a max_delay, unless the initial delay is already longer.
+const DefaultMaxRetryDelay = time.Hour
+
+// BackoffDelay returns the delay before the given retry, where retry 1 is the
+// first attempt after the initial one. Jitter is not applied.
+func (p RetryPolicy) BackoffDelay(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+
+	limit := p.MaxDelay
+	if limit == 0 {
+		limit = max(DefaultMaxRetryDelay, p.Delay)
+	}
+
+	delay := p.Delay
+	switch p.Backoff {
+	case BackoffLinear:
+		if p.Delay > limit/time.Duration(retry) {
+			return limit
+		}
+		delay = p.Delay * time.Duration(retry)
+	case BackoffExponential:
+		for i := 1; i < retry && delay < limit; i++ {
+			delay *= 2
+		}
+	}
+
+	return min(delay, limit)
+}
+
+// MatchesHTTPStatus reports whether code is covered by one of the policy's
+// http_status conditions.
+func (c RetryConditions) MatchesHTTPStatus(code int) bool {
+	text := strconv.Itoa(code)
+	for _, status := range c.HTTPStatus {
+		status = strings.ToLower(status)
+		if status == text || (strings.HasSuffix(status, "xx") && status[0] == text[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l StepLimits) Validate() error {
+	if l.MaxMemory < 0 || l.MaxOutput < 0 {
+		return errors.New("sizes cannot be negative")
+	}
+	if l.CPUTime < 0 {
+		return errors.New("cpu time cannot be negative")
+	}
+	if l.CPUTime > 0 && l.CPUTime < time.Second {
+		return errors.New("cpu time must be at least 1s")
+	}
+	if l.OpenFiles < 0 {
+		return errors.New("open files cannot be negative")
+	}
+	if l.MaxProcesses < 0 {
+		return errors.New("max processes cannot be negative")
+	}
+	return nil
+}
+
 func (h HTTPAction) Validate() error {
 	if strings.TrimSpace(h.URL) == "" {
 		return errors.New("http url is required")
@@ -433,6 +1681,32 @@ func detectCycles(steps map[string]WorkflowStep) error {
 	return nil
 }
 
+// RetryPolicy returns the policy used to retry the step, translating the
+// legacy retries and retry_delay fields when no retry block is set.
+func (s WorkflowStep) RetryPolicy() RetryPolicy {
+	if s.Retry != nil {
+		return *s.Retry
+	}
+	return RetryPolicy{
+		MaxRetries: s.Retries,
+		Backoff:    BackoffConstant,
+		Delay:      s.RetryDelay,
+	}
+}
+
+// ProvidesOutput reports whether the step stores key as step data, either
+// as one of its declared outputs or, for HTTP steps, as the status, body or
+// a header_ value that every HTTP step stores.
+func (s WorkflowStep) ProvidesOutput(key string) bool {
+	if _, ok := s.Outputs[key]; ok {
+		return true
+	}
+	if s.HTTP != nil {
+		return key == "status" || key == "body" || strings.HasPrefix(key, "header_")
+	}
+	return false
+}
+
 func (s WorkflowStep) ActionType() StepType {
 	if s.Exec != nil {
 		return StepTypeExec
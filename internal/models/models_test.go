@@ -1,9 +1,12 @@
 package models
 
 import (
+	"slices"
 	"strings"
 	"testing"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 func TestValidateWorkflowSuccess(t *testing.T) {
@@ -131,3 +134,566 @@ func TestExecActionValidation(t *testing.T) {
 		t.Fatalf("expected exec validation error, got: %v", err)
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]ByteSize{
+		"512":    512,
+		"4K":     4 << 10,
+		"256MiB": 256 << 20,
+		"1g":     1 << 30,
+		"10 MB":  10 << 20,
+	}
+	for input, want := range cases {
+		got, err := ParseByteSize(input)
+		if err != nil {
+			t.Fatalf("ParseByteSize(%q) returned error: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("ParseByteSize(%q) = %d, want %d", input, got, want)
+		}
+	}
+
+	if _, err := ParseByteSize("lots"); err == nil {
+		t.Fatal("expected error for invalid byte size")
+	}
+}
+
+func TestValidateStepLimits(t *testing.T) {
+	step := WorkflowStep{
+		Name:   "limited-http",
+		HTTP:   &HTTPAction{URL: "https://example.com"},
+		Limits: &StepLimits{MaxMemory: 64 << 20},
+	}
+
+	err := step.Validate()
+	if err == nil || !strings.Contains(err.Error(), "only support the max_output limit") {
+		t.Fatalf("expected http limits error, got: %v", err)
+	}
+
+	step = WorkflowStep{
+		Name:   "limited-exec",
+		Exec:   &ExecAction{Command: "echo"},
+		Limits: &StepLimits{CPUTime: 500 * time.Millisecond},
+	}
+
+	err = step.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cpu time must be at least 1s") {
+		t.Fatalf("expected cpu time error, got: %v", err)
+	}
+}
+
+func TestRetryPolicyBackoffDelay(t *testing.T) {
+	policy := RetryPolicy{Backoff: BackoffExponential, Delay: time.Second, MaxDelay: 5 * time.Second}
+	want := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for retry, expected := range want {
+		if got := policy.BackoffDelay(retry); got != expected {
+			t.Fatalf("exponential BackoffDelay(%d) = %s, want %s", retry, got, expected)
+		}
+	}
+
+	policy = RetryPolicy{Backoff: BackoffLinear, Delay: 2 * time.Second}
+	if got := policy.BackoffDelay(3); got != 6*time.Second {
+		t.Fatalf("linear BackoffDelay(3) = %s, want 6s", got)
+	}
+
+	for _, backoff := range []BackoffStrategy{BackoffLinear, BackoffExponential} {
+		policy = RetryPolicy{Backoff: backoff, Delay: time.Second}
+		for _, retry := range []int{10000, 1 << 40} {
+			if got := policy.BackoffDelay(retry); got != DefaultMaxRetryDelay {
+				t.Fatalf("%s BackoffDelay(%d) without max_delay = %s, want %s", backoff, retry, got, DefaultMaxRetryDelay)
+			}
+		}
+	}
+
+	legacy := WorkflowStep{Retries: 2, RetryDelay: 3 * time.Second}.RetryPolicy()
+	if legacy.MaxRetries != 2 || legacy.BackoffDelay(2) != 3*time.Second {
+		t.Fatalf("unexpected legacy policy: %+v", legacy)
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	step := WorkflowStep{
+		Name:    "retry-conflict",
+		Exec:    &ExecAction{Command: "echo"},
+		Retries: 1,
+		Retry:   &RetryPolicy{MaxRetries: 3},
+	}
+
+	err := step.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined with a retry block") {
+		t.Fatalf("expected retry conflict error, got: %v", err)
+	}
+
+	step = WorkflowStep{
+		Name:  "retry-status",
+		HTTP:  &HTTPAction{URL: "https://example.com"},
+		Retry: &RetryPolicy{MaxRetries: 3, RetryOn: &RetryConditions{HTTPStatus: []string{"5xx", "600"}}},
+	}
+
+	err = step.Validate()
+	if err == nil || !strings.Contains(err.Error(), "invalid http status") {
+		t.Fatalf("expected http status error, got: %v", err)
+	}
+
+	conditions := RetryConditions{HTTPStatus: []string{"5xx", "429"}}
+	if !conditions.MatchesHTTPStatus(503) || !conditions.MatchesHTTPStatus(429) || conditions.MatchesHTTPStatus(404) {
+		t.Fatal("unexpected http status matching")
+	}
+}
+
+func TestStepAttemptSummary(t *testing.T) {
+	code := 3
+	started := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	attempt := StepAttempt{
+		Attempt:     1,
+		Status:      StepStatusFailed,
+		StartedAt:   started,
+		CompletedAt: started.Add(1500 * time.Millisecond),
+		ExitCode:    &code,
+	}
+
+	if got, want := attempt.Summary(), "attempt 2: failed, exit code 3, 1.5s"; got != want {
+		t.Fatalf("Summary() = %q, want %q", got, want)
+	}
+}
+
+func TestWorkflowNextDeadline(t *testing.T) {
+	w := Workflow{Name: "nightly", Schedule: "24h", Deadline: "06:00"}
+
+	start := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	got, ok := w.NextDeadline(start)
+	if !ok || !got.Equal(time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC)) {
+		t.Fatalf("NextDeadline(%s) = %s, %v", start, got, ok)
+	}
+
+	start = time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)
+	got, ok = w.NextDeadline(start)
+	if !ok || !got.Equal(time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC)) {
+		t.Fatalf("NextDeadline(%s) = %s, %v", start, got, ok)
+	}
+}
+
+func TestValidateWorkflowDeadline(t *testing.T) {
+	w := Workflow{
+		Name:     "unscheduled",
+		Deadline: "06:00",
+		Steps:    []WorkflowStep{{Name: "step", Exec: &ExecAction{Command: "echo"}}},
+	}
+
+	err := w.Validate()
+	if err == nil || !strings.Contains(err.Error(), "deadline requires a schedule") {
+		t.Fatalf("expected deadline schedule error, got: %v", err)
+	}
+
+	w.Schedule = "24h"
+	w.Deadline = "6am"
+	err = w.Validate()
+	if err == nil || !strings.Contains(err.Error(), "invalid deadline") {
+		t.Fatalf("expected invalid deadline error, got: %v", err)
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	if err := ValidateParams(map[string]string{"TARGET": "prod", "_retries2": "3"}); err != nil {
+		t.Fatalf("expected valid params, got: %v", err)
+	}
+
+	for _, name := range []string{"1BAD", "has-dash", ""} {
+		if err := ValidateParams(map[string]string{name: "x"}); err == nil {
+			t.Fatalf("expected error for parameter name %q", name)
+		}
+	}
+}
+
+func TestValidateWorkflowConcurrency(t *testing.T) {
+	w := Workflow{
+		ID:          7,
+		Name:        "deploy",
+		Concurrency: &Concurrency{Policy: "drop"},
+		Steps:       []WorkflowStep{{Name: "step", Exec: &ExecAction{Command: "echo"}}},
+	}
+
+	err := w.Validate()
+	if err == nil || !strings.Contains(err.Error(), "unknown policy") {
+		t.Fatalf("expected unknown policy error, got: %v", err)
+	}
+
+	w.Concurrency = &Concurrency{}
+	if w.Concurrency.EffectiveLimit() != 1 || w.Concurrency.EffectivePolicy() != ConcurrencyQueue {
+		t.Fatalf("unexpected concurrency defaults: %+v", w.Concurrency)
+	}
+	if key := w.ConcurrencyKey(); key != "workflow:7" {
+		t.Fatalf("ConcurrencyKey() = %q, want workflow:7", key)
+	}
+
+	w.Concurrency.Group = "database"
+	if key := w.ConcurrencyKey(); key != "group:database" {
+		t.Fatalf("ConcurrencyKey() = %q, want group:database", key)
+	}
+}
+
+func TestWorkflowPlanSlots(t *testing.T) {
+	last := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	// Three days later and ten seconds past the latest slot.
+	now := last.Add(3*day + 10*time.Second)
+
+	tests := []struct {
+		name    string
+		misfire *Misfire
+		want    int
+		dropped int
+	}{
+		{"default runs once", nil, 1, 2},
+		{"skip runs the on-time slot", &Misfire{Policy: MisfireSkip}, 1, 2},
+		{"catch up runs every slot", &Misfire{Policy: MisfireCatchUp}, 3, 0},
+		{"catch up is bounded", &Misfire{Policy: MisfireCatchUp, MaxCatchUp: 1}, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := Workflow{Schedule: "24h", Misfire: tt.misfire}
+			slots, dropped, latest := w.PlanSlots(last, day, now)
+			if len(slots) != tt.want || dropped != tt.dropped {
+				t.Fatalf("PlanSlots() = %d slots, %d dropped, want %d and %d", len(slots), dropped, tt.want, tt.dropped)
+			}
+			if !latest.Equal(last.Add(3 * day)) {
+				t.Fatalf("latest = %v, want %v", latest, last.Add(3*day))
+			}
+			if !slots[len(slots)-1].Equal(latest) {
+				t.Fatalf("last slot to run = %v, want %v", slots[len(slots)-1], latest)
+			}
+		})
+	}
+
+	w := Workflow{Schedule: "24h", Misfire: &Misfire{Policy: MisfireSkip}}
+	if slots, dropped, _ := w.PlanSlots(last, day, now.Add(time.Hour)); len(slots) != 0 || dropped != 3 {
+		t.Fatalf("skip with no on-time slot = %d slots, %d dropped, want 0 and 3", len(slots), dropped)
+	}
+}
+
+func TestWorkflowBackfillSlots(t *testing.T) {
+	from := time.Date(2024, 9, 1, 15, 30, 0, 0, time.UTC)
+	to := time.Date(2024, 9, 3, 0, 0, 0, 0, time.UTC)
+
+	w := Workflow{Name: "report", Schedule: "24h"}
+	slots, err := w.BackfillSlots(from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(slots) != 3 {
+		t.Fatalf("got %d slots, want 3", len(slots))
+	}
+	if got := LogicalDate(slots[0], 24*time.Hour); got != "2024-09-01" {
+		t.Fatalf("LogicalDate() = %q, want 2024-09-01", got)
+	}
+
+	w.Schedule = "6h"
+	if slots, err = w.BackfillSlots(from, to); err != nil || len(slots) != 12 {
+		t.Fatalf("got %d slots and error %v, want 12 slots", len(slots), err)
+	}
+	if got := LogicalDate(slots[4], 6*time.Hour); got != "2024-09-02T00:00:00Z" {
+		t.Fatalf("LogicalDate() = %q, want 2024-09-02T00:00:00Z", got)
+	}
+
+	if _, err := w.BackfillSlots(to, from); err == nil {
+		t.Fatal("expected error for a reversed range")
+	}
+	w.Schedule = ""
+	if _, err := w.BackfillSlots(from, to); err == nil {
+		t.Fatal("expected error for a workflow without a schedule")
+	}
+}
+
+func TestWorkflowPausedNotExported(t *testing.T) {
+	w := Workflow{Name: "nightly", Schedule: "24h", Paused: true}
+
+	out, err := yaml.Marshal(w)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(out), "paused") {
+		t.Fatalf("paused state should not be part of the exported definition:\n%s", out)
+	}
+}
+
+func TestScheduleTimesAndNextRun(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	times, err := ScheduleTimes("15m", start, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !times[0].Equal(start) || !times[2].Equal(start.Add(30*time.Minute)) {
+		t.Fatalf("unexpected fire times: %v", times)
+	}
+	if _, err := ScheduleTimes("-1h", start, 3); err == nil {
+		t.Fatal("expected error for a negative interval")
+	}
+
+	w := Workflow{Name: "sync", Schedule: "15m", NextFireAt: start.Add(90 * time.Second)}
+	if got := w.NextRunSummary(start); got != "next run in 1m30s" {
+		t.Fatalf("NextRunSummary() = %q", got)
+	}
+	if got := w.NextRunSummary(start.Add(time.Hour)); got != "due now" {
+		t.Fatalf("NextRunSummary() = %q, want due now", got)
+	}
+	w.Paused = true
+	if got := w.NextRunSummary(start); got != "paused" {
+		t.Fatalf("NextRunSummary() = %q, want paused", got)
+	}
+
+	w = Workflow{Name: "sync", Schedule: "often", Steps: []WorkflowStep{{Name: "step", Exec: &ExecAction{Command: "echo"}}}}
+	if err := w.Validate(); err == nil || !strings.Contains(err.Error(), "invalid schedule") {
+		t.Fatalf("expected invalid schedule error, got: %v", err)
+	}
+}
+
+func TestValidateWorkflowTriggers(t *testing.T) {
+	w := Workflow{
+		Name:  "ingest",
+		Steps: []WorkflowStep{{Name: "step", Exec: &ExecAction{Command: "echo"}}},
+		Triggers: &Triggers{
+			Files:   []FileTrigger{{Dir: "/srv/inbox", Pattern: "*.csv", Events: []FileEvent{FileCreated}}},
+			Webhook: &WebhookTrigger{SecretEnv: "INGEST_SECRET"},
+		},
+	}
+	if err := w.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !w.Triggers.Files[0].Watches(FileCreated) || w.Triggers.Files[0].Watches(FileModified) {
+		t.Fatal("file trigger should only watch created files")
+	}
+
+	w.Triggers.Webhook.Secret = "s3cret"
+	if err := w.Validate(); err == nil || !strings.Contains(err.Error(), "exactly one of secret or secret_env") {
+		t.Fatalf("expected secret error, got: %v", err)
+	}
+	w.Triggers.Webhook = nil
+
+	w.Triggers.Files[0].Events = []FileEvent{"deleted"}
+	if err := w.Validate(); err == nil || !strings.Contains(err.Error(), "unknown event") {
+		t.Fatalf("expected unknown event error, got: %v", err)
+	}
+	w.Triggers.Files[0] = FileTrigger{Pattern: "*.csv"}
+	if err := w.Validate(); err == nil || !strings.Contains(err.Error(), "dir is required") {
+		t.Fatalf("expected dir error, got: %v", err)
+	}
+}
+
+func TestFindTriggerCycle(t *testing.T) {
+	after := func(name string, upstreams ...string) Workflow {
+		w := Workflow{Name: name, Triggers: &Triggers{}}
+		for _, u := range upstreams {
+			w.Triggers.After = append(w.Triggers.After, AfterTrigger{Workflow: u})
+		}
+		return w
+	}
+	upstreams := map[string][]string{
+		"transform": {"ingest"},
+		"report":    {"transform"},
+	}
+
+	if cycle := FindTriggerCycle(after("audit", "report"), upstreams); cycle != nil {
+		t.Fatalf("unexpected cycle: %v", cycle)
+	}
+	cycle := FindTriggerCycle(after("ingest", "report"), upstreams)
+	if want := []string{"ingest", "transform", "report", "ingest"}; !slices.Equal(cycle, want) {
+		t.Fatalf("FindTriggerCycle() = %v, want %v", cycle, want)
+	}
+	if cycle := FindTriggerCycle(after("loop", "loop"), nil); len(cycle) != 2 {
+		t.Fatalf("expected a self-trigger cycle, got %v", cycle)
+	}
+
+	a := AfterTrigger{Workflow: "ingest"}
+	if !a.Matches("ingest", RunStatusSuccess) || a.Matches("ingest", RunStatusFailed) || a.Matches("report", RunStatusSuccess) {
+		t.Fatal("after trigger without statuses should only match successful runs of its workflow")
+	}
+	if err := (AfterTrigger{Workflow: "ingest", Statuses: []RunStatus{RunStatusPending}}).Validate(); err == nil {
+		t.Fatal("expected error for a non-final status")
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := Lease{Name: DaemonLeasePrefix + "host:42", Holder: "host:42", ExpiresAt: now.Add(5 * time.Second)}
+
+	if l.Expired(now) {
+		t.Fatal("lease should not have expired yet")
+	}
+	if !l.Expired(now.Add(5 * time.Second)) {
+		t.Fatal("lease should expire at its expiry time")
+	}
+}
+
+func TestWorkflowRestartPolicy(t *testing.T) {
+	w := Workflow{Name: "etl", Steps: []WorkflowStep{{Name: "step", Exec: &ExecAction{Command: "echo"}}}}
+	if got := w.EffectiveRestartPolicy(); got != RestartCancel {
+		t.Fatalf("EffectiveRestartPolicy() = %q, want cancel", got)
+	}
+
+	w.OnRestart = RestartResume
+	if err := w.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.OnRestart = "retry"
+	if err := w.Validate(); err == nil || !strings.Contains(err.Error(), "unknown on_restart policy") {
+		t.Fatalf("expected on_restart error, got: %v", err)
+	}
+
+	if !StepStatusInterrupted.IsTerminal() {
+		t.Fatal("interrupted step runs should be terminal")
+	}
+}
+
+func TestWorkflowStepRunsOn(t *testing.T) {
+	step := WorkflowStep{Name: "build", Exec: &ExecAction{Command: "echo"}, RunsOn: []string{"linux", "gpu"}}
+	if err := step.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !HasLabels([]string{"linux", "amd64", "gpu"}, step.RunsOn) {
+		t.Fatal("worker with every label should match")
+	}
+	if HasLabels([]string{"linux", "amd64"}, step.RunsOn) {
+		t.Fatal("worker missing a label should not match")
+	}
+
+	step.RunsOn = []string{"has space"}
+	if err := step.Validate(); err == nil || !strings.Contains(err.Error(), "runs_on") {
+		t.Fatalf("expected runs_on error, got: %v", err)
+	}
+}
+
+func TestNotifierValidate(t *testing.T) {
+	n := Notifier{Slack: &SlackNotify{URLEnv: "SLACK_URL", Text: "{{.Workflow}} failed: {{.Error}}"}}
+	if err := n.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !n.Wants(EventRunFailed) || n.Wants(EventRunSucceeded) {
+		t.Fatal("notifier without events should only want run.failed")
+	}
+
+	tests := []struct {
+		name     string
+		notifier Notifier
+		wantErr  string
+	}{
+		{"no kind", Notifier{}, "exactly one of webhook, slack or email"},
+		{"two kinds", Notifier{Slack: n.Slack, Webhook: &WebhookNotify{URL: "http://example.com"}}, "exactly one of webhook, slack or email"},
+		{"unknown event", Notifier{Events: []EventType{"run.exploded"}, Slack: n.Slack}, "unknown event"},
+		{"bad template", Notifier{Webhook: &WebhookNotify{URL: "http://example.com", Payload: "{{.Workflow"}}, "invalid payload template"},
+		{"email without port", Notifier{Email: &EmailNotify{SMTP: "mail.example.com", From: "gork@example.com", To: []string{"ops@example.com"}}}, "host:port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.notifier.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWorkflowValidateAll(t *testing.T) {
+	w := Workflow{
+		Name:    "etl",
+		Timeout: -time.Second,
+		Steps: []WorkflowStep{
+			{Name: "extract", Exec: &ExecAction{Command: "echo"}, Outputs: map[string]string{"rows": "ROWS:"}},
+			{Name: "fetch", HTTP: &HTTPAction{Method: "GET", URL: "http://example.com"}, DependsOn: []string{"extract"}},
+			{Name: "load", DependsOn: []string{"fetch", "missing"}},
+		},
+	}
+
+	errs := w.ValidateAll()
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %d: %v", len(errs), errs)
+	}
+	wantPaths := [][]string{{"timeout"}, {"steps", "2"}, {"steps", "2", "depends_on", "1"}}
+	for i, want := range wantPaths {
+		if !slices.Equal(errs[i].Path, want) {
+			t.Errorf("error %d (%v): expected path %v, got %v", i, errs[i], want, errs[i].Path)
+		}
+	}
+	if err := w.Validate(); err == nil || err.Error() != errs[0].Error() {
+		t.Fatalf("Validate should return the first error, got: %v", err)
+	}
+
+	ancestors := w.Ancestors("load")
+	if len(ancestors) != 2 || !ancestors["fetch"] || !ancestors["extract"] {
+		t.Fatalf("unexpected ancestors of load: %v", ancestors)
+	}
+	if len(w.Ancestors("extract")) != 0 {
+		t.Fatal("extract should have no ancestors")
+	}
+
+	if !w.Steps[0].ProvidesOutput("rows") || w.Steps[0].ProvidesOutput("status") {
+		t.Fatal("exec steps should only provide their declared outputs")
+	}
+	if !w.Steps[1].ProvidesOutput("status") || !w.Steps[1].ProvidesOutput("header_etag") {
+		t.Fatal("http steps should provide their status and headers")
+	}
+}
+
+func TestWorkflowLevels(t *testing.T) {
+	w := Workflow{Steps: []WorkflowStep{
+		{Name: "report", DependsOn: []string{"load", "extract"}},
+		{Name: "extract"},
+		{Name: "load", DependsOn: []string{"transform"}},
+		{Name: "transform", DependsOn: []string{"extract"}},
+		{Name: "notify"},
+	}}
+
+	want := [][]string{{"extract", "notify"}, {"transform"}, {"load"}, {"report"}}
+	got := w.Levels()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if !slices.Equal(got[i], want[i]) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestWorkflowSubset(t *testing.T) {
+	w := Workflow{Steps: []WorkflowStep{
+		{Name: "extract"},
+		{Name: "transform", DependsOn: []string{"extract"}},
+		{Name: "load", DependsOn: []string{"transform"}},
+		{Name: "report", DependsOn: []string{"load"}},
+		{Name: "notify"},
+	}}
+
+	tests := []struct {
+		only, skip []string
+		want       []string
+		wantErr    bool
+	}{
+		{want: []string{"extract", "transform", "load", "report", "notify"}},
+		{only: []string{"load"}, want: []string{"extract", "transform", "load"}},
+		{skip: []string{"transform"}, want: []string{"extract", "notify"}},
+		{only: []string{"load", "notify"}, skip: []string{"report"}, want: []string{"extract", "transform", "load", "notify"}},
+		{only: []string{"report"}, skip: []string{"extract"}, wantErr: true},
+		{only: []string{"missing"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		subset, err := w.Subset(tt.only, tt.skip)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("only %v, skip %v: expected an error", tt.only, tt.skip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("only %v, skip %v: %v", tt.only, tt.skip, err)
+		}
+		var got []string
+		for _, s := range subset.Steps {
+			got = append(got, s.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("only %v, skip %v: expected %v, got %v", tt.only, tt.skip, tt.want, got)
+		}
+	}
+}
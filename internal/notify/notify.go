@@ -0,0 +1,297 @@
+// Package notify sends the notifiers configured on workflows when run and
+// step events happen.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// Templates used by notifiers that do not set their own.
+const (
+	defaultText    = `{{.Workflow}} run {{.RunID}}: {{.Type}}{{if .Step}} at step {{.Step}}{{end}}{{if .Error}}: {{.Error}}{{end}}`
+	defaultSubject = `[gork] {{.Workflow}} run {{.RunID}}: {{.Type}}`
+	defaultBody    = `Workflow: {{.Workflow}}
+Run: {{.RunID}}
+Event: {{.Type}}
+{{if .Step}}Step: {{.Step}} (attempt {{.Attempt}})
+{{end}}{{if .Error}}Error: {{.Error}}
+{{end}}Time: {{.Time.Format "2006-01-02 15:04:05 MST"}}
+`
+)
+
+const sendTimeout = 10 * time.Second
+
+// retryDelay is the wait before the second attempt; it doubles after each
+// failed attempt. Tests shorten it.
+var retryDelay = time.Second
+
+// permanentError is a failure that retrying cannot fix, such as a template
+// that does not render.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Sender delivers notifications in the background, retrying failed
+// deliveries and recording every attempt.
+type Sender struct {
+	db     *db.DB
+	client *http.Client
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewSender(db *db.DB) *Sender {
+	return &Sender{
+		db:     db,
+		client: &http.Client{Timeout: sendTimeout},
+		stop:   make(chan struct{}),
+	}
+}
+
+// Handle sends every notifier of workflow that wants event. It does not
+// wait for delivery, so it can be subscribed to the engine's events.
+func (s *Sender) Handle(workflow *models.Workflow, event models.Event) {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	for _, n := range workflow.Notify {
+		if !n.Wants(event.Type) {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.deliver(n, event)
+		}()
+	}
+}
+
+// Shutdown stops retrying and waits, until ctx ends, for deliveries in
+// progress to finish.
+func (s *Sender) Shutdown(ctx context.Context) {
+	s.once.Do(func() { close(s.stop) })
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Stopped waiting for notifications to be delivered", "component", "notify")
+	}
+}
+
+func (s *Sender) deliver(n models.Notifier, event models.Event) {
+	name := n.DisplayName()
+	delay := retryDelay
+	attempts := n.EffectiveAttempts()
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err := s.send(n, event)
+
+		record := &models.NotificationAttempt{
+			RunID:     event.RunID,
+			Notifier:  name,
+			Event:     event.Type,
+			Step:      event.Step,
+			Attempt:   attempt,
+			Status:    models.NotificationSent,
+			CreatedAt: time.Now(),
+		}
+		if err != nil {
+			record.Status = models.NotificationFailed
+			record.Error = err.Error()
+		}
+		if dbErr := s.db.InsertNotificationAttempt(record); dbErr != nil {
+			slog.Error("Failed to record notification attempt", "component", "notify", "run_id", event.RunID, "error", dbErr)
+		}
+
+		if err == nil {
+			slog.Info("Sent notification", "component", "notify", "workflow", event.Workflow, "run_id", event.RunID, "notifier", name, "event", event.Type)
+			return
+		}
+		slog.Warn("Failed to send notification", "component", "notify", "workflow", event.Workflow, "run_id", event.RunID, "notifier", name, "event", event.Type, "attempt", attempt, "error", err)
+
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempt == attempts {
+			return
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Sender) send(n models.Notifier, event models.Event) error {
+	switch {
+	case n.Webhook != nil:
+		return s.sendWebhook(n.Webhook, event)
+	case n.Slack != nil:
+		return s.sendSlack(n.Slack, event)
+	case n.Email != nil:
+		return sendEmail(n.Email, event)
+	}
+	return permanentError{errors.New("notifier has no webhook, slack or email settings")}
+}
+
+func (s *Sender) sendWebhook(w *models.WebhookNotify, event models.Event) error {
+	var payload []byte
+	if w.Payload == "" {
+		var err error
+		if payload, err = json.Marshal(event); err != nil {
+			return permanentError{err}
+		}
+	} else {
+		rendered, err := render("payload", w.Payload, event)
+		if err != nil {
+			return err
+		}
+		if !json.Valid([]byte(rendered)) {
+			return permanentError{errors.New("payload template did not render valid JSON")}
+		}
+		payload = []byte(rendered)
+	}
+
+	url, err := resolveURL(w.URL, w.URLEnv)
+	if err != nil {
+		return err
+	}
+	return s.post(url, w.Headers, payload)
+}
+
+func (s *Sender) sendSlack(sl *models.SlackNotify, event models.Event) error {
+	text := sl.Text
+	if text == "" {
+		text = defaultText
+	}
+	rendered, err := render("text", text, event)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]string{"text": rendered})
+	if err != nil {
+		return permanentError{err}
+	}
+
+	url, err := resolveURL(sl.URL, sl.URLEnv)
+	if err != nil {
+		return err
+	}
+	return s.post(url, nil, payload)
+}
+
+func (s *Sender) post(url string, headers map[string]string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("%s returned %s", req.URL.Redacted(), resp.Status)
+		if msg := strings.TrimSpace(string(msg)); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		// Other client errors mean the request itself is wrong.
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func sendEmail(e *models.EmailNotify, event models.Event) error {
+	subjectTemplate, bodyTemplate := e.Subject, e.Body
+	if subjectTemplate == "" {
+		subjectTemplate = defaultSubject
+	}
+	if bodyTemplate == "" {
+		bodyTemplate = defaultBody
+	}
+	subject, err := render("subject", subjectTemplate, event)
+	if err != nil {
+		return err
+	}
+	body, err := render("body", bodyTemplate, event)
+	if err != nil {
+		return err
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.Join(strings.Fields(subject), " "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if e.Username != "" {
+		password := os.Getenv(e.PasswordEnv)
+		if password == "" {
+			return permanentError{fmt.Errorf("environment variable %s is not set", e.PasswordEnv)}
+		}
+		host, _, _ := net.SplitHostPort(e.SMTP)
+		auth = smtp.PlainAuth("", e.Username, password, host)
+	}
+	return smtp.SendMail(e.SMTP, auth, e.From, e.To, []byte(msg.String()))
+}
+
+func render(name, text string, event models.Event) (string, error) {
+	t, err := models.ParseNotifyTemplate(name, text)
+	if err != nil {
+		return "", permanentError{err}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, event); err != nil {
+		return "", permanentError{fmt.Errorf("failed to render %s: %w", name, err)}
+	}
+	return buf.String(), nil
+}
+
+func resolveURL(url, env string) (string, error) {
+	if url != "" {
+		return url, nil
+	}
+	if v := os.Getenv(env); v != "" {
+		return v, nil
+	}
+	return "", permanentError{fmt.Errorf("environment variable %s is not set", env)}
+}
@@ -0,0 +1,298 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// request is what the test server received.
+type request struct {
+	at     time.Time
+	header http.Header
+	body   string
+}
+
+// server answers each request with the next of statuses, repeating the last
+// one, and records the requests.
+type server struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func newServer(t *testing.T, statuses ...int) *server {
+	t.Helper()
+	s := &server{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		status := s.statuses[min(len(s.requests), len(s.statuses)-1)]
+		s.requests = append(s.requests, request{at: time.Now(), header: r.Header.Clone(), body: string(body)})
+		s.mu.Unlock()
+		w.WriteHeader(status)
+		if status/100 != 2 {
+			io.WriteString(w, "try again")
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) received() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]request(nil), s.requests...)
+}
+
+// newSender returns a sender with a short retry delay, and the ID of a run
+// that attempts can be recorded against.
+func newSender(t *testing.T) (*Sender, *db.DB, int64) {
+	t.Helper()
+	old := retryDelay
+	retryDelay = 20 * time.Millisecond
+	t.Cleanup(func() { retryDelay = old })
+
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	w := &models.Workflow{Name: "nightly", Steps: []models.WorkflowStep{{Name: "load", Exec: &models.ExecAction{Command: "true"}}}}
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(w.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runID, err := database.InsertRun(&models.Run{WorkflowID: stored.ID, Status: models.RunStatusFailed, Trigger: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSender(database), database, runID
+}
+
+func failedEvent(runID int64) models.Event {
+	return models.Event{
+		Type:     models.EventStepFailed,
+		Time:     time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Workflow: "nightly",
+		RunID:    runID,
+		Step:     "load",
+		Attempt:  2,
+		Error:    `exit status 1: "disk full"`,
+	}
+}
+
+func attempts(t *testing.T, database *db.DB, runID int64) []models.NotificationAttempt {
+	t.Helper()
+	attempts, err := database.ListNotificationAttempts(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attempts
+}
+
+func TestDeliverRetriesWithBackoff(t *testing.T) {
+	sender, database, runID := newSender(t)
+	srv := newServer(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+
+	n := models.Notifier{Name: "ops", Attempts: 5, Webhook: &models.WebhookNotify{URL: srv.URL}}
+	sender.deliver(n, failedEvent(runID))
+
+	requests := srv.received()
+	if len(requests) != 3 {
+		t.Fatalf("%d requests, want 3: two failures and a success", len(requests))
+	}
+	if first, second := requests[1].at.Sub(requests[0].at), requests[2].at.Sub(requests[1].at); first < retryDelay || second < 2*retryDelay {
+		t.Fatalf("retried after %s and %s, want at least %s and %s", first, second, retryDelay, 2*retryDelay)
+	}
+
+	recorded := attempts(t, database, runID)
+	if len(recorded) != 3 {
+		t.Fatalf("%d attempts recorded, want 3", len(recorded))
+	}
+	for i, a := range recorded {
+		want := models.NotificationFailed
+		if i == 2 {
+			want = models.NotificationSent
+		}
+		if a.Attempt != i+1 || a.Status != want || a.Notifier != "ops" || a.Event != models.EventStepFailed || a.Step != "load" {
+			t.Errorf("attempt %d = %+v, want attempt %d %s for ops on step.failed at load", i, a, i+1, want)
+		}
+	}
+	if !strings.Contains(recorded[0].Error, "503 Service Unavailable: try again") {
+		t.Errorf("first attempt error = %q, want the status and body of the response", recorded[0].Error)
+	}
+	if recorded[2].Error != "" {
+		t.Errorf("successful attempt error = %q, want none", recorded[2].Error)
+	}
+}
+
+func TestDeliverGivesUpOnClientErrors(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		tries  int
+	}{
+		{http.StatusBadRequest, 1},
+		{http.StatusUnauthorized, 1},
+		{http.StatusNotFound, 1},
+		{http.StatusRequestTimeout, 3},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusInternalServerError, 3},
+	} {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			sender, database, runID := newSender(t)
+			srv := newServer(t, tt.status)
+
+			sender.deliver(models.Notifier{Webhook: &models.WebhookNotify{URL: srv.URL}}, failedEvent(runID))
+
+			if got := len(srv.received()); got != tt.tries {
+				t.Fatalf("%d requests, want %d", got, tt.tries)
+			}
+			recorded := attempts(t, database, runID)
+			if len(recorded) != tt.tries {
+				t.Fatalf("%d attempts recorded, want %d", len(recorded), tt.tries)
+			}
+			for _, a := range recorded {
+				if a.Status != models.NotificationFailed {
+					t.Fatalf("attempt %d status = %s, want failed", a.Attempt, a.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	t.Setenv("GORK_TEST_TOKEN", "t0ken")
+	for _, tt := range []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{
+			name:    "template",
+			payload: `{"text": {{json (printf "%s failed at %s: %s" .Workflow .Step .Error)}}, "run": {{.RunID}}}`,
+			want:    `{"text": "nightly failed at load: exit status 1: \"disk full\"", "run": RUN}`,
+		},
+		{
+			name: "event",
+			want: `{"type":"step.failed","time":"2026-01-02T03:04:05Z","workflow_id":0,"workflow":"nightly","run_id":RUN,"step":"load","attempt":2,"error":"exit status 1: \"disk full\""}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, _, runID := newSender(t)
+			srv := newServer(t, http.StatusNoContent)
+
+			n := models.Notifier{Webhook: &models.WebhookNotify{
+				URL:     srv.URL,
+				Headers: map[string]string{"Authorization": "Bearer ${GORK_TEST_TOKEN}"},
+				Payload: tt.payload,
+			}}
+			sender.deliver(n, failedEvent(runID))
+
+			requests := srv.received()
+			if len(requests) != 1 {
+				t.Fatalf("%d requests, want 1", len(requests))
+			}
+			if want := strings.ReplaceAll(tt.want, "RUN", strconv.FormatInt(runID, 10)); requests[0].body != want {
+				t.Errorf("body = %s, want %s", requests[0].body, want)
+			}
+			if got := requests[0].header.Get("Authorization"); got != "Bearer t0ken" {
+				t.Errorf("Authorization = %q, want the header with the environment expanded", got)
+			}
+			if got := requests[0].header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+		})
+	}
+}
+
+func TestWebhookPayloadThatIsNotJSON(t *testing.T) {
+	sender, database, runID := newSender(t)
+	srv := newServer(t, http.StatusOK)
+
+	n := models.Notifier{Webhook: &models.WebhookNotify{URL: srv.URL, Payload: `{"text": "{{.Error}}"}`}}
+	sender.deliver(n, failedEvent(runID))
+
+	if got := len(srv.received()); got != 0 {
+		t.Fatalf("%d requests, want none for a payload that is not JSON", got)
+	}
+	recorded := attempts(t, database, runID)
+	if len(recorded) != 1 || recorded[0].Status != models.NotificationFailed || !strings.Contains(recorded[0].Error, "valid JSON") {
+		t.Fatalf("attempts = %+v, want one failed attempt that is not retried", recorded)
+	}
+}
+
+func TestSlackText(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{"default", "", `nightly run RUN: step.failed at step load: exit status 1: "disk full"`},
+		{"template", "{{.Workflow}}/{{.Step}} attempt {{.Attempt}}", "nightly/load attempt 2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, _, runID := newSender(t)
+			srv := newServer(t, http.StatusOK)
+
+			sender.deliver(models.Notifier{Slack: &models.SlackNotify{URL: srv.URL, Text: tt.text}}, failedEvent(runID))
+
+			requests := srv.received()
+			if len(requests) != 1 {
+				t.Fatalf("%d requests, want 1", len(requests))
+			}
+			var msg struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal([]byte(requests[0].body), &msg); err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.ReplaceAll(tt.want, "RUN", strconv.FormatInt(runID, 10)); msg.Text != want {
+				t.Fatalf("text = %q, want %q", msg.Text, want)
+			}
+		})
+	}
+}
+
+func TestHandleSendsWantedEvents(t *testing.T) {
+	sender, database, runID := newSender(t)
+	srv := newServer(t, http.StatusOK)
+	workflow := &models.Workflow{Name: "nightly", Notify: []models.Notifier{
+		{Name: "failures", Webhook: &models.WebhookNotify{URL: srv.URL}},
+		{Name: "steps", Events: []models.EventType{models.EventStepFailed}, Webhook: &models.WebhookNotify{URL: srv.URL}},
+	}}
+
+	sender.Handle(workflow, failedEvent(runID))
+	sender.Handle(workflow, models.Event{Type: models.EventRunFailed, Workflow: "nightly", RunID: runID})
+	sender.Handle(workflow, models.Event{Type: models.EventRunSucceeded, Workflow: "nightly", RunID: runID})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sender.Shutdown(ctx)
+
+	sent := map[string]models.EventType{}
+	for _, a := range attempts(t, database, runID) {
+		sent[a.Notifier+" "+string(a.Event)] = a.Event
+	}
+	if len(sent) != 2 || sent["steps step.failed"] == "" || sent["failures run.failed"] == "" {
+		t.Fatalf("sent %v, want step.failed to steps and run.failed to failures", sent)
+	}
+
+	sender.Handle(workflow, models.Event{Type: models.EventRunFailed, Workflow: "nightly", RunID: runID})
+	if got := len(srv.received()); got != 2 {
+		t.Fatalf("%d requests, want none after shutdown", got-2)
+	}
+}
@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// LimitError is returned when a step is stopped because it exceeded one of
+// its configured resource limits.
+type LimitError struct {
+	Limit string
+	Value string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %s exceeded", e.Limit, e.Value)
+}
+
+// outputLimiter caps the combined stdout and stderr captured for a command.
+// Once the cap is reached further output is discarded and onExceeded is
+// called so the command can be stopped.
+type outputLimiter struct {
+	mu         sync.Mutex
+	max        int64
+	written    int64
+	exceeded   bool
+	onExceeded func()
+}
+
+// writer returns a writer that captures into buf and, if lines is not nil,
+// also passes the captured output on to it.
+func (l *outputLimiter) writer(buf *bytes.Buffer, lines *lineSplitter) io.Writer {
+	return &limitedWriter{limiter: l, buf: buf, lines: lines}
+}
+
+func (l *outputLimiter) Exceeded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+type limitedWriter struct {
+	limiter *outputLimiter
+	buf     *bytes.Buffer
+	lines   *lineSplitter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	l := w.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 {
+		remaining := l.max - l.written
+		if int64(len(p)) > remaining {
+			if remaining > 0 {
+				w.buf.Write(p[:remaining])
+				w.lines.write(p[:remaining])
+				l.written += remaining
+			}
+			if !l.exceeded {
+				l.exceeded = true
+				l.onExceeded()
+			}
+			// Report the write as consumed so the process is not blocked on a
+			// full pipe while it is being stopped.
+			return len(p), nil
+		}
+	}
+
+	w.buf.Write(p)
+	w.lines.write(p)
+	l.written += int64(len(p))
+	return len(p), nil
+}
+
+// lineSplitter passes output to a LogSink one complete line at a time.
+type lineSplitter struct {
+	sink    LogSink
+	partial []byte
+}
+
+func newLineSplitter(sink LogSink) *lineSplitter {
+	if sink == nil {
+		return nil
+	}
+	return &lineSplitter{sink: sink}
+}
+
+func (s *lineSplitter) write(p []byte) {
+	if s == nil {
+		return
+	}
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			return
+		}
+		s.sink(strings.TrimSuffix(string(s.partial[:i]), "\r"))
+		s.partial = s.partial[i+1:]
+	}
+}
+
+// flush passes on a final line that did not end in a newline.
+func (s *lineSplitter) flush() {
+	if s == nil || len(s.partial) == 0 {
+		return
+	}
+	s.sink(string(s.partial))
+	s.partial = nil
+}
@@ -0,0 +1,112 @@
+//go:build !windows
+
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcessGroup sends SIGTERM to the process group led by proc and,
+// if any member is still alive after grace, SIGKILL. It returns notes
+// describing what was signalled for the step log.
+func terminateProcessGroup(proc *os.Process, grace time.Duration, exited <-chan struct{}) []string {
+	pgid := proc.Pid
+	var notes []string
+
+	members := processGroupMembers(pgid)
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return []string{fmt.Sprintf("failed to signal process group %d: %v", pgid, err)}
+	}
+	notes = append(notes, fmt.Sprintf("step stopped; sent SIGTERM to process group %d%s", pgid, describeMembers(members)))
+
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-poll.C:
+			if !processGroupAlive(pgid) {
+				return notes
+			}
+		case <-deadline.C:
+			members := processGroupMembers(pgid)
+			if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+				return notes
+			}
+			return append(notes, fmt.Sprintf("process group %d still running after %s; sent SIGKILL%s", pgid, grace, describeMembers(members)))
+		}
+	}
+}
+
+// processGroupAlive reports whether any process in the group is still
+// running. Zombies that have not been reaped yet do not count, which kill(2)
+// alone cannot tell apart.
+func processGroupAlive(pgid int) bool {
+	if _, err := os.Stat("/proc/self/stat"); err == nil {
+		return len(processGroupMembers(pgid)) > 0
+	}
+	return syscall.Kill(-pgid, 0) == nil
+}
+
+// processGroupMembers lists the live processes in a process group as
+// "pid (name)". It relies on /proc and returns nil where that is unavailable.
+func processGroupMembers(pgid int) []string {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var members []string
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name is parenthesised and may contain spaces, so the
+		// remaining fields are parsed from after the closing parenthesis.
+		stat := string(data)
+		open, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+		if open < 0 || end < open {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if group, err := strconv.Atoi(fields[2]); err == nil && group == pgid {
+			members = append(members, fmt.Sprintf("%d (%s)", pid, stat[open+1:end]))
+		}
+	}
+	return members
+}
+
+func describeMembers(members []string) string {
+	if len(members) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(members, ", ")
+}
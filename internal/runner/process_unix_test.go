@@ -0,0 +1,129 @@
+//go:build !windows
+
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runUntilStarted runs script, which must write the PID of a background child
+// to $PIDFILE, and cancels the step once it has. It returns the step's logs
+// and the child's PID, how long the step took to stop and the step's error.
+func runUntilStarted(t *testing.T, script string, grace time.Duration) ([]string, int, time.Duration, error) {
+	t.Helper()
+	pidfile := filepath.Join(t.TempDir(), "pid")
+	step := scriptStep(fmt.Sprintf("PIDFILE=%s\n%s", pidfile, script), nil)
+	step.KillGrace = grace
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pid := make(chan int, 1)
+	var canceled time.Time
+	go func() {
+		defer cancel()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			data, err := os.ReadFile(pidfile)
+			if n, convErr := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && convErr == nil {
+				pid <- n
+				break
+			}
+		}
+		canceled = time.Now()
+	}()
+
+	logs, err := RunStep(ctx, step)
+	stopped := time.Since(canceled)
+	select {
+	case n := <-pid:
+		return logs, n, stopped, err
+	default:
+		t.Fatalf("the step never wrote its child's PID; logs = %q, err = %v", logs, err)
+		return nil, 0, 0, nil
+	}
+}
+
+// processAlive reports whether pid is still running and not a zombie a
+// moment after it was signalled, which SIGKILL takes to be delivered.
+func processAlive(pid int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if !processRunning(pid) {
+			return false
+		}
+	}
+	return true
+}
+
+func processRunning(pid int) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func hasNote(logs []string, note string) bool {
+	for _, l := range logs {
+		if strings.HasPrefix(l, "[gork] ") && strings.Contains(l, note) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCanceledStepStopsBackgroundProcesses(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc is not available")
+	}
+
+	logs, child, stopped, err := runUntilStarted(t, `sleep 60 & echo $! > "$PIDFILE"; wait`, 5*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if processAlive(child) {
+		t.Fatalf("background child %d is still running", child)
+	}
+	if stopped >= 5*time.Second {
+		t.Fatalf("step took %s to stop, want it stopped by SIGTERM before the grace period ended", stopped)
+	}
+	if !hasNote(logs, "sent SIGTERM to process group") || !hasNote(logs, "(sleep)") {
+		t.Fatalf("logs = %q, want a note that the process group, including sleep, was sent SIGTERM", logs)
+	}
+	if hasNote(logs, "SIGKILL") {
+		t.Fatalf("logs = %q, want no SIGKILL for a group that stopped on SIGTERM", logs)
+	}
+}
+
+func TestCanceledStepIsKilledAfterGrace(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc is not available")
+	}
+
+	// The ignored SIGTERM is inherited by the background child too.
+	const grace = 300 * time.Millisecond
+	logs, child, stopped, err := runUntilStarted(t, `trap '' TERM; sleep 60 & echo $! > "$PIDFILE"; wait`, grace)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if processAlive(child) {
+		t.Fatalf("background child %d is still running", child)
+	}
+	if stopped < grace {
+		t.Fatalf("step stopped after %s, want SIGKILL only once the %s grace period ended", stopped, grace)
+	}
+	if !hasNote(logs, "sent SIGTERM to process group") {
+		t.Fatalf("logs = %q, want a note that the process group was sent SIGTERM", logs)
+	}
+	if !hasNote(logs, fmt.Sprintf("still running after %s; sent SIGKILL", grace)) {
+		t.Fatalf("logs = %q, want a note that the process group was sent SIGKILL after %s", logs, grace)
+	}
+}
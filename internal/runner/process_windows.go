@@ -0,0 +1,37 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// terminateProcessGroup asks the process tree rooted at proc to close and,
+// if it has not exited after grace, forcibly terminates the whole tree. It
+// returns notes describing what was signalled for the step log.
+func terminateProcessGroup(proc *os.Process, grace time.Duration, exited <-chan struct{}) []string {
+	pid := strconv.Itoa(proc.Pid)
+	notes := []string{fmt.Sprintf("step stopped; requested process tree %s to close", pid)}
+	exec.Command("taskkill", "/T", "/PID", pid).Run()
+
+	select {
+	case <-exited:
+		return notes
+	case <-time.After(grace):
+	}
+
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", pid).Run(); err != nil {
+		return append(notes, fmt.Sprintf("failed to terminate process tree %s: %v", pid, err))
+	}
+	return append(notes, fmt.Sprintf("process tree %s still running after %s; terminated it", pid, grace))
+}
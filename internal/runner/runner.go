@@ -5,58 +5,143 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/kingoftac/gork/internal/models"
+	"github.com/kingoftac/gork/internal/tracing"
 )
 
+// defaultKillGrace is how long a step's process group is given to exit after
+// SIGTERM before it is killed, when the step does not set kill_grace.
+const defaultKillGrace = 10 * time.Second
+
+// HTTPStatusError is returned by HTTP steps when the server responds with an
+// error status.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http error: %d", e.StatusCode)
+}
+
+// LogSink receives each line of a step's output as it is written.
+type LogSink func(line string)
+
 func RunStep(ctx context.Context, step models.WorkflowStep) ([]string, error) {
+	return RunStepStreaming(ctx, step, nil)
+}
+
+// RunStepStreaming runs step like RunStep and also passes each output line of
+// an exec or script step to sink while the step runs. The returned logs are
+// the same as RunStep's.
+func RunStepStreaming(ctx context.Context, step models.WorkflowStep, sink LogSink) ([]string, error) {
 	switch step.ActionType() {
 	case models.StepTypeExec:
-		return runExec(ctx, step)
+		return runExec(ctx, step, sink)
 	case models.StepTypeHTTP:
 		return runHTTP(ctx, step)
 	case models.StepTypeScript:
-		return runScript(ctx, step)
+		return runScript(ctx, step, sink)
 	default:
 		return nil, fmt.Errorf("unknown action type")
 	}
 }
 
-func runExec(ctx context.Context, step models.WorkflowStep) ([]string, error) {
-	cmd := exec.CommandContext(ctx, step.Exec.Command, step.Exec.Args...)
-
-	// SECURITY: Restrict working directory to current directory only
-	// Prevent steps from accessing files outside the workspace
-	cmd.Dir = "."
-
+func runExec(ctx context.Context, step models.WorkflowStep, sink LogSink) ([]string, error) {
 	if step.Exec.WorkingDir != "" {
 		// TODO: Log security warning but allow relative paths within current directory
 		// The validation should prevent dangerous paths, but this is an extra safeguard
 	}
 
-	cmd.Env = []string{}
+	env := []string{}
 
 	for k, v := range step.Env {
 		if !strings.Contains(k, "=") {
-			cmd.Env = append(cmd.Env, k+"="+v)
+			env = append(env, k+"="+v)
 		}
 	}
 	for k, v := range step.Exec.Env {
 		if !strings.Contains(k, "=") {
-			cmd.Env = append(cmd.Env, k+"="+v)
+			env = append(env, k+"="+v)
 		}
 	}
 
+	logs, err := runCommand(ctx, step, step.Exec.Command, step.Exec.Args, env, sink)
+	if err != nil {
+		return logs, fmt.Errorf("exec failed: %w", err)
+	}
+
+	return logs, nil
+}
+
+// runCommand starts a command for an exec or script step, enforcing the
+// step's limits, and returns its stdout followed by its stderr as log lines.
+// The command runs in its own process group so that everything it spawned is
+// stopped if the step times out or is canceled.
+func runCommand(ctx context.Context, step models.WorkflowStep, name string, args []string, env []string, sink LogSink) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.Command(name, args...)
+
+	// SECURITY: Restrict working directory to current directory only
+	// Prevent steps from accessing files outside the workspace
+	cmd.Dir = "."
+	cmd.Env = env
+	setProcessGroup(cmd)
+
+	var maxOutput models.ByteSize
+	if step.Limits != nil {
+		maxOutput = step.Limits.MaxOutput
+	}
+	output := &outputLimiter{max: int64(maxOutput), onExceeded: cancel}
 	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	stdoutLines, stderrLines := newLineSplitter(sink), newLineSplitter(sink)
+	cmd.Stdout = output.writer(&stdout, stdoutLines)
+	cmd.Stderr = output.writer(&stderr, stderrLines)
 
-	err := cmd.Run()
 	logs := []string{}
+	finish, warnings, err := applySandbox(cmd, step.Limits)
+	if err != nil {
+		return logs, err
+	}
+	// Warnings stay out of the step's logs, which outputs are extracted from.
+	for _, w := range warnings {
+		slog.Warn("Step limits not fully enforced", "step", step.Name, "reason", w)
+	}
+
+	if err := cmd.Start(); err != nil {
+		finish(nil)
+		return logs, err
+	}
+
+	grace := step.KillGrace
+	if grace == 0 {
+		grace = defaultKillGrace
+	}
+
+	exited := make(chan struct{})
+	killed := make(chan []string, 1)
+	go func() {
+		select {
+		case <-exited:
+			killed <- nil
+		case <-ctx.Done():
+			killed <- terminateProcessGroup(cmd.Process, grace, exited)
+		}
+	}()
+
+	err = cmd.Wait()
+	close(exited)
+	limitErr := finish(cmd.ProcessState)
+	stdoutLines.flush()
+	stderrLines.flush()
 
 	if out := stdout.String(); out != "" {
 		logs = append(logs, strings.Split(strings.TrimSpace(out), "\n")...)
@@ -64,15 +149,24 @@ func runExec(ctx context.Context, step models.WorkflowStep) ([]string, error) {
 	if errOut := stderr.String(); errOut != "" {
 		logs = append(logs, strings.Split(strings.TrimSpace(errOut), "\n")...)
 	}
+	for _, note := range <-killed {
+		logs = append(logs, "[gork] "+note)
+	}
 
-	if err != nil {
-		return logs, fmt.Errorf("exec failed: %w", err)
+	if output.Exceeded() {
+		return logs, &LimitError{Limit: "max_output", Value: maxOutput.String()}
+	}
+	if limitErr != nil {
+		return logs, limitErr
+	}
+	if err != nil && ctx.Err() != nil {
+		return logs, fmt.Errorf("%w: %w", ctx.Err(), err)
 	}
 
-	return logs, nil
+	return logs, err
 }
 
-func runHTTP(ctx context.Context, step models.WorkflowStep) ([]string, error) {
+func runHTTP(ctx context.Context, step models.WorkflowStep) (logs []string, err error) {
 	method := step.HTTP.Method
 	if method == "" {
 		method = "GET"
@@ -81,6 +175,15 @@ func runHTTP(ctx context.Context, step models.WorkflowStep) ([]string, error) {
 	url := interpolateEnvVars(step.HTTP.URL, step.Env)
 	body := interpolateEnvVars(step.HTTP.Body, step.Env)
 
+	ctx, span := tracing.Start(ctx, "HTTP "+method, tracing.KindClient,
+		tracing.String("http.request.method", method),
+		tracing.String("url.full", url),
+	)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
 	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
@@ -89,6 +192,7 @@ func runHTTP(ctx context.Context, step models.WorkflowStep) ([]string, error) {
 	for k, v := range step.HTTP.Headers {
 		req.Header.Set(k, interpolateEnvVars(v, step.Env))
 	}
+	tracing.Inject(ctx, req.Header)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -96,13 +200,25 @@ func runHTTP(ctx context.Context, step models.WorkflowStep) ([]string, error) {
 		return nil, fmt.Errorf("http request failed: %w", err)
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(tracing.Int("http.response.status_code", int64(resp.StatusCode)))
 
-	respBody, err := io.ReadAll(resp.Body)
+	var maxOutput models.ByteSize
+	var bodyReader io.Reader = resp.Body
+	if step.Limits != nil && step.Limits.MaxOutput > 0 {
+		maxOutput = step.Limits.MaxOutput
+		bodyReader = io.LimitReader(resp.Body, int64(maxOutput)+1)
+	}
+
+	respBody, err := io.ReadAll(bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
+	if maxOutput > 0 && int64(len(respBody)) > int64(maxOutput) {
+		logs := []string{fmt.Sprintf("HTTP %s %s -> %d", method, url, resp.StatusCode)}
+		return logs, &LimitError{Limit: "max_output", Value: maxOutput.String()}
+	}
 
-	logs := []string{
+	logs = []string{
 		fmt.Sprintf("HTTP %s %s -> %d", method, url, resp.StatusCode),
 		fmt.Sprintf("HTTP_STATUS:%d", resp.StatusCode),
 		fmt.Sprintf("HTTP_BODY:%s", string(respBody)),
@@ -113,38 +229,24 @@ func runHTTP(ctx context.Context, step models.WorkflowStep) ([]string, error) {
 	}
 
 	if resp.StatusCode >= 400 {
-		return logs, fmt.Errorf("http error: %d", resp.StatusCode)
+		return logs, &HTTPStatusError{StatusCode: resp.StatusCode}
 	}
 
 	return logs, nil
 }
 
-func runScript(ctx context.Context, step models.WorkflowStep) ([]string, error) {
+func runScript(ctx context.Context, step models.WorkflowStep, sink LogSink) ([]string, error) {
 	shell := "sh"
 	if step.Script.Language != "" {
 		shell = step.Script.Language
 	}
 
-	cmd := exec.CommandContext(ctx, shell, "-c", step.Script.Inline)
-	cmd.Env = os.Environ()
+	env := os.Environ()
 	for k, v := range step.Env {
-		cmd.Env = append(cmd.Env, k+"="+v)
-	}
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	logs := []string{}
-
-	if out := stdout.String(); out != "" {
-		logs = append(logs, strings.Split(strings.TrimSpace(out), "\n")...)
-	}
-	if errOut := stderr.String(); errOut != "" {
-		logs = append(logs, strings.Split(strings.TrimSpace(errOut), "\n")...)
+		env = append(env, k+"="+v)
 	}
 
+	logs, err := runCommand(ctx, step, shell, []string{"-c", step.Script.Inline}, env, sink)
 	if err != nil {
 		return logs, fmt.Errorf("script failed: %w", err)
 	}
@@ -0,0 +1,38 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/kingoftac/gork/internal/models"
+)
+
+func scriptStep(inline string, limits *models.StepLimits) models.WorkflowStep {
+	return models.WorkflowStep{Name: "step", Script: &models.ScriptAction{Inline: inline}, Limits: limits}
+}
+
+func TestRunStepMaxOutput(t *testing.T) {
+	logs, err := RunStep(context.Background(), scriptStep("echo hello; while :; do echo more; done", &models.StepLimits{MaxOutput: 1 << 10}))
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "max_output" {
+		t.Fatalf("err = %v, want the max_output limit", err)
+	}
+	if len(logs) == 0 || logs[0] != "hello" {
+		t.Fatalf("logs = %q, want the output captured before the limit", logs)
+	}
+}
+
+func TestRunStepLimitWarningsStayOutOfLogs(t *testing.T) {
+	// Whether or not the limits can be enforced here, only the step's own
+	// output may end up in its logs.
+	limits := &models.StepLimits{MaxMemory: 256 << 20, MaxProcesses: 64, IsolateNetwork: true}
+	logs, err := RunStep(context.Background(), scriptStep("echo ROWS:42", limits))
+	if err != nil {
+		t.Skipf("limits cannot be applied here: %v", err)
+	}
+	if !slices.Equal(logs, []string{"ROWS:42"}) {
+		t.Fatalf("logs = %q, want only the step's output", logs)
+	}
+}
@@ -0,0 +1,442 @@
+package runner
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// When a step needs rlimits or a read-only root, the command is started
+// through the current executable with sandboxArg0 as argv[0]. The helper
+// applies the restrictions from inside the new namespaces and then execs the
+// real command, so limits are in place before any step code runs.
+const (
+	sandboxArg0    = "gork-sandbox"
+	sandboxSpecEnv = "GORK_SANDBOX_SPEC"
+	cgroupRoot     = "/sys/fs/cgroup"
+)
+
+type sandboxRlimit struct {
+	Resource int    `json:"resource"`
+	Soft     uint64 `json:"soft"`
+	Hard     uint64 `json:"hard"`
+}
+
+type sandboxSpec struct {
+	Path         string          `json:"path"`
+	Rlimits      []sandboxRlimit `json:"rlimits,omitempty"`
+	ReadOnlyRoot bool            `json:"read_only_root,omitempty"`
+	Workspace    string          `json:"workspace,omitempty"`
+}
+
+// Step cgroups live in a gork subtree of the cgroup the process started in.
+// cgroup v2 only lets a cgroup with no processes of its own pass controllers
+// to its children, so the process moves into a leaf of the subtree and each
+// step's cgroup is created as a sibling of that leaf:
+//
+//	<start>/gork/daemon       the gork process itself
+//	<start>/gork/step-<n>-<m> one per limited step
+const (
+	cgroupSubtree = "gork"
+	cgroupLeaf    = "daemon"
+)
+
+// errCgroupsNotPrepared is why steps of processes that never called
+// PrepareCgroups get no cgroup. Moving a short-lived process such as a CLI
+// into a subtree of its own would leave that subtree behind in the user's
+// session.
+var errCgroupsNotPrepared = errors.New("step cgroups were not prepared when this process started")
+
+var (
+	cgroupSeq atomic.Int64
+
+	cgroupOnce sync.Once
+	cgroupMu   sync.Mutex
+	cgroupDir  string
+	cgroupErr  = errCgroupsNotPrepared
+)
+
+// PrepareCgroups sets up the cgroup subtree that step memory and process
+// limits are enforced in. Long-running processes call it at startup, before
+// any step runs: a step started from the original cgroup keeps it occupied
+// and the subtree can no longer be set up. Without it, or when it fails,
+// those limits fall back to rlimits.
+func PrepareCgroups() error {
+	cgroupOnce.Do(func() {
+		dir, err := delegateCgroup(cgroupRoot)
+		cgroupMu.Lock()
+		cgroupDir, cgroupErr = dir, err
+		cgroupMu.Unlock()
+	})
+	_, err := preparedCgroups()
+	return err
+}
+
+// preparedCgroups returns the subtree set up by PrepareCgroups, or why there
+// is none.
+func preparedCgroups() (string, error) {
+	cgroupMu.Lock()
+	defer cgroupMu.Unlock()
+	return cgroupDir, cgroupErr
+}
+
+// delegateCgroup moves the current process into the leaf of a gork subtree
+// of its cgroup under root, enables the memory and pids controllers for the
+// subtree's children and returns the subtree's directory.
+func delegateCgroup(root string) (string, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not mounted")
+	}
+
+	self, err := currentCgroup()
+	if err != nil {
+		return "", err
+	}
+	start := filepath.Join(root, self)
+	if filepath.Base(start) == cgroupLeaf && filepath.Base(filepath.Dir(start)) == cgroupSubtree {
+		// Already in the leaf, e.g. when started by another gork process.
+		start = filepath.Dir(filepath.Dir(start))
+	}
+	dir := filepath.Join(start, cgroupSubtree)
+	leaf := filepath.Join(dir, cgroupLeaf)
+
+	for _, d := range []string{dir, leaf} {
+		if err := os.Mkdir(d, 0755); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("failed to create cgroup: %w", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte("0"), 0644); err != nil {
+		return "", fmt.Errorf("failed to move into cgroup %s: %w", leaf, err)
+	}
+
+	for _, d := range []string{start, dir} {
+		if err := enableControllers(d, "memory", "pids"); err != nil {
+			// Leave the cgroup the process was started in as it was. The
+			// directories stay if another gork process is using them.
+			_ = os.WriteFile(filepath.Join(start, "cgroup.procs"), []byte("0"), 0644)
+			os.Remove(leaf)
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// enableControllers enables those of controllers that dir has for its
+// children. Controllers dir does not have are skipped, as long as one is
+// left; limits that need them then fail when the step's cgroup is
+// configured.
+func enableControllers(dir string, controllers ...string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read cgroup controllers: %w", err)
+	}
+	available := strings.Fields(string(data))
+	enabled := 0
+	for _, c := range controllers {
+		if !slices.Contains(available, c) {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+c), 0644); err != nil {
+			return fmt.Errorf("failed to enable the %s controller in %s: %w", c, dir, err)
+		}
+		enabled++
+	}
+	if enabled == 0 {
+		return fmt.Errorf("cgroup %s has none of the %s controllers", dir, strings.Join(controllers, " and "))
+	}
+	return nil
+}
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == sandboxArg0 {
+		runSandboxHelper()
+	}
+}
+
+func runSandboxHelper() {
+	fail := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, sandboxArg0+": "+format+"\n", args...)
+		os.Exit(125)
+	}
+
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxSpecEnv)), &spec); err != nil {
+		fail("invalid sandbox spec: %v", err)
+	}
+
+	if spec.ReadOnlyRoot {
+		if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+			fail("failed to make mounts private: %v", err)
+		}
+		if err := unix.Mount(spec.Workspace, spec.Workspace, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			fail("failed to bind workspace: %v", err)
+		}
+		if err := unix.MountSetattr(unix.AT_FDCWD, "/", unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+			fail("failed to make root read-only: %v", err)
+		}
+		if err := unix.MountSetattr(unix.AT_FDCWD, spec.Workspace, unix.AT_RECURSIVE, &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY}); err != nil {
+			fail("failed to make workspace writable: %v", err)
+		}
+		// The working directory still refers to the mount underneath the
+		// new bind; re-enter it so relative paths resolve to the writable one.
+		if err := unix.Chdir(spec.Workspace); err != nil {
+			fail("failed to enter workspace: %v", err)
+		}
+	}
+
+	for _, rl := range spec.Rlimits {
+		if err := unix.Setrlimit(rl.Resource, &unix.Rlimit{Cur: rl.Soft, Max: rl.Hard}); err != nil {
+			fail("failed to set rlimit %d: %v", rl.Resource, err)
+		}
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sandboxSpecEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	if err := unix.Exec(spec.Path, os.Args[1:], env); err != nil {
+		fail("failed to exec %s: %v", spec.Path, err)
+	}
+}
+
+// applySandbox configures cmd to run under limits. The returned finish func
+// must be called once the command has exited; it releases any resources and
+// reports the limit that stopped the process, if one can be identified.
+func applySandbox(cmd *exec.Cmd, limits *models.StepLimits) (func(*os.ProcessState) error, []string, error) {
+	noop := func(*os.ProcessState) error { return nil }
+	if limits == nil || cmd.Err != nil {
+		return noop, nil, nil
+	}
+
+	var warnings []string
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	var cg *stepCgroup
+	if limits.MaxMemory > 0 || limits.MaxProcesses > 0 {
+		dir, err := preparedCgroups()
+		if err == nil {
+			cg, err = newStepCgroup(dir, limits)
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("memory and process limits fall back to rlimits: %v", err))
+		} else {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = cg.fd
+		}
+	}
+
+	var rlimits []sandboxRlimit
+	if limits.CPUTime > 0 {
+		secs := uint64(limits.CPUTime.Round(time.Second) / time.Second)
+		// The soft limit delivers SIGXCPU; the hard limit follows a second
+		// later with SIGKILL for processes that ignore it.
+		rlimits = append(rlimits, sandboxRlimit{Resource: unix.RLIMIT_CPU, Soft: secs, Hard: secs + 1})
+	}
+	if limits.OpenFiles > 0 {
+		n := uint64(limits.OpenFiles)
+		rlimits = append(rlimits, sandboxRlimit{Resource: unix.RLIMIT_NOFILE, Soft: n, Hard: n})
+	}
+	if cg == nil && limits.MaxMemory > 0 {
+		n := uint64(limits.MaxMemory)
+		rlimits = append(rlimits, sandboxRlimit{Resource: unix.RLIMIT_AS, Soft: n, Hard: n})
+	}
+	if cg == nil && limits.MaxProcesses > 0 {
+		// RLIMIT_NPROC counts every process of the user, not just the step's.
+		n := uint64(limits.MaxProcesses)
+		rlimits = append(rlimits, sandboxRlimit{Resource: unix.RLIMIT_NPROC, Soft: n, Hard: n})
+	}
+
+	if limits.IsolateNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if limits.ReadOnlyRoot {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if cmd.SysProcAttr.Cloneflags != 0 && os.Geteuid() != 0 {
+		// Unprivileged users need their own user namespace to create the
+		// others; map the current user onto itself inside it.
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Geteuid(), HostID: os.Geteuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getegid(), HostID: os.Getegid(), Size: 1}}
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	}
+
+	if len(rlimits) > 0 || limits.ReadOnlyRoot {
+		self, err := os.Executable()
+		if err != nil {
+			if cg != nil {
+				cg.close()
+			}
+			return noop, warnings, fmt.Errorf("failed to locate sandbox helper: %w", err)
+		}
+
+		spec := sandboxSpec{Path: cmd.Path, Rlimits: rlimits, ReadOnlyRoot: limits.ReadOnlyRoot}
+		if limits.ReadOnlyRoot {
+			workspace, err := filepath.Abs(cmd.Dir)
+			if err != nil {
+				if cg != nil {
+					cg.close()
+				}
+				return noop, warnings, fmt.Errorf("failed to resolve workspace: %w", err)
+			}
+			spec.Workspace = workspace
+		}
+		specJSON, err := json.Marshal(spec)
+		if err != nil {
+			if cg != nil {
+				cg.close()
+			}
+			return noop, warnings, fmt.Errorf("failed to encode sandbox spec: %w", err)
+		}
+
+		cmd.Args = append([]string{sandboxArg0}, cmd.Args...)
+		cmd.Path = self
+		cmd.Env = append(cmd.Env, sandboxSpecEnv+"="+string(specJSON))
+	}
+
+	finish := func(state *os.ProcessState) error {
+		var limitErr error
+		if cg != nil {
+			limitErr = cg.limitHit(limits)
+			cg.close()
+		}
+		if limitErr == nil && state != nil && limits.CPUTime > 0 {
+			if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() &&
+				(ws.Signal() == syscall.SIGXCPU || state.UserTime()+state.SystemTime() >= limits.CPUTime) {
+				limitErr = &LimitError{Limit: "cpu_time", Value: limits.CPUTime.String()}
+			}
+		}
+		return limitErr
+	}
+
+	return finish, warnings, nil
+}
+
+// stepCgroup is a cgroup v2 child of the gork subtree created to hold a
+// single step's processes.
+type stepCgroup struct {
+	dir string
+	fd  int
+}
+
+func newStepCgroup(parent string, limits *models.StepLimits) (*stepCgroup, error) {
+	dir := filepath.Join(parent, fmt.Sprintf("step-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	cg := &stepCgroup{dir: dir, fd: -1}
+	if limits.MaxMemory > 0 {
+		if err := cg.write("memory.max", strconv.FormatInt(int64(limits.MaxMemory), 10)); err != nil {
+			cg.close()
+			return nil, err
+		}
+		// Not every kernel has swap accounting; memory.max alone still applies.
+		_ = cg.write("memory.swap.max", "0")
+	}
+	if limits.MaxProcesses > 0 {
+		if err := cg.write("pids.max", strconv.Itoa(limits.MaxProcesses)); err != nil {
+			cg.close()
+			return nil, err
+		}
+	}
+
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		cg.close()
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	cg.fd = fd
+
+	return cg, nil
+}
+
+func currentCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("failed to read cgroup membership: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("process is not in a cgroup v2 hierarchy")
+}
+
+func (cg *stepCgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cg.dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set %s: %w", file, err)
+	}
+	return nil
+}
+
+// limitHit inspects the cgroup's event counters for memory or process limit
+// hits.
+func (cg *stepCgroup) limitHit(limits *models.StepLimits) error {
+	if limits.MaxMemory > 0 && cg.eventCount("memory.events", "oom_kill") > 0 {
+		return &LimitError{Limit: "max_memory", Value: limits.MaxMemory.String()}
+	}
+	if limits.MaxProcesses > 0 && cg.eventCount("pids.events", "max") > 0 {
+		return &LimitError{Limit: "max_processes", Value: strconv.Itoa(limits.MaxProcesses)}
+	}
+	return nil
+}
+
+func (cg *stepCgroup) eventCount(file, key string) int64 {
+	data, err := os.ReadFile(filepath.Join(cg.dir, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// close removes the cgroup. Processes the step left running keep it busy;
+// those exiting along with the step are given a moment to be reaped, and
+// the cgroup is reported if any outlive that.
+func (cg *stepCgroup) close() {
+	if cg.fd >= 0 {
+		unix.Close(cg.fd)
+		cg.fd = -1
+	}
+	err := os.Remove(cg.dir)
+	for i := 0; i < 10 && errors.Is(err, unix.EBUSY); i++ {
+		time.Sleep(50 * time.Millisecond)
+		err = os.Remove(cg.dir)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove step cgroup", "cgroup", cg.dir, "error", err)
+	}
+}
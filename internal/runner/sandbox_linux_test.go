@@ -0,0 +1,173 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/kingoftac/gork/internal/models"
+)
+
+func writeCgroupFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readCgroupFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestDelegateCgroup lays out the subtree in a directory standing in for
+// the cgroup filesystem, whose files keep only the last value written.
+func TestDelegateCgroup(t *testing.T) {
+	self, err := currentCgroup()
+	if err != nil {
+		t.Skip(err)
+	}
+	root := t.TempDir()
+	start := filepath.Join(root, self)
+	writeCgroupFile(t, root, "cgroup.controllers", "cpu memory pids")
+	writeCgroupFile(t, start, "cgroup.controllers", "cpu memory pids")
+	writeCgroupFile(t, filepath.Join(start, cgroupSubtree), "cgroup.controllers", "memory")
+
+	dir, err := delegateCgroup(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(start, cgroupSubtree); dir != want {
+		t.Fatalf("subtree = %s, want %s", dir, want)
+	}
+	if got := readCgroupFile(t, filepath.Join(dir, cgroupLeaf), "cgroup.procs"); got != "0" {
+		t.Fatalf("process was not moved into the leaf: cgroup.procs = %q", got)
+	}
+	if got := readCgroupFile(t, start, "cgroup.subtree_control"); got != "+pids" {
+		t.Fatalf("start cgroup subtree_control = %q, want pids enabled last", got)
+	}
+	if got := readCgroupFile(t, dir, "cgroup.subtree_control"); got != "+memory" {
+		t.Fatalf("subtree subtree_control = %q, want only the available memory controller", got)
+	}
+
+	cg, err := newStepCgroup(dir, &models.StepLimits{MaxMemory: 64 << 20, MaxProcesses: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unlike a real cgroup, the directory cannot be removed while it has
+	// files, so only the descriptor is released.
+	defer unix.Close(cg.fd)
+	if filepath.Dir(cg.dir) != dir {
+		t.Fatalf("step cgroup %s is not a sibling of the leaf", cg.dir)
+	}
+	for file, want := range map[string]string{"memory.max": "67108864", "memory.swap.max": "0", "pids.max": "8"} {
+		if got := readCgroupFile(t, cg.dir, file); got != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+
+	limits := &models.StepLimits{MaxMemory: 64 << 20, MaxProcesses: 8}
+	if err := cg.limitHit(limits); err != nil {
+		t.Fatalf("limitHit() = %v before any event", err)
+	}
+	writeCgroupFile(t, cg.dir, "memory.events", "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n")
+	var limitErr *LimitError
+	if err := cg.limitHit(limits); !errors.As(err, &limitErr) || limitErr.Limit != "max_memory" {
+		t.Fatalf("limitHit() = %v, want the max_memory limit", err)
+	}
+}
+
+func TestDelegateCgroupWithoutCgroup2(t *testing.T) {
+	if _, err := delegateCgroup(t.TempDir()); err == nil || !strings.Contains(err.Error(), "not mounted") {
+		t.Fatalf("err = %v, want cgroup v2 not mounted", err)
+	}
+}
+
+func TestEnableControllersWithoutAny(t *testing.T) {
+	dir := t.TempDir()
+	writeCgroupFile(t, dir, "cgroup.controllers", "cpu hugetlb")
+	if err := enableControllers(dir, "memory", "pids"); err == nil || !strings.Contains(err.Error(), "none of the memory and pids controllers") {
+		t.Fatalf("err = %v, want none of the controllers available", err)
+	}
+}
+
+func TestRunStepCPUTime(t *testing.T) {
+	_, err := RunStep(context.Background(), scriptStep("while :; do :; done", &models.StepLimits{CPUTime: time.Second}))
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "cpu_time" {
+		t.Fatalf("err = %v, want the cpu_time limit", err)
+	}
+}
+
+func TestRunStepOpenFiles(t *testing.T) {
+	logs, err := RunStep(context.Background(), scriptStep("ulimit -n", &models.StepLimits{OpenFiles: 16}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(logs, []string{"16"}) {
+		t.Fatalf("logs = %q, want the open file limit of 16", logs)
+	}
+}
+
+// TestRunStepMemoryAndProcessesWithoutCgroups runs a step in a process that
+// never prepared step cgroups, which gets rlimits instead.
+func TestRunStepMemoryAndProcessesWithoutCgroups(t *testing.T) {
+	if _, err := preparedCgroups(); err == nil {
+		t.Skip("step cgroups are prepared")
+	}
+	logs, err := RunStep(context.Background(), scriptStep("ulimit -v", &models.StepLimits{MaxMemory: 256 << 20}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(logs, []string{"262144"}) {
+		t.Fatalf("logs = %q, want an address space limit of 262144 KiB", logs)
+	}
+}
+
+// TestRunStepMemoryAndProcesses moves the test process into a gork subtree
+// of the host's cgroups, so it only runs when GORK_TEST_CGROUPS=1.
+func TestRunStepMemoryAndProcesses(t *testing.T) {
+	if os.Getenv("GORK_TEST_CGROUPS") != "1" {
+		t.Skip("set GORK_TEST_CGROUPS=1 to set up step cgroups on this host")
+	}
+	if err := PrepareCgroups(); err != nil {
+		t.Skip(err)
+	}
+
+	dir, _ := preparedCgroups()
+	enabled := strings.Fields(readCgroupFile(t, dir, "cgroup.subtree_control"))
+	for _, tt := range []struct {
+		controller string
+		script     string
+		limits     *models.StepLimits
+		want       string
+	}{
+		{"memory", "head -c 512m /dev/zero | tail", &models.StepLimits{MaxMemory: 64 << 20}, "max_memory"},
+		{"pids", "for i in 1 2 3 4 5 6 7 8; do sleep 1 & done; wait", &models.StepLimits{MaxProcesses: 4}, "max_processes"},
+	} {
+		t.Run(tt.controller, func(t *testing.T) {
+			if !slices.Contains(enabled, tt.controller) {
+				t.Skipf("the %s controller is not available", tt.controller)
+			}
+			_, err := RunStep(context.Background(), scriptStep(tt.script, tt.limits))
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != tt.want {
+				t.Fatalf("err = %v, want the %s limit", err, tt.want)
+			}
+		})
+	}
+}
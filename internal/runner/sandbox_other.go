@@ -0,0 +1,37 @@
+//go:build !linux
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// PrepareCgroups reports that step limits cannot be enforced on this
+// platform.
+func PrepareCgroups() error {
+	return fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+}
+
+// applySandbox only reports which limits cannot be enforced; max_output is
+// handled by runCommand on every platform.
+func applySandbox(cmd *exec.Cmd, limits *models.StepLimits) (func(*os.ProcessState) error, []string, error) {
+	noop := func(*os.ProcessState) error { return nil }
+	if limits == nil {
+		return noop, nil, nil
+	}
+
+	var warnings []string
+	if limits.MaxMemory > 0 || limits.CPUTime > 0 || limits.OpenFiles > 0 || limits.MaxProcesses > 0 {
+		warnings = append(warnings, fmt.Sprintf("resource limits are not supported on %s and were not applied", runtime.GOOS))
+	}
+	if limits.IsolateNetwork || limits.ReadOnlyRoot {
+		warnings = append(warnings, fmt.Sprintf("sandboxing is not supported on %s and was not applied", runtime.GOOS))
+	}
+
+	return noop, warnings, nil
+}
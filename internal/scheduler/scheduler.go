@@ -7,32 +7,43 @@ import (
 	"time"
 
 	"github.com/kingoftac/gork/internal/db"
-	"github.com/kingoftac/gork/internal/engine"
+	"github.com/kingoftac/gork/internal/metrics"
 	"github.com/kingoftac/gork/internal/models"
 )
 
 type workflowSchedule struct {
-	workflow  *models.Workflow
-	timer     *time.Timer
-	duration  time.Duration
-	running   bool
-	cancelRun context.CancelFunc
+	workflow *models.Workflow
+	timer    *time.Timer
+	duration time.Duration
+	lastSlot time.Time
 }
 
+// changePollInterval is how often the scheduler checks the workflow change
+// log, and reloadInterval how often it reloads every workflow in case a
+// change was missed.
+const (
+	changePollInterval = time.Second
+	reloadInterval     = 5 * time.Minute
+)
+
+// changeRetention is how long workflow changes are kept in the change log.
+const changeRetention = 24 * time.Hour
+
 type Scheduler struct {
-	db        *db.DB
-	eng       *engine.Engine
-	schedules map[int64]*workflowSchedule
-	mu        sync.Mutex
-	ctx       context.Context
-	cancel    context.CancelFunc
-	wg        sync.WaitGroup
+	db           *db.DB
+	schedules    map[int64]*workflowSchedule
+	lastChangeID int64
+	// paused is the global maintenance switch; it is guarded by mu.
+	paused bool
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func NewScheduler(db *db.DB) *Scheduler {
 	return &Scheduler{
 		db:        db,
-		eng:       engine.NewEngineWithVerboseLogs(db),
 		schedules: make(map[int64]*workflowSchedule),
 	}
 }
@@ -42,12 +53,20 @@ func (s *Scheduler) Start(ctx context.Context) {
 
 	s.ctx, s.cancel = context.WithCancel(ctx)
 
-	s.recoverRuns()
+	// Changes made while loading are picked up from the change log
+	// afterwards, so the position is taken first.
+	lastChangeID, err := s.db.LatestWorkflowChangeID()
+	if err != nil {
+		slog.Error("Failed to read workflow change log", "component", "scheduler", "error", err)
+	}
+	s.lastChangeID = lastChangeID
+	s.refreshPaused()
 	s.loadWorkflows()
 
-	// TODO: See if this can be event-driven instead of using polling
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+	changes := time.NewTicker(changePollInterval)
+	defer changes.Stop()
+	reload := time.NewTicker(reloadInterval)
+	defer reload.Stop()
 
 	slog.Info("Scheduler started", "component", "scheduler")
 
@@ -58,9 +77,74 @@ func (s *Scheduler) Start(ctx context.Context) {
 			s.shutdown()
 			slog.Info("Scheduler shutdown complete", "component", "scheduler")
 			return
-		case <-ticker.C:
+		case <-changes.C:
+			s.refreshPaused()
+			s.applyChanges()
+		case <-reload.C:
 			s.loadWorkflows()
+			if err := s.db.PruneWorkflowChanges(time.Now().Add(-changeRetention)); err != nil {
+				slog.Error("Failed to prune workflow change log", "component", "scheduler", "error", err)
+			}
+		}
+	}
+}
+
+// refreshPaused reads the global pause switch so that it applies to the next
+// slot that fires.
+func (s *Scheduler) refreshPaused() {
+	paused, err := s.db.SchedulingPaused()
+	if err != nil {
+		slog.Error("Failed to read scheduling pause switch", "component", "scheduler", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if paused == s.paused {
+		return
+	}
+	s.paused = paused
+	if paused {
+		slog.Info("Scheduling paused for all workflows", "component", "scheduler")
+	} else {
+		slog.Info("Scheduling resumed for all workflows", "component", "scheduler")
+	}
+}
+
+// applyChanges updates the schedules of workflows created, updated or
+// deleted since the last change the scheduler saw.
+func (s *Scheduler) applyChanges() {
+	changes, err := s.db.ListWorkflowChanges(s.lastChangeID)
+	if err != nil {
+		slog.Error("Failed to read workflow change log", "component", "scheduler", "error", err)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	s.lastChangeID = changes[len(changes)-1].ID
+
+	// Only the latest state of each workflow matters.
+	changed := make(map[int64]models.WorkflowChange)
+	for _, c := range changes {
+		changed[c.WorkflowID] = c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, c := range changed {
+		slog.Debug("Applying workflow change", "component", "scheduler", "workflow", c.WorkflowName, "change", c.Change)
+		if c.Change == models.WorkflowDeleted {
+			s.removeWorkflow(id)
+			continue
+		}
+		w, err := s.db.GetWorkflow(id)
+		if err != nil {
+			slog.Error("Failed to load changed workflow", "component", "scheduler", "workflow", c.WorkflowName, "error", err)
+			continue
 		}
+		s.updateWorkflow(w)
 	}
 }
 
@@ -78,92 +162,124 @@ func (s *Scheduler) loadWorkflows() {
 
 	for _, w := range workflows {
 		seenIDs[w.ID] = true
+		s.updateWorkflow(&w)
+	}
 
-		if w.Schedule == "" {
-			if sched, exists := s.schedules[w.ID]; exists {
-				slog.Info("Removing schedule for workflow (no longer scheduled)", "component", "scheduler", "workflow", w.Name)
-				sched.timer.Stop()
-				delete(s.schedules, w.ID)
-			}
-			continue
-		}
-
-		duration, err := time.ParseDuration(w.Schedule)
-		if err != nil {
-			slog.Warn("Invalid schedule duration", "component", "scheduler", "workflow", w.Name, "schedule", w.Schedule, "error", err)
-			continue
+	for id := range s.schedules {
+		if !seenIDs[id] {
+			s.removeWorkflow(id)
 		}
+	}
+}
 
+// updateWorkflow schedules, reschedules or unschedules w to match its
+// current definition. The caller must hold s.mu.
+func (s *Scheduler) updateWorkflow(w *models.Workflow) {
+	if w.Schedule == "" {
 		if sched, exists := s.schedules[w.ID]; exists {
-			if sched.duration == duration {
-				sched.workflow = &w
-				continue
-			}
-			slog.Info("Updating workflow schedule", "component", "scheduler", "workflow", w.Name, "old_duration", sched.duration, "new_duration", duration)
+			slog.Info("Removing schedule for workflow (no longer scheduled)", "component", "scheduler", "workflow", w.Name)
 			sched.timer.Stop()
+			delete(s.schedules, w.ID)
 		}
+		if !w.NextFireAt.IsZero() {
+			s.setNextFire(w, time.Time{})
+		}
+		return
+	}
 
-		wCopy := w
-		s.scheduleWorkflow(&wCopy, duration)
+	duration, err := models.ParseSchedule(w.Schedule)
+	if err != nil {
+		slog.Warn("Invalid schedule duration", "component", "scheduler", "workflow", w.Name, "schedule", w.Schedule, "error", err)
+		return
 	}
 
-	for id, sched := range s.schedules {
-		if !seenIDs[id] {
-			slog.Info("Removing deleted workflow from scheduler", "component", "scheduler", "workflow", sched.workflow.Name)
-			sched.timer.Stop()
-			if sched.cancelRun != nil {
-				sched.cancelRun()
+	if sched, exists := s.schedules[w.ID]; exists {
+		if sched.duration == duration {
+			if sched.workflow.Paused != w.Paused {
+				slog.Info("Workflow schedule paused state changed", "component", "scheduler", "workflow", w.Name, "paused", w.Paused)
 			}
-			delete(s.schedules, id)
+			sched.workflow = w
+			return
 		}
+		slog.Info("Updating workflow schedule", "component", "scheduler", "workflow", w.Name, "old_duration", sched.duration, "new_duration", duration)
+		sched.timer.Stop()
 	}
+
+	s.scheduleWorkflow(w, duration)
+}
+
+// removeWorkflow stops scheduling a deleted workflow. The caller must hold
+// s.mu.
+func (s *Scheduler) removeWorkflow(id int64) {
+	sched, exists := s.schedules[id]
+	if !exists {
+		return
+	}
+	slog.Info("Removing deleted workflow from scheduler", "component", "scheduler", "workflow", sched.workflow.Name)
+	sched.timer.Stop()
+	delete(s.schedules, id)
 }
 
 func (s *Scheduler) scheduleWorkflow(w *models.Workflow, duration time.Duration) {
-	initialDelay := s.calculateInitialDelay(w, duration)
+	lastSlot := s.lastSlot(w, duration)
+	initialDelay := max(time.Until(lastSlot.Add(duration)), 0)
 
 	slog.Info("Scheduling workflow", "component", "scheduler", "workflow", w.Name, "interval", duration, "initial_delay", initialDelay)
 
 	sched := &workflowSchedule{
 		workflow: w,
 		duration: duration,
-		running:  false,
+		lastSlot: lastSlot,
 	}
 
-	sched.timer = time.AfterFunc(initialDelay, func() {
+	s.arm(sched, initialDelay)
+	s.schedules[w.ID] = sched
+}
+
+// arm sets the timer for the next time sched fires and records that time so
+// it can be shown outside the daemon. The caller must hold s.mu.
+func (s *Scheduler) arm(sched *workflowSchedule, delay time.Duration) {
+	sched.timer = time.AfterFunc(delay, func() {
 		s.runWorkflow(sched)
 	})
-
-	s.schedules[w.ID] = sched
+	s.setNextFire(sched.workflow, time.Now().Add(delay))
 }
 
-func (s *Scheduler) calculateInitialDelay(w *models.Workflow, duration time.Duration) time.Duration {
-	runs, err := s.db.ListRuns(&w.ID)
-	if err != nil || len(runs) == 0 {
-		return 0
+func (s *Scheduler) setNextFire(w *models.Workflow, next time.Time) {
+	if err := s.db.SetNextFireAt(w.ID, next); err != nil {
+		slog.Error("Failed to record next fire time", "component", "scheduler", "workflow", w.Name, "error", err)
 	}
+}
 
-	lastRun := runs[0]
-	if lastRun.CompletedAt.IsZero() {
-		return duration
+// lastSlot returns the schedule slot of the workflow's last scheduled run. A
+// workflow the scheduler has never run is treated as due now.
+func (s *Scheduler) lastSlot(w *models.Workflow, duration time.Duration) time.Time {
+	last, err := s.db.LastScheduledAt(w.ID)
+	if err != nil {
+		slog.Error("Failed to get last scheduled run", "component", "scheduler", "workflow", w.Name, "error", err)
 	}
-
-	elapsed := time.Since(lastRun.CompletedAt)
-	if elapsed >= duration {
-		return 0
+	if last.IsZero() {
+		return time.Now().Add(-duration)
 	}
+	return last
+}
 
-	return duration - elapsed
+// current reports whether sched is still the schedule of its workflow. A
+// schedule is replaced when its interval changes and dropped when its
+// workflow is deleted or unscheduled, after which its timer and run must not
+// arm it again. The caller must hold s.mu.
+func (s *Scheduler) current(sched *workflowSchedule) bool {
+	return s.schedules[sched.workflow.ID] == sched
 }
 
+// runWorkflow queues a run for each slot that is due under the misfire
+// policy and arms the next one. Whether a run may overlap one that is still
+// going is left to the workflow's concurrency setting, which the dispatcher
+// applies.
 func (s *Scheduler) runWorkflow(sched *workflowSchedule) {
 	s.mu.Lock()
 
-	if sched.running {
-		slog.Debug("Workflow already running, skipping", "component", "scheduler", "workflow", sched.workflow.Name)
-		sched.timer = time.AfterFunc(sched.duration, func() {
-			s.runWorkflow(sched)
-		})
+	if !s.current(sched) {
 		s.mu.Unlock()
 		return
 	}
@@ -175,64 +291,61 @@ func (s *Scheduler) runWorkflow(sched *workflowSchedule) {
 	default:
 	}
 
-	sched.running = true
-	runCtx, cancel := context.WithCancel(s.ctx)
-	sched.cancelRun = cancel
-	s.mu.Unlock()
+	workflow := sched.workflow
+	slots, dropped, latest := workflow.PlanSlots(sched.lastSlot, sched.duration, time.Now())
 
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-		defer func() {
-			s.mu.Lock()
-			sched.running = false
-			sched.cancelRun = nil
-
-			select {
-			case <-s.ctx.Done():
-			default:
-				sched.timer = time.AfterFunc(sched.duration, func() {
-					s.runWorkflow(sched)
-				})
-				slog.Debug("Rescheduled workflow", "component", "scheduler", "workflow", sched.workflow.Name, "next_run_in", sched.duration)
-			}
-			s.mu.Unlock()
-		}()
+	// Slots that come due while paused are passed over rather than treated
+	// as missed, so resuming does not trigger a catch-up.
+	if workflow.Paused || s.paused {
+		slog.Info("Skipping paused workflow", "component", "scheduler", "workflow", workflow.Name, "slots", len(slots)+dropped, "global", s.paused)
+		sched.lastSlot = latest
+		s.arm(sched, max(time.Until(latest.Add(sched.duration)), 0))
+		s.mu.Unlock()
+		return
+	}
+	if dropped > 0 {
+		slog.Warn("Dropping missed schedule slots", "component", "scheduler", "workflow", workflow.Name, "dropped", dropped, "last_slot", sched.lastSlot, "latest_slot", latest)
+	}
 
-		slog.Info("Starting scheduled workflow execution", "component", "scheduler", "workflow", sched.workflow.Name, "workflow_id", sched.workflow.ID)
+	s.wg.Add(1)
+	defer s.wg.Done()
+	s.mu.Unlock()
 
-		run, err := s.eng.ExecuteWorkflow(runCtx, sched.workflow, "scheduler")
-		if err != nil {
-			slog.Error("Failed to execute scheduled workflow", "component", "scheduler", "workflow", sched.workflow.Name, "workflow_id", sched.workflow.ID, "error", err)
-		} else {
-			slog.Info("Completed scheduled workflow execution", "component", "scheduler", "workflow", sched.workflow.Name, "workflow_id", sched.workflow.ID, "run_id", run.ID, "status", run.Status)
+	// Missed slots are queued oldest first, so that under a queue policy
+	// each runs after, and sees the results of, the one before it.
+	for _, slot := range slots {
+		if !s.queueSlot(workflow, slot) {
+			break
 		}
-	}()
-}
-
-func (s *Scheduler) recoverRuns() {
-	slog.Info("Starting recovery of incomplete runs", "component", "scheduler")
+	}
 
-	runs, err := s.db.ListRuns(nil)
-	if err != nil {
-		slog.Error("Failed to list runs during recovery", "component", "scheduler", "error", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sched.lastSlot = latest
+	select {
+	case <-s.ctx.Done():
 		return
+	default:
 	}
-
-	recoveredCount := 0
-	for _, r := range runs {
-		if r.Status == models.RunStatusRunning || r.Status == models.RunStatusPending {
-			now := time.Now()
-			if err := s.db.UpdateRunStatus(r.ID, models.RunStatusCanceled, &now); err != nil {
-				slog.Error("Failed to cancel incomplete run", "component", "scheduler", "run_id", r.ID, "error", err)
-			} else {
-				recoveredCount++
-				slog.Info("Recovered incomplete run", "component", "scheduler", "run_id", r.ID, "status", r.Status)
-			}
-		}
+	if !s.current(sched) {
+		return
 	}
+	delay := max(time.Until(latest.Add(sched.duration)), 0)
+	s.arm(sched, delay)
+	slog.Debug("Rescheduled workflow", "component", "scheduler", "workflow", workflow.Name, "next_run_in", delay)
+}
 
-	slog.Info("Recovery complete", "component", "scheduler", "runs_recovered", recoveredCount)
+// queueSlot queues a run for one schedule slot. It returns false if the run
+// could not be queued.
+func (s *Scheduler) queueSlot(workflow *models.Workflow, slot time.Time) bool {
+	runID, err := s.db.EnqueueRun(&models.Run{WorkflowID: workflow.ID, Trigger: "scheduler", ScheduledAt: slot}, 0)
+	if err != nil {
+		slog.Error("Failed to queue scheduled workflow", "component", "scheduler", "workflow", workflow.Name, "workflow_id", workflow.ID, "error", err)
+		return false
+	}
+	metrics.SchedulerLag.Observe(time.Since(slot).Seconds(), workflow.Name)
+	slog.Info("Queued scheduled workflow run", "component", "scheduler", "workflow", workflow.Name, "workflow_id", workflow.ID, "run_id", runID, "scheduled_at", slot)
+	return true
 }
 
 func (s *Scheduler) shutdown() {
@@ -242,14 +355,17 @@ func (s *Scheduler) shutdown() {
 
 	for _, sched := range s.schedules {
 		sched.timer.Stop()
-		if sched.cancelRun != nil {
-			slog.Info("Canceling active workflow run", "component", "scheduler", "workflow", sched.workflow.Name)
-			sched.cancelRun()
-		}
+		s.setNextFire(sched.workflow, time.Time{})
 	}
 	s.mu.Unlock()
 
-	slog.Info("Waiting for active workflows to complete", "component", "scheduler")
+	// Queued runs are left to the dispatcher; only slots being queued are
+	// waited for.
 	s.wg.Wait()
-	slog.Info("All workflows completed", "component", "scheduler")
+
+	// The scheduler may be started again if this daemon becomes leader
+	// again, and reloads every workflow when it is.
+	s.mu.Lock()
+	s.schedules = make(map[int64]*workflowSchedule)
+	s.mu.Unlock()
 }
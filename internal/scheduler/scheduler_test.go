@@ -0,0 +1,109 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+func TestRemovedScheduleIsNotRearmed(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := &models.Workflow{Name: "hourly", Schedule: "1h", Steps: []models.WorkflowStep{
+		{Name: "report", Exec: &models.ExecAction{Command: "echo"}},
+	}}
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(w.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewScheduler(database)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+
+	s.mu.Lock()
+	s.scheduleWorkflow(stored, time.Hour)
+	sched := s.schedules[stored.ID]
+	sched.timer.Stop()
+	s.mu.Unlock()
+
+	// The workflow has never run, so its first slot is due.
+	s.runWorkflow(sched)
+	s.mu.Lock()
+	timer := sched.timer
+	s.removeWorkflow(stored.ID)
+	s.mu.Unlock()
+
+	// A timer that was already firing when the schedule was dropped must not
+	// queue another run either.
+	s.runWorkflow(sched)
+	s.wg.Wait()
+
+	if sched.timer != timer {
+		t.Fatal("a removed schedule was armed again")
+	}
+	runs, err := database.ListRuns(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("got %d runs, want only the one queued before the workflow was removed", len(runs))
+	}
+}
+
+func TestMissedSlotsAreQueuedWithoutWaiting(t *testing.T) {
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	w := &models.Workflow{Name: "hourly", Schedule: "1h", Misfire: &models.Misfire{Policy: models.MisfireCatchUp}, Steps: []models.WorkflowStep{
+		{Name: "report", Exec: &models.ExecAction{Command: "echo"}},
+	}}
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(w.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewScheduler(database)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+
+	s.mu.Lock()
+	s.scheduleWorkflow(stored, time.Hour)
+	sched := s.schedules[stored.ID]
+	sched.timer.Stop()
+	sched.lastSlot = time.Now().Add(-3*time.Hour - time.Minute)
+	s.mu.Unlock()
+
+	// No dispatcher runs the queued runs; the scheduler must not wait for
+	// them, but leave overlapping to the dispatcher.
+	s.runWorkflow(sched)
+
+	entries, err := database.ListQueuedRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("queued %d runs, want one for each of the 3 missed slots", len(entries))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.current(sched) || time.Until(sched.lastSlot.Add(time.Hour)) <= 0 {
+		t.Fatal("the schedule was not armed for the next slot")
+	}
+}
@@ -0,0 +1,357 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kingoftac/gork/internal/version"
+)
+
+const (
+	// DefaultEndpoint is the OTLP/HTTP traces endpoint of a collector
+	// running on the same host.
+	DefaultEndpoint = "http://localhost:4318/v1/traces"
+
+	batchSize     = 256
+	flushInterval = 5 * time.Second
+	// maxQueued bounds the spans waiting for export, so that a collector
+	// that is down does not grow the daemon's memory without limit.
+	maxQueued = 8192
+)
+
+// Config selects where spans are exported. It is the tracing section of the
+// daemon config file.
+type Config struct {
+	// Exporter is "otlp", "file", "stdout" or empty to disable tracing.
+	Exporter    string            `yaml:"exporter"`
+	Endpoint    string            `yaml:"endpoint,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	File        string            `yaml:"file,omitempty"`
+	ServiceName string            `yaml:"service_name,omitempty"`
+}
+
+func (c Config) Validate() error {
+	switch c.Exporter {
+	case "", "otlp", "stdout":
+	case "file":
+		if c.File == "" {
+			return errors.New("the file exporter needs a file")
+		}
+	default:
+		return fmt.Errorf("unknown exporter %q (want otlp, file or stdout)", c.Exporter)
+	}
+	return nil
+}
+
+// exporter sends one encoded batch of spans.
+type exporter interface {
+	export(ctx context.Context, payload []byte) error
+	close() error
+}
+
+// provider batches finished spans and hands them to an exporter.
+type provider struct {
+	exporter    exporter
+	serviceName string
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+	flush   chan struct{}
+	done    chan struct{}
+}
+
+// Setup starts exporting spans as configured and returns a function that
+// exports the spans still queued and stops. It does nothing if no exporter
+// is configured.
+func Setup(cfg Config) (shutdown func(ctx context.Context), err error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var exp exporter
+	switch cfg.Exporter {
+	case "":
+		return func(context.Context) {}, nil
+	case "otlp":
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultEndpoint
+		}
+		exp = &otlpExporter{endpoint: endpoint, headers: cfg.Headers, client: &http.Client{Timeout: 10 * time.Second}}
+	case "stdout":
+		exp = &writerExporter{w: os.Stdout}
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exp = &writerExporter{w: f, closer: f}
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "gork"
+	}
+	p := &provider{
+		exporter:    exp,
+		serviceName: serviceName,
+		flush:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	stop := make(chan struct{})
+	go p.run(stop)
+	current.Store(p)
+
+	return func(ctx context.Context) {
+		current.CompareAndSwap(p, nil)
+		close(stop)
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+		}
+		if err := exp.close(); err != nil {
+			slog.Error("Failed to close trace exporter", "component", "tracing", "error", err)
+		}
+	}, nil
+}
+
+func (p *provider) enqueue(s *Span) {
+	p.mu.Lock()
+	if len(p.queue) >= maxQueued {
+		p.dropped++
+	} else {
+		p.queue = append(p.queue, s)
+	}
+	full := len(p.queue) >= batchSize
+	p.mu.Unlock()
+
+	if full {
+		select {
+		case p.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports queued spans every flush interval, or sooner once a batch is
+// full, until stop is closed, and then exports what is left.
+func (p *provider) run(stop chan struct{}) {
+	defer close(p.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			p.export()
+			return
+		case <-ticker.C:
+		case <-p.flush:
+		}
+		p.export()
+	}
+}
+
+func (p *provider) export() {
+	for {
+		p.mu.Lock()
+		n := min(len(p.queue), batchSize)
+		batch := p.queue[:n:n]
+		p.queue = p.queue[n:]
+		dropped := p.dropped
+		p.dropped = 0
+		p.mu.Unlock()
+
+		if dropped > 0 {
+			slog.Warn("Dropped spans because the export queue was full", "component", "tracing", "dropped", dropped)
+		}
+		if n == 0 {
+			return
+		}
+
+		payload, err := json.Marshal(p.encode(batch))
+		if err != nil {
+			slog.Error("Failed to encode spans", "component", "tracing", "error", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = p.exporter.export(ctx, payload)
+		cancel()
+		if err != nil {
+			slog.Warn("Failed to export spans", "component", "tracing", "spans", n, "error", err)
+		}
+	}
+}
+
+// otlpExporter posts batches to an OTLP/HTTP collector using the JSON
+// encoding.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() error { return nil }
+
+// writerExporter writes each batch as one line of OTLP JSON, which
+// collectors can replay and which is easy to inspect offline.
+type writerExporter struct {
+	w      io.Writer
+	closer io.Closer
+}
+
+func (e *writerExporter) export(_ context.Context, payload []byte) error {
+	_, err := e.w.Write(append(payload, '\n'))
+	return err
+}
+
+func (e *writerExporter) close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// The types below are the OTLP JSON encoding of an ExportTraceServiceRequest.
+// IDs are hex strings and 64-bit integers are decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (p *provider) encode(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+			Status:            otlpStatus{Code: s.Status, Message: s.StatusMessage},
+		}
+		if s.ParentSpanID != (SpanID{}) {
+			span.ParentSpanID = s.ParentSpanID.String()
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttributes([]Attribute{
+			String("service.name", p.serviceName),
+			String("service.version", version.Version),
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/kingoftac/gork", Version: version.Version},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func encodeAttributes(attrs []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch value := a.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		case float64:
+			v.DoubleValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
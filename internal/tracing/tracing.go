@@ -0,0 +1,194 @@
+// Package tracing records runs and steps as OpenTelemetry spans and exports
+// them in the OTLP JSON encoding, either to a collector or to a file.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpanKind says what a span represents, as in the OTLP SpanKind enum.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindClient   SpanKind = 3
+)
+
+// StatusCode is the outcome of a span, as in the OTLP Status.StatusCode enum.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key and a string, int64, bool or float64 value.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attribute    { return Attribute{key, value} }
+func Int(key string, value int64) Attribute { return Attribute{key, value} }
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// Span is one timed operation in a trace. All methods are safe to call on a
+// nil span, which is what Start returns when tracing is disabled.
+type Span struct {
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentSpanID  SpanID
+	Name          string
+	Kind          SpanKind
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Status        StatusCode
+	StatusMessage string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetAttributes adds attrs to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attributes = append(s.Attributes, attrs...)
+	s.mu.Unlock()
+}
+
+// SetStatus sets the outcome of the span.
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Status, s.StatusMessage = code, message
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed with err, or as succeeded if err is nil.
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.SetStatus(StatusError, err.Error())
+	} else {
+		s.SetStatus(StatusOK, "")
+	}
+}
+
+// Finish ends the span and queues it for export. Only the first call has
+// any effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if p := current.Load(); p != nil {
+		p.enqueue(s)
+	}
+}
+
+// TraceParent returns the W3C traceparent header value identifying s as the
+// parent of a remote operation.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// current is the provider spans are exported through, or nil when tracing is
+// disabled.
+var current atomic.Pointer[provider]
+
+// Enabled reports whether spans are being recorded.
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+type spanKey struct{}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins a span that is a child of the span in ctx, or the root of a
+// new trace if there is none, and returns a context carrying it. It returns
+// a nil span when tracing is disabled.
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: attrs,
+	}
+	if parent := FromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(s.TraceID[:])
+	}
+	rand.Read(s.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// WithRemoteParent returns ctx carrying the span identified by traceparent,
+// a W3C traceparent value received from another process, so that spans
+// started from it continue that trace. The span is not recorded here. ctx is
+// returned unchanged if traceparent is empty or malformed.
+func WithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 2*len(TraceID{}) || len(parts[2]) != 2*len(SpanID{}) {
+		return ctx
+	}
+	s := &Span{}
+	if _, err := hex.Decode(s.TraceID[:], []byte(parts[1])); err != nil || s.TraceID == (TraceID{}) {
+		return ctx
+	}
+	if _, err := hex.Decode(s.SpanID[:], []byte(parts[2])); err != nil || s.SpanID == (SpanID{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Inject sets the traceparent header of an outgoing request to the span in
+// ctx, so that the receiving service continues the trace.
+func Inject(ctx context.Context, h http.Header) {
+	if s := FromContext(ctx); s != nil {
+		h.Set("traceparent", s.TraceParent())
+	}
+}
@@ -0,0 +1,97 @@
+package trigger
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// upstreamOutputPrefix prefixes the run parameters carrying the outputs of
+// the upstream run.
+const upstreamOutputPrefix = "GORK_UPSTREAM_"
+
+// EnqueueDownstream queues a run of every workflow with an after trigger
+// matching the finished run of upstream, passing it the upstream run's ID,
+// status and outputs.
+func EnqueueDownstream(db *db.DB, upstream *models.Workflow, run *models.Run) {
+	workflows, err := db.ListWorkflows()
+	if err != nil {
+		slog.Error("Failed to list workflows for after triggers", "component", "trigger", "workflow", upstream.Name, "error", err)
+		return
+	}
+
+	var params map[string]string
+	for _, w := range workflows {
+		if w.Triggers == nil || !matchesAny(w.Triggers.After, upstream.Name, run.Status) {
+			continue
+		}
+
+		if params == nil {
+			params, err = upstreamParams(db, upstream, run)
+			if err != nil {
+				slog.Error("Failed to load upstream outputs", "component", "trigger", "workflow", upstream.Name, "run_id", run.ID, "error", err)
+				return
+			}
+		}
+
+		downstream := &models.Run{
+			WorkflowID: w.ID,
+			Trigger:    "after:" + upstream.Name,
+			Params:     params,
+		}
+		runID, err := db.EnqueueRun(downstream, 0)
+		if err != nil {
+			slog.Error("Failed to enqueue triggered run", "component", "trigger", "workflow", w.Name, "upstream_run_id", run.ID, "error", err)
+			continue
+		}
+		slog.Info("After trigger fired", "component", "trigger", "workflow", w.Name, "upstream", upstream.Name, "upstream_run_id", run.ID, "status", run.Status, "run_id", runID)
+	}
+}
+
+func matchesAny(triggers []models.AfterTrigger, upstream string, status models.RunStatus) bool {
+	for _, a := range triggers {
+		if a.Matches(upstream, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamParams returns the run parameters describing run, including each
+// step output as GORK_UPSTREAM_<STEP>_<KEY>.
+func upstreamParams(db *db.DB, upstream *models.Workflow, run *models.Run) (map[string]string, error) {
+	params := map[string]string{
+		models.UpstreamRunIDParam:    strconv.FormatInt(run.ID, 10),
+		models.UpstreamWorkflowParam: upstream.Name,
+		models.UpstreamStatusParam:   string(run.Status),
+	}
+
+	outputs, err := db.GetAllStepData(run.ID)
+	if err != nil {
+		return nil, err
+	}
+	for step, values := range outputs {
+		for key, value := range values {
+			params[upstreamOutputPrefix+paramSuffix(step)+"_"+paramSuffix(key)] = value
+		}
+	}
+	return params, nil
+}
+
+// paramSuffix upper-cases s and replaces characters that cannot appear in an
+// environment variable name with underscores.
+func paramSuffix(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,236 @@
+package trigger
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// pollInterval is how often watched directories are scanned. A file must
+// look the same on two consecutive scans before it fires, so that a run does
+// not start while the file is still being written.
+const pollInterval = time.Second
+
+// fileState is what the watcher compares between scans to detect changes.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watch is the scan state of one file trigger.
+type watch struct {
+	workflow *models.Workflow
+	trigger  models.FileTrigger
+	// fired holds the state each file had when it last fired, or when it was
+	// first seen; pending holds changes waiting for the file to settle.
+	fired    map[string]fileState
+	pending  map[string]fileState
+	baseline bool
+}
+
+// FileWatcher starts runs of workflows whose file triggers match files
+// created or modified in a watched directory. Directories are polled rather
+// than subscribed to, which works the same on every platform and on network
+// file systems.
+type FileWatcher struct {
+	db           *db.DB
+	watches      map[int64][]*watch
+	lastChangeID int64
+}
+
+func NewFileWatcher(db *db.DB) *FileWatcher {
+	return &FileWatcher{
+		db:      db,
+		watches: make(map[int64][]*watch),
+	}
+}
+
+// Start watches the directories of every workflow's file triggers until ctx
+// is canceled. Files that already exist when a trigger is loaded do not fire.
+func (fw *FileWatcher) Start(ctx context.Context) {
+	slog.Info("File watcher starting", "component", "trigger")
+
+	lastChangeID, err := fw.db.LatestWorkflowChangeID()
+	if err != nil {
+		slog.Error("Failed to read workflow change log", "component", "trigger", "error", err)
+	}
+	fw.lastChangeID = lastChangeID
+	fw.watches = make(map[int64][]*watch)
+	fw.loadWorkflows()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("File watcher stopped", "component", "trigger")
+			return
+		case <-ticker.C:
+			fw.applyChanges()
+			for _, watches := range fw.watches {
+				for _, w := range watches {
+					fw.scan(w)
+				}
+			}
+		}
+	}
+}
+
+func (fw *FileWatcher) loadWorkflows() {
+	workflows, err := fw.db.ListWorkflows()
+	if err != nil {
+		slog.Error("Failed to list workflows", "component", "trigger", "error", err)
+		return
+	}
+	for _, w := range workflows {
+		fw.updateWorkflow(&w)
+	}
+}
+
+// applyChanges reloads the triggers of workflows created, updated or deleted
+// since the last change the watcher saw.
+func (fw *FileWatcher) applyChanges() {
+	changes, err := fw.db.ListWorkflowChanges(fw.lastChangeID)
+	if err != nil {
+		slog.Error("Failed to read workflow change log", "component", "trigger", "error", err)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	fw.lastChangeID = changes[len(changes)-1].ID
+
+	changed := make(map[int64]models.WorkflowChange)
+	for _, c := range changes {
+		changed[c.WorkflowID] = c
+	}
+
+	for id, c := range changed {
+		if c.Change == models.WorkflowDeleted {
+			delete(fw.watches, id)
+			continue
+		}
+		w, err := fw.db.GetWorkflow(id)
+		if err != nil {
+			slog.Error("Failed to load changed workflow", "component", "trigger", "workflow", c.WorkflowName, "error", err)
+			continue
+		}
+		fw.updateWorkflow(w)
+	}
+}
+
+// updateWorkflow replaces the watches of w. Triggers that did not change
+// keep their scan state, so files are not reported again.
+func (fw *FileWatcher) updateWorkflow(w *models.Workflow) {
+	var triggers []models.FileTrigger
+	if w.Triggers != nil {
+		triggers = w.Triggers.Files
+	}
+	if len(triggers) == 0 {
+		delete(fw.watches, w.ID)
+		return
+	}
+
+	existing := fw.watches[w.ID]
+	watches := make([]*watch, 0, len(triggers))
+	for _, t := range triggers {
+		i := slices.IndexFunc(existing, func(e *watch) bool {
+			return e.trigger.Dir == t.Dir && e.trigger.Pattern == t.Pattern
+		})
+		if i >= 0 {
+			existing[i].workflow = w
+			existing[i].trigger = t
+			watches = append(watches, existing[i])
+			continue
+		}
+		slog.Info("Watching directory", "component", "trigger", "workflow", w.Name, "dir", t.Dir, "pattern", t.EffectivePattern())
+		watches = append(watches, &watch{
+			workflow: w,
+			trigger:  t,
+			fired:    make(map[string]fileState),
+			pending:  make(map[string]fileState),
+		})
+	}
+	fw.watches[w.ID] = watches
+}
+
+// scan compares the files matching w with the previous scan and fires for
+// those that changed and have since settled.
+func (fw *FileWatcher) scan(w *watch) {
+	matches, err := filepath.Glob(filepath.Join(w.trigger.Dir, w.trigger.EffectivePattern()))
+	if err != nil {
+		slog.Warn("Invalid file trigger pattern", "component", "trigger", "workflow", w.workflow.Name, "error", err)
+		return
+	}
+
+	present := make(map[string]bool, len(matches))
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		present[path] = true
+		state := fileState{modTime: info.ModTime(), size: info.Size()}
+
+		if !w.baseline {
+			w.fired[path] = state
+			continue
+		}
+
+		last, seen := w.fired[path]
+		if seen && last == state {
+			delete(w.pending, path)
+			continue
+		}
+		if w.pending[path] != state {
+			w.pending[path] = state
+			continue
+		}
+
+		delete(w.pending, path)
+		w.fired[path] = state
+		event := models.FileModified
+		if !seen {
+			event = models.FileCreated
+		}
+		if w.trigger.Watches(event) {
+			fw.fire(w, path, event)
+		}
+	}
+	w.baseline = true
+
+	for path := range w.fired {
+		if !present[path] {
+			delete(w.fired, path)
+		}
+	}
+	for path := range w.pending {
+		if !present[path] {
+			delete(w.pending, path)
+		}
+	}
+}
+
+func (fw *FileWatcher) fire(w *watch, path string, event models.FileEvent) {
+	run := &models.Run{
+		WorkflowID: w.workflow.ID,
+		Trigger:    "file:" + filepath.Join(w.trigger.Dir, w.trigger.EffectivePattern()),
+		Params: map[string]string{
+			models.TriggerFileParam:  path,
+			models.TriggerEventParam: string(event),
+		},
+	}
+	runID, err := fw.db.EnqueueRun(run, 0)
+	if err != nil {
+		slog.Error("Failed to enqueue triggered run", "component", "trigger", "workflow", w.workflow.Name, "file", path, "error", err)
+		return
+	}
+	slog.Info("File trigger fired", "component", "trigger", "workflow", w.workflow.Name, "file", path, "event", event, "run_id", runID)
+}
@@ -0,0 +1,133 @@
+package trigger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// scanAll does what the watcher does on each tick.
+func scanAll(fw *FileWatcher) {
+	fw.applyChanges()
+	for _, watches := range fw.watches {
+		for _, w := range watches {
+			fw.scan(w)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectFired checks that the scan queued exactly the given runs since the
+// previous check.
+func expectFired(t *testing.T, database *db.DB, seen *int, want ...map[string]string) {
+	t.Helper()
+	runs := queuedRuns(t, database)
+	fired := runs[*seen:]
+	*seen = len(runs)
+	if len(fired) != len(want) {
+		t.Fatalf("%d runs fired, want %d", len(fired), len(want))
+	}
+	for i, run := range fired {
+		for k, v := range want[i] {
+			if run.Params[k] != v {
+				t.Fatalf("run %d param %s = %q, want %q", run.ID, k, run.Params[k], v)
+			}
+		}
+	}
+}
+
+func TestFileWatcherFiresOnceFilesSettle(t *testing.T) {
+	database := newTestDB(t)
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.csv")
+	writeFile(t, existing, "a\n")
+	insertWorkflow(t, database, "ingest", &models.Triggers{Files: []models.FileTrigger{{Dir: dir, Pattern: "*.csv"}}})
+
+	fw := NewFileWatcher(database)
+	fw.loadWorkflows()
+	seen := 0
+
+	// Files that exist when the trigger is loaded do not fire.
+	scanAll(fw)
+	scanAll(fw)
+	expectFired(t, database, &seen)
+
+	// A new file fires once it looks the same on two scans in a row, and
+	// not while it is still growing.
+	report := filepath.Join(dir, "report.csv")
+	writeFile(t, report, "a\n")
+	scanAll(fw)
+	expectFired(t, database, &seen)
+	appendFile(t, report, "b\n")
+	scanAll(fw)
+	expectFired(t, database, &seen)
+	scanAll(fw)
+	expectFired(t, database, &seen, map[string]string{
+		models.TriggerFileParam:  report,
+		models.TriggerEventParam: string(models.FileCreated),
+	})
+	scanAll(fw)
+	expectFired(t, database, &seen)
+
+	// Modifying a file fires again once it settles.
+	appendFile(t, existing, "b\n")
+	scanAll(fw)
+	expectFired(t, database, &seen)
+	scanAll(fw)
+	expectFired(t, database, &seen, map[string]string{
+		models.TriggerFileParam:  existing,
+		models.TriggerEventParam: string(models.FileModified),
+	})
+
+	// Files that do not match the pattern never fire.
+	writeFile(t, filepath.Join(dir, "notes.txt"), "a\n")
+	scanAll(fw)
+	scanAll(fw)
+	expectFired(t, database, &seen)
+}
+
+func TestFileWatcherOnlyFiresWatchedEvents(t *testing.T) {
+	database := newTestDB(t)
+	dir := t.TempDir()
+	insertWorkflow(t, database, "ingest", &models.Triggers{Files: []models.FileTrigger{{Dir: dir, Events: []models.FileEvent{models.FileModified}}}})
+
+	fw := NewFileWatcher(database)
+	fw.loadWorkflows()
+	seen := 0
+	scanAll(fw)
+
+	path := filepath.Join(dir, "data")
+	writeFile(t, path, "a\n")
+	scanAll(fw)
+	scanAll(fw)
+	expectFired(t, database, &seen)
+
+	appendFile(t, path, "b\n")
+	scanAll(fw)
+	scanAll(fw)
+	expectFired(t, database, &seen, map[string]string{
+		models.TriggerFileParam:  path,
+		models.TriggerEventParam: string(models.FileModified),
+	})
+}
@@ -0,0 +1,159 @@
+package trigger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+// WebhookPath is the path under which the daemon accepts webhooks; the rest
+// of the path is the workflow name.
+const WebhookPath = "/hooks/"
+
+// maxPayloadSize bounds the body of a webhook request.
+const maxPayloadSize = 1 << 20
+
+// Signature headers, both carrying "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the body. The second is what GitHub sends.
+const (
+	signatureHeader       = "X-Gork-Signature"
+	githubSignatureHeader = "X-Hub-Signature-256"
+)
+
+// payloadParamPrefix prefixes the run parameters made from the top-level
+// fields of a JSON object payload.
+const payloadParamPrefix = "GORK_PAYLOAD_"
+
+// WebhookHandler starts runs of workflows with a webhook trigger when it
+// receives a POST to WebhookPath followed by the workflow name, signed with
+// the workflow's secret.
+type WebhookHandler struct {
+	db *db.DB
+}
+
+func NewWebhookHandler(db *db.DB) *WebhookHandler {
+	return &WebhookHandler{db: db}
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, WebhookPath)
+	workflow, err := h.db.GetWorkflowByName(name)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (workflow.Triggers == nil || workflow.Triggers.Webhook == nil)) {
+		http.Error(w, "no webhook for workflow", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load webhook workflow", "component", "trigger", "workflow", name, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	secret := workflow.Triggers.Webhook.ResolveSecret()
+	if secret == "" {
+		slog.Warn("Webhook secret is empty, rejecting request", "component", "trigger", "workflow", name)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if !validSignature(secret, body, r.Header) {
+		slog.Warn("Rejected webhook with invalid signature", "component", "trigger", "workflow", name, "remote", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	run := &models.Run{
+		WorkflowID: workflow.ID,
+		Trigger:    "webhook",
+		Params:     PayloadParams(body),
+	}
+	runID, err := h.db.EnqueueRun(run, 0)
+	if err != nil {
+		slog.Error("Failed to enqueue triggered run", "component", "trigger", "workflow", name, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Webhook trigger fired", "component", "trigger", "workflow", name, "run_id", runID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int64{"run_id": runID})
+}
+
+// validSignature reports whether the request carries the HMAC-SHA256 of body
+// keyed with secret.
+func validSignature(secret string, body []byte, header http.Header) bool {
+	signature := header.Get(signatureHeader)
+	if signature == "" {
+		signature = header.Get(githubSignatureHeader)
+	}
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// PayloadParams returns the run parameters for a webhook payload: the raw
+// body, plus each top-level string, number or boolean field of a JSON object
+// body whose name can be used as an environment variable.
+func PayloadParams(body []byte) map[string]string {
+	params := map[string]string{models.TriggerPayloadParam: string(body)}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return params
+	}
+	for key, raw := range fields {
+		name := payloadParamPrefix + strings.ToUpper(key)
+		if models.ValidateParams(map[string]string{name: ""}) != nil {
+			continue
+		}
+		raw = bytes.TrimSpace(raw)
+		switch {
+		case len(raw) == 0, raw[0] == '{', raw[0] == '[', bytes.Equal(raw, []byte("null")):
+			continue
+		case raw[0] == '"':
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				continue
+			}
+			params[name] = s
+		default:
+			params[name] = string(raw)
+		}
+	}
+	return params
+}
@@ -0,0 +1,178 @@
+package trigger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kingoftac/gork/internal/db"
+	"github.com/kingoftac/gork/internal/models"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database, err := db.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func insertWorkflow(t *testing.T, database *db.DB, name string, triggers *models.Triggers) *models.Workflow {
+	t.Helper()
+	w := &models.Workflow{Name: name, Triggers: triggers, Steps: []models.WorkflowStep{
+		{Name: "step", Exec: &models.ExecAction{Command: "true"}},
+	}}
+	if err := database.InsertWorkflow(w); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := database.GetWorkflowByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// queuedRuns returns the runs waiting in the queue.
+func queuedRuns(t *testing.T, database *db.DB) []*models.Run {
+	t.Helper()
+	entries, err := database.ListQueuedRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs []*models.Run
+	for _, e := range entries {
+		run, err := database.GetRun(e.RunID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func TestValidSignature(t *testing.T) {
+	const secret, body = "s3cret", `{"ref":"main"}`
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"gork header", http.Header{signatureHeader: {sign(secret, body)}}, true},
+		{"github header", http.Header{githubSignatureHeader: {sign(secret, body)}}, true},
+		{"gork header takes precedence", http.Header{signatureHeader: {sign("other", body)}, githubSignatureHeader: {sign(secret, body)}}, false},
+		{"wrong secret", http.Header{signatureHeader: {sign("other", body)}}, false},
+		{"other body", http.Header{signatureHeader: {sign(secret, body+" ")}}, false},
+		{"no algorithm", http.Header{signatureHeader: {strings.TrimPrefix(sign(secret, body), "sha256=")}}, false},
+		{"not hex", http.Header{signatureHeader: {"sha256=zz"}}, false},
+		{"unsigned", http.Header{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validSignature(secret, []byte(body), tt.header); got != tt.want {
+				t.Fatalf("validSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayloadParams(t *testing.T) {
+	body := `{"ref":"main","count":3,"forced":true,"quoted":"a \"b\"","head":{"id":1},"files":["a"],"before":null,"bad-name":"x","9lives":"x"}`
+	want := map[string]string{
+		models.TriggerPayloadParam: body,
+		"GORK_PAYLOAD_REF":         "main",
+		"GORK_PAYLOAD_COUNT":       "3",
+		"GORK_PAYLOAD_FORCED":      "true",
+		"GORK_PAYLOAD_QUOTED":      `a "b"`,
+		"GORK_PAYLOAD_9LIVES":      "x",
+	}
+	if got := PayloadParams([]byte(body)); !maps.Equal(got, want) {
+		t.Fatalf("PayloadParams() = %v, want %v", got, want)
+	}
+
+	for _, body := range []string{"plain text", `["a","b"]`, ""} {
+		want := map[string]string{models.TriggerPayloadParam: body}
+		if got := PayloadParams([]byte(body)); !maps.Equal(got, want) {
+			t.Errorf("PayloadParams(%q) = %v, want only the raw payload", body, got)
+		}
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	database := newTestDB(t)
+	deploy := insertWorkflow(t, database, "deploy", &models.Triggers{Webhook: &models.WebhookTrigger{Secret: "s3cret"}})
+	t.Setenv("GORK_TEST_WEBHOOK_SECRET", "")
+	insertWorkflow(t, database, "unset", &models.Triggers{Webhook: &models.WebhookTrigger{SecretEnv: "GORK_TEST_WEBHOOK_SECRET"}})
+	insertWorkflow(t, database, "manual", nil)
+	handler := NewWebhookHandler(database)
+
+	const body = `{"ref":"main"}`
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		body   string
+		status int
+		queued bool
+	}{
+		{"signed", http.MethodPost, "deploy", http.Header{signatureHeader: {sign("s3cret", body)}}, body, http.StatusAccepted, true},
+		{"signed by github", http.MethodPost, "deploy", http.Header{githubSignatureHeader: {sign("s3cret", body)}}, body, http.StatusAccepted, true},
+		{"bad signature", http.MethodPost, "deploy", http.Header{signatureHeader: {sign("guess", body)}}, body, http.StatusUnauthorized, false},
+		{"unsigned", http.MethodPost, "deploy", nil, body, http.StatusUnauthorized, false},
+		{"empty secret", http.MethodPost, "unset", http.Header{signatureHeader: {sign("", body)}}, body, http.StatusUnauthorized, false},
+		{"no webhook", http.MethodPost, "manual", http.Header{signatureHeader: {sign("s3cret", body)}}, body, http.StatusNotFound, false},
+		{"unknown workflow", http.MethodPost, "missing", http.Header{signatureHeader: {sign("s3cret", body)}}, body, http.StatusNotFound, false},
+		{"not a post", http.MethodGet, "deploy", nil, "", http.StatusMethodNotAllowed, false},
+		{"too large", http.MethodPost, "deploy", nil, strings.Repeat("x", maxPayloadSize+1), http.StatusRequestEntityTooLarge, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(queuedRuns(t, database))
+
+			req := httptest.NewRequest(tt.method, WebhookPath+tt.path, strings.NewReader(tt.body))
+			maps.Copy(req.Header, tt.header)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			runs := queuedRuns(t, database)
+			if !tt.queued {
+				if len(runs) != before {
+					t.Fatalf("%d runs queued, want none", len(runs)-before)
+				}
+				return
+			}
+			if len(runs) != before+1 {
+				t.Fatalf("%d runs queued, want one", len(runs)-before)
+			}
+			var resp struct {
+				RunID int64 `json:"run_id"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			run := runs[len(runs)-1]
+			if run.ID != resp.RunID || run.WorkflowID != deploy.ID || run.Trigger != "webhook" {
+				t.Fatalf("queued run %d of workflow %d triggered by %q, want run %d of workflow %d triggered by webhook",
+					run.ID, run.WorkflowID, run.Trigger, resp.RunID, deploy.ID)
+			}
+			if want := PayloadParams([]byte(body)); !maps.Equal(run.Params, want) {
+				t.Fatalf("params = %v, want %v", run.Params, want)
+			}
+		})
+	}
+}
@@ -132,6 +132,11 @@ func (a App) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return a.handleExportWorkflow()
 			}
 
+		case key.Matches(msg, a.keys.Pause):
+			if a.currentView == common.ViewWorkflows {
+				return a.handleTogglePause()
+			}
+
 		case key.Matches(msg, a.keys.Reset):
 			if a.currentView == common.ViewWorkflows {
 				return a.handleReset()
@@ -195,7 +200,7 @@ func (a App) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	// Handle workflow messages
-	case common.WorkflowsLoadedMsg, common.WorkflowExecutedMsg, common.WorkflowDeletedMsg,
+	case common.WorkflowsLoadedMsg, common.WorkflowQueuedMsg, common.WorkflowPausedMsg, common.WorkflowDeletedMsg,
 		common.WorkflowCreatedMsg, common.WorkflowExportedMsg, common.DataResetMsg:
 		a.loading = false
 		newWorkflows, cmd := a.workflows.Update(msg)
@@ -228,6 +233,11 @@ func (a App) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		a.errMessage = a.logs.ErrMessage()
 		return a, cmd
 
+	case common.CountdownTickMsg:
+		newWorkflows, cmd := a.workflows.Update(msg)
+		a.workflows = &newWorkflows
+		return a, cmd
+
 	// Handle daemon messages
 	case common.DaemonStartedMsg, common.DaemonStoppedMsg, common.TickMsg:
 		if a.currentView == common.ViewDaemon {
@@ -387,6 +397,7 @@ func (a App) renderHelp() string {
 			common.HelpKeyStyle.Render("r") + common.HelpDescStyle.Render(" run"),
 			common.HelpKeyStyle.Render("c") + common.HelpDescStyle.Render(" create"),
 			common.HelpKeyStyle.Render("e") + common.HelpDescStyle.Render(" export"),
+			common.HelpKeyStyle.Render("p") + common.HelpDescStyle.Render(" pause"),
 			common.HelpKeyStyle.Render("d") + common.HelpDescStyle.Render(" delete"),
 			common.HelpKeyStyle.Render("D") + common.HelpDescStyle.Render(" daemon"),
 			common.HelpKeyStyle.Render("X") + common.HelpDescStyle.Render(" reset"),
@@ -491,12 +502,20 @@ func (a App) handleEnter() (tea.Model, tea.Cmd) {
 func (a App) handleRunWorkflow() (tea.Model, tea.Cmd) {
 	if workflow := a.workflows.GetSelectedWorkflow(); workflow != nil {
 		a.loading = true
-		a.statusMessage = "Running workflow..."
+		a.statusMessage = "Queueing workflow run..."
 		return a, a.workflows.ExecuteWorkflow(workflow)
 	}
 	return a, nil
 }
 
+func (a App) handleTogglePause() (tea.Model, tea.Cmd) {
+	if workflow := a.workflows.GetSelectedWorkflow(); workflow != nil {
+		a.loading = true
+		return a, a.workflows.TogglePause(workflow)
+	}
+	return a, nil
+}
+
 func (a App) handleDeleteWorkflow() (tea.Model, tea.Cmd) {
 	if workflow := a.workflows.GetSelectedWorkflow(); workflow != nil {
 		a.loading = true
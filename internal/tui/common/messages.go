@@ -24,12 +24,19 @@ type StepRunsLoadedMsg struct {
 	Err      error
 }
 
-// WorkflowExecutedMsg is sent when a workflow execution completes
-type WorkflowExecutedMsg struct {
+// WorkflowQueuedMsg is sent when a workflow run has been queued for the daemon
+type WorkflowQueuedMsg struct {
 	Run *models.Run
 	Err error
 }
 
+// WorkflowPausedMsg is sent when a workflow's schedule is paused or resumed
+type WorkflowPausedMsg struct {
+	Workflow *models.Workflow
+	Paused   bool
+	Err      error
+}
+
 // WorkflowDeletedMsg is sent when a workflow is deleted
 type WorkflowDeletedMsg struct {
 	ID  int64
@@ -88,6 +95,9 @@ type ErrorMsg struct {
 // TickMsg is sent for periodic updates
 type TickMsg struct{}
 
+// CountdownTickMsg refreshes the next-run countdowns in the workflow list
+type CountdownTickMsg struct{}
+
 // NavigateMsg is sent when navigating between views
 type NavigateMsg struct {
 	View View
@@ -160,7 +160,7 @@ func StatusStyle(status string) lipgloss.Style {
 		return StatusRunningStyle
 	case "success", "succeeded", "completed":
 		return StatusSuccessStyle
-	case "failed", "error":
+	case "failed", "error", "timeout":
 		return StatusFailedStyle
 	default:
 		return lipgloss.NewStyle().Foreground(SecondaryColor)
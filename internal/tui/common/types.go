@@ -45,6 +45,7 @@ type KeyMap struct {
 	Help      key.Binding
 	Create    key.Binding
 	Export    key.Binding
+	Pause     key.Binding
 	Reset     key.Binding
 	Daemon    key.Binding
 	Tab       key.Binding
@@ -103,6 +104,10 @@ var DefaultKeyMap = KeyMap{
 		key.WithKeys("e"),
 		key.WithHelp("e", "export"),
 	),
+	Pause: key.NewBinding(
+		key.WithKeys("p"),
+		key.WithHelp("p", "pause/resume"),
+	),
 	Reset: key.NewBinding(
 		key.WithKeys("X"),
 		key.WithHelp("X", "reset all"),
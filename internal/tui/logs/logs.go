@@ -146,13 +146,16 @@ func (m Model) renderLogs() string {
 			sb.WriteString("\n")
 		}
 
-		// Output (from Logs field)
-		if len(sr.Logs) > 0 {
+		// Output, split by attempt when the run recorded them
+		if len(sr.Attempts) == 0 && len(sr.Logs) > 0 {
 			sb.WriteString("\n")
-			for i, line := range sr.Logs {
-				lineNum := common.LogLineNumberStyle.Render(fmt.Sprintf("%d", i+1))
-				sb.WriteString(fmt.Sprintf("%s %s\n", lineNum, common.LogStyle.Render(line)))
-			}
+			writeLogLines(&sb, sr.Logs)
+		}
+		for _, attempt := range sr.Attempts {
+			sb.WriteString("\n")
+			sb.WriteString(common.SubtitleStyle.Render(fmt.Sprintf("─── %s ───", attempt.Summary())))
+			sb.WriteString("\n")
+			writeLogLines(&sb, attempt.Logs)
 		}
 
 		// Error output
@@ -169,6 +172,13 @@ func (m Model) renderLogs() string {
 	return sb.String()
 }
 
+func writeLogLines(sb *strings.Builder, lines []string) {
+	for i, line := range lines {
+		lineNum := common.LogLineNumberStyle.Render(fmt.Sprintf("%d", i+1))
+		sb.WriteString(fmt.Sprintf("%s %s\n", lineNum, common.LogStyle.Render(line)))
+	}
+}
+
 // Commands
 
 // LoadStepRuns loads step runs for a run
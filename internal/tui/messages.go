@@ -19,11 +19,17 @@ type StepRunsLoadedMsg struct {
 	Err      error
 }
 
-type WorkflowExecutedMsg struct {
+type WorkflowQueuedMsg struct {
 	Run *models.Run
 	Err error
 }
 
+type WorkflowPausedMsg struct {
+	Workflow *models.Workflow
+	Paused   bool
+	Err      error
+}
+
 type WorkflowDeletedMsg struct {
 	ID  int64
 	Err error
@@ -70,3 +76,6 @@ type StatusMsg struct {
 }
 
 type TickMsg struct{}
+
+// CountdownTickMsg refreshes the next-run countdowns in the workflow list.
+type CountdownTickMsg struct{}
@@ -57,6 +57,7 @@ type KeyMap struct {
 	Help      key.Binding
 	Create    key.Binding
 	Export    key.Binding
+	Pause     key.Binding
 	Reset     key.Binding
 	Daemon    key.Binding
 	Tab       key.Binding
@@ -114,6 +115,10 @@ var DefaultKeyMap = KeyMap{
 		key.WithKeys("e"),
 		key.WithHelp("e", "export"),
 	),
+	Pause: key.NewBinding(
+		key.WithKeys("p"),
+		key.WithHelp("p", "pause/resume"),
+	),
 	Reset: key.NewBinding(
 		key.WithKeys("X"),
 		key.WithHelp("X", "reset all"),
@@ -160,8 +165,22 @@ type WorkflowItem struct {
 	workflow models.Workflow
 }
 
-func (i WorkflowItem) Title() string       { return i.workflow.Name }
-func (i WorkflowItem) Description() string { return i.workflow.Description }
+func (i WorkflowItem) Title() string {
+	if i.workflow.Paused {
+		return i.workflow.Name + " " + DimmedItemStyle.Render("(paused)")
+	}
+	return i.workflow.Name
+}
+func (i WorkflowItem) Description() string {
+	next := i.workflow.NextRunSummary(time.Now())
+	if next == "" || i.workflow.Paused {
+		return i.workflow.Description
+	}
+	if i.workflow.Description == "" {
+		return next
+	}
+	return next + " · " + i.workflow.Description
+}
 func (i WorkflowItem) FilterValue() string { return i.workflow.Name }
 
 type RunItem struct {
@@ -281,7 +300,7 @@ func NewModel(database *db.DB, daemonExePath string) Model {
 }
 
 func (m Model) Init() tea.Cmd {
-	return m.loadWorkflows()
+	return tea.Batch(m.loadWorkflows(), countdownTick())
 }
 
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -343,6 +362,11 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m.handleExportWorkflow()
 			}
 
+		case key.Matches(msg, m.keys.Pause):
+			if m.currentView == ViewWorkflows {
+				return m.handleTogglePause()
+			}
+
 		case key.Matches(msg, m.keys.Reset):
 			if m.currentView == ViewWorkflows {
 				return m.handleReset()
@@ -435,13 +459,26 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.updateLogViewport()
 		return m, nil
 
-	case WorkflowExecutedMsg:
+	case WorkflowQueuedMsg:
+		m.loading = false
+		if msg.Err != nil {
+			m.errMessage = msg.Err.Error()
+			return m, nil
+		}
+		m.statusMessage = fmt.Sprintf("Queued run #%d for the daemon", msg.Run.ID)
+		return m, m.loadWorkflows()
+
+	case WorkflowPausedMsg:
 		m.loading = false
 		if msg.Err != nil {
 			m.errMessage = msg.Err.Error()
 			return m, nil
 		}
-		m.statusMessage = "Workflow completed with status: " + string(msg.Run.Status)
+		if msg.Paused {
+			m.statusMessage = "Paused schedule of '" + msg.Workflow.Name + "'"
+		} else {
+			m.statusMessage = "Resumed schedule of '" + msg.Workflow.Name + "'"
+		}
 		return m, m.loadWorkflows()
 
 	case WorkflowDeletedMsg:
@@ -520,6 +557,14 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.errMessage = msg.Err.Error()
 		return m, nil
 
+	case CountdownTickMsg:
+		// Reload once a countdown runs out to pick up the next fire time
+		// the scheduler records.
+		if m.currentView == ViewWorkflows && hasDueWorkflow(m.workflows) {
+			return m, tea.Batch(countdownTick(), m.loadWorkflows())
+		}
+		return m, countdownTick()
+
 	case TickMsg:
 		if m.currentView == ViewDaemon {
 			var needsUpdate bool
@@ -688,7 +733,7 @@ func (m Model) handleEnter() (tea.Model, tea.Cmd) {
 func (m Model) handleRunWorkflow() (tea.Model, tea.Cmd) {
 	if item, ok := m.workflowList.SelectedItem().(WorkflowItem); ok {
 		m.loading = true
-		m.statusMessage = "Running workflow..."
+		m.statusMessage = "Queueing workflow run..."
 		return m, m.executeWorkflow(&item.workflow)
 	}
 	return m, nil
@@ -702,6 +747,14 @@ func (m Model) handleDeleteWorkflow() (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+func (m Model) handleTogglePause() (tea.Model, tea.Cmd) {
+	if item, ok := m.workflowList.SelectedItem().(WorkflowItem); ok {
+		m.loading = true
+		return m, m.togglePause(&item.workflow)
+	}
+	return m, nil
+}
+
 func (m Model) handleRefresh() (tea.Model, tea.Cmd) {
 	m.loading = true
 	m.errMessage = ""
@@ -917,6 +970,22 @@ func (m Model) startDaemon() tea.Cmd {
 	}
 }
 
+func countdownTick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return CountdownTickMsg{}
+	})
+}
+
+func hasDueWorkflow(workflows []models.Workflow) bool {
+	now := time.Now()
+	for _, w := range workflows {
+		if w.Schedule != "" && !w.Paused && !w.NextFireAt.IsZero() && !w.NextFireAt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m Model) readDaemonOutput() tea.Cmd {
 	tickRate := 200 * time.Millisecond
 	if m.animating {
@@ -1,7 +1,6 @@
 package tui
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -37,9 +36,18 @@ func (m Model) loadStepRuns(runID int64) tea.Cmd {
 
 func (m Model) executeWorkflow(workflow *models.Workflow) tea.Cmd {
 	return func() tea.Msg {
-		eng := engine.NewEngine(m.db)
-		run, err := eng.ExecuteWorkflow(context.Background(), workflow, "tui")
-		return WorkflowExecutedMsg{Run: run, Err: err}
+		run := &models.Run{WorkflowID: workflow.ID, Status: models.RunStatusPending, Trigger: "tui"}
+		runID, err := m.db.EnqueueRun(run, 0)
+		run.ID = runID
+		return WorkflowQueuedMsg{Run: run, Err: err}
+	}
+}
+
+func (m Model) togglePause(workflow *models.Workflow) tea.Cmd {
+	return func() tea.Msg {
+		paused := !workflow.Paused
+		err := m.db.SetWorkflowPaused(workflow.ID, paused)
+		return WorkflowPausedMsg{Workflow: workflow, Paused: paused, Err: err}
 	}
 }
 
@@ -210,6 +218,7 @@ func (m Model) renderHelp() string {
 			HelpKeyStyle.Render("r") + HelpDescStyle.Render(" run"),
 			HelpKeyStyle.Render("c") + HelpDescStyle.Render(" create"),
 			HelpKeyStyle.Render("e") + HelpDescStyle.Render(" export"),
+			HelpKeyStyle.Render("p") + HelpDescStyle.Render(" pause"),
 			HelpKeyStyle.Render("d") + HelpDescStyle.Render(" delete"),
 			HelpKeyStyle.Render("D") + HelpDescStyle.Render(" daemon"),
 			HelpKeyStyle.Render("X") + HelpDescStyle.Render(" reset"),
@@ -306,6 +315,9 @@ func (m Model) renderRunInfo() string {
 		"Status: %s  |  Started: %s  |  Completed: %s  |  Trigger: %s",
 		status, started, completed, r.Trigger,
 	)
+	if !r.ScheduledAt.IsZero() {
+		info += "  |  Scheduled: " + r.ScheduledAt.Format("2006-01-02 15:04:05")
+	}
 
 	return SubtitleStyle.Render(info)
 }
@@ -329,19 +341,30 @@ func (m Model) renderLogs() string {
 			sb.WriteString(ErrorBoxStyle.Render("Error: "+sr.Error) + "\n")
 		}
 
-		if len(sr.Logs) == 0 {
-			sb.WriteString(DimmedItemStyle.Render("  (no output)") + "\n")
-		} else {
-			for i, logLine := range sr.Logs {
-				lineNum := LogLineNumberStyle.Render(fmt.Sprintf("%d", i+1))
-				sb.WriteString(fmt.Sprintf("%s %s\n", lineNum, LogStyle.Render(logLine)))
-			}
+		if len(sr.Attempts) == 0 {
+			writeLogLines(&sb, sr.Logs)
+		}
+		for _, attempt := range sr.Attempts {
+			sb.WriteString(SubtitleStyle.Render(fmt.Sprintf("─── %s ───", attempt.Summary())))
+			sb.WriteString("\n")
+			writeLogLines(&sb, attempt.Logs)
 		}
 	}
 
 	return sb.String()
 }
 
+func writeLogLines(sb *strings.Builder, lines []string) {
+	if len(lines) == 0 {
+		sb.WriteString(DimmedItemStyle.Render("  (no output)") + "\n")
+		return
+	}
+	for i, logLine := range lines {
+		lineNum := LogLineNumberStyle.Render(fmt.Sprintf("%d", i+1))
+		sb.WriteString(fmt.Sprintf("%s %s\n", lineNum, LogStyle.Render(logLine)))
+	}
+}
+
 func (m Model) renderCreateWorkflowView() string {
 	title := TitleStyle.Render("Create Workflow from YAML")
 
@@ -1,8 +1,9 @@
 package workflows
 
 import (
-	"context"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/textinput"
@@ -21,8 +22,22 @@ type WorkflowItem struct {
 	Workflow models.Workflow
 }
 
-func (i WorkflowItem) Title() string       { return i.Workflow.Name }
-func (i WorkflowItem) Description() string { return i.Workflow.Description }
+func (i WorkflowItem) Title() string {
+	if i.Workflow.Paused {
+		return i.Workflow.Name + " " + common.DimmedItemStyle.Render("(paused)")
+	}
+	return i.Workflow.Name
+}
+func (i WorkflowItem) Description() string {
+	next := i.Workflow.NextRunSummary(time.Now())
+	if next == "" || i.Workflow.Paused {
+		return i.Workflow.Description
+	}
+	if i.Workflow.Description == "" {
+		return next
+	}
+	return next + " · " + i.Workflow.Description
+}
 func (i WorkflowItem) FilterValue() string { return i.Workflow.Name }
 
 // Model represents the workflow management feature
@@ -78,7 +93,25 @@ func New(database *db.DB) Model {
 
 // Init initializes the workflow model
 func (m Model) Init() tea.Cmd {
-	return m.LoadWorkflows()
+	return tea.Batch(m.LoadWorkflows(), countdownTick())
+}
+
+func countdownTick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return common.CountdownTickMsg{}
+	})
+}
+
+// hasDueWorkflow reports whether a countdown has run out, so the list should
+// be reloaded to pick up the next fire time the scheduler records.
+func (m Model) hasDueWorkflow() bool {
+	now := time.Now()
+	for _, w := range m.workflows {
+		if w.Schedule != "" && !w.Paused && !w.NextFireAt.IsZero() && !w.NextFireAt.After(now) {
+			return true
+		}
+	}
+	return false
 }
 
 // SetSize updates the component size
@@ -190,13 +223,32 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 		m.updateList()
 		return m, nil
 
-	case common.WorkflowExecutedMsg:
+	case common.CountdownTickMsg:
+		if m.hasDueWorkflow() {
+			return m, tea.Batch(countdownTick(), m.LoadWorkflows())
+		}
+		return m, countdownTick()
+
+	case common.WorkflowQueuedMsg:
 		m.loading = false
 		if msg.Err != nil {
 			m.errMessage = msg.Err.Error()
 			return m, nil
 		}
-		m.statusMessage = "Workflow completed with status: " + string(msg.Run.Status)
+		m.statusMessage = fmt.Sprintf("Queued run #%d for the daemon", msg.Run.ID)
+		return m, m.LoadWorkflows()
+
+	case common.WorkflowPausedMsg:
+		m.loading = false
+		if msg.Err != nil {
+			m.errMessage = msg.Err.Error()
+			return m, nil
+		}
+		if msg.Paused {
+			m.statusMessage = "Paused schedule of '" + msg.Workflow.Name + "'"
+		} else {
+			m.statusMessage = "Resumed schedule of '" + msg.Workflow.Name + "'"
+		}
 		return m, m.LoadWorkflows()
 
 	case common.WorkflowDeletedMsg:
@@ -316,12 +368,22 @@ func (m Model) LoadWorkflows() tea.Cmd {
 	}
 }
 
-// ExecuteWorkflow executes a workflow
+// ExecuteWorkflow queues a run of workflow for the daemon
 func (m Model) ExecuteWorkflow(workflow *models.Workflow) tea.Cmd {
 	return func() tea.Msg {
-		eng := engine.NewEngine(m.db)
-		run, err := eng.ExecuteWorkflow(context.Background(), workflow, "tui")
-		return common.WorkflowExecutedMsg{Run: run, Err: err}
+		run := &models.Run{WorkflowID: workflow.ID, Status: models.RunStatusPending, Trigger: "tui"}
+		runID, err := m.db.EnqueueRun(run, 0)
+		run.ID = runID
+		return common.WorkflowQueuedMsg{Run: run, Err: err}
+	}
+}
+
+// TogglePause pauses or resumes the schedule of a workflow
+func (m Model) TogglePause(workflow *models.Workflow) tea.Cmd {
+	return func() tea.Msg {
+		paused := !workflow.Paused
+		err := m.db.SetWorkflowPaused(workflow.ID, paused)
+		return common.WorkflowPausedMsg{Workflow: workflow, Paused: paused, Err: err}
 	}
 }
 
@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kingoftac/gork/internal/runner"
+	"github.com/kingoftac/gork/internal/tracing"
+)
+
+// retryDelay is how long an agent waits before polling again after the
+// daemon could not be reached.
+const retryDelay = 2 * time.Second
+
+// Agent polls a daemon for steps matching its labels and runs them locally,
+// streaming their output back while they run.
+type Agent struct {
+	url    string
+	id     string
+	name   string
+	labels []string
+	token  string
+	slots  int
+	client *http.Client
+}
+
+// NewAgent returns an agent for the daemon at url that runs up to slots steps
+// at a time. The host's OS and architecture are always among its labels.
+func NewAgent(url, name string, labels []string, token string, slots int) *Agent {
+	for _, l := range []string{runtime.GOOS, runtime.GOARCH} {
+		if !slices.Contains(labels, l) {
+			labels = append(labels, l)
+		}
+	}
+	return &Agent{
+		url:    strings.TrimSuffix(url, "/"),
+		id:     fmt.Sprintf("%s-%d-%d", name, os.Getpid(), time.Now().UnixNano()),
+		name:   name,
+		labels: labels,
+		token:  token,
+		slots:  max(slots, 1),
+		client: &http.Client{Timeout: pollTimeout + 10*time.Second},
+	}
+}
+
+// Labels returns the labels the agent advertises.
+func (a *Agent) Labels() []string {
+	return a.labels
+}
+
+// Run polls for and runs steps until ctx is canceled. Steps still running
+// when ctx ends are stopped and reported.
+func (a *Agent) Run(ctx context.Context) {
+	slog.Info("Worker starting", "component", "worker", "worker", a.name, "daemon", a.url, "labels", strings.Join(a.labels, ","), "slots", a.slots)
+
+	var wg sync.WaitGroup
+	for range a.slots {
+		wg.Go(func() { a.poll(ctx) })
+	}
+	wg.Wait()
+
+	slog.Info("Worker stopped", "component", "worker", "worker", a.name)
+}
+
+func (a *Agent) poll(ctx context.Context) {
+	for ctx.Err() == nil {
+		var asg Assignment
+		status, err := a.post(ctx, Path+"poll", PollRequest{ID: a.id, Name: a.name, Labels: a.labels}, &asg)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			slog.Warn("Failed to poll daemon", "component", "worker", "worker", a.name, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryDelay):
+			}
+		case status == http.StatusOK:
+			a.execute(ctx, asg)
+		}
+	}
+}
+
+// execute runs one assignment, sending its output every heartbeat interval
+// and stopping it if the daemon asks to.
+func (a *Agent) execute(ctx context.Context, asg Assignment) {
+	slog.Info("Running step", "component", "worker", "worker", a.name, "step", asg.Step.Name, "assignment", asg.ID)
+
+	stepCtx, cancel := context.WithCancel(tracing.WithRemoteParent(ctx, asg.TraceParent))
+	defer cancel()
+	stepCtx, span := tracing.Start(stepCtx, "worker step "+asg.Step.Name, tracing.KindInternal,
+		tracing.String("gork.step", asg.Step.Name),
+		tracing.String("gork.worker", a.name),
+	)
+
+	var (
+		mu      sync.Mutex
+		pending []string
+	)
+	sink := func(line string) {
+		mu.Lock()
+		pending = append(pending, line)
+		mu.Unlock()
+	}
+	// flush sends buffered lines, or an empty heartbeat, and reports whether
+	// the daemon wants the step stopped.
+	flush := func() bool {
+		mu.Lock()
+		lines := pending
+		pending = nil
+		mu.Unlock()
+
+		var resp LogsResponse
+		// Logs are still sent once ctx ends, so use a context of their own.
+		sendCtx, done := context.WithTimeout(context.Background(), heartbeatInterval*2)
+		defer done()
+		if _, err := a.post(sendCtx, Path+"assignments/"+asg.ID+"/logs", LogsRequest{Worker: a.id, Lines: lines}, &resp); err != nil {
+			slog.Warn("Failed to send step logs", "component", "worker", "worker", a.name, "assignment", asg.ID, "error", err)
+			return false
+		}
+		return resp.Cancel
+	}
+
+	finished := make(chan struct{})
+	heartbeats := make(chan struct{})
+	go func() {
+		defer close(heartbeats)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+				if flush() {
+					slog.Info("Daemon canceled step", "component", "worker", "worker", a.name, "assignment", asg.ID)
+					cancel()
+				}
+			}
+		}
+	}()
+
+	logs, err := runner.RunStepStreaming(stepCtx, asg.Step, sink)
+	close(finished)
+	<-heartbeats
+	span.SetError(err)
+	span.Finish()
+
+	completion := Completion{Worker: a.id, Logs: logs, Error: NewStepError(err)}
+	for attempt := range 3 {
+		if attempt > 0 {
+			time.Sleep(retryDelay)
+		}
+		sendCtx, done := context.WithTimeout(context.Background(), 10*time.Second)
+		status, sendErr := a.post(sendCtx, Path+"assignments/"+asg.ID+"/complete", completion, nil)
+		done()
+		if sendErr == nil || status == http.StatusConflict {
+			return
+		}
+		slog.Warn("Failed to report step result", "component", "worker", "worker", a.name, "assignment", asg.ID, "error", sendErr)
+	}
+}
+
+// post sends body as JSON to path and decodes a 200 response into out. It
+// returns an error for any status other than 200 or 204.
+func (a *Agent) post(ctx context.Context, path string, body, out any) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set(TokenHeader, a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out == nil {
+			return resp.StatusCode, nil
+		}
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNoContent:
+		return resp.StatusCode, nil
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("daemon returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
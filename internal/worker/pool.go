@@ -0,0 +1,358 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kingoftac/gork/internal/models"
+	"github.com/kingoftac/gork/internal/tracing"
+)
+
+const (
+	// pollTimeout is how long a poll waits for a step before returning
+	// empty, after which the agent polls again.
+	pollTimeout = 20 * time.Second
+	// heartbeatInterval is how often an agent reports on a running step.
+	heartbeatInterval = 2 * time.Second
+	// lossTimeout is how long a worker may go without reporting on a step
+	// before the step is handed to another worker.
+	lossTimeout = 5 * heartbeatInterval
+	// maxHandoffs bounds how many times a step is handed to another worker
+	// after losing the one running it.
+	maxHandoffs = 3
+	// defaultKillGrace mirrors the runner's default, for waiting on a worker
+	// to stop a canceled step.
+	defaultKillGrace = 10 * time.Second
+	// maxRequestSize bounds the body of agent requests, which carry logs.
+	maxRequestSize = 16 << 20
+)
+
+// Pool hands steps with runs_on labels to worker agents that poll the daemon
+// for work, and collects their logs and results. Workers are only known
+// while they keep polling; nothing about them is stored.
+type Pool struct {
+	token string
+
+	mu          sync.Mutex
+	workers     map[string]*workerInfo
+	waiting     []*assignment
+	assignments map[string]*assignment
+	wake        chan struct{}
+	nextID      int64
+}
+
+type workerInfo struct {
+	name     string
+	labels   []string
+	lastSeen time.Time
+}
+
+// assignment is a step waiting for, or running on, a worker.
+type assignment struct {
+	Assignment
+	worker    string
+	heartbeat time.Time
+	handoffs  int
+	canceled  bool
+	onLogs    func([]string)
+	done      chan Completion
+}
+
+// NewPool returns a pool that accepts agents presenting token. An empty
+// token accepts none.
+func NewPool(token string) *Pool {
+	return &Pool{
+		token:       token,
+		workers:     make(map[string]*workerInfo),
+		assignments: make(map[string]*assignment),
+		wake:        make(chan struct{}),
+	}
+}
+
+// RunStep runs step on a worker with all of its runs_on labels, passing its
+// output lines to onLogs as they arrive, and returns its logs once it has
+// finished. If ctx ends first the worker is told to stop the step.
+func (p *Pool) RunStep(ctx context.Context, step models.WorkflowStep, onLogs func([]string)) ([]string, error) {
+	a := &assignment{
+		Assignment: Assignment{Step: step, TraceParent: tracing.FromContext(ctx).TraceParent()},
+		onLogs:     onLogs,
+		done:       make(chan Completion, 1),
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	a.ID = strconv.FormatInt(p.nextID, 10)
+	p.assignments[a.ID] = a
+	p.waiting = append(p.waiting, a)
+	available := p.hasWorkerLocked(step.RunsOn)
+	p.wakeLocked()
+	p.mu.Unlock()
+
+	if !available {
+		onLogs([]string{"[gork] waiting for a worker labeled " + strings.Join(step.RunsOn, ", ")})
+	}
+
+	select {
+	case c := <-a.done:
+		return c.Logs, completionError(c)
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	a.canceled = true
+	if a.worker == "" {
+		p.removeLocked(a)
+		p.mu.Unlock()
+		return nil, ctx.Err()
+	}
+	p.mu.Unlock()
+
+	// Give the worker time to notice, stop the step and send its output.
+	grace := step.KillGrace
+	if grace == 0 {
+		grace = defaultKillGrace
+	}
+	select {
+	case c := <-a.done:
+		if err := completionError(c); err != nil {
+			return c.Logs, fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+		return c.Logs, ctx.Err()
+	case <-time.After(grace + 2*heartbeatInterval):
+		p.mu.Lock()
+		p.removeLocked(a)
+		p.mu.Unlock()
+		return []string{"[gork] worker did not confirm the step stopped"}, ctx.Err()
+	}
+}
+
+func completionError(c Completion) error {
+	if c.Error == nil {
+		return nil
+	}
+	return c.Error
+}
+
+// Start hands the steps of workers that stop reporting to other workers
+// until ctx is canceled.
+func (p *Pool) Start(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkWorkers()
+		}
+	}
+}
+
+func (p *Pool) checkWorkers() {
+	type note struct {
+		onLogs func([]string)
+		line   string
+	}
+	var notes []note
+
+	p.mu.Lock()
+	now := time.Now()
+	for _, a := range p.assignments {
+		if a.worker == "" || now.Sub(a.heartbeat) < lossTimeout {
+			continue
+		}
+
+		lost := a.worker
+		name := lost
+		if w, ok := p.workers[lost]; ok {
+			name = w.name
+			delete(p.workers, lost)
+		}
+		slog.Warn("Lost worker running step", "component", "worker", "worker", name, "step", a.Step.Name, "assignment", a.ID)
+
+		if a.canceled || a.handoffs >= maxHandoffs {
+			p.removeLocked(a)
+			msg := fmt.Sprintf("worker %s stopped responding", name)
+			if !a.canceled {
+				msg = fmt.Sprintf("%s; gave up after %d handoffs", msg, a.handoffs)
+			}
+			a.done <- Completion{Error: &StepError{Message: msg}}
+			continue
+		}
+
+		a.worker = ""
+		a.handoffs++
+		p.waiting = append([]*assignment{a}, p.waiting...)
+		notes = append(notes, note{a.onLogs, fmt.Sprintf("[gork] worker %s stopped responding; handing the step to another worker", name)})
+	}
+	for id, w := range p.workers {
+		if now.Sub(w.lastSeen) > lossTimeout+pollTimeout {
+			delete(p.workers, id)
+		}
+	}
+	if len(notes) > 0 {
+		p.wakeLocked()
+	}
+	p.mu.Unlock()
+
+	for _, n := range notes {
+		n.onLogs([]string{n.line})
+	}
+}
+
+func (p *Pool) hasWorkerLocked(runsOn []string) bool {
+	for _, w := range p.workers {
+		if models.HasLabels(w.labels, runsOn) {
+			return true
+		}
+	}
+	return false
+}
+
+// wakeLocked wakes every waiting poll so they look for new steps.
+func (p *Pool) wakeLocked() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+func (p *Pool) removeLocked(a *assignment) {
+	delete(p.assignments, a.ID)
+	p.waiting = slices.DeleteFunc(p.waiting, func(w *assignment) bool { return w == a })
+}
+
+// Handler serves the agent API under Path.
+func (p *Pool) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+Path+"poll", p.handlePoll)
+	mux.HandleFunc("POST "+Path+"assignments/{id}/logs", p.handleLogs)
+	mux.HandleFunc("POST "+Path+"assignments/{id}/complete", p.handleComplete)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, p.token) {
+			http.Error(w, "invalid worker token", http.StatusUnauthorized)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (p *Pool) handlePoll(w http.ResponseWriter, r *http.Request) {
+	var req PollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		http.Error(w, "worker id is required", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateWorkerLabels(req.Labels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+
+	for {
+		p.mu.Lock()
+		if _, known := p.workers[req.ID]; !known {
+			slog.Info("Worker connected", "component", "worker", "worker", req.Name, "labels", strings.Join(req.Labels, ","))
+		}
+		p.workers[req.ID] = &workerInfo{name: req.Name, labels: req.Labels, lastSeen: time.Now()}
+
+		i := slices.IndexFunc(p.waiting, func(a *assignment) bool {
+			return models.HasLabels(req.Labels, a.Step.RunsOn)
+		})
+		if i >= 0 {
+			a := p.waiting[i]
+			p.waiting = slices.Delete(p.waiting, i, i+1)
+			a.worker = req.ID
+			a.heartbeat = time.Now()
+			assigned := a.Assignment
+			p.mu.Unlock()
+
+			slog.Info("Assigned step to worker", "component", "worker", "worker", req.Name, "step", assigned.Step.Name, "assignment", assigned.ID)
+			writeJSON(w, http.StatusOK, assigned)
+			return
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (p *Pool) handleLogs(w http.ResponseWriter, r *http.Request) {
+	var req LogsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	a, ok := p.assignments[r.PathValue("id")]
+	if !ok || a.worker != req.Worker {
+		// The step finished, was handed to another worker or was
+		// forgotten; whoever is still running it should stop.
+		p.mu.Unlock()
+		writeJSON(w, http.StatusOK, LogsResponse{Cancel: true})
+		return
+	}
+	now := time.Now()
+	a.heartbeat = now
+	if info, ok := p.workers[req.Worker]; ok {
+		info.lastSeen = now
+	}
+	canceled, onLogs := a.canceled, a.onLogs
+	p.mu.Unlock()
+
+	if len(req.Lines) > 0 {
+		onLogs(req.Lines)
+	}
+	writeJSON(w, http.StatusOK, LogsResponse{Cancel: canceled})
+}
+
+func (p *Pool) handleComplete(w http.ResponseWriter, r *http.Request) {
+	var c Completion
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	a, ok := p.assignments[r.PathValue("id")]
+	if !ok || a.worker != c.Worker {
+		p.mu.Unlock()
+		http.Error(w, "assignment is no longer held by this worker", http.StatusConflict)
+		return
+	}
+	p.removeLocked(a)
+	p.mu.Unlock()
+
+	a.done <- c
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,403 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kingoftac/gork/internal/models"
+	"github.com/kingoftac/gork/internal/tracing"
+)
+
+const testToken = "secret"
+
+// testPool serves a pool to agents driven by the test.
+type testPool struct {
+	*Pool
+	srv *httptest.Server
+}
+
+func newTestPool(t *testing.T, token string) *testPool {
+	t.Helper()
+	p := NewPool(token)
+	srv := httptest.NewServer(p.Handler())
+	t.Cleanup(srv.Close)
+	return &testPool{Pool: p, srv: srv}
+}
+
+// post sends body to path with the test token and decodes a 200 response
+// into out.
+func (tp *testPool) post(t *testing.T, path string, body, out any) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, tp.srv.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TokenHeader, testToken)
+	resp, err := tp.srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func (tp *testPool) poll(t *testing.T, worker string) Assignment {
+	t.Helper()
+	var a Assignment
+	if code := tp.post(t, Path+"poll", PollRequest{ID: worker, Name: worker, Labels: []string{"gpu"}}, &a); code != http.StatusOK {
+		t.Fatalf("poll by %s = %d, want an assignment", worker, code)
+	}
+	return a
+}
+
+func (tp *testPool) heartbeat(t *testing.T, worker, id string) LogsResponse {
+	t.Helper()
+	var resp LogsResponse
+	if code := tp.post(t, Path+"assignments/"+id+"/logs", LogsRequest{Worker: worker}, &resp); code != http.StatusOK {
+		t.Fatalf("logs from %s = %d, want 200", worker, code)
+	}
+	return resp
+}
+
+func (tp *testPool) complete(t *testing.T, id string, c Completion) int {
+	t.Helper()
+	return tp.post(t, Path+"assignments/"+id+"/complete", c, nil)
+}
+
+// loseWorkers makes every assigned step look like its worker stopped
+// reporting, and lets the pool notice.
+func (tp *testPool) loseWorkers() {
+	tp.mu.Lock()
+	for _, a := range tp.assignments {
+		a.heartbeat = time.Now().Add(-lossTimeout)
+	}
+	tp.mu.Unlock()
+	tp.checkWorkers()
+}
+
+type stepResult struct {
+	logs []string
+	err  error
+}
+
+// stepLogs collects the lines a pool passes to onLogs.
+type stepLogs struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *stepLogs) add(lines []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, lines...)
+}
+
+func (l *stepLogs) contains(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.ContainsFunc(l.lines, func(line string) bool { return strings.Contains(line, substr) })
+}
+
+func (tp *testPool) runStep(ctx context.Context, step models.WorkflowStep) (<-chan stepResult, *stepLogs) {
+	logs := &stepLogs{}
+	done := make(chan stepResult, 1)
+	go func() {
+		lines, err := tp.RunStep(ctx, step, logs.add)
+		done <- stepResult{lines, err}
+	}()
+	return done, logs
+}
+
+func wait(t *testing.T, done <-chan stepResult) stepResult {
+	t.Helper()
+	select {
+	case r := <-done:
+		return r
+	case <-time.After(20 * time.Second):
+		t.Fatal("timed out waiting for the step to return")
+		return stepResult{}
+	}
+}
+
+var gpuStep = models.WorkflowStep{Name: "train", RunsOn: []string{"gpu"}}
+
+func TestPoolRequiresToken(t *testing.T) {
+	for _, tt := range []struct {
+		name, token, presented string
+		want                   int
+	}{
+		{"no token configured", "", "", http.StatusUnauthorized},
+		{"no token presented", testToken, "", http.StatusUnauthorized},
+		{"wrong token", testToken, "guess", http.StatusUnauthorized},
+		{"right token", testToken, testToken, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestPool(t, tt.token)
+			req, err := http.NewRequest(http.MethodPost, tp.srv.URL+Path+"assignments/1/logs", strings.NewReader(`{"worker":"w1"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.presented != "" {
+				req.Header.Set(TokenHeader, tt.presented)
+			}
+			resp, err := tp.srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolRunsStepOnWorker(t *testing.T) {
+	tp := newTestPool(t, testToken)
+	done, logs := tp.runStep(context.Background(), gpuStep)
+
+	a := tp.poll(t, "w1")
+	if a.Step.Name != gpuStep.Name {
+		t.Fatalf("assigned step %q, want %q", a.Step.Name, gpuStep.Name)
+	}
+	if code := tp.post(t, Path+"assignments/"+a.ID+"/logs", LogsRequest{Worker: "w1", Lines: []string{"epoch 1"}}, nil); code != http.StatusOK {
+		t.Fatalf("logs = %d, want 200", code)
+	}
+	exit := 3
+	if code := tp.complete(t, a.ID, Completion{Worker: "w1", Logs: []string{"epoch 1"}, Error: &StepError{Message: "exit status 3", Exit: &exit}}); code != http.StatusNoContent {
+		t.Fatalf("complete = %d, want 204", code)
+	}
+
+	r := wait(t, done)
+	var stepErr *StepError
+	if !errors.As(r.err, &stepErr) || stepErr.ExitCode() != 3 {
+		t.Fatalf("err = %v, want the worker's exit status 3", r.err)
+	}
+	if !slices.Equal(r.logs, []string{"epoch 1"}) {
+		t.Fatalf("logs = %q, want the worker's logs", r.logs)
+	}
+	if !logs.contains("epoch 1") {
+		t.Fatal("streamed lines were not passed on")
+	}
+}
+
+func TestPoolHandsOffLostWorker(t *testing.T) {
+	tp := newTestPool(t, testToken)
+	done, logs := tp.runStep(context.Background(), gpuStep)
+
+	first := tp.poll(t, "w1")
+	tp.loseWorkers()
+	if !logs.contains("handing the step to another worker") {
+		t.Fatal("handoff was not noted in the step logs")
+	}
+	second := tp.poll(t, "w2")
+	if second.ID != first.ID {
+		t.Fatalf("w2 got assignment %s, want the lost %s", second.ID, first.ID)
+	}
+
+	// The lost worker is told to stop and cannot finish the step any more.
+	if !tp.heartbeat(t, "w1", first.ID).Cancel {
+		t.Fatal("lost worker was not told to stop")
+	}
+	if code := tp.complete(t, first.ID, Completion{Worker: "w1"}); code != http.StatusConflict {
+		t.Fatalf("complete by lost worker = %d, want 409", code)
+	}
+
+	if code := tp.complete(t, second.ID, Completion{Worker: "w2", Logs: []string{"done"}}); code != http.StatusNoContent {
+		t.Fatalf("complete = %d, want 204", code)
+	}
+	if r := wait(t, done); r.err != nil || !slices.Equal(r.logs, []string{"done"}) {
+		t.Fatalf("got logs %q and err %v, want w2's logs", r.logs, r.err)
+	}
+}
+
+func TestPoolGivesUpAfterMaxHandoffs(t *testing.T) {
+	tp := newTestPool(t, testToken)
+	done, _ := tp.runStep(context.Background(), gpuStep)
+
+	for i := range maxHandoffs + 1 {
+		tp.poll(t, fmt.Sprintf("w%d", i+1))
+		tp.loseWorkers()
+	}
+
+	r := wait(t, done)
+	if r.err == nil || !strings.Contains(r.err.Error(), "gave up after 3 handoffs") {
+		t.Fatalf("err = %v, want giving up after 3 handoffs", r.err)
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.assignments) != 0 || len(tp.waiting) != 0 {
+		t.Fatal("abandoned step is still held by the pool")
+	}
+}
+
+func TestPoolCancelsWaitingStep(t *testing.T) {
+	tp := newTestPool(t, testToken)
+	ctx, cancel := context.WithCancel(context.Background())
+	done, logs := tp.runStep(ctx, gpuStep)
+	cancel()
+
+	r := wait(t, done)
+	if !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", r.err)
+	}
+	if !logs.contains("waiting for a worker labeled gpu") {
+		t.Fatal("missing worker was not noted in the step logs")
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.assignments) != 0 || len(tp.waiting) != 0 {
+		t.Fatal("canceled step is still waiting for a worker")
+	}
+}
+
+func TestPoolCancelsRunningStep(t *testing.T) {
+	tp := newTestPool(t, testToken)
+	ctx, cancel := context.WithCancel(context.Background())
+	done, _ := tp.runStep(ctx, gpuStep)
+
+	a := tp.poll(t, "w1")
+	if tp.heartbeat(t, "w1", a.ID).Cancel {
+		t.Fatal("worker was told to stop before the step was canceled")
+	}
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for !tp.heartbeat(t, "w1", a.ID).Cancel {
+		if time.Now().After(deadline) {
+			t.Fatal("worker was not told to stop the canceled step")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := tp.complete(t, a.ID, Completion{Worker: "w1", Logs: []string{"stopped"}, Error: &StepError{Message: "signal: terminated"}}); code != http.StatusNoContent {
+		t.Fatalf("complete = %d, want 204", code)
+	}
+
+	r := wait(t, done)
+	if !errors.Is(r.err, context.Canceled) || !strings.Contains(r.err.Error(), "signal: terminated") {
+		t.Fatalf("err = %v, want context.Canceled with the worker's error", r.err)
+	}
+	if !slices.Equal(r.logs, []string{"stopped"}) {
+		t.Fatalf("logs = %q, want the worker's logs", r.logs)
+	}
+}
+
+func TestPoolStopsWaitingForUnconfirmedCancel(t *testing.T) {
+	tp := newTestPool(t, testToken)
+	ctx, cancel := context.WithCancel(context.Background())
+	step := gpuStep
+	step.KillGrace = time.Millisecond
+	done, _ := tp.runStep(ctx, step)
+
+	a := tp.poll(t, "w1")
+	cancel()
+
+	r := wait(t, done)
+	if !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", r.err)
+	}
+	if len(r.logs) != 1 || !strings.Contains(r.logs[0], "did not confirm") {
+		t.Fatalf("logs = %q, want a note that the worker did not confirm", r.logs)
+	}
+	if code := tp.complete(t, a.ID, Completion{Worker: "w1"}); code != http.StatusConflict {
+		t.Fatalf("late complete = %d, want 409", code)
+	}
+}
+
+func TestAgentContinuesTrace(t *testing.T) {
+	traces := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := tracing.Setup(tracing.Config{Exporter: "file", File: traces})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Spans are read back after shutting down, which may only happen once.
+	var once sync.Once
+	stopTracing := func() { once.Do(func() { shutdown(context.Background()) }) }
+	defer stopTracing()
+
+	headers := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("traceparent")
+	}))
+	defer target.Close()
+
+	tp := newTestPool(t, testToken)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		NewAgent(tp.srv.URL, "w1", []string{"gpu"}, testToken, 1).Run(ctx)
+		close(stopped)
+	}()
+
+	attemptCtx, attempt := tracing.Start(ctx, "step call", tracing.KindInternal)
+	step := models.WorkflowStep{Name: "call", RunsOn: []string{"gpu"}, HTTP: &models.HTTPAction{URL: target.URL}}
+	if _, err := tp.RunStep(attemptCtx, step, func([]string) {}); err != nil {
+		t.Fatal(err)
+	}
+	attempt.Finish()
+	cancel()
+	<-stopped
+	stopTracing()
+
+	data, err := os.ReadFile(traces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := map[string]struct{ trace, id, parent string }{}
+	for line := range strings.SplitSeq(strings.TrimSpace(string(data)), "\n") {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID      string `json:"traceId"`
+						SpanID       string `json:"spanId"`
+						ParentSpanID string `json:"parentSpanId"`
+						Name         string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatal(err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = struct{ trace, id, parent string }{s.TraceID, s.SpanID, s.ParentSpanID}
+				}
+			}
+		}
+	}
+
+	worker, ok := spans["worker step call"]
+	if !ok || worker.trace != attempt.TraceID.String() || worker.parent != attempt.SpanID.String() {
+		t.Fatalf("worker span = %+v, want a child of the attempt span %s in trace %s", worker, attempt.SpanID, attempt.TraceID)
+	}
+	call, ok := spans["HTTP GET"]
+	if !ok || call.trace != worker.trace || call.parent != worker.id {
+		t.Fatalf("HTTP span = %+v, want a child of the worker span %s", call, worker.id)
+	}
+	if got, want := <-headers, fmt.Sprintf("00-%s-%s-01", call.trace, call.id); got != want {
+		t.Fatalf("traceparent = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/kingoftac/gork/internal/models"
+	"github.com/kingoftac/gork/internal/runner"
+)
+
+// Path is the path under which the daemon serves worker agents.
+const Path = "/workers/"
+
+// TokenHeader carries the shared token that agents authenticate with.
+const TokenHeader = "X-Gork-Worker-Token"
+
+// PollRequest registers a worker, or renews its registration, and asks for
+// a step to run.
+type PollRequest struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+// Assignment is a step handed to a worker. TraceParent identifies the span
+// of the step attempt, for the worker to continue the run's trace.
+type Assignment struct {
+	ID          string              `json:"id"`
+	Step        models.WorkflowStep `json:"step"`
+	TraceParent string              `json:"traceparent,omitempty"`
+}
+
+// LogsRequest streams output lines of an assignment to the daemon. Agents
+// send one, possibly empty, at least every heartbeat interval while a step
+// runs, which is how the daemon knows they are still alive.
+type LogsRequest struct {
+	Worker string   `json:"worker"`
+	Lines  []string `json:"lines,omitempty"`
+}
+
+// LogsResponse tells the agent whether to stop the step.
+type LogsResponse struct {
+	Cancel bool `json:"cancel"`
+}
+
+// Completion reports how an assignment ended.
+type Completion struct {
+	Worker string     `json:"worker"`
+	Logs   []string   `json:"logs"`
+	Error  *StepError `json:"error,omitempty"`
+}
+
+// StepError is a step failure reported by a worker. It keeps the parts of
+// the original error that retry policies and attempt records look at.
+type StepError struct {
+	Message    string `json:"message"`
+	Exit       *int   `json:"exit_code,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+}
+
+// NewStepError describes err for sending to the daemon.
+func NewStepError(err error) *StepError {
+	if err == nil {
+		return nil
+	}
+	e := &StepError{Message: err.Error()}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		code := exitErr.ExitCode()
+		e.Exit = &code
+	}
+	var statusErr *runner.HTTPStatusError
+	if errors.As(err, &statusErr) {
+		e.StatusCode = statusErr.StatusCode
+	}
+	return e
+}
+
+func (e *StepError) Error() string {
+	return e.Message
+}
+
+// ExitCode returns the exit code of the step's process, or -1 if it did not
+// exit on its own.
+func (e *StepError) ExitCode() int {
+	if e.Exit == nil {
+		return -1
+	}
+	return *e.Exit
+}
+
+func (e *StepError) Unwrap() error {
+	if e.StatusCode != 0 {
+		return &runner.HTTPStatusError{StatusCode: e.StatusCode}
+	}
+	return nil
+}
+
+// NewToken returns a random token for a daemon that only runs its own worker.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func authorized(r *http.Request, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(TokenHeader)), []byte(token)) == 1
+}